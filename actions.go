@@ -14,6 +14,14 @@ func osRemove(path string) error {
 	return os.Remove(path)
 }
 
+func osRemoveAll(path string) error {
+	if *dryRun {
+		fmt.Printf("rm -r %s\n", path)
+		return nil
+	}
+	return os.RemoveAll(path)
+}
+
 func osRename(source, dest string) error {
 	if *dryRun {
 		fmt.Printf("mv %s %s\n", source, dest)
@@ -22,6 +30,14 @@ func osRename(source, dest string) error {
 	return os.Rename(source, dest)
 }
 
+func replaceFile(path string, data []byte) error {
+	if *dryRun {
+		fmt.Printf("write %s\n", path)
+		return nil
+	}
+	return writeFileAtomic(path, data)
+}
+
 func symlink(source, dest string) error {
 	if *dryRun {
 		fmt.Printf("ln -s %s %s\n", dest, source)
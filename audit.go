@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/google/subcommands"
+)
+
+// auditReport is the result of auditing a file
+type auditReport interface {
+	WriteText(w io.Writer)
+	failed() bool
+}
+
+// auditFindings contains the problems found in a file, which
+// make audit fail, and the warnings
+type auditFindings struct {
+	Problems []string `json:"problems,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+func (a *auditFindings) problem(format string, args ...interface{}) {
+	a.Problems = append(a.Problems, fmt.Sprintf(format, args...))
+}
+
+func (a *auditFindings) warning(format string, args ...interface{}) {
+	a.Warnings = append(a.Warnings, fmt.Sprintf(format, args...))
+}
+
+func (a *auditFindings) failed() bool {
+	return len(a.Problems) > 0
+}
+
+// writeFindings writes the name of the file, with the given
+// architecture if not empty, followed by its findings. Files
+// without any are only listed in verbose mode.
+func (a *auditFindings) writeFindings(w io.Writer, p string, arch string) {
+	name := p
+	if arch != "" {
+		name += " [" + arch + "]"
+	}
+	if len(a.Problems) == 0 && len(a.Warnings) == 0 {
+		if *verbose > 0 {
+			fmt.Fprintf(w, "%s: ok\n", name)
+		}
+	} else {
+		fmt.Fprintf(w, "%s:\n", name)
+	}
+	for _, v := range a.Problems {
+		fmt.Fprintf(w, "  %s\n", v)
+	}
+	for _, v := range a.Warnings {
+		fmt.Fprintf(w, "  warning: %s\n", v)
+	}
+}
+
+type auditCmd struct {
+	JSON bool
+}
+
+func (*auditCmd) Name() string {
+	return "audit"
+}
+
+func (*auditCmd) Synopsis() string {
+	return "Check the code in an app bundle for common distribution problems"
+}
+
+func (*auditCmd) Usage() string {
+	return `audit libs|versions|binaries [-json] some.app|some-binary
+
+libs reads the libraries and run paths used by every Mach-O
+file in the bundle and resolves @rpath, @loader_path and
+@executable_path, reporting the libraries which are missing
+or outside of the bundle and the system library paths.
+
+versions reads the platform, minimum OS version and SDK of
+every slice of the Mach-O files in the bundle, reporting the
+slices which can't run on macOS, the ones built with an SDK
+older than the 10.9 one, which can't be notarized, and the
+ones requiring a newer macOS than LSMinimumSystemVersion.
+
+binaries looks for files anywhere in the bundle containing
+code which can't run on macOS, like ELF, PE/COFF and
+WebAssembly files, or Mach-O slices built for other
+platforms. Use fix -remove-foreign to remove them.
+`
+}
+
+func (c *auditCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.JSON, "json", false, "Print the report as JSON")
+}
+
+func (c *auditCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	// The flags for each action can also come after it
+	action := f.Arg(0)
+	if err := f.Parse(f.Args()[1:]); err != nil {
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() == 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	var audit func(root string) ([]auditReport, error)
+	switch action {
+	case "libs":
+		audit = auditLibs
+	case "versions":
+		audit = auditVersions
+	case "binaries":
+		audit = auditBinaries
+	default:
+		errPrintf("unknown action %q, must be libs, versions or binaries\n", action)
+		return subcommands.ExitUsageError
+	}
+	var reports []auditReport
+	for _, arg := range f.Args() {
+		r, err := audit(strings.TrimSuffix(arg, "/"))
+		if err != nil {
+			errPrintf("error auditing %s: %v\n", arg, err)
+			return subcommands.ExitFailure
+		}
+		reports = append(reports, r...)
+	}
+	failed := false
+	for _, r := range reports {
+		if r.failed() {
+			failed = true
+		}
+	}
+	if c.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if reports == nil {
+			reports = []auditReport{}
+		}
+		if err := enc.Encode(reports); err != nil {
+			errPrint(err)
+			return subcommands.ExitFailure
+		}
+	} else {
+		for _, r := range reports {
+			r.WriteText(os.Stdout)
+		}
+	}
+	if failed {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
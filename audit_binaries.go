@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"macapptool/internal/macho"
+)
+
+// foreignBinary is a file in a bundle containing code which
+// can't run on macOS
+type foreignBinary struct {
+	Path string
+	Kind fileKind
+	// Binary is the parsed file, for Mach-O files
+	Binary *macho.Binary
+	// Foreign contains the Mach-O slices built for other
+	// platforms, like the iOS simulator
+	Foreign []*macho.Slice
+}
+
+// Native returns the slices of a Mach-O file which can
+// run on macOS
+func (b *foreignBinary) Native() []*macho.Slice {
+	var native []*macho.Slice
+	for _, s := range b.Binary.Slices {
+		if ok, _ := runsOnMacOS(s.File); ok {
+			native = append(native, s)
+		}
+	}
+	return native
+}
+
+// findForeignBinaries returns the files in root, which can be
+// a bundle or a single file, containing code for other systems,
+// like ELF and PE files, or Mach-O slices for other platforms
+func findForeignBinaries(root string) ([]*foreignBinary, error) {
+	var binaries []*foreignBinary
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		kind, err := classifyFile(p)
+		if err != nil {
+			return err
+		}
+		if kind.IsForeign() {
+			binaries = append(binaries, &foreignBinary{Path: p, Kind: kind})
+			return nil
+		}
+		if !kind.IsMachO() {
+			return nil
+		}
+		bin, err := macho.ReadFile(p)
+		if err != nil {
+			verbosePrintf(1, "skipping %s: %v\n", p, err)
+			return nil
+		}
+		var foreign []*macho.Slice
+		for _, s := range bin.Slices {
+			if ok, _ := runsOnMacOS(s.File); !ok {
+				foreign = append(foreign, s)
+			}
+		}
+		if len(foreign) > 0 {
+			binaries = append(binaries, &foreignBinary{Path: p, Kind: kind, Binary: bin, Foreign: foreign})
+		}
+		return nil
+	})
+	return binaries, err
+}
+
+type binaryReport struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"`
+	// Arches contains the Mach-O slices for other platforms
+	Arches []string `json:"arches,omitempty"`
+	auditFindings
+}
+
+func (r *binaryReport) WriteText(w io.Writer) {
+	r.writeFindings(w, r.Path, "")
+}
+
+// auditBinaries reports the files in root containing code which
+// can't run on macOS
+func auditBinaries(root string) ([]auditReport, error) {
+	binaries, err := findForeignBinaries(root)
+	if err != nil {
+		return nil, err
+	}
+	var reports []auditReport
+	for _, b := range binaries {
+		name, _ := filepath.Rel(filepath.Dir(root), b.Path)
+		report := &binaryReport{Path: name, Kind: b.Kind.String()}
+		if b.Binary == nil {
+			report.problem("%s, which can't run on macOS", b.Kind)
+		}
+		for _, s := range b.Foreign {
+			_, platforms := runsOnMacOS(s.File)
+			report.Arches = append(report.Arches, s.Arch())
+			report.problem("%s slice built for %s, which can't run on macOS", s.Arch(), platforms)
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
+// removeForeignBinary removes a file containing code for other
+// systems. Mach-O files with slices for macOS are thinned
+// instead, keeping them.
+func removeForeignBinary(b *foreignBinary) error {
+	var native []*macho.Slice
+	if b.Binary != nil {
+		native = b.Native()
+	}
+	if len(native) == 0 {
+		verbosePrintf(1, "removing %s\n", b.Path)
+		return osRemove(b.Path)
+	}
+	var arches []string
+	for _, s := range b.Foreign {
+		arches = append(arches, s.Arch())
+	}
+	verbosePrintf(1, "removing %s from %s\n", strings.Join(arches, ", "), b.Path)
+	data := native[0].File.Data
+	if len(native) > 1 {
+		var slices []macho.SliceData
+		for _, s := range native {
+			slices = append(slices, sliceData(s))
+		}
+		data = macho.BuildUniversal(slices, b.Binary.Fat64)
+	}
+	return replaceFile(b.Path, data)
+}
+
+// signedContainers returns the signed bundles in root which
+// contain any of the given files, whose seals are invalidated
+// by removing them
+func signedContainers(root string, files []string) ([]string, error) {
+	var signed []string
+	err := walkCode(root, func(p string) error {
+		if !isBundleDir(p) {
+			return nil
+		}
+		contents, _ := bundleContents(p)
+		if !fileExists(filepath.Join(contents, "_CodeSignature")) {
+			return nil
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f, p+string(filepath.Separator)) {
+				signed = append(signed, p)
+				break
+			}
+		}
+		return nil
+	})
+	return signed, err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"macapptool/internal/macho"
+)
+
+// withPlatform returns the testdata file name, which must be
+// thin, with the platform in its LC_BUILD_VERSION replaced
+func withPlatform(t *testing.T, name string, platform uint32) *macho.File {
+	bin, err := macho.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := bin.Slices[0].File
+	l := f.Load(macho.LoadCmdBuildVersion)
+	if l == nil {
+		t.Fatalf("%s has no LC_BUILD_VERSION", name)
+	}
+	f.ByteOrder.PutUint32(f.Data[l.Offset+8:], platform)
+	if f, err = macho.NewFile(f.Data); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestRunsOnMacOS(t *testing.T) {
+	tests := []struct {
+		platform  uint32
+		ok        bool
+		platforms string
+	}{
+		{macho.PlatformMacOS, true, "macos"},
+		{macho.PlatformMacCatalyst, true, "maccatalyst"},
+		{macho.PlatformDriverKit, true, "driverkit"},
+		{macho.PlatformIOS, false, "ios"},
+		{macho.PlatformIOSSimulator, false, "iossimulator"},
+		{macho.PlatformWatchOS, false, "watchos"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platforms, func(t *testing.T) {
+			ok, platforms := runsOnMacOS(withPlatform(t, "hello_arm64", tt.platform))
+			if ok != tt.ok || platforms != tt.platforms {
+				t.Errorf("runsOnMacOS() = %v, %q, want %v, %q", ok, platforms, tt.ok, tt.platforms)
+			}
+		})
+	}
+}
+
+func TestRemoveForeign(t *testing.T) {
+	root, cleanup := writeTestBundle(t, map[string]string{
+		"MacOS/App":                    "hello_arm64",
+		"Resources/helper.exe":         "hello_arm64",
+		"Resources/helper-linux":       "hello_arm64",
+		"Resources/notes.txt":          "hello_arm64",
+		"_CodeSignature/CodeResources": "hello_arm64",
+	})
+	defer cleanup()
+	contents := filepath.Join(root, "Contents")
+	write := func(rel string, data []byte) {
+		if err := ioutil.WriteFile(filepath.Join(contents, rel), data, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	arm64, err := ioutil.ReadFile(filepath.Join("testdata", "hello_arm64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The x86_64 slice is built for the iOS simulator
+	simulator := withPlatform(t, "hello_x86_64", macho.PlatformIOSSimulator)
+	write(filepath.Join("MacOS", "App"), macho.BuildUniversal([]macho.SliceData{
+		{Cpu: simulator.Cpu, SubCpu: simulator.SubCpu, Data: simulator.Data},
+		{Cpu: macho.CpuArm64, Align: 14, Data: arm64},
+	}, false))
+	write(filepath.Join("Resources", "helper.exe"), peHeader())
+	write(filepath.Join("Resources", "helper-linux"), []byte("\x7fELF\x02\x01\x01\x00"))
+	write(filepath.Join("Resources", "notes.txt"), []byte("MZ is not always a PE file\n"))
+
+	reports, err := auditBinaries(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for _, r := range reports {
+		r := r.(*binaryReport)
+		found = append(found, filepath.Base(r.Path)+" "+r.Kind+" "+strings.Join(r.Arches, ","))
+	}
+	if got, want := strings.Join(found, "; "), "App executable x86_64; helper-linux ELF file ; helper.exe PE/COFF file "; got != want {
+		t.Errorf("found %q, want %q", got, want)
+	}
+
+	// Signed bundles are only modified with -force
+	c := &fixCmd{RemoveForeign: true}
+	if err := c.removeForeign(root); err == nil || !strings.Contains(err.Error(), "use -force") {
+		t.Errorf("error = %v, want use -force", err)
+	}
+	defer func(v bool) { *dryRun = v }(*dryRun)
+	*dryRun = true
+	c.Force = true
+	if err := c.removeForeign(root); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(filepath.Join(contents, "Resources", "helper.exe")) {
+		t.Error("helper.exe removed in dry run mode")
+	}
+	*dryRun = false
+	if err := c.removeForeign(root); err != nil {
+		t.Fatal(err)
+	}
+	checkSameFile(t, filepath.Join(contents, "MacOS", "App"), "hello_arm64")
+	for _, name := range []string{"helper.exe", "helper-linux"} {
+		if fileExists(filepath.Join(contents, "Resources", name)) {
+			t.Errorf("%s not removed", name)
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(contents, "Resources", "notes.txt")); err != nil || !bytes.HasPrefix(data, []byte("MZ")) {
+		t.Errorf("notes.txt modified: %v", err)
+	}
+	if reports, err := auditBinaries(root); err != nil || len(reports) != 0 {
+		t.Errorf("audit after removing = %d reports, %v", len(reports), err)
+	}
+
+	// Unsigned bundles don't need -force
+	if err := os.RemoveAll(filepath.Join(contents, "_CodeSignature")); err != nil {
+		t.Fatal(err)
+	}
+	write(filepath.Join("Resources", "helper.exe"), peHeader())
+	c.Force = false
+	if err := c.removeForeign(root); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(filepath.Join(contents, "Resources", "helper.exe")) {
+		t.Error("helper.exe not removed")
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"macapptool/internal/macho"
+)
+
+// systemLibraryDirs contains the prefixes of the libraries
+// shipped with macOS. Since macOS 11, most of them are only
+// in the dyld shared cache, so they can't be checked for
+// existence.
+var systemLibraryDirs = []string{
+	"/usr/lib/",
+	"/System/Library/",
+	"/System/iOSSupport/",
+	"/Library/Apple/",
+}
+
+func isSystemLibrary(p string) bool {
+	for _, dir := range systemLibraryDirs {
+		if strings.HasPrefix(p, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// executableBundleExtensions contains the extensions of the
+// bundles which run as their own process, so their main
+// executable is the @executable_path for the code inside them
+var executableBundleExtensions = map[string]bool{
+	".app":             true,
+	".appex":           true,
+	".xpc":             true,
+	".systemextension": true,
+}
+
+type libDependency struct {
+	Name     string `json:"name"`
+	Weak     bool   `json:"weak,omitempty"`
+	Resolved string `json:"resolved,omitempty"`
+	System   bool   `json:"system,omitempty"`
+}
+
+type libReport struct {
+	Path         string          `json:"path"`
+	Arch         string          `json:"arch,omitempty"`
+	ID           string          `json:"id,omitempty"`
+	Rpaths       []string        `json:"rpaths,omitempty"`
+	Dependencies []libDependency `json:"dependencies,omitempty"`
+	auditFindings
+}
+
+func (r *libReport) WriteText(w io.Writer) {
+	r.writeFindings(w, r.Path, r.Arch)
+	if *verbose > 1 {
+		for _, d := range r.Dependencies {
+			resolved := d.Resolved
+			if d.System {
+				resolved = "system"
+			}
+			fmt.Fprintf(w, "  %s => %s\n", d.Name, resolved)
+		}
+	}
+}
+
+// libResolver resolves the libraries used by the Mach-O
+// files inside a bundle
+type libResolver struct {
+	// root is the directory every library must be in
+	root string
+	// executables caches the main executable for each
+	// directory, with its run paths
+	executables map[string]*libExecutable
+}
+
+// libExecutable is a main executable, which provides
+// @executable_path and additional run paths to the code
+// it loads
+type libExecutable struct {
+	Path   string
+	Rpaths []string
+}
+
+func newLibResolver(root string) (*libResolver, error) {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	dir := root
+	if !st.IsDir() {
+		dir = filepath.Dir(root)
+	}
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		return nil, err
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return nil, err
+	}
+	return &libResolver{root: dir, executables: make(map[string]*libExecutable)}, nil
+}
+
+// contains returns true iff p is inside the root
+func (r *libResolver) contains(p string) bool {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return false
+	}
+	if real, err = filepath.Abs(real); err != nil {
+		return false
+	}
+	return strings.HasPrefix(real, r.root+string(filepath.Separator))
+}
+
+// executableFor returns the main executable of the process
+// which loads the code at p. Executables are their own main
+// executable. For other code, it's the executable of the
+// innermost app, extension or XPC service containing it.
+func (r *libResolver) executableFor(p string, f *macho.File) *libExecutable {
+	if f.Type == macho.TypeExecute {
+		return &libExecutable{Path: p, Rpaths: expandRpaths(f, p, p)}
+	}
+	for dir := filepath.Dir(p); dir != "." && dir != "/"; dir = filepath.Dir(dir) {
+		if exe, ok := r.executables[dir]; ok {
+			if exe != nil {
+				return exe
+			}
+			continue
+		}
+		r.executables[dir] = nil
+		if !executableBundleExtensions[filepath.Ext(dir)] {
+			continue
+		}
+		exePath, err := bundleExecutable(dir)
+		if err != nil {
+			continue
+		}
+		bin, err := macho.ReadFile(exePath)
+		if err != nil {
+			continue
+		}
+		exe := &libExecutable{Path: exePath, Rpaths: expandRpaths(bin.Slices[0].File, exePath, exePath)}
+		r.executables[dir] = exe
+		return exe
+	}
+	return nil
+}
+
+// expandLoadPath replaces @loader_path and @executable_path
+// in p. It returns an empty string if p uses
+// @executable_path but exe is unknown.
+func expandLoadPath(p string, loader string, exe string) string {
+	switch {
+	case p == "@loader_path" || strings.HasPrefix(p, "@loader_path/"):
+		return filepath.Join(filepath.Dir(loader), strings.TrimPrefix(p, "@loader_path"))
+	case p == "@executable_path" || strings.HasPrefix(p, "@executable_path/"):
+		if exe == "" {
+			return ""
+		}
+		return filepath.Join(filepath.Dir(exe), strings.TrimPrefix(p, "@executable_path"))
+	}
+	return p
+}
+
+// expandRpaths returns the run paths in f, which is at
+// loader, with @loader_path and @executable_path expanded
+func expandRpaths(f *macho.File, loader string, exe string) []string {
+	var rpaths []string
+	for _, rp := range f.Rpaths() {
+		if p := expandLoadPath(rp.Path, loader, exe); p != "" {
+			rpaths = append(rpaths, p)
+		}
+	}
+	return rpaths
+}
+
+// resolveLibrary returns the path a library is loaded from, using
+// the given run paths for @rpath, or an empty string if it
+// can't be found
+func resolveLibrary(name string, loader string, exe string, rpaths []string) string {
+	if strings.HasPrefix(name, "@rpath/") {
+		rel := strings.TrimPrefix(name, "@rpath/")
+		for _, rp := range rpaths {
+			if p := filepath.Join(rp, rel); fileExists(p) {
+				return p
+			}
+		}
+		return ""
+	}
+	if p := expandLoadPath(name, loader, exe); p != "" && fileExists(p) {
+		return p
+	}
+	return ""
+}
+
+// runPaths returns the main executable of the process which
+// loads the code at p, if known, and the run paths used to
+// resolve @rpath for it, which include the ones of the main
+// executable
+func (r *libResolver) runPaths(p string, f *macho.File) (string, []string) {
+	exe := r.executableFor(p, f)
+	if exe == nil {
+		return "", expandRpaths(f, p, "")
+	}
+	rpaths := expandRpaths(f, p, exe.Path)
+	if exe.Path != p {
+		rpaths = append(rpaths, exe.Rpaths...)
+	}
+	return exe.Path, rpaths
+}
+
+// audit checks the libraries and run paths of a slice of
+// the Mach-O file at p
+func (r *libResolver) audit(p string, f *macho.File) *libReport {
+	report := &libReport{}
+	exePath, rpaths := r.runPaths(p, f)
+	for _, rp := range f.Rpaths() {
+		report.Rpaths = append(report.Rpaths, rp.Path)
+		expanded := expandLoadPath(rp.Path, p, exePath)
+		switch {
+		case expanded == "":
+			report.warning("run path %s can't be resolved without a main executable", rp.Path)
+		case !strings.HasPrefix(rp.Path, "@") && !isSystemLibrary(expanded+"/"):
+			report.warning("run path %s is outside of the bundle", rp.Path)
+		}
+	}
+	if id := f.DylibID(); id != nil {
+		report.ID = id.Name
+		if !strings.HasPrefix(id.Name, "@") && !isSystemLibrary(id.Name) {
+			report.warning("install name %s is an absolute path outside of the bundle", id.Name)
+		}
+	}
+	for _, d := range f.Dylibs() {
+		dep := libDependency{Name: d.Name, Weak: d.Weak()}
+		if isSystemLibrary(d.Name) {
+			dep.System = true
+			report.Dependencies = append(report.Dependencies, dep)
+			continue
+		}
+		dep.Resolved = resolveLibrary(d.Name, p, exePath, rpaths)
+		var problem string
+		switch {
+		case dep.Resolved == "" && strings.HasPrefix(d.Name, "/"):
+			problem = fmt.Sprintf("%s is outside of the bundle and the system library paths", d.Name)
+		case dep.Resolved == "":
+			problem = fmt.Sprintf("%s can't be found in the bundle", d.Name)
+		case !r.contains(dep.Resolved):
+			problem = fmt.Sprintf("%s resolves to %s, outside of the bundle", d.Name, dep.Resolved)
+		}
+		if problem != "" {
+			if dep.Weak {
+				report.warning("weak library %s", problem)
+			} else {
+				report.problem("%s", problem)
+			}
+		}
+		report.Dependencies = append(report.Dependencies, dep)
+	}
+	return report
+}
+
+// auditLibs checks the libraries used by every Mach-O file
+// in root
+func auditLibs(root string) ([]auditReport, error) {
+	r, err := newLibResolver(root)
+	if err != nil {
+		return nil, err
+	}
+	var reports []auditReport
+	err = walkCode(root, func(p string) error {
+		exe, err := codeExecutable(p)
+		if err != nil {
+			return err
+		}
+		bin, err := macho.ReadFile(exe)
+		if err != nil {
+			if err == macho.ErrNotMachO {
+				return nil
+			}
+			return fmt.Errorf("%s: %v", exe, err)
+		}
+		name, _ := filepath.Rel(filepath.Dir(root), exe)
+		for _, s := range bin.Slices {
+			report := r.audit(exe, s.File)
+			report.Path = name
+			if bin.Fat {
+				report.Arch = s.Arch()
+			}
+			reports = append(reports, report)
+		}
+		return nil
+	})
+	return reports, err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuditLibs(t *testing.T) {
+	// hello_arm64 loads @rpath/libfoo.dylib from
+	// @executable_path/../Frameworks and weakly links
+	// /opt/local/lib/libbar.1.dylib
+	root, cleanup := writeTestBundle(t, map[string]string{
+		"MacOS/App":               "hello_arm64",
+		"Frameworks/libfoo.dylib": "libfoo_arm64.dylib",
+	})
+	defer cleanup()
+	audit := func() *libReport {
+		t.Helper()
+		reports, err := auditLibs(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, r := range reports {
+			if r := r.(*libReport); r.Path == filepath.Join("App.app", "Contents", "MacOS", "App") {
+				return r
+			}
+		}
+		t.Fatalf("no report for the executable in %d reports", len(reports))
+		return nil
+	}
+
+	r := audit()
+	if len(r.Problems) != 0 {
+		t.Errorf("problems = %q", r.Problems)
+	}
+	if len(r.Warnings) != 1 || !strings.Contains(r.Warnings[0], "weak library /opt/local/lib/libbar.1.dylib") {
+		t.Errorf("warnings = %q", r.Warnings)
+	}
+	want := filepath.Join(root, "Contents", "Frameworks", "libfoo.dylib")
+	if d := r.Dependencies[1]; d.Resolved != want {
+		t.Errorf("%s resolved to %q, want %q", d.Name, d.Resolved, want)
+	}
+	if d := r.Dependencies[0]; !d.System {
+		t.Errorf("%s is not a system library", d.Name)
+	}
+
+	if err := os.Remove(want); err != nil {
+		t.Fatal(err)
+	}
+	r = audit()
+	if len(r.Problems) != 1 || !strings.Contains(r.Problems[0], "@rpath/libfoo.dylib can't be found") {
+		t.Errorf("problems = %q", r.Problems)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"macapptool/internal/macho"
+)
+
+var (
+	// minimumNotarizationSDK is the oldest macOS SDK accepted
+	// by the notary service
+	minimumNotarizationSDK = macho.MakeVersion(10, 9, 0)
+	// minimumAppleSiliconOS is the first macOS version running
+	// on Apple Silicon, which the linker enforces as the
+	// minimum for arm64 slices
+	minimumAppleSiliconOS = macho.MakeVersion(11, 0, 0)
+)
+
+type buildVersion struct {
+	Platform string `json:"platform"`
+	MinOS    string `json:"min_os"`
+	SDK      string `json:"sdk"`
+}
+
+type versionReport struct {
+	Path     string         `json:"path"`
+	Arch     string         `json:"arch,omitempty"`
+	Versions []buildVersion `json:"versions,omitempty"`
+	auditFindings
+}
+
+func (r *versionReport) WriteText(w io.Writer) {
+	r.writeFindings(w, r.Path, r.Arch)
+	if *verbose > 1 {
+		for _, v := range r.Versions {
+			fmt.Fprintf(w, "  %s min-os=%s sdk=%s\n", v.Platform, v.MinOS, v.SDK)
+		}
+	}
+}
+
+// minimumSystemVersion returns the LSMinimumSystemVersion of
+// the bundle at root, or zero if it's not a bundle or doesn't
+// declare it
+func minimumSystemVersion(root string) (macho.Version, error) {
+	if !isBundleDir(root) {
+		return 0, nil
+	}
+	pl, err := bundleInfoPlist(root)
+	if err != nil {
+		return 0, err
+	}
+	s, err := pl.MinimumSystemVersion()
+	if err != nil || s == "" {
+		errPrintf("warning: %s doesn't declare LSMinimumSystemVersion\n", root)
+		return 0, nil
+	}
+	v, err := macho.ParseVersion(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSMinimumSystemVersion: %v", err)
+	}
+	return v, nil
+}
+
+// auditSliceVersions checks the build versions of a slice
+// against the minimum macOS version of the app, if not zero
+func auditSliceVersions(report *versionReport, f *macho.File, minimum macho.Version) {
+	versions := f.BuildVersions()
+	if len(versions) == 0 {
+		report.warning("no LC_BUILD_VERSION or LC_VERSION_MIN_MACOSX load command")
+		return
+	}
+	// Apple Silicon Macs can't run older macOS versions, so
+	// arm64 slices always require 11.0
+	if f.Cpu == macho.CpuArm64 && minimum != 0 && minimum < minimumAppleSiliconOS {
+		minimum = minimumAppleSiliconOS
+	}
+	for _, v := range versions {
+		report.Versions = append(report.Versions, buildVersion{
+			Platform: macho.PlatformName(v.Platform),
+			MinOS:    v.MinOS.String(),
+			SDK:      v.SDK.String(),
+		})
+		if v.Platform != macho.PlatformMacOS {
+			continue
+		}
+		if v.SDK < minimumNotarizationSDK {
+			report.problem("built with the macOS %s SDK, notarization requires %s or later", v.SDK, minimumNotarizationSDK)
+		}
+		if minimum != 0 && v.MinOS > minimum {
+			report.problem("requires macOS %s, newer than LSMinimumSystemVersion %s", v.MinOS, minimum)
+		}
+	}
+	if ok, platforms := runsOnMacOS(f); !ok {
+		report.problem("built for %s, which can't run on macOS", platforms)
+	}
+}
+
+// runsOnMacOS returns true if a slice can run on macOS, along
+// with the names of its platforms. Slices without any build
+// version are assumed to be old macOS ones.
+func runsOnMacOS(f *macho.File) (bool, string) {
+	versions := f.BuildVersions()
+	if len(versions) == 0 {
+		return true, macho.PlatformName(macho.PlatformMacOS)
+	}
+	ok := false
+	var platforms []string
+	for _, v := range versions {
+		platforms = append(platforms, macho.PlatformName(v.Platform))
+		switch v.Platform {
+		case macho.PlatformMacOS, macho.PlatformMacCatalyst, macho.PlatformDriverKit:
+			// Mac Catalyst and DriverKit use their own
+			// versions, but run on macOS
+			ok = true
+		}
+	}
+	return ok, strings.Join(platforms, ", ")
+}
+
+// auditVersions checks the build versions of every Mach-O
+// file in root
+func auditVersions(root string) ([]auditReport, error) {
+	minimum, err := minimumSystemVersion(root)
+	if err != nil {
+		return nil, err
+	}
+	var reports []auditReport
+	err = walkCode(root, func(p string) error {
+		exe, err := codeExecutable(p)
+		if err != nil {
+			return err
+		}
+		bin, err := macho.ReadFile(exe)
+		if err != nil {
+			if err == macho.ErrNotMachO {
+				return nil
+			}
+			return fmt.Errorf("%s: %v", exe, err)
+		}
+		name, _ := filepath.Rel(filepath.Dir(root), exe)
+		for _, s := range bin.Slices {
+			report := &versionReport{Path: name}
+			if bin.Fat {
+				report.Arch = s.Arch()
+			}
+			auditSliceVersions(report, s.File, minimum)
+			reports = append(reports, report)
+		}
+		return nil
+	})
+	return reports, err
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"macapptool/internal/macho"
+)
+
+// withBuildVersions returns the thin file name in testdata with
+// its LC_BUILD_VERSION replaced by the given versions. The
+// additional ones, like the Mac Catalyst version of zippered
+// files, are appended to the load commands.
+func withBuildVersions(t *testing.T, name string, versions ...macho.BuildVersion) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := macho.NewFile(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := f.Load(macho.LoadCmdBuildVersion)
+	if l == nil {
+		t.Fatalf("%s has no LC_BUILD_VERSION", name)
+	}
+	bo := f.ByteOrder
+	ncmds := bo.Uint32(data[16:])
+	sizeofcmds := bo.Uint32(data[20:])
+	if uint64(len(l.Raw)*(len(versions)-1)) > f.LoadCommandsSpace() {
+		t.Fatalf("no space for %d load commands in %s", len(versions)-1, name)
+	}
+	for ii, v := range versions {
+		offset := uint64(l.Offset)
+		if ii > 0 {
+			offset = uint64(f.HeaderSize()) + uint64(sizeofcmds)
+			copy(data[offset:], l.Raw)
+			ncmds++
+			sizeofcmds += uint32(len(l.Raw))
+		}
+		bo.PutUint32(data[offset+8:], v.Platform)
+		bo.PutUint32(data[offset+12:], uint32(v.MinOS))
+		bo.PutUint32(data[offset+16:], uint32(v.SDK))
+	}
+	bo.PutUint32(data[16:], ncmds)
+	bo.PutUint32(data[20:], sizeofcmds)
+	return data
+}
+
+func buildVersionFile(t *testing.T, name string, versions ...macho.BuildVersion) *macho.File {
+	f, err := macho.NewFile(withBuildVersions(t, name, versions...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestAuditSliceVersions(t *testing.T) {
+	v := func(major, minor int) macho.Version {
+		return macho.MakeVersion(major, minor, 0)
+	}
+	macOS := func(minOS, sdk macho.Version) macho.BuildVersion {
+		return macho.BuildVersion{Platform: macho.PlatformMacOS, MinOS: minOS, SDK: sdk}
+	}
+	catalyst := macho.BuildVersion{Platform: macho.PlatformMacCatalyst, MinOS: v(14, 0), SDK: v(15, 0)}
+	tests := []struct {
+		name      string
+		file      string
+		versions  []macho.BuildVersion
+		minimum   macho.Version
+		platforms string
+		problems  []string
+	}{
+		{
+			name:      "same minimum",
+			file:      "hello_x86_64",
+			versions:  []macho.BuildVersion{macOS(v(10, 13), v(12, 0))},
+			minimum:   v(10, 13),
+			platforms: "macos",
+		},
+		{
+			name:      "no minimum",
+			file:      "hello_x86_64",
+			versions:  []macho.BuildVersion{macOS(v(12, 0), v(12, 0))},
+			platforms: "macos",
+		},
+		{
+			name:      "newer than the app",
+			file:      "hello_x86_64",
+			versions:  []macho.BuildVersion{macOS(v(10, 15), v(12, 0))},
+			minimum:   v(10, 13),
+			platforms: "macos",
+			problems:  []string{"requires macOS 10.15, newer than LSMinimumSystemVersion 10.13"},
+		},
+		{
+			// arm64 slices require 11.0 even if the app
+			// supports older versions on Intel
+			name:      "arm64 on an older app",
+			file:      "hello_arm64",
+			versions:  []macho.BuildVersion{macOS(v(11, 0), v(12, 0))},
+			minimum:   v(10, 13),
+			platforms: "macos",
+		},
+		{
+			name:      "arm64 newer than 11.0",
+			file:      "hello_arm64",
+			versions:  []macho.BuildVersion{macOS(v(12, 0), v(12, 0))},
+			minimum:   v(10, 13),
+			platforms: "macos",
+			problems:  []string{"requires macOS 12.0, newer than LSMinimumSystemVersion 11.0"},
+		},
+		{
+			name:      "old SDK",
+			file:      "hello_x86_64",
+			versions:  []macho.BuildVersion{macOS(v(10, 6), v(10, 8))},
+			minimum:   v(10, 6),
+			platforms: "macos",
+			problems:  []string{"built with the macOS 10.8 SDK, notarization requires 10.9 or later"},
+		},
+		{
+			// Only the macOS version is compared, Mac Catalyst
+			// uses iOS version numbers
+			name:      "zippered",
+			file:      "libfoo_arm64.dylib",
+			versions:  []macho.BuildVersion{macOS(v(11, 0), v(12, 0)), catalyst},
+			minimum:   v(11, 0),
+			platforms: "macos,maccatalyst",
+		},
+		{
+			name:      "zippered newer than the app",
+			file:      "libfoo_arm64.dylib",
+			versions:  []macho.BuildVersion{macOS(v(12, 0), v(12, 0)), catalyst},
+			minimum:   v(11, 0),
+			platforms: "macos,maccatalyst",
+			problems:  []string{"requires macOS 12.0, newer than LSMinimumSystemVersion 11.0"},
+		},
+		{
+			name:      "iOS",
+			file:      "hello_arm64",
+			versions:  []macho.BuildVersion{{Platform: macho.PlatformIOS, MinOS: v(14, 0), SDK: v(15, 0)}},
+			minimum:   v(11, 0),
+			platforms: "ios",
+			problems:  []string{"built for ios, which can't run on macOS"},
+		},
+		{
+			name:      "iOS simulator with an old SDK",
+			file:      "hello_arm64",
+			versions:  []macho.BuildVersion{{Platform: macho.PlatformIOSSimulator, MinOS: v(8, 0), SDK: v(8, 0)}},
+			platforms: "iossimulator",
+			problems:  []string{"built for iossimulator, which can't run on macOS"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := &versionReport{}
+			auditSliceVersions(report, buildVersionFile(t, tt.file, tt.versions...), tt.minimum)
+			var platforms []string
+			for _, v := range report.Versions {
+				platforms = append(platforms, v.Platform)
+			}
+			if got := strings.Join(platforms, ","); got != tt.platforms {
+				t.Errorf("platforms = %s, want %s", got, tt.platforms)
+			}
+			if got, want := strings.Join(report.Problems, "\n"), strings.Join(tt.problems, "\n"); got != want {
+				t.Errorf("problems = %q, want %q", report.Problems, tt.problems)
+			}
+			if len(report.Warnings) != 0 {
+				t.Errorf("warnings = %q", report.Warnings)
+			}
+		})
+	}
+}
+
+func TestAuditVersions(t *testing.T) {
+	root, cleanup := writeTestBundle(t, map[string]string{
+		"MacOS/App":               "hello_arm64",
+		"Frameworks/libfoo.dylib": "libfoo_arm64.dylib",
+	})
+	defer cleanup()
+	contents := filepath.Join(root, "Contents")
+	// The fixtures require macOS 11.0, make the library require
+	// 12.0 and declare support for 10.13 in the Info.plist
+	v := func(major, minor int) macho.Version {
+		return macho.MakeVersion(major, minor, 0)
+	}
+	writeTestFile(t, contents, "Frameworks/libfoo.dylib", withBuildVersions(t, "libfoo_arm64.dylib",
+		macho.BuildVersion{Platform: macho.PlatformMacOS, MinOS: v(12, 0), SDK: v(12, 0)}))
+	writeTestFile(t, contents, "Info.plist", []byte(strings.Replace(testInfoPlist, "</dict>",
+		"<key>LSMinimumSystemVersion</key><string>10.13</string>\n</dict>", 1)))
+
+	reports, err := auditVersions(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := make(map[string]string)
+	for _, r := range reports {
+		r := r.(*versionReport)
+		problems[filepath.ToSlash(r.Path)] = strings.Join(r.Problems, ",")
+	}
+	want := map[string]string{
+		"App.app/Contents/MacOS/App":               "",
+		"App.app/Contents/Frameworks/libfoo.dylib": "requires macOS 12.0, newer than LSMinimumSystemVersion 11.0",
+	}
+	if fmt.Sprint(problems) != fmt.Sprint(want) {
+		t.Errorf("problems = %q, want %q", problems, want)
+	}
+
+	writeTestFile(t, contents, "Info.plist", []byte(strings.Replace(testInfoPlist, "</dict>",
+		"<key>LSMinimumSystemVersion</key><string>10.13.1000</string>\n</dict>", 1)))
+	if _, err := auditVersions(root); err == nil || !strings.Contains(err.Error(), "invalid LSMinimumSystemVersion") {
+		t.Errorf("error = %v, want invalid LSMinimumSystemVersion", err)
+	}
+}
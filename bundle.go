@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"macapptool/internal/plist"
+)
+
+func fileExists(p string) bool {
+	_, err := os.Stat(p)
+	return err == nil
+}
+
+// bundleContents returns the directory containing the Info.plist
+// for the bundle at p and whether it uses the framework layout
+// (with Resources/Info.plist and the executable at the root).
+// For versioned frameworks, it's the version directory which
+// Versions/Current points to, never the symlink itself, so
+// it can be walked with filepath.Walk.
+func bundleContents(p string) (string, bool) {
+	if fileExists(filepath.Join(p, "Contents", "Info.plist")) {
+		return filepath.Join(p, "Contents"), false
+	}
+	// Versioned frameworks also have a Resources symlink
+	// at the root, but their contents are in the version
+	// directory
+	current := filepath.Join(p, "Versions", "Current")
+	if fileExists(filepath.Join(current, "Resources", "Info.plist")) {
+		return frameworkVersion(p), true
+	}
+	if fileExists(filepath.Join(p, "Resources", "Info.plist")) {
+		return p, true
+	}
+	// Shallow bundle
+	return p, false
+}
+
+// frameworkVersion returns the directory Versions/Current
+// points to in the versioned framework at p
+func frameworkVersion(p string) string {
+	versions := filepath.Join(p, "Versions")
+	current := filepath.Join(versions, "Current")
+	target, err := os.Readlink(current)
+	if err != nil {
+		// Not a symlink, the contents are in Current itself
+		return current
+	}
+	// Keep the path inside the framework when the symlink
+	// points to a sibling, like A, rather than resolving
+	// the symlinks in the path of the framework too
+	if v := filepath.Join(versions, target); !filepath.IsAbs(target) && filepath.Dir(v) == versions {
+		return v
+	}
+	if real, err := filepath.EvalSymlinks(current); err == nil {
+		return real
+	}
+	return current
+}
+
+// bundleInfoPlistPath returns the path to the Info.plist
+// of the bundle at p
+func bundleInfoPlistPath(p string) string {
+	contents, framework := bundleContents(p)
+	if framework {
+		return filepath.Join(contents, "Resources", "Info.plist")
+	}
+	return filepath.Join(contents, "Info.plist")
+}
+
+// bundleInfoPlist reads the Info.plist for the bundle at p
+func bundleInfoPlist(p string) (*plist.PList, error) {
+	return plist.NewFile(bundleInfoPlistPath(p))
+}
+
+// bundleExecutable returns the path to the main executable
+// of the bundle at p
+func bundleExecutable(p string) (string, error) {
+	pl, err := bundleInfoPlist(p)
+	if err != nil {
+		return "", err
+	}
+	name, err := pl.BundleExecutable()
+	if err != nil {
+		return "", err
+	}
+	contents, framework := bundleContents(p)
+	candidates := []string{filepath.Join(contents, name)}
+	if !framework {
+		candidates = append([]string{filepath.Join(contents, "MacOS", name)}, candidates...)
+	}
+	for _, v := range candidates {
+		if fileExists(v) {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("can't find executable %s in %s", name, p)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+// readCertificates reads the PEM or DER encoded certificates
+// in the file at p
+func readCertificates(p string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block == nil {
+		certs, err := x509.ParseCertificates(data)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificates in %s: %v", p, err)
+		}
+		return certs, nil
+	}
+	var certs []*x509.Certificate
+	rest := data
+	for {
+		block, r := pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		rest = r
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificate in %s: %v", p, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", p)
+	}
+	return certs, nil
+}
+
+type certsCmd struct {
+	Days        int
+	P12Password string
+
+	// keychainIDs, when keychainRead is true, are used
+	// instead of reading the identities from the keychain
+	keychainIDs  []*signingIdentity
+	keychainRead bool
+}
+
+func (*certsCmd) Name() string {
+	return "certs"
+}
+
+func (*certsCmd) Synopsis() string {
+	return "Check the signing certificates for upcoming expirations"
+}
+
+func (*certsCmd) Usage() string {
+	return `certs check [-days N][-p12-password secret] [some.p12...]
+
+check verifies that none of the signing identities in the
+keychain or, when files are given, in the PKCS#12 files
+expire within the given number of days. For PKCS#12 files,
+the intermediate certificates are checked too. It exits with
+a non-zero status if any of them is about to expire, so it
+can be used in scheduled CI jobs.
+`
+}
+
+func (c *certsCmd) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&c.Days, "days", int(identityExpiryWarning/(24*time.Hour)), "Warn about certificates expiring within this number of days")
+	f.StringVar(&c.P12Password, "p12-password", "", "Password for the PKCS#12 files. Use @env:NAME, @keychain:ITEM or @file:PATH to read it from elsewhere")
+}
+
+func (c *certsCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	// The flags for each action can also come after it
+	action := f.Arg(0)
+	if err := f.Parse(f.Args()[1:]); err != nil {
+		return subcommands.ExitUsageError
+	}
+	var err error
+	switch action {
+	case "check":
+		err = c.check(ctx, f.Args())
+	default:
+		errPrintf("unknown action %q, must be check\n", action)
+		return subcommands.ExitUsageError
+	}
+	if err != nil {
+		errPrint(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// expiringCertificate is a certificate checked by certs check
+type expiringCertificate struct {
+	Name     string
+	Hash     string
+	NotAfter time.Time
+}
+
+func (c *certsCmd) certificates(ctx context.Context, files []string) ([]expiringCertificate, error) {
+	var certs []expiringCertificate
+	if len(files) == 0 {
+		if !c.keychainRead {
+			ids, err := keychainIdentities(ctx)
+			if err != nil {
+				return nil, err
+			}
+			c.keychainIDs, c.keychainRead = ids, true
+		}
+		for _, id := range c.keychainIDs {
+			certs = append(certs, expiringCertificate{Name: id.Name, Hash: id.Hash, NotAfter: id.NotAfter})
+		}
+		return certs, nil
+	}
+	password, err := resolveSecret(c.P12Password)
+	if err != nil {
+		return nil, fmt.Errorf("error reading PKCS#12 password: %v", err)
+	}
+	for _, p := range files {
+		id, err := loadP12Identity(p, password)
+		if err != nil {
+			return nil, err
+		}
+		for _, cert := range append([]*x509.Certificate{id.Certificate}, id.Chain...) {
+			certs = append(certs, expiringCertificate{
+				Name:     cert.Subject.CommonName,
+				Hash:     certificateHash(cert),
+				NotAfter: cert.NotAfter,
+			})
+		}
+	}
+	return certs, nil
+}
+
+func (c *certsCmd) check(ctx context.Context, files []string) error {
+	if c.Days < 0 {
+		return errors.New("-days can't be negative")
+	}
+	certs, err := c.certificates(ctx, files)
+	if err != nil {
+		return err
+	}
+	if len(certs) == 0 {
+		return errors.New("no signing identities found")
+	}
+	now := time.Now()
+	within := time.Duration(c.Days) * 24 * time.Hour
+	expiring := 0
+	for _, cert := range certs {
+		days := int(cert.NotAfter.Sub(now).Hours() / 24)
+		fmt.Printf("%s %s %4d days %q\n", cert.Hash, cert.NotAfter.Format("2006-01-02"), days, cert.Name)
+		if w := certificateExpiryWarning(cert.Name, cert.NotAfter, now, within); w != "" {
+			errPrintf("warning: %s\n", w)
+			expiring++
+		}
+	}
+	if expiring > 0 {
+		return fmt.Errorf("%d certificates expire within %d days", expiring, c.Days)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"macapptool/internal/testpki"
+)
+
+func TestCertsCheck(t *testing.T) {
+	now := time.Now()
+	identity := func(name string, notAfter time.Time) *signingIdentity {
+		cert := testpki.New(t, name, nil, &testpki.Options{NotAfter: notAfter})
+		return newSigningIdentity(cert.Cert, "", "keychain")
+	}
+	valid := identity("Developer ID Application: Valid (ABCDE12345)", now.AddDate(1, 0, 0))
+	soon := identity("Developer ID Application: Soon (ABCDE12345)", now.AddDate(0, 0, 10))
+	expired := identity("Apple Development: Expired (ABCDE12345)", now.Add(-time.Hour))
+	tests := []struct {
+		days int
+		ids  []*signingIdentity
+		err  string
+	}{
+		{30, []*signingIdentity{valid}, ""},
+		{30, []*signingIdentity{valid, soon}, "1 certificates expire within 30 days"},
+		{5, []*signingIdentity{valid, soon}, ""},
+		{5, []*signingIdentity{valid, soon, expired}, "1 certificates expire within 5 days"},
+		{400, []*signingIdentity{valid, soon, expired}, "3 certificates expire within 400 days"},
+		{0, []*signingIdentity{valid}, ""},
+		{30, nil, "no signing identities found"},
+		{-1, []*signingIdentity{valid}, "-days can't be negative"},
+	}
+	for _, tt := range tests {
+		c := &certsCmd{Days: tt.days, keychainIDs: tt.ids, keychainRead: true}
+		err := c.check(context.Background(), nil)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("-days %d with %d identities: %v", tt.days, len(tt.ids), err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("-days %d with %d identities: error = %v, want %s", tt.days, len(tt.ids), err, tt.err)
+		}
+	}
+}
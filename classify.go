@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+
+	"macapptool/internal/macho"
+)
+
+// fileKind is the kind of a file, as determined from its
+// header rather than its name or permissions
+type fileKind int
+
+const (
+	kindData fileKind = iota
+	// kindExecutable is a Mach-O MH_EXECUTE file
+	kindExecutable
+	// kindDylib is a Mach-O MH_DYLIB file
+	kindDylib
+	// kindLoadable is a Mach-O MH_BUNDLE or MH_KEXT_BUNDLE
+	// file, like plugins and Python or Node.js modules
+	kindLoadable
+	// kindMachO is any other Mach-O file, like object files,
+	// which can't be signed
+	kindMachO
+	// kindArchive is a static library
+	kindArchive
+	// kindScript is a file starting with a shebang
+	kindScript
+	// kindELF is an ELF file, used by Linux and most other
+	// Unix systems
+	kindELF
+	// kindPE is a PE/COFF file, used by Windows
+	kindPE
+	// kindWasm is a WebAssembly module
+	kindWasm
+)
+
+var fileKindNames = map[fileKind]string{
+	kindData:       "data",
+	kindExecutable: "executable",
+	kindDylib:      "dylib",
+	kindLoadable:   "loadable bundle",
+	kindMachO:      "Mach-O file",
+	kindArchive:    "static archive",
+	kindScript:     "script",
+	kindELF:        "ELF file",
+	kindPE:         "PE/COFF file",
+	kindWasm:       "WebAssembly module",
+}
+
+func (k fileKind) String() string {
+	return fileKindNames[k]
+}
+
+// IsCode returns true for the kinds of files which get their
+// own code signature. Scripts can be signed by codesign using
+// extended attributes, but those are lost in most archive
+// formats, so scripts are sealed as resources instead.
+func (k fileKind) IsCode() bool {
+	return k == kindExecutable || k == kindDylib || k == kindLoadable
+}
+
+// IsForeign returns true for the kinds of executable files
+// which can't run natively on macOS
+func (k fileKind) IsForeign() bool {
+	return k == kindELF || k == kindPE || k == kindWasm
+}
+
+// IsMachO returns true for the kinds of Mach-O files
+func (k fileKind) IsMachO() bool {
+	return k == kindExecutable || k == kindDylib || k == kindLoadable || k == kindMachO
+}
+
+var (
+	// archiveMagic is the header of static libraries
+	archiveMagic = []byte("!<arch>\n")
+	elfMagic     = []byte("\x7fELF")
+	wasmMagic    = []byte("\x00asm")
+	// dosMagic is the header of the MS-DOS stub which starts
+	// PE files, with the offset of the PE header at 0x3c
+	dosMagic = []byte("MZ")
+	peMagic  = []byte("PE\x00\x00")
+)
+
+// isPE returns true if the file read by r, which starts with
+// the given header, is a PE file rather than just a file
+// starting with MZ
+func isPE(r io.ReaderAt, header []byte) bool {
+	if len(header) < 32 {
+		return false
+	}
+	offset := make([]byte, 4)
+	if _, err := r.ReadAt(offset, 0x3c); err != nil {
+		return false
+	}
+	magic := make([]byte, len(peMagic))
+	if _, err := r.ReadAt(magic, int64(binary.LittleEndian.Uint32(offset))); err != nil {
+		return false
+	}
+	return bytes.Equal(magic, peMagic)
+}
+
+// machOKind returns the kind of a thin Mach-O header
+func machOKind(header []byte) fileKind {
+	if len(header) < 16 {
+		return kindData
+	}
+	var bo binary.ByteOrder = binary.LittleEndian
+	switch binary.LittleEndian.Uint32(header) {
+	case macho.Magic32, macho.Magic64:
+	default:
+		bo = binary.BigEndian
+	}
+	switch macho.Type(bo.Uint32(header[12:])) {
+	case macho.TypeExecute:
+		return kindExecutable
+	case macho.TypeDylib:
+		return kindDylib
+	case macho.TypeBundle, macho.TypeKextBundle:
+		return kindLoadable
+	}
+	return kindMachO
+}
+
+// classify returns the kind of the file read by r, using
+// the header of its first slice for universal files
+func classify(r io.ReaderAt) (fileKind, error) {
+	header := make([]byte, 32)
+	n, err := r.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return kindData, err
+	}
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, archiveMagic):
+		return kindArchive, nil
+	case bytes.HasPrefix(header, []byte("#!")):
+		return kindScript, nil
+	case bytes.HasPrefix(header, elfMagic):
+		return kindELF, nil
+	case bytes.HasPrefix(header, wasmMagic):
+		return kindWasm, nil
+	case bytes.HasPrefix(header, dosMagic) && isPE(r, header):
+		return kindPE, nil
+	case !macho.IsMachO(header):
+		return kindData, nil
+	}
+	switch binary.BigEndian.Uint32(header) {
+	case macho.MagicFat:
+		// struct fat_arch follows the 8 bytes fat_header,
+		// with its offset at byte 8
+		if len(header) < 20 {
+			return kindData, nil
+		}
+		return classifySlice(r, int64(binary.BigEndian.Uint32(header[16:])))
+	case macho.MagicFat64:
+		if len(header) < 24 {
+			return kindData, nil
+		}
+		return classifySlice(r, int64(binary.BigEndian.Uint64(header[16:])))
+	}
+	return machOKind(header), nil
+}
+
+func classifySlice(r io.ReaderAt, offset int64) (fileKind, error) {
+	header := make([]byte, 16)
+	if _, err := r.ReadAt(header, offset); err != nil {
+		if err == io.EOF {
+			return kindData, nil
+		}
+		return kindData, err
+	}
+	// Universal static libraries contain an archive per slice
+	if bytes.HasPrefix(header, archiveMagic) {
+		return kindArchive, nil
+	}
+	if !macho.IsMachO(header) {
+		return kindData, nil
+	}
+	return machOKind(header), nil
+}
+
+// classifyFile returns the kind of the file at p
+func classifyFile(p string) (fileKind, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return kindData, err
+	}
+	defer f.Close()
+	return classify(f)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"macapptool/internal/macho"
+)
+
+// peHeader returns a minimal PE file, with the offset of the
+// PE header at 0x3c
+func peHeader() []byte {
+	data := make([]byte, 0x48)
+	copy(data, dosMagic)
+	binary.LittleEndian.PutUint32(data[0x3c:], 0x40)
+	copy(data[0x40:], peMagic)
+	return data
+}
+
+func TestClassify(t *testing.T) {
+	read := func(name string) []byte {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	arm64 := read("hello_arm64")
+	universal := macho.BuildUniversal([]macho.SliceData{
+		{Cpu: macho.CpuAmd64, Data: read("hello_x86_64")},
+		{Cpu: macho.CpuArm64, Data: arm64},
+	}, false)
+	universal64 := macho.BuildUniversal([]macho.SliceData{{Cpu: macho.CpuArm64, Data: read("libfoo_arm64.dylib")}}, true)
+	notPE := peHeader()
+	copy(notPE[0x40:], "NE")
+	tests := []struct {
+		name    string
+		data    []byte
+		kind    fileKind
+		foreign bool
+	}{
+		{"empty", nil, kindData, false},
+		{"text", []byte("hello, world\n"), kindData, false},
+		{"script", []byte("#!/bin/sh\necho hello\n"), kindScript, false},
+		{"archive", []byte("!<arch>\n"), kindArchive, false},
+		{"executable", arm64, kindExecutable, false},
+		{"dylib", read("libfoo_arm64.dylib"), kindDylib, false},
+		{"universal", universal, kindExecutable, false},
+		{"universal fat64", universal64, kindDylib, false},
+		{"truncated universal", universal[:16], kindData, false},
+		{"ELF", []byte("\x7fELF\x02\x01\x01\x00"), kindELF, true},
+		{"PE", peHeader(), kindPE, true},
+		{"MZ without PE header", notPE, kindData, false},
+		{"MZ text", []byte("MZ"), kindData, false},
+		{"wasm", []byte("\x00asm\x01\x00\x00\x00"), kindWasm, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, err := classify(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind != tt.kind {
+				t.Errorf("kind = %s, want %s", kind, tt.kind)
+			}
+			if kind.IsForeign() != tt.foreign {
+				t.Errorf("IsForeign() = %v", kind.IsForeign())
+			}
+			if kind.IsForeign() && kind.IsMachO() {
+				t.Error("foreign kind is Mach-O")
+			}
+		})
+	}
+}
+
+// withFileType returns a copy of the thin Mach-O file in data
+// with its header changed to the given file type
+func withFileType(data []byte, typ macho.Type) []byte {
+	data = append([]byte(nil), data...)
+	binary.LittleEndian.PutUint32(data[12:], uint32(typ))
+	return data
+}
+
+func TestMachOKind(t *testing.T) {
+	dylib, err := ioutil.ReadFile(filepath.Join("testdata", "libfoo_arm64.dylib"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A big endian 32-bit PowerPC header
+	ppc := []byte{0xfe, 0xed, 0xfa, 0xce, 0, 0, 0, 18, 0, 0, 0, 0, 0, 0, 0, 2}
+	archive := macho.BuildUniversal([]macho.SliceData{{Cpu: macho.CpuArm64, Data: []byte("!<arch>\nlibfoo.a")}}, false)
+	tests := []struct {
+		name   string
+		data   []byte
+		kind   fileKind
+		code   bool
+		isMach bool
+	}{
+		{"dylib", dylib, kindDylib, true, true},
+		{"bundle", withFileType(dylib, macho.TypeBundle), kindLoadable, true, true},
+		{"kext", withFileType(dylib, macho.TypeKextBundle), kindLoadable, true, true},
+		{"object", withFileType(dylib, macho.TypeObject), kindMachO, false, true},
+		{"dSYM", withFileType(dylib, macho.TypeDsym), kindMachO, false, true},
+		{"big endian executable", ppc, kindExecutable, true, true},
+		{"universal archive", archive, kindArchive, false, false},
+		{"script", []byte("#!/usr/bin/env python3\n"), kindScript, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kind, err := classify(bytes.NewReader(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind != tt.kind || kind.IsCode() != tt.code || kind.IsMachO() != tt.isMach {
+				t.Errorf("kind = %s, IsCode() = %v, IsMachO() = %v, want %s, %v, %v",
+					kind, kind.IsCode(), kind.IsMachO(), tt.kind, tt.code, tt.isMach)
+			}
+		})
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"macapptool/internal/codesign"
+	"macapptool/internal/macho"
+)
+
+// bundleExtensions contains the extensions of the directories
+// which are always treated as bundles
+var bundleExtensions = map[string]bool{
+	".app":             true,
+	".appex":           true,
+	".bundle":          true,
+	".framework":       true,
+	".kext":            true,
+	".mdimporter":      true,
+	".plugin":          true,
+	".prefPane":        true,
+	".qlgenerator":     true,
+	".saver":           true,
+	".systemextension": true,
+	".xpc":             true,
+}
+
+// nestedCodeDirs contains the directories, relative to the
+// bundle contents, where nested code is placed
+var nestedCodeDirs = []string{
+	"Frameworks",
+	"SharedFrameworks",
+	"PlugIns",
+	"XPCServices",
+	"Library/LoginItems",
+	"Library/LaunchServices",
+	"Library/SystemExtensions",
+	"Helpers",
+	"MacOS",
+}
+
+func isBundleDir(p string) bool {
+	if bundleExtensions[filepath.Ext(p)] {
+		return true
+	}
+	return fileExists(filepath.Join(p, "Contents", "Info.plist"))
+}
+
+// hostArch returns the Mach-O architecture name for the
+// running system
+func hostArch() string {
+	switch runtime.GOARCH {
+	case "amd64":
+		return "x86_64"
+	case "386":
+		return "i386"
+	}
+	return runtime.GOARCH
+}
+
+// nestedCode returns the cdhash and designated requirement
+// of the code at p, for sealing it in the bundle containing
+// it. It returns nil if p is not a bundle nor signable code.
+// For universal binaries, the slice for the running system is
+// used, like codesign does.
+func nestedCode(p string, info os.FileInfo) (*codesign.NestedCode, error) {
+	exe := p
+	if info.IsDir() {
+		if !isBundleDir(p) {
+			return nil, nil
+		}
+		var err error
+		if exe, err = bundleExecutable(p); err != nil {
+			return nil, err
+		}
+	} else if kind, err := classifyFile(p); err != nil || !kind.IsCode() {
+		return nil, err
+	}
+	bin, err := macho.ReadFile(exe)
+	if err != nil {
+		return nil, err
+	}
+	slice := bin.Slices[0]
+	for _, s := range bin.Slices {
+		if s.Arch() == hostArch() {
+			slice = s
+			break
+		}
+	}
+	data := slice.Signature()
+	if data == nil {
+		return nil, errors.New("nested code is not signed")
+	}
+	sig, err := codesign.ParseSignature(data)
+	if err != nil {
+		return nil, err
+	}
+	return codesign.NewNestedCode(sig)
+}
+
+// codeObject is a bundle or a standalone Mach-O file which
+// gets its own signature
+type codeObject struct {
+	Path   string
+	Bundle bool
+	// deps contains the code objects which must be signed
+	// before this one, like the ones nested inside it
+	deps []*codeObject
+}
+
+// codeGraph contains the code objects inside a path and
+// their dependencies
+type codeGraph struct {
+	objects map[string]*codeObject
+	roots   []*codeObject
+}
+
+// newCodeGraph finds the code objects inside p. If p is a
+// bundle or a Mach-O file, it's the only root. Otherwise
+// p is searched for bundles and Mach-O files.
+func newCodeGraph(p string) (*codeGraph, error) {
+	g := &codeGraph{objects: make(map[string]*codeObject)}
+	st, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !st.IsDir() || isBundleDir(p) {
+		obj, err := g.add(p, st.IsDir())
+		if err != nil {
+			return nil, err
+		}
+		g.roots = append(g.roots, obj)
+		return g, nil
+	}
+	objs, err := g.scanDir(p, "", true)
+	if err != nil {
+		return nil, err
+	}
+	g.roots = objs
+	return g, nil
+}
+
+// add returns the code object at p, creating it and scanning
+// its nested code if it's not in the graph yet. Objects are
+// keyed by their real path, so code reachable via symlinks
+// is only added once.
+func (g *codeGraph) add(p string, bundle bool) (*codeObject, error) {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return nil, err
+	}
+	if obj := g.objects[real]; obj != nil {
+		return obj, nil
+	}
+	obj := &codeObject{Path: p, Bundle: bundle}
+	g.objects[real] = obj
+	if bundle {
+		if err := g.scanBundle(obj); err != nil {
+			return nil, err
+		}
+	}
+	return obj, nil
+}
+
+// scanBundle adds the code nested in the bundle. Bundles are
+// only expected in the nestedCodeDirs, but standalone code,
+// like Python and Node.js modules, can be anywhere.
+func (g *codeGraph) scanBundle(obj *codeObject) error {
+	contents, _ := bundleContents(obj.Path)
+	var mainExe string
+	if exe, err := bundleExecutable(obj.Path); err == nil {
+		mainExe, _ = filepath.EvalSymlinks(exe)
+	}
+	nestedDirs := make(map[string]bool)
+	for _, dir := range nestedCodeDirs {
+		p := filepath.Join(contents, filepath.FromSlash(dir))
+		nestedDirs[p] = true
+		// Also mark the parents of nested directories, like
+		// Library for Library/LoginItems, so they are not
+		// scanned as a whole
+		for parent := filepath.Dir(p); parent != contents; parent = filepath.Dir(parent) {
+			if !nestedDirs[parent] {
+				nestedDirs[parent] = false
+			}
+		}
+	}
+	var scan func(dir string) error
+	scan = func(dir string) error {
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, v := range entries {
+			p := filepath.Join(dir, v.Name())
+			bundles, known := nestedDirs[p]
+			var nested []*codeObject
+			switch {
+			case v.Mode()&os.ModeSymlink != 0 || strings.HasPrefix(v.Name(), "_CodeSignature"):
+				continue
+			case known && !bundles:
+				if err := scan(p); err != nil {
+					return err
+				}
+				continue
+			case v.IsDir():
+				nested, err = g.scanDir(p, mainExe, bundles)
+			default:
+				nested, err = g.scanFile(p, v, mainExe)
+			}
+			if err != nil {
+				return err
+			}
+			obj.deps = append(obj.deps, nested...)
+		}
+		return nil
+	}
+	return scan(contents)
+}
+
+// scanFile returns the code object for the file at p, or nil
+// if it's not code. The file at skip, which is the main
+// executable of the enclosing bundle, is ignored.
+func (g *codeGraph) scanFile(p string, info os.FileInfo, skip string) ([]*codeObject, error) {
+	if !info.Mode().IsRegular() {
+		return nil, nil
+	}
+	if real, err := filepath.EvalSymlinks(p); err != nil || real == skip {
+		return nil, err
+	}
+	kind, err := classifyFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if !kind.IsCode() {
+		return nil, nil
+	}
+	obj, err := g.add(p, false)
+	if err != nil {
+		return nil, err
+	}
+	return []*codeObject{obj}, nil
+}
+
+// scanDir returns the code objects inside dir, searching
+// inside subdirectories. When bundles is true, the bundles
+// found are added as code objects. Otherwise, they're treated
+// as regular directories. Symlinks are ignored, since they
+// point to code which is found by other paths. The file at
+// skip, which is the main executable of the enclosing bundle,
+// is ignored too.
+func (g *codeGraph) scanDir(dir string, skip string, bundles bool) ([]*codeObject, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var objs []*codeObject
+	for _, v := range entries {
+		p := filepath.Join(dir, v.Name())
+		switch {
+		case v.Mode()&os.ModeSymlink != 0:
+			continue
+		case v.IsDir() && bundles && isBundleDir(p):
+			obj, err := g.add(p, true)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, obj)
+		case v.IsDir():
+			if strings.HasPrefix(v.Name(), "_CodeSignature") {
+				continue
+			}
+			nested, err := g.scanDir(p, skip, bundles)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, nested...)
+		default:
+			nested, err := g.scanFile(p, v, skip)
+			if err != nil {
+				return nil, err
+			}
+			objs = append(objs, nested...)
+		}
+	}
+	return objs, nil
+}
+
+// order returns the code objects in signing order, with
+// every object after its dependencies
+func (g *codeGraph) order() []*codeObject {
+	var objs []*codeObject
+	visited := make(map[*codeObject]bool)
+	var visit func(obj *codeObject)
+	visit = func(obj *codeObject) {
+		if visited[obj] {
+			return
+		}
+		visited[obj] = true
+		for _, dep := range obj.deps {
+			visit(dep)
+		}
+		objs = append(objs, obj)
+	}
+	for _, obj := range g.roots {
+		visit(obj)
+	}
+	return objs
+}
+
+// walkCode calls fn for every code object inside p that
+// needs to be signed, in signing order. Nested code is
+// visited before the code containing it, and every code
+// object is visited exactly once.
+func walkCode(p string, fn func(p string) error) error {
+	g, err := newCodeGraph(p)
+	if err != nil {
+		return err
+	}
+	for _, obj := range g.order() {
+		if err := fn(obj.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkCodeParallel is like walkCode, but calls fn for up to
+// jobs code objects at the same time. A code object is only
+// visited after all its dependencies have been visited
+// successfully. After the first error, no more code objects
+// are visited and the context passed to the running calls
+// is cancelled.
+func walkCodeParallel(ctx context.Context, p string, jobs int, fn func(ctx context.Context, p string) error) error {
+	g, err := newCodeGraph(p)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	objs := g.order()
+	pending := make(map[*codeObject]int)
+	dependents := make(map[*codeObject][]*codeObject)
+	var queue []*codeObject
+	for _, obj := range objs {
+		seen := make(map[*codeObject]bool)
+		for _, dep := range obj.deps {
+			if !seen[dep] {
+				seen[dep] = true
+				pending[obj]++
+				dependents[dep] = append(dependents[dep], obj)
+			}
+		}
+		if pending[obj] == 0 {
+			queue = append(queue, obj)
+		}
+	}
+
+	type result struct {
+		obj *codeObject
+		err error
+	}
+	results := make(chan result)
+	running := 0
+	var firstErr error
+	for {
+		for firstErr == nil && running < jobs && len(queue) > 0 {
+			obj := queue[0]
+			queue = queue[1:]
+			running++
+			go func() {
+				results <- result{obj: obj, err: fn(ctx, obj.Path)}
+			}()
+		}
+		if running == 0 {
+			break
+		}
+		r := <-results
+		running--
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+				cancel()
+			}
+			continue
+		}
+		for _, obj := range dependents[r.obj] {
+			if pending[obj]--; pending[obj] == 0 {
+				queue = append(queue, obj)
+			}
+		}
+	}
+	return firstErr
+}
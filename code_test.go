@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBundlePlist returns the Info.plist of a bundle with the
+// given identifier and executable
+func testBundlePlist(id string, exe string) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+<key>CFBundleIdentifier</key><string>%s</string>
+<key>CFBundleExecutable</key><string>%s</string>
+</dict></plist>`, id, exe)
+}
+
+// writeTestFile writes data to rel inside root, creating the
+// directories containing it
+func writeTestFile(t *testing.T, root string, rel string, data []byte) {
+	p := filepath.Join(root, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// copyTestFile copies the file name in testdata to rel
+// inside root
+func copyTestFile(t *testing.T, root string, rel string, name string) {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, root, rel, data)
+}
+
+// writeTestFramework creates a versioned framework at p, with
+// its contents in Versions/A and the Versions/Current, binary
+// and Resources symlinks, like the ones made by Xcode
+func writeTestFramework(t *testing.T, p string) {
+	name := strings.TrimSuffix(filepath.Base(p), ".framework")
+	version := filepath.Join(p, "Versions", "A")
+	copyTestFile(t, version, name, "libfoo_arm64.dylib")
+	writeTestFile(t, version, "Resources/Info.plist", []byte(testBundlePlist("com.example."+strings.ToLower(name), name)))
+	writeTestFile(t, version, "Resources/data.txt", []byte("framework data\n"))
+	for _, link := range [][2]string{
+		{"Versions/Current", "A"},
+		{name, "Versions/Current/" + name},
+		{"Resources", "Versions/Current/Resources"},
+	} {
+		if err := os.Symlink(link[1], filepath.Join(p, filepath.FromSlash(link[0]))); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// writeNestedTestBundle creates App.app with a versioned
+// framework, which contains a helper tool, a plugin and a
+// loose Python module in Resources
+func writeNestedTestBundle(t *testing.T) (string, func()) {
+	root, cleanup := writeTestBundle(t, map[string]string{
+		"MacOS/App":               "hello_arm64",
+		"Resources/python/mod.so": "libfoo_arm64.dylib",
+		"PlugIns/Plugin.bundle/Contents/MacOS/Plugin": "hello_arm64",
+	})
+	contents := filepath.Join(root, "Contents")
+	writeTestFile(t, contents, "PlugIns/Plugin.bundle/Contents/Info.plist", []byte(testBundlePlist("com.example.plugin", "Plugin")))
+	writeTestFile(t, contents, "Resources/data.txt", []byte("app data\n"))
+	framework := filepath.Join(contents, "Frameworks", "Foo.framework")
+	writeTestFramework(t, framework)
+	copyTestFile(t, filepath.Join(framework, "Versions", "A"), "Helpers/tool", "hello_arm64")
+	return root, cleanup
+}
+
+func TestBundleContents(t *testing.T) {
+	root, cleanup := writeNestedTestBundle(t)
+	defer cleanup()
+	framework := filepath.Join(root, "Contents", "Frameworks", "Foo.framework")
+	plugin := filepath.Join(root, "Contents", "PlugIns", "Plugin.bundle")
+	tests := []struct {
+		path      string
+		contents  string
+		framework bool
+		exe       string
+	}{
+		{root, "Contents", false, "Contents/MacOS/App"},
+		{plugin, "Contents", false, "Contents/MacOS/Plugin"},
+		{framework, "Versions/A", true, "Versions/A/Foo"},
+	}
+	for _, tt := range tests {
+		t.Run(filepath.Base(tt.path), func(t *testing.T) {
+			contents, isFramework := bundleContents(tt.path)
+			if want := filepath.Join(tt.path, filepath.FromSlash(tt.contents)); contents != want || isFramework != tt.framework {
+				t.Errorf("bundleContents() = %s, %v, want %s, %v", contents, isFramework, want, tt.framework)
+			}
+			exe, err := bundleExecutable(tt.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(tt.path, filepath.FromSlash(tt.exe)); exe != want {
+				t.Errorf("bundleExecutable() = %s, want %s", exe, want)
+			}
+		})
+	}
+}
+
+func TestCodeGraphOrder(t *testing.T) {
+	root, cleanup := writeNestedTestBundle(t)
+	defer cleanup()
+	var order []string
+	err := walkCode(root, func(p string) error {
+		rel, err := filepath.Rel(filepath.Dir(root), p)
+		if err != nil {
+			return err
+		}
+		order = append(order, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Nested code comes before the code containing it, and the
+	// symlinks at the root of the framework don't add it twice
+	want := []string{
+		"App.app/Contents/Frameworks/Foo.framework/Versions/A/Helpers/tool",
+		"App.app/Contents/Frameworks/Foo.framework",
+		"App.app/Contents/PlugIns/Plugin.bundle",
+		"App.app/Contents/Resources/python/mod.so",
+		"App.app",
+	}
+	if got := strings.Join(order, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("order =\n%s\nwant\n%s", got, strings.Join(want, "\n"))
+	}
+
+	// Walking a directory finds every bundle in it
+	order = nil
+	dir := filepath.Dir(root)
+	writeTestFramework(t, filepath.Join(dir, "Bar.framework"))
+	err = walkCode(dir, func(p string) error {
+		order = append(order, filepath.Base(p))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(order, ","), "tool,Foo.framework,Plugin.bundle,mod.so,App.app,Bar.framework"; got != want {
+		t.Errorf("order = %s, want %s", got, want)
+	}
+}
+
+func TestWalkCodeParallel(t *testing.T) {
+	root, cleanup := writeNestedTestBundle(t)
+	defer cleanup()
+	g, err := newCodeGraph(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deps := make(map[string][]string)
+	for _, obj := range g.order() {
+		for _, dep := range obj.deps {
+			deps[obj.Path] = append(deps[obj.Path], dep.Path)
+		}
+	}
+
+	const jobs = 2
+	var mu sync.Mutex
+	done := make(map[string]bool)
+	running, maxRunning := 0, 0
+	err = walkCodeParallel(context.Background(), root, jobs, func(ctx context.Context, p string) error {
+		mu.Lock()
+		for _, dep := range deps[p] {
+			if !done[dep] {
+				t.Errorf("%s started before %s finished", filepath.Base(p), filepath.Base(dep))
+			}
+		}
+		if done[p] {
+			t.Errorf("%s visited twice", filepath.Base(p))
+		}
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		running--
+		done[p] = true
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(done) != len(g.order()) {
+		t.Errorf("visited %d code objects, want %d", len(done), len(g.order()))
+	}
+	if maxRunning > jobs {
+		t.Errorf("%d code objects visited at the same time, want at most %d", maxRunning, jobs)
+	}
+}
+
+func TestWalkCodeParallelError(t *testing.T) {
+	root, cleanup := writeNestedTestBundle(t)
+	defer cleanup()
+	// tool and Plugin.bundle have no dependencies, so they're
+	// visited first. The failure of Plugin.bundle cancels tool
+	// and nothing else is visited after it.
+	failure := errors.New("signing failed")
+	var mu sync.Mutex
+	var visited []string
+	err := walkCodeParallel(context.Background(), root, 2, func(ctx context.Context, p string) error {
+		name := filepath.Base(p)
+		mu.Lock()
+		visited = append(visited, name)
+		mu.Unlock()
+		switch name {
+		case "Plugin.bundle":
+			return failure
+		case "tool":
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(5 * time.Second):
+				return errors.New("not cancelled")
+			}
+		}
+		return nil
+	})
+	if err != failure {
+		t.Errorf("error = %v, want %v", err, failure)
+	}
+	sort.Strings(visited)
+	if got := strings.Join(visited, ","); got != "Plugin.bundle,tool" {
+		t.Errorf("visited %s, want Plugin.bundle,tool", got)
+	}
+}
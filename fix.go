@@ -7,11 +7,14 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/google/subcommands"
 )
 
 type fixCmd struct {
+	RemoveForeign bool
+	Force         bool
 }
 
 func (*fixCmd) Name() string {
@@ -23,10 +26,16 @@ func (*fixCmd) Synopsis() string {
 }
 
 func (*fixCmd) Usage() string {
-	return fmt.Sprintf(`Usage: %s fix some.app
+	return fmt.Sprintf(`Usage: %s fix [-remove-foreign [-force]] some.app
 
 	fix checks the app bundle for invalid structures
 	(like unsealed resources) and fixes them automatically.
+	With -remove-foreign, it also removes the files which
+	audit binaries reports, like ELF and PE files, and the
+	Mach-O slices built for other platforms. Since that
+	invalidates the signatures of the bundles containing
+	them, signed bundles are only modified with -force,
+	and they must be signed again afterwards.
 `, filepath.Base(os.Args[0]))
 }
 
@@ -41,6 +50,8 @@ func (p *fixCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) s
 }
 
 func (p *fixCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.RemoveForeign, "remove-foreign", false, "Remove the files containing code which can't run on macOS")
+	f.BoolVar(&p.Force, "force", false, "Allow -remove-foreign to modify signed bundles")
 }
 
 func (p *fixCmd) fixApp(path string) error {
@@ -67,6 +78,41 @@ func (p *fixCmd) fixApp(path string) error {
 			return err
 		}
 	}
+	if p.RemoveForeign {
+		return p.removeForeign(path)
+	}
+	return nil
+}
+
+// removeForeign removes the code which can't run on macOS
+// from the bundle at path
+func (p *fixCmd) removeForeign(path string) error {
+	binaries, err := findForeignBinaries(path)
+	if err != nil {
+		return err
+	}
+	if len(binaries) == 0 {
+		return nil
+	}
+	var files []string
+	for _, b := range binaries {
+		files = append(files, b.Path)
+	}
+	signed, err := signedContainers(path, files)
+	if err != nil {
+		return err
+	}
+	if len(signed) > 0 && !p.Force {
+		return fmt.Errorf("removing foreign binaries would invalidate the signature of %s, use -force to remove them anyway", strings.Join(signed, ", "))
+	}
+	for _, b := range binaries {
+		if err := removeForeignBinary(b); err != nil {
+			return err
+		}
+	}
+	for _, s := range signed {
+		errPrintf("warning: %s must be signed again\n", s)
+	}
 	return nil
 }
 
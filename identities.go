@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+// identityExpiryWarning is how long before the certificate
+// expiration we start warning about it
+const identityExpiryWarning = 30 * 24 * time.Hour
+
+// signingIdentity is a certificate with a private key which
+// can be used for signing code
+type signingIdentity struct {
+	// Hash is the SHA-1 of the certificate, in uppercase hex
+	// as shown by security and accepted by codesign
+	Hash     string    `json:"hash"`
+	Name     string    `json:"name"`
+	TeamID   string    `json:"team_id,omitempty"`
+	Type     string    `json:"type"`
+	NotAfter time.Time `json:"not_after"`
+	// Source is either keychain or the path to a .p12 file
+	Source string `json:"source"`
+
+	Certificate *x509.Certificate `json:"-"`
+}
+
+func certificateHash(cert *x509.Certificate) string {
+	sum := sha1.Sum(cert.Raw)
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func newSigningIdentity(cert *x509.Certificate, name string, source string) *signingIdentity {
+	if name == "" {
+		name = cert.Subject.CommonName
+	}
+	id := &signingIdentity{
+		Hash:        certificateHash(cert),
+		Name:        name,
+		NotAfter:    cert.NotAfter,
+		Source:      source,
+		Certificate: cert,
+	}
+	if len(cert.Subject.OrganizationalUnit) > 0 {
+		id.TeamID = cert.Subject.OrganizationalUnit[0]
+	} else if m := identityTeamIDRe.FindStringSubmatch(name); m != nil {
+		id.TeamID = m[1]
+	}
+	id.Type = identityType(name)
+	return id
+}
+
+// identityType returns the type of an identity from its name.
+// Apple certificates are named after their type, like
+// "Developer ID Application: Name (TEAMID)"
+func identityType(name string) string {
+	if sep := strings.Index(name, ": "); sep > 0 {
+		return name[:sep]
+	}
+	return "Other"
+}
+
+// distributionTypes contains the identity types used for
+// distributing apps, as opposed to development ones like
+// "Apple Development"
+var distributionTypes = map[string]bool{
+	"Developer ID Application":            true,
+	"Apple Distribution":                  true,
+	"3rd Party Mac Developer Application": true,
+}
+
+// expiryWarning returns a warning if the identity expires
+// within the given duration from now
+func (id *signingIdentity) expiryWarning(now time.Time, within time.Duration) string {
+	return certificateExpiryWarning(id.Name, id.NotAfter, now, within)
+}
+
+// certificateExpiryWarning returns a warning if a certificate
+// expiring at notAfter expires within the given duration
+// from now
+func certificateExpiryWarning(name string, notAfter time.Time, now time.Time, within time.Duration) string {
+	if now.After(notAfter) {
+		return fmt.Sprintf("certificate for %s expired on %s", name, notAfter.Format("2006-01-02"))
+	}
+	if left := notAfter.Sub(now); left < within {
+		return fmt.Sprintf("certificate for %s expires in %d days, on %s", name, int(left.Hours()/24), notAfter.Format("2006-01-02"))
+	}
+	return ""
+}
+
+// findIdentityRe matches the identities in the output of
+// security find-identity, which are listed as
+// `1) 0123...CDEF "Developer ID Application: Name (TEAMID)"`,
+// followed by the error for invalid ones, like
+// `(CSSMERR_TP_CERT_EXPIRED)`
+var findIdentityRe = regexp.MustCompile(`^\s*\d+\)\s+([0-9A-F]{40})\s+"(.*)"\s*(\(\w+\))?\s*$`)
+
+// parseFindIdentity returns the hashes and names of the valid
+// identities in the output of security find-identity. Without
+// -v, the output lists every identity and then the valid ones
+// again, so each one is returned only once.
+func parseFindIdentity(out []byte) (hashes []string, names []string) {
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		m := findIdentityRe.FindStringSubmatch(sc.Text())
+		if m == nil || m[3] != "" || seen[m[1]] {
+			continue
+		}
+		seen[m[1]] = true
+		hashes = append(hashes, m[1])
+		names = append(names, m[2])
+	}
+	return hashes, names
+}
+
+// parseFindCertificate decodes the output of security
+// find-certificate -a -Z -p, returning the certificates
+// by their SHA-1 hash
+func parseFindCertificate(out []byte) map[string]*x509.Certificate {
+	certs := make(map[string]*x509.Certificate)
+	rest := out
+	for {
+		block, r := pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		rest = r
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		certs[certificateHash(cert)] = cert
+	}
+	return certs
+}
+
+func securityOutput(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "security", args...)
+	verbosePrintf(2, "%s\n", strings.Join(cmd.Args, " "))
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("security %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// keychainIdentities returns the valid code signing identities
+// in the keychain search list
+func keychainIdentities(ctx context.Context) ([]*signingIdentity, error) {
+	out, err := securityOutput(ctx, "find-identity", "-v", "-p", "codesigning")
+	if err != nil {
+		return nil, err
+	}
+	hashes, names := parseFindIdentity(out)
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	// find-identity doesn't show the expiration nor the team,
+	// so get them from the certificates
+	out, err = securityOutput(ctx, "find-certificate", "-a", "-Z", "-p")
+	if err != nil {
+		return nil, err
+	}
+	certs := parseFindCertificate(out)
+	var ids []*signingIdentity
+	for ii, hash := range hashes {
+		cert := certs[hash]
+		if cert == nil {
+			return nil, fmt.Errorf("can't find the certificate for identity %s (%s)", names[ii], hash)
+		}
+		ids = append(ids, newSigningIdentity(cert, names[ii], "keychain"))
+	}
+	return ids, nil
+}
+
+// p12SigningIdentity returns the identity in the given
+// PKCS#12 file
+func p12SigningIdentity(p string, password string) (*signingIdentity, error) {
+	id, err := loadP12Identity(p, password)
+	if err != nil {
+		return nil, err
+	}
+	return newSigningIdentity(id.Certificate, "", p), nil
+}
+
+var hashRe = regexp.MustCompile(`^[0-9A-Fa-f]{40}$`)
+
+// selectIdentity returns the only identity in ids matching
+// the given name and team ID. If name is a SHA-1 hash, the
+// identity with that hash is selected. Otherwise, name must
+// be a substring of the identity name, like codesign does.
+func selectIdentity(ids []*signingIdentity, name string, teamID string) (*signingIdentity, error) {
+	var matches []*signingIdentity
+	for _, id := range ids {
+		if teamID != "" && id.TeamID != teamID {
+			continue
+		}
+		if hashRe.MatchString(name) {
+			if !strings.EqualFold(id.Hash, name) {
+				continue
+			}
+		} else if !strings.Contains(id.Name, name) {
+			continue
+		}
+		matches = append(matches, id)
+	}
+	what := fmt.Sprintf("%q", name)
+	if teamID != "" {
+		what += " for team " + teamID
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no signing identity matches %s", what)
+	case 1:
+		return matches[0], nil
+	}
+	var candidates []string
+	for _, id := range matches {
+		candidates = append(candidates, fmt.Sprintf("%s %q", id.Hash, id.Name))
+	}
+	return nil, fmt.Errorf("%d signing identities match %s, select one by hash or with -team: %s",
+		len(matches), what, strings.Join(candidates, ", "))
+}
+
+type identitiesCmd struct {
+	P12Password string
+	JSON        bool
+}
+
+func (*identitiesCmd) Name() string {
+	return "identities"
+}
+
+func (*identitiesCmd) Synopsis() string {
+	return "List the available signing identities"
+}
+
+func (*identitiesCmd) Usage() string {
+	return `identities [-p12-password secret][-json] [some.p12...]
+
+List the code signing identities in the keychain or, when
+files are given, in the PKCS#12 files.
+`
+}
+
+func (c *identitiesCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.P12Password, "p12-password", "", "Password for the PKCS#12 files. Use @env:NAME, @keychain:ITEM or @file:PATH to read it from elsewhere")
+	f.BoolVar(&c.JSON, "json", false, "Print the identities as JSON")
+}
+
+func (c *identitiesCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	ids, err := c.identities(ctx, f.Args())
+	if err != nil {
+		errPrint(err)
+		return subcommands.ExitFailure
+	}
+	if c.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if ids == nil {
+			ids = []*signingIdentity{}
+		}
+		if err := enc.Encode(ids); err != nil {
+			errPrint(err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+	now := time.Now()
+	for _, id := range ids {
+		teamID := id.TeamID
+		if teamID == "" {
+			teamID = "-"
+		}
+		fmt.Printf("%s %s %s %s %q", id.Hash, teamID, id.NotAfter.Format("2006-01-02"), id.Type, id.Name)
+		if id.Source != "keychain" {
+			fmt.Printf(" (%s)", id.Source)
+		}
+		fmt.Printf("\n")
+		if w := id.expiryWarning(now, identityExpiryWarning); w != "" {
+			errPrintf("warning: %s\n", w)
+		}
+	}
+	if len(ids) == 0 {
+		errPrintf("no signing identities found\n")
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *identitiesCmd) identities(ctx context.Context, files []string) ([]*signingIdentity, error) {
+	if len(files) == 0 {
+		return keychainIdentities(ctx)
+	}
+	password, err := resolveSecret(c.P12Password)
+	if err != nil {
+		return nil, fmt.Errorf("error reading PKCS#12 password: %v", err)
+	}
+	var ids []*signingIdentity
+	for _, p := range files {
+		id, err := p12SigningIdentity(p, password)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"macapptool/internal/testpki"
+)
+
+// testFindIdentityOutput is the output of security find-identity
+// -p codesigning with an expired and a revoked identity, which
+// are only listed before the valid ones
+const testFindIdentityOutput = `
+Policy: Code Signing
+  Matching identities
+  1) 5E6B9C2A1F0D3E4B7A8C9D0E1F2A3B4C5D6E7F80 "Developer ID Application: Example Inc. (ABCDE12345)"
+  2) 0A1B2C3D4E5F60718293A4B5C6D7E8F901234567 "Apple Development: Jane Doe (XYZ9876543)"
+  3) 89ABCDEF0123456789ABCDEF0123456789ABCDEF "Developer ID Application: Example Inc. (ABCDE12345)" (CSSMERR_TP_CERT_EXPIRED)
+  4) FEDCBA9876543210FEDCBA9876543210FEDCBA98 "Apple Distribution: Other Corp (ZZZZZ99999)" (CSSMERR_TP_CERT_REVOKED)
+     4 identities found
+
+  Valid identities only
+  1) 5E6B9C2A1F0D3E4B7A8C9D0E1F2A3B4C5D6E7F80 "Developer ID Application: Example Inc. (ABCDE12345)"
+  2) 0A1B2C3D4E5F60718293A4B5C6D7E8F901234567 "Apple Development: Jane Doe (XYZ9876543)"
+     2 valid identities found
+`
+
+func TestParseFindIdentity(t *testing.T) {
+	hashes, names := parseFindIdentity([]byte(testFindIdentityOutput))
+	wantHashes := []string{"5E6B9C2A1F0D3E4B7A8C9D0E1F2A3B4C5D6E7F80", "0A1B2C3D4E5F60718293A4B5C6D7E8F901234567"}
+	wantNames := []string{"Developer ID Application: Example Inc. (ABCDE12345)", "Apple Development: Jane Doe (XYZ9876543)"}
+	if strings.Join(hashes, ",") != strings.Join(wantHashes, ",") {
+		t.Errorf("hashes = %v, want %v", hashes, wantHashes)
+	}
+	if strings.Join(names, ",") != strings.Join(wantNames, ",") {
+		t.Errorf("names = %q, want %q", names, wantNames)
+	}
+
+	// With -v only the valid identities are listed
+	out := "  1) 5E6B9C2A1F0D3E4B7A8C9D0E1F2A3B4C5D6E7F80 \"Developer ID Application: \\\"Quoted\\\" Inc. (ABCDE12345)\"\n     1 valid identities found\n"
+	if hashes, names = parseFindIdentity([]byte(out)); len(hashes) != 1 || names[0] != `Developer ID Application: \"Quoted\" Inc. (ABCDE12345)` {
+		t.Errorf("parsed %v %q", hashes, names)
+	}
+	if hashes, _ = parseFindIdentity([]byte("     0 valid identities found\n")); len(hashes) != 0 {
+		t.Errorf("parsed %v from an empty list", hashes)
+	}
+}
+
+func TestParseFindCertificate(t *testing.T) {
+	root := testpki.New(t, "Test Root", nil, &testpki.Options{CA: true})
+	leaf := testpki.New(t, "Developer ID Application: Example Inc. (ABCDE12345)", root, nil)
+	// security find-certificate -Z prints the hashes before
+	// each certificate
+	var buf bytes.Buffer
+	for _, c := range []*testpki.Cert{root, leaf} {
+		fmt.Fprintf(&buf, "SHA-256 hash: %s\nSHA-1 hash: %s\n", strings.Repeat("0", 64), certificateHash(c.Cert))
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: c.Cert.Raw})
+	}
+	pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: []byte("not a certificate")})
+	pem.Encode(&buf, &pem.Block{Type: "PUBLIC KEY", Bytes: []byte("key")})
+
+	certs := parseFindCertificate(buf.Bytes())
+	if len(certs) != 2 {
+		t.Fatalf("parsed %d certificates, want 2", len(certs))
+	}
+	for _, c := range []*testpki.Cert{root, leaf} {
+		if got := certs[certificateHash(c.Cert)]; got == nil || !got.Equal(c.Cert) {
+			t.Errorf("certificate %s not found by hash", c.Cert.Subject.CommonName)
+		}
+	}
+
+	id := newSigningIdentity(certs[certificateHash(leaf.Cert)], "", "keychain")
+	if id.Type != "Developer ID Application" || id.TeamID != "ABCDE12345" || !id.NotAfter.Equal(leaf.Cert.NotAfter) {
+		t.Errorf("identity type = %q, team = %q, expires on %s", id.Type, id.TeamID, id.NotAfter)
+	}
+}
+
+func TestSelectIdentity(t *testing.T) {
+	ids := []*signingIdentity{
+		{Hash: "5E6B9C2A1F0D3E4B7A8C9D0E1F2A3B4C5D6E7F80", Name: "Developer ID Application: Example Inc. (ABCDE12345)", TeamID: "ABCDE12345"},
+		{Hash: "0A1B2C3D4E5F60718293A4B5C6D7E8F901234567", Name: "Developer ID Application: Jane Doe (XYZ9876543)", TeamID: "XYZ9876543"},
+		{Hash: "89ABCDEF0123456789ABCDEF0123456789ABCDEF", Name: "Apple Development: Jane Doe (XYZ9876543)", TeamID: "XYZ9876543"},
+	}
+	tests := []struct {
+		name   string
+		teamID string
+		want   int
+		err    string
+	}{
+		{name: "Developer ID", teamID: "ABCDE12345", want: 0},
+		{name: "Developer ID", teamID: "XYZ9876543", want: 1},
+		{name: "Apple Development", want: 2},
+		{name: "Jane Doe", teamID: "XYZ9876543", err: "2 signing identities match \"Jane Doe\" for team XYZ9876543"},
+		{name: "Developer ID", err: "2 signing identities match \"Developer ID\", select one by hash or with -team"},
+		{name: "Developer ID", teamID: "ZZZZZ99999", err: "no signing identity matches \"Developer ID\" for team ZZZZZ99999"},
+		{name: "Apple Distribution", err: "no signing identity matches \"Apple Distribution\""},
+		// Hashes select a single identity, in any case
+		{name: "0A1B2C3D4E5F60718293A4B5C6D7E8F901234567", want: 1},
+		{name: "0a1b2c3d4e5f60718293a4b5c6d7e8f901234567", want: 1},
+		{name: "0A1B2C3D4E5F60718293A4B5C6D7E8F901234567", teamID: "ABCDE12345", err: "no signing identity matches"},
+		{name: "FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF", err: "no signing identity matches"},
+	}
+	for _, tt := range tests {
+		id, err := selectIdentity(ids, tt.name, tt.teamID)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s %s: error = %v, want %s", tt.name, tt.teamID, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.name, tt.teamID, err)
+		} else if id != ids[tt.want] {
+			t.Errorf("%s %s: selected %q, want %q", tt.name, tt.teamID, id.Name, ids[tt.want].Name)
+		}
+	}
+	// Ambiguous selections list the candidates
+	_, err := selectIdentity(ids, "Jane Doe", "")
+	for _, id := range ids[1:] {
+		if err == nil || !strings.Contains(err.Error(), id.Hash) {
+			t.Errorf("error = %v, doesn't list %s", err, id.Hash)
+		}
+	}
+}
+
+func TestIdentityExpiryWarning(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		notAfter time.Time
+		want     string
+	}{
+		{now.AddDate(1, 0, 0), ""},
+		{now.Add(10 * 24 * time.Hour), "certificate for Example expires in 10 days, on 2024-06-11"},
+		{now.Add(-time.Hour), "certificate for Example expired on 2024-05-31"},
+	}
+	for _, tt := range tests {
+		id := &signingIdentity{Name: "Example", NotAfter: tt.notAfter}
+		if got := id.expiryWarning(now, identityExpiryWarning); got != tt.want {
+			t.Errorf("expiryWarning() = %q, want %q", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/pkcs12"
+
+	"macapptool/internal/codesign"
+)
+
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, errors.New("unsupported private key type")
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %T", key)
+}
+
+func publicKeyMatches(cert *x509.Certificate, key crypto.Signer) bool {
+	certKey, err := x509.MarshalPKIXPublicKey(cert.PublicKey)
+	if err != nil {
+		return false
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	return err == nil && bytes.Equal(certKey, pub)
+}
+
+// certificateChain returns the certificates in certs which
+// issued leaf, from the closest issuer to the root
+func certificateChain(leaf *x509.Certificate, certs []*x509.Certificate) []*x509.Certificate {
+	var chain []*x509.Certificate
+	used := make(map[*x509.Certificate]bool)
+	cur := leaf
+	for !bytes.Equal(cur.RawIssuer, cur.RawSubject) {
+		var issuer *x509.Certificate
+		for _, c := range certs {
+			if !used[c] && c != leaf && bytes.Equal(c.RawSubject, cur.RawIssuer) && cur.CheckSignatureFrom(c) == nil {
+				issuer = c
+				break
+			}
+		}
+		if issuer == nil {
+			break
+		}
+		used[issuer] = true
+		chain = append(chain, issuer)
+		cur = issuer
+	}
+	return chain
+}
+
+// loadP12Identity loads the signing identity from a PKCS#12
+// file, as exported from Keychain Access. Certificates other
+// than the one matching the private key and the bundled Apple
+// CAs are used to build its chain. Use completeChain to fetch
+// the missing intermediates.
+func loadP12Identity(p string, password string) (*codesign.Identity, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", p, err)
+	}
+	var key crypto.Signer
+	var certs []*x509.Certificate
+	for _, b := range blocks {
+		switch b.Type {
+		case "PRIVATE KEY":
+			if key != nil {
+				return nil, fmt.Errorf("%s contains multiple private keys", p)
+			}
+			if key, err = parsePrivateKey(b.Bytes); err != nil {
+				return nil, err
+			}
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(b.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			certs = append(certs, cert)
+		}
+	}
+	if key == nil {
+		return nil, fmt.Errorf("%s doesn't contain a private key", p)
+	}
+	for _, c := range certs {
+		if publicKeyMatches(c, key) {
+			return &codesign.Identity{
+				Key:         key,
+				Certificate: c,
+				Chain:       certificateChain(c, append(certs, codesign.AppleCertificates()...)),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("%s doesn't contain a certificate for its private key", p)
+}
+
+// issuerClient is used for fetching missing intermediates
+var issuerClient = &http.Client{Timeout: 30 * time.Second}
+
+// fetchIssuer downloads the certificate which issued cert,
+// from the URLs in its Authority Information Access extension
+func fetchIssuer(cert *x509.Certificate) (*x509.Certificate, error) {
+	var lastErr error
+	for _, u := range cert.IssuingCertificateURL {
+		verbosePrintf(1, "fetching issuer of %q from %s\n", cert.Subject.CommonName, u)
+		resp, err := issuerClient.Get(u)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("GET %s: unexpected status %d", u, resp.StatusCode)
+			continue
+		}
+		if b, _ := pem.Decode(data); b != nil {
+			data = b.Bytes
+		}
+		issuer, err := x509.ParseCertificate(data)
+		if err == nil {
+			err = cert.CheckSignatureFrom(issuer)
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %v", u, err)
+			continue
+		}
+		return issuer, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no issuer URL in certificate")
+	}
+	return nil, lastErr
+}
+
+// completeChain adds the intermediates missing from the chain
+// of id, as well as the root. codesign includes the whole
+// chain in signatures and Gatekeeper can't validate them
+// without it. Self-signed certificates, used for testing,
+// need no chain.
+func completeChain(id *codesign.Identity) error {
+	var extra []*x509.Certificate
+	for {
+		cur := id.Certificate
+		if n := len(id.Chain); n > 0 {
+			cur = id.Chain[n-1]
+		}
+		if bytes.Equal(cur.RawIssuer, cur.RawSubject) {
+			return nil
+		}
+		issuer, err := fetchIssuer(cur)
+		if err != nil {
+			return fmt.Errorf("can't complete the chain of %q: error fetching the issuer of %q: %v",
+				id.Certificate.Subject.CommonName, cur.Subject.CommonName, err)
+		}
+		extra = append(extra, issuer)
+		n := len(id.Chain)
+		id.Chain = certificateChain(id.Certificate, append(append(id.Chain, extra...), codesign.AppleCertificates()...))
+		if len(id.Chain) <= n {
+			return fmt.Errorf("can't complete the chain of %q: %q doesn't extend it", id.Certificate.Subject.CommonName, issuer.Subject.CommonName)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"macapptool/internal/codesign"
+	"macapptool/internal/testpki"
+)
+
+func testIdentity(c *testpki.Cert, chain ...*testpki.Cert) *codesign.Identity {
+	id := &codesign.Identity{Key: c.Key, Certificate: c.Cert}
+	for _, v := range chain {
+		id.Chain = append(id.Chain, v.Cert)
+	}
+	return id
+}
+
+func chainNames(certs []*x509.Certificate) string {
+	var names []string
+	for _, c := range certs {
+		names = append(names, c.Subject.CommonName)
+	}
+	return strings.Join(names, ", ")
+}
+
+func TestCertificateChain(t *testing.T) {
+	root := testpki.New(t, "Root", nil, &testpki.Options{CA: true})
+	inter := testpki.New(t, "Intermediate", root, &testpki.Options{CA: true})
+	other := testpki.New(t, "Other", root, &testpki.Options{CA: true})
+	leaf := testpki.New(t, "Leaf", inter, nil)
+	chain := certificateChain(leaf.Cert, []*x509.Certificate{root.Cert, other.Cert, leaf.Cert, inter.Cert})
+	if got, want := chainNames(chain), "Intermediate, Root"; got != want {
+		t.Errorf("chain = %s, want %s", got, want)
+	}
+}
+
+func TestCompleteChain(t *testing.T) {
+	var fetched []string
+	var root, inter *testpki.Cert
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetched = append(fetched, r.URL.Path)
+		switch r.URL.Path {
+		case "/root.cer":
+			w.Write(root.Cert.Raw)
+		case "/inter.cer":
+			w.Write(inter.Cert.Raw)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	root = testpki.New(t, "Root", nil, &testpki.Options{CA: true})
+	inter = testpki.New(t, "Intermediate", root, &testpki.Options{CA: true, IssuerURL: srv.URL + "/root.cer"})
+	leaf := testpki.New(t, "Leaf", inter, &testpki.Options{IssuerURL: srv.URL + "/inter.cer"})
+
+	id := testIdentity(leaf)
+	if err := completeChain(id); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := chainNames(id.Chain), "Intermediate, Root"; got != want {
+		t.Errorf("chain = %s, want %s", got, want)
+	}
+	if got, want := strings.Join(fetched, ","), "/inter.cer,/root.cer"; got != want {
+		t.Errorf("fetched %s, want %s", got, want)
+	}
+
+	// Complete chains and self-signed certificates are kept
+	fetched = nil
+	for _, id := range []*codesign.Identity{testIdentity(leaf, inter, root), testIdentity(root)} {
+		if err := completeChain(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(fetched) != 0 {
+		t.Errorf("fetched %v for complete chains", fetched)
+	}
+
+	// The fetched certificate must be the actual issuer
+	other := testpki.New(t, "Other", root, &testpki.Options{IssuerURL: srv.URL + "/root.cer"})
+	if err := completeChain(testIdentity(other)); err != nil {
+		t.Fatal(err)
+	}
+	wrong := testpki.New(t, "Wrong", inter, &testpki.Options{IssuerURL: srv.URL + "/root.cer"})
+	if err := completeChain(testIdentity(wrong)); err == nil {
+		t.Error("chain completed with the wrong issuer")
+	}
+	missing := testpki.New(t, "Missing", inter, &testpki.Options{IssuerURL: srv.URL + "/missing.cer"})
+	if err := completeChain(testIdentity(missing)); err == nil || !strings.Contains(err.Error(), "unexpected status 404") {
+		t.Errorf("error = %v, want unexpected status 404", err)
+	}
+	noURL := testpki.New(t, "No URL", inter, nil)
+	if err := completeChain(testIdentity(noURL)); err == nil || !strings.Contains(err.Error(), "no issuer URL") {
+		t.Errorf("error = %v, want no issuer URL", err)
+	}
+}
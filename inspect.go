@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+
+	"macapptool/internal/cms"
+	"macapptool/internal/codesign"
+	"macapptool/internal/macho"
+)
+
+type signerReport struct {
+	Subject            string     `json:"subject"`
+	Issuer             string     `json:"issuer"`
+	TeamID             string     `json:"team_id,omitempty"`
+	NotAfter           time.Time  `json:"not_after"`
+	Chain              []string   `json:"chain,omitempty"`
+	SigningTime        *time.Time `json:"signing_time,omitempty"`
+	Timestamp          *time.Time `json:"timestamp,omitempty"`
+	TimestampAuthority string     `json:"timestamp_authority,omitempty"`
+}
+
+type codeDirectoryReport struct {
+	Version      string   `json:"version"`
+	HashType     string   `json:"hash_type"`
+	CDHash       string   `json:"cdhash"`
+	Identifier   string   `json:"identifier"`
+	TeamID       string   `json:"team_id,omitempty"`
+	Flags        []string `json:"flags,omitempty"`
+	PageSize     int      `json:"page_size"`
+	CodeLimit    uint64   `json:"code_limit"`
+	CodeSlots    int      `json:"code_slots"`
+	SpecialSlots int      `json:"special_slots"`
+	Runtime      string   `json:"runtime,omitempty"`
+}
+
+type sliceReport struct {
+	Arch            string                 `json:"arch"`
+	Offset          uint64                 `json:"offset,omitempty"`
+	Size            uint64                 `json:"size,omitempty"`
+	Align           uint32                 `json:"align,omitempty"`
+	MinOS           string                 `json:"min_os,omitempty"`
+	Signed          bool                   `json:"signed"`
+	Adhoc           bool                   `json:"adhoc,omitempty"`
+	CodeDirectories []codeDirectoryReport  `json:"code_directories,omitempty"`
+	Requirements    []string               `json:"requirements,omitempty"`
+	Entitlements    string                 `json:"entitlements,omitempty"`
+	EntitlementsDER map[string]interface{} `json:"entitlements_der,omitempty"`
+	Signer          *signerReport          `json:"signer,omitempty"`
+	Warnings        []string               `json:"warnings,omitempty"`
+	Error           string                 `json:"error,omitempty"`
+}
+
+type codeReport struct {
+	Path   string        `json:"path"`
+	Slices []sliceReport `json:"slices,omitempty"`
+	Error  string        `json:"error,omitempty"`
+}
+
+type inspectCmd struct {
+	JSON bool
+}
+
+func (*inspectCmd) Name() string {
+	return "inspect"
+}
+
+func (*inspectCmd) Synopsis() string {
+	return "Show the code signatures in an app bundle or Mach-O file"
+}
+
+func (*inspectCmd) Usage() string {
+	return fmt.Sprintf(`Usage: %s inspect [-json] some.app|some-binary
+
+	inspect decodes the code signature of every code object
+	in the app bundle, without relying on codesign.
+`, filepath.Base(os.Args[0]))
+}
+
+func (c *inspectCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.JSON, "json", false, "Print the report as JSON")
+}
+
+func (c *inspectCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		return subcommands.ExitUsageError
+	}
+	var reports []*codeReport
+	for _, arg := range f.Args() {
+		root := strings.TrimSuffix(arg, "/")
+		err := walkCode(root, func(p string) error {
+			reports = append(reports, inspectCode(root, p))
+			return nil
+		})
+		if err != nil {
+			errPrintf("error inspecting %s: %v\n", arg, err)
+			return subcommands.ExitFailure
+		}
+	}
+	if c.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			errPrint(err)
+			return subcommands.ExitFailure
+		}
+	} else {
+		for _, r := range reports {
+			r.WriteText(os.Stdout)
+		}
+	}
+	return subcommands.ExitSuccess
+}
+
+// codeExecutable returns the Mach-O file for a code object
+// returned by walkCode, resolving bundles to their main
+// executable
+func codeExecutable(p string) (string, error) {
+	st, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if st.IsDir() {
+		return bundleExecutable(p)
+	}
+	return p, nil
+}
+
+func inspectCode(root, p string) *codeReport {
+	name, _ := filepath.Rel(filepath.Dir(root), p)
+	report := &codeReport{Path: name}
+	exe, err := codeExecutable(p)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	bin, err := macho.ReadFile(exe)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	for _, s := range bin.Slices {
+		report.Slices = append(report.Slices, inspectSlice(s))
+	}
+	return report
+}
+
+func formatRuntimeVersion(v uint32) string {
+	return fmt.Sprintf("%d.%d.%d", v>>16, (v>>8)&0xff, v&0xff)
+}
+
+func teamIDFromCertificate(cert *x509.Certificate) string {
+	if len(cert.Subject.OrganizationalUnit) > 0 {
+		return cert.Subject.OrganizationalUnit[0]
+	}
+	return ""
+}
+
+func inspectSlice(s *macho.Slice) sliceReport {
+	report := sliceReport{
+		Arch:   s.Arch(),
+		Offset: s.Offset,
+		Size:   s.FatArch.Size,
+		Align:  s.Align,
+	}
+	if s.FatArch.Size != 0 && s.Offset%(1<<s.Align) != 0 {
+		report.Warnings = append(report.Warnings, fmt.Sprintf("slice offset %d is not aligned to 2^%d", s.Offset, s.Align))
+	}
+	if bv := s.BuildVersion(); bv != nil {
+		report.MinOS = fmt.Sprintf("%s %s", macho.PlatformName(bv.Platform), bv.MinOS)
+	}
+	data := s.Signature()
+	if data == nil {
+		return report
+	}
+	report.Signed = true
+	sig, err := codesign.ParseSignature(data)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	report.Adhoc = sig.IsAdhoc()
+	for _, cd := range sig.CodeDirectories {
+		cdr := codeDirectoryReport{
+			Version:      fmt.Sprintf("%#x", cd.Version),
+			HashType:     codesign.HashTypeName(cd.HashType),
+			CDHash:       hex.EncodeToString(cd.CDHash()[:codesign.CDHashSize]),
+			Identifier:   cd.Identifier,
+			TeamID:       cd.TeamID,
+			Flags:        codesign.FlagNames(cd.Flags),
+			PageSize:     cd.PageSize(),
+			CodeLimit:    cd.CodeLimit,
+			CodeSlots:    len(cd.CodeSlots),
+			SpecialSlots: len(cd.SpecialSlots),
+		}
+		if cd.Runtime != 0 {
+			cdr.Runtime = formatRuntimeVersion(cd.Runtime)
+		}
+		report.CodeDirectories = append(report.CodeDirectories, cdr)
+	}
+	// Older systems only check the primary CodeDirectory,
+	// which must use a hash type they support
+	if primary := sig.CodeDirectory(); primary != nil {
+		if want := codesign.DefaultHashTypes(s.File)[0]; want != primary.HashType {
+			report.Warnings = append(report.Warnings, fmt.Sprintf("primary CodeDirectory uses %s, but the deployment target requires %s",
+				codesign.HashTypeName(primary.HashType), codesign.HashTypeName(want)))
+		}
+	}
+	for _, r := range sig.Requirements {
+		report.Requirements = append(report.Requirements, r.String())
+	}
+	report.Entitlements = string(sig.Entitlements)
+	if sig.EntitlementsDER != nil {
+		ents, err := codesign.ParseEntitlementsDER(sig.EntitlementsDER)
+		if err != nil {
+			report.Error = fmt.Sprintf("invalid DER entitlements: %v", err)
+		}
+		report.EntitlementsDER = ents
+	}
+	if len(sig.CMS) > 0 {
+		signer, err := inspectCMS(sig.CMS)
+		if err != nil {
+			report.Error = fmt.Sprintf("invalid CMS signature: %v", err)
+		}
+		report.Signer = signer
+	}
+	return report
+}
+
+func inspectCMS(data []byte) (*signerReport, error) {
+	sd, err := cms.Parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(sd.Signers) == 0 {
+		// Ad-hoc signatures contain an empty SignedData
+		return nil, nil
+	}
+	si := sd.Signers[0]
+	cert := sd.Certificate(si)
+	if cert == nil {
+		return nil, fmt.Errorf("signer certificate not found")
+	}
+	report := &signerReport{
+		Subject:  cert.Subject.String(),
+		Issuer:   cert.Issuer.String(),
+		TeamID:   teamIDFromCertificate(cert),
+		NotAfter: cert.NotAfter,
+	}
+	for _, c := range sd.Certificates {
+		report.Chain = append(report.Chain, c.Subject.CommonName)
+	}
+	if t, ok := si.SigningTime(); ok {
+		report.SigningTime = &t
+	}
+	if token := si.TimeStampToken(); token != nil {
+		ts, err := cms.ParseTimeStamp(token)
+		if err != nil {
+			return report, fmt.Errorf("invalid timestamp: %v", err)
+		}
+		report.Timestamp = &ts.Time
+		if ts.Certificate != nil {
+			report.TimestampAuthority = ts.Certificate.Subject.CommonName
+		}
+	}
+	return report, nil
+}
+
+func (r *codeReport) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "%s\n", r.Path)
+	if r.Error != "" {
+		fmt.Fprintf(w, "  error: %s\n", r.Error)
+		return
+	}
+	for _, s := range r.Slices {
+		s.WriteText(w)
+	}
+}
+
+func (s *sliceReport) WriteText(w io.Writer) {
+	state := "not signed"
+	if s.Signed {
+		state = "signed"
+		if s.Adhoc {
+			state = "signed (ad-hoc)"
+		}
+	}
+	fmt.Fprintf(w, "  %s: %s\n", s.Arch, state)
+	if s.Size != 0 {
+		fmt.Fprintf(w, "    offset=%d size=%d align=2^%d\n", s.Offset, s.Size, s.Align)
+	}
+	if s.MinOS != "" {
+		fmt.Fprintf(w, "    min-os=%s\n", s.MinOS)
+	}
+	if s.Error != "" {
+		fmt.Fprintf(w, "    error: %s\n", s.Error)
+	}
+	for _, v := range s.Warnings {
+		fmt.Fprintf(w, "    warning: %s\n", v)
+	}
+	for _, cd := range s.CodeDirectories {
+		fmt.Fprintf(w, "    CodeDirectory v=%s hash=%s cdhash=%s\n", cd.Version, cd.HashType, cd.CDHash)
+		fmt.Fprintf(w, "      identifier=%s\n", cd.Identifier)
+		if cd.TeamID != "" {
+			fmt.Fprintf(w, "      team=%s\n", cd.TeamID)
+		}
+		if len(cd.Flags) > 0 {
+			fmt.Fprintf(w, "      flags=%s\n", strings.Join(cd.Flags, ","))
+		}
+		if cd.Runtime != "" {
+			fmt.Fprintf(w, "      runtime=%s\n", cd.Runtime)
+		}
+		fmt.Fprintf(w, "      page-size=%d code-limit=%d slots=%d+%d\n", cd.PageSize, cd.CodeLimit, cd.SpecialSlots, cd.CodeSlots)
+	}
+	for _, v := range s.Requirements {
+		fmt.Fprintf(w, "    %s\n", v)
+	}
+	if s.Entitlements != "" {
+		fmt.Fprintf(w, "    entitlements:\n")
+		for _, line := range strings.Split(strings.TrimSpace(s.Entitlements), "\n") {
+			fmt.Fprintf(w, "      %s\n", line)
+		}
+	}
+	if s.EntitlementsDER != nil {
+		data, _ := json.Marshal(s.EntitlementsDER)
+		fmt.Fprintf(w, "    entitlements (DER): %s\n", data)
+	}
+	if signer := s.Signer; signer != nil {
+		fmt.Fprintf(w, "    signer: %s\n", signer.Subject)
+		fmt.Fprintf(w, "      issuer=%s\n", signer.Issuer)
+		if signer.TeamID != "" {
+			fmt.Fprintf(w, "      team=%s\n", signer.TeamID)
+		}
+		fmt.Fprintf(w, "      expires=%s\n", signer.NotAfter.Format(time.RFC3339))
+		if len(signer.Chain) > 0 {
+			fmt.Fprintf(w, "      chain=%s\n", strings.Join(signer.Chain, " / "))
+		}
+		if signer.SigningTime != nil {
+			fmt.Fprintf(w, "      signing-time=%s\n", signer.SigningTime.Format(time.RFC3339))
+		}
+		if signer.Timestamp != nil {
+			fmt.Fprintf(w, "      timestamp=%s (%s)\n", signer.Timestamp.Format(time.RFC3339), signer.TimestampAuthority)
+		} else {
+			fmt.Fprintf(w, "      timestamp=none\n")
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package cms
+
+import (
+	"errors"
+)
+
+var errInvalidBER = errors.New("invalid BER encoding")
+
+// berElement is a decoded BER TLV
+type berElement struct {
+	tag         []byte
+	constructed bool
+	content     []byte
+	children    []*berElement
+}
+
+// parseBER decodes the element at the start of data, returning
+// it and the remaining data
+func parseBER(data []byte) (*berElement, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, errInvalidBER
+	}
+	// Tag, including the high tag number form
+	n := 1
+	if data[0]&0x1f == 0x1f {
+		for n < len(data) && data[n]&0x80 != 0 {
+			n++
+		}
+		n++
+	}
+	if n >= len(data) {
+		return nil, nil, errInvalidBER
+	}
+	el := &berElement{tag: data[:n], constructed: data[0]&0x20 != 0}
+	rest := data[n:]
+	l := int(rest[0])
+	rest = rest[1:]
+	if l == 0x80 {
+		// Indefinite length, children until the end of contents
+		if !el.constructed {
+			return nil, nil, errInvalidBER
+		}
+		for {
+			if len(rest) < 2 {
+				return nil, nil, errInvalidBER
+			}
+			if rest[0] == 0 && rest[1] == 0 {
+				return el, rest[2:], nil
+			}
+			child, r, err := parseBER(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			el.children = append(el.children, child)
+			rest = r
+		}
+	}
+	if l > 0x80 {
+		size := l & 0x7f
+		if size > 4 || len(rest) < size {
+			return nil, nil, errInvalidBER
+		}
+		l = 0
+		for _, b := range rest[:size] {
+			l = l<<8 | int(b)
+		}
+		rest = rest[size:]
+	}
+	if l > len(rest) {
+		return nil, nil, errInvalidBER
+	}
+	content := rest[:l]
+	rest = rest[l:]
+	if el.constructed {
+		for len(content) > 0 {
+			child, r, err := parseBER(content)
+			if err != nil {
+				return nil, nil, err
+			}
+			el.children = append(el.children, child)
+			content = r
+		}
+	} else {
+		el.content = content
+	}
+	return el, rest, nil
+}
+
+func appendLength(b []byte, l int) []byte {
+	if l < 0x80 {
+		return append(b, byte(l))
+	}
+	var size []byte
+	for v := l; v > 0; v >>= 8 {
+		size = append([]byte{byte(v)}, size...)
+	}
+	b = append(b, 0x80|byte(len(size)))
+	return append(b, size...)
+}
+
+// encode appends the DER encoding of the element to b.
+// Constructed strings are converted to primitive ones.
+func (el *berElement) encode(b []byte) []byte {
+	tag := el.tag
+	var content []byte
+	const constructedOctetString = 0x24
+	if len(tag) == 1 && tag[0] == constructedOctetString {
+		tag = []byte{0x04}
+		content = el.octets(nil)
+	} else if el.constructed {
+		for _, child := range el.children {
+			content = child.encode(content)
+		}
+	} else {
+		content = el.content
+	}
+	b = append(b, tag...)
+	b = appendLength(b, len(content))
+	return append(b, content...)
+}
+
+// octets returns the concatenated contents of a constructed
+// octet string
+func (el *berElement) octets(b []byte) []byte {
+	if !el.constructed {
+		return append(b, el.content...)
+	}
+	for _, child := range el.children {
+		b = child.octets(b)
+	}
+	return b
+}
+
+// berToDER converts BER encoded data, as used by some Apple
+// signatures like provisioning profiles, to DER, so it can
+// be decoded with encoding/asn1. Only indefinite lengths and
+// constructed octet strings are converted, since those are
+// the only BER features found in CMS messages in practice.
+func berToDER(data []byte) ([]byte, []byte, error) {
+	el, rest, err := parseBER(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return el.encode(nil), rest, nil
+}
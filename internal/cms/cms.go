@@ -0,0 +1,319 @@
+// Package cms implements the subset of CMS (RFC 5652) SignedData
+// used by Apple code signatures and RFC 3161 timestamps.
+package cms
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var (
+	OIDData                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	OIDSignedData           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	OIDContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	OIDMessageDigest        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	OIDSigningTime          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	OIDTimeStampToken       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 2, 14}
+	OIDTSTInfo              = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	OIDAppleCDHashPlist     = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 9, 1}
+	OIDAppleCDHashes        = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 9, 2}
+	OIDDigestSHA1           = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	OIDDigestSHA256         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	OIDDigestSHA384         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	OIDDigestSHA512         = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	OIDEncryptionRSA        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	OIDSignatureSHA256RSA   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}
+	OIDSignatureECDSASHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+)
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type encapsulatedContentInfo struct {
+	EContentType asn1.ObjectIdentifier
+	EContent     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapsulatedContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type issuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// Attribute is a signed or unsigned attribute
+type Attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue `asn1:"set"`
+}
+
+// SignerInfo describes a signer in a SignedData
+type SignerInfo struct {
+	// Issuer and SerialNumber identify the signing certificate.
+	// When the signer is identified by its subject key ID,
+	// SubjectKeyID is set instead.
+	Issuer             []byte
+	SerialNumber       *big.Int
+	SubjectKeyID       []byte
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	SignedAttrs        []Attribute
+	// RawSignedAttrs contains the DER encoded signed attributes,
+	// as used for computing the signature
+	RawSignedAttrs []byte
+	Signature      []byte
+	UnsignedAttrs  []Attribute
+}
+
+// SignedData is a decoded CMS SignedData
+type SignedData struct {
+	ContentType  asn1.ObjectIdentifier
+	Content      []byte
+	Certificates []*x509.Certificate
+	Signers      []*SignerInfo
+}
+
+func parseAttributes(raw asn1.RawValue) ([]Attribute, error) {
+	var attrs []Attribute
+	rest := raw.Bytes
+	for len(rest) > 0 {
+		var attr Attribute
+		var err error
+		if rest, err = asn1.Unmarshal(rest, &attr); err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	return attrs, nil
+}
+
+// Parse decodes a DER encoded ContentInfo containing
+// a SignedData
+func Parse(der []byte) (*SignedData, error) {
+	var ci contentInfo
+	rest, err := asn1.Unmarshal(der, &ci)
+	if err != nil {
+		// Try again after converting from BER
+		converted, berRest, berErr := berToDER(der)
+		if berErr != nil {
+			return nil, err
+		}
+		if _, err := asn1.Unmarshal(converted, &ci); err != nil {
+			return nil, err
+		}
+		rest = berRest
+	}
+	// Apple pads the CMS blob with zeroes
+	if len(bytes.TrimRight(rest, "\x00")) > 0 {
+		return nil, errors.New("trailing data after CMS ContentInfo")
+	}
+	if !ci.ContentType.Equal(OIDSignedData) {
+		return nil, fmt.Errorf("unsupported content type %s", ci.ContentType)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, err
+	}
+	result := &SignedData{ContentType: sd.EncapContentInfo.EContentType}
+	if len(sd.EncapContentInfo.EContent.Bytes) > 0 {
+		var content []byte
+		if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent.Bytes, &content); err != nil {
+			return nil, fmt.Errorf("invalid encapsulated content: %v", err)
+		}
+		result.Content = content
+	}
+	if len(sd.Certificates.Bytes) > 0 {
+		certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		result.Certificates = certs
+	}
+	for _, v := range sd.SignerInfos {
+		si := &SignerInfo{
+			DigestAlgorithm:    v.DigestAlgorithm,
+			SignatureAlgorithm: v.SignatureAlgorithm,
+			Signature:          v.Signature,
+		}
+		if v.SID.Class == asn1.ClassContextSpecific {
+			si.SubjectKeyID = v.SID.Bytes
+		} else {
+			var ias issuerAndSerialNumber
+			if _, err := asn1.Unmarshal(v.SID.FullBytes, &ias); err != nil {
+				return nil, err
+			}
+			si.Issuer = ias.Issuer.FullBytes
+			si.SerialNumber = ias.SerialNumber
+		}
+		if len(v.SignedAttrs.FullBytes) > 0 {
+			if si.SignedAttrs, err = parseAttributes(v.SignedAttrs); err != nil {
+				return nil, err
+			}
+			// The signature is computed over the attributes
+			// encoded as an explicit SET OF
+			si.RawSignedAttrs = append([]byte{0x31}, v.SignedAttrs.FullBytes[1:]...)
+		}
+		if len(v.UnsignedAttrs.FullBytes) > 0 {
+			if si.UnsignedAttrs, err = parseAttributes(v.UnsignedAttrs); err != nil {
+				return nil, err
+			}
+		}
+		result.Signers = append(result.Signers, si)
+	}
+	return result, nil
+}
+
+// Certificate returns the certificate used by the signer
+func (sd *SignedData) Certificate(si *SignerInfo) *x509.Certificate {
+	for _, c := range sd.Certificates {
+		if si.SubjectKeyID != nil {
+			if bytes.Equal(c.SubjectKeyId, si.SubjectKeyID) {
+				return c
+			}
+			continue
+		}
+		if si.SerialNumber != nil && c.SerialNumber.Cmp(si.SerialNumber) == 0 &&
+			bytes.Equal(c.RawIssuer, si.Issuer) {
+			return c
+		}
+	}
+	return nil
+}
+
+// Attr returns the first value of the attribute with
+// the given type, or nil if there's no such attribute.
+func Attr(attrs []Attribute, oid asn1.ObjectIdentifier) []byte {
+	for _, a := range attrs {
+		if a.Type.Equal(oid) {
+			var v asn1.RawValue
+			if _, err := asn1.Unmarshal(a.Values.Bytes, &v); err != nil {
+				return nil
+			}
+			return v.FullBytes
+		}
+	}
+	return nil
+}
+
+// SigningTime returns the signing time attribute
+func (si *SignerInfo) SigningTime() (time.Time, bool) {
+	v := Attr(si.SignedAttrs, OIDSigningTime)
+	if v == nil {
+		return time.Time{}, false
+	}
+	var t time.Time
+	if _, err := asn1.Unmarshal(v, &t); err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// MessageDigest returns the message digest attribute
+func (si *SignerInfo) MessageDigest() []byte {
+	v := Attr(si.SignedAttrs, OIDMessageDigest)
+	if v == nil {
+		return nil
+	}
+	var digest []byte
+	if _, err := asn1.Unmarshal(v, &digest); err != nil {
+		return nil
+	}
+	return digest
+}
+
+// TimeStampToken returns the RFC 3161 timestamp token in
+// the signer unsigned attributes, or nil if there's none
+func (si *SignerInfo) TimeStampToken() []byte {
+	return Attr(si.UnsignedAttrs, OIDTimeStampToken)
+}
+
+type messageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+// accuracy is a SEQUENCE, so it's not confused with the
+// nonce when it's omitted, like an optional RawValue would
+type accuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tstInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint messageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       accuracy      `asn1:"optional"`
+	Ordering       bool          `asn1:"optional,default:false"`
+	Nonce          *big.Int      `asn1:"optional"`
+	TSA            asn1.RawValue `asn1:"explicit,optional,tag:0"`
+	Extensions     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+// TimeStamp is a decoded RFC 3161 timestamp token
+type TimeStamp struct {
+	Time          time.Time
+	HashAlgorithm asn1.ObjectIdentifier
+	HashedMessage []byte
+	SerialNumber  *big.Int
+	Nonce         *big.Int
+	// Certificate is the TSA certificate, if included
+	Certificate *x509.Certificate
+	SignedData  *SignedData
+}
+
+// ParseTimeStamp decodes a timestamp token, which is a
+// SignedData containing a TSTInfo
+func ParseTimeStamp(der []byte) (*TimeStamp, error) {
+	sd, err := Parse(der)
+	if err != nil {
+		return nil, err
+	}
+	if !sd.ContentType.Equal(OIDTSTInfo) {
+		return nil, fmt.Errorf("unexpected timestamp content type %s", sd.ContentType)
+	}
+	var info tstInfo
+	if _, err := asn1.Unmarshal(sd.Content, &info); err != nil {
+		return nil, fmt.Errorf("invalid TSTInfo: %v", err)
+	}
+	ts := &TimeStamp{
+		Time:          info.GenTime,
+		HashAlgorithm: info.MessageImprint.HashAlgorithm.Algorithm,
+		HashedMessage: info.MessageImprint.HashedMessage,
+		SerialNumber:  info.SerialNumber,
+		Nonce:         info.Nonce,
+		SignedData:    sd,
+	}
+	if len(sd.Signers) > 0 {
+		ts.Certificate = sd.Certificate(sd.Signers[0])
+	}
+	return ts, nil
+}
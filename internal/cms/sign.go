@@ -0,0 +1,181 @@
+package cms
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// SignOptions contains the parameters for creating
+// a SignedData
+type SignOptions struct {
+	Key         crypto.Signer
+	Certificate *x509.Certificate
+	// Certificates contains additional certificates to
+	// include, like the intermediate CAs
+	Certificates []*x509.Certificate
+	// SignedAttrs contains additional signed attributes. The
+	// content type, signing time and message digest are
+	// always included.
+	SignedAttrs []Attribute
+	// SigningTime defaults to the current time
+	SigningTime time.Time
+	// TimeStamp, if non-nil, is called with the signature
+	// value and returns an RFC 3161 timestamp token for it,
+	// which is added as an unsigned attribute.
+	TimeStamp func(signature []byte) ([]byte, error)
+}
+
+// NewAttribute returns an attribute with the given values,
+// encoded with encoding/asn1
+func NewAttribute(oid asn1.ObjectIdentifier, values ...interface{}) (Attribute, error) {
+	var data []byte
+	for _, v := range values {
+		b, err := asn1.Marshal(v)
+		if err != nil {
+			return Attribute{}, err
+		}
+		data = append(data, b...)
+	}
+	return Attribute{
+		Type:   oid,
+		Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: data},
+	}, nil
+}
+
+// marshalAttributes encodes attrs as a DER SET OF, which
+// requires sorting them by their encoding
+func marshalAttributes(attrs []Attribute) ([]byte, error) {
+	var encoded [][]byte
+	for _, a := range attrs {
+		b, err := asn1.Marshal(a)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, b)
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	return asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassUniversal,
+		Tag:        asn1.TagSet,
+		IsCompound: true,
+		Bytes:      bytes.Join(encoded, nil),
+	})
+}
+
+// signatureAlgorithm returns the algorithm identifier used
+// in the SignerInfo for the given key
+func signatureAlgorithm(key crypto.Signer) (pkix.AlgorithmIdentifier, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: OIDEncryptionRSA, Parameters: asn1.NullRawValue}, nil
+	case *ecdsa.PublicKey:
+		return pkix.AlgorithmIdentifier{Algorithm: OIDSignatureECDSASHA256}, nil
+	}
+	return pkix.AlgorithmIdentifier{}, fmt.Errorf("unsupported key type %T", key.Public())
+}
+
+// SignDetached returns a DER encoded ContentInfo with a
+// SignedData signing content with SHA-256, without
+// including the content itself
+func SignDetached(content []byte, opts *SignOptions) ([]byte, error) {
+	if opts.Key == nil || opts.Certificate == nil {
+		return nil, errors.New("missing signing key or certificate")
+	}
+	sigAlg, err := signatureAlgorithm(opts.Key)
+	if err != nil {
+		return nil, err
+	}
+	signingTime := opts.SigningTime
+	if signingTime.IsZero() {
+		signingTime = time.Now()
+	}
+	digest := sha256.Sum256(content)
+	contentType, err := NewAttribute(OIDContentType, OIDData)
+	if err != nil {
+		return nil, err
+	}
+	signingTimeAttr, err := NewAttribute(OIDSigningTime, signingTime.UTC())
+	if err != nil {
+		return nil, err
+	}
+	messageDigest, err := NewAttribute(OIDMessageDigest, digest[:])
+	if err != nil {
+		return nil, err
+	}
+	attrs := append([]Attribute{contentType, signingTimeAttr, messageDigest}, opts.SignedAttrs...)
+	rawAttrs, err := marshalAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+	attrsDigest := sha256.Sum256(rawAttrs)
+	signature, err := opts.Key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	sid, err := asn1.Marshal(issuerAndSerialNumber{
+		Issuer:       asn1.RawValue{FullBytes: opts.Certificate.RawIssuer},
+		SerialNumber: opts.Certificate.SerialNumber,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// In the SignerInfo, attributes use implicit tags
+	signedAttrs := append([]byte{0xa0}, rawAttrs[1:]...)
+	var unsignedAttrs []byte
+	if opts.TimeStamp != nil {
+		token, err := opts.TimeStamp(signature)
+		if err != nil {
+			return nil, fmt.Errorf("error timestamping signature: %v", err)
+		}
+		attr, err := NewAttribute(OIDTimeStampToken, asn1.RawValue{FullBytes: token})
+		if err != nil {
+			return nil, err
+		}
+		rawUnsigned, err := marshalAttributes([]Attribute{attr})
+		if err != nil {
+			return nil, err
+		}
+		unsignedAttrs = append([]byte{0xa1}, rawUnsigned[1:]...)
+	}
+	var certs []byte
+	for _, c := range append([]*x509.Certificate{opts.Certificate}, opts.Certificates...) {
+		certs = append(certs, c.Raw...)
+	}
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: OIDDigestSHA256, Parameters: asn1.NullRawValue}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Alg},
+		EncapContentInfo: encapsulatedContentInfo{EContentType: OIDData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                asn1.RawValue{FullBytes: sid},
+			DigestAlgorithm:    sha256Alg,
+			SignedAttrs:        asn1.RawValue{FullBytes: signedAttrs},
+			SignatureAlgorithm: sigAlg,
+			Signature:          signature,
+			UnsignedAttrs:      asn1.RawValue{FullBytes: unsignedAttrs},
+		}},
+	}
+	sdData, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(contentInfo{
+		ContentType: OIDSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sdData},
+	})
+}
@@ -0,0 +1,140 @@
+package cms
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"macapptool/internal/testpki"
+)
+
+func TestSignDetached(t *testing.T) {
+	pki := testpki.NewPKI(t)
+	content := []byte("CodeDirectory contents")
+	signingTime := time.Date(2020, 5, 4, 3, 2, 1, 0, time.UTC)
+	extra, err := NewAttribute(OIDAppleCDHashPlist, []byte("<plist/>"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rsaKey := range []bool{false, true} {
+		leaf := pki.Issue(t, "Test Signer", &testpki.Options{RSA: rsaKey})
+		der, err := SignDetached(content, &SignOptions{
+			Key:          leaf.Key,
+			Certificate:  leaf.Cert,
+			Certificates: []*x509.Certificate{pki.Intermediate.Cert, pki.Root.Cert},
+			SignedAttrs:  []Attribute{extra},
+			SigningTime:  signingTime,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sd, err := Parse(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(sd.Content) != 0 {
+			t.Error("detached signature includes the content")
+		}
+		signer, err := sd.VerifyDetached(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !signer.Equal(leaf.Cert) {
+			t.Errorf("signer = %q", signer.Subject.CommonName)
+		}
+		var names []string
+		for _, c := range sd.Certificates {
+			names = append(names, c.Subject.CommonName)
+		}
+		if got, want := strings.Join(names, ", "), "Test Signer, Test Intermediate CA, Test Root CA"; got != want {
+			t.Errorf("certificates = %s, want %s", got, want)
+		}
+		// The included certificates must be enough to validate
+		// the chain up to the root
+		roots := x509.NewCertPool()
+		roots.AddCert(pki.Root.Cert)
+		intermediates := x509.NewCertPool()
+		for _, c := range sd.Certificates[1:] {
+			intermediates.AddCert(c)
+		}
+		_, err = signer.Verify(x509.VerifyOptions{
+			Roots:         roots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		})
+		if err != nil {
+			t.Errorf("chain: %v", err)
+		}
+		si := sd.Signers[0]
+		if st, ok := si.SigningTime(); !ok || !st.Equal(signingTime) {
+			t.Errorf("signing time = %v, want %v", st, signingTime)
+		}
+		if v := Attr(si.SignedAttrs, OIDAppleCDHashPlist); v == nil {
+			t.Error("missing additional signed attribute")
+		} else {
+			var plist []byte
+			if _, err := asn1.Unmarshal(v, &plist); err != nil || string(plist) != "<plist/>" {
+				t.Errorf("additional attribute = %q, %v", plist, err)
+			}
+		}
+		if si.TimeStampToken() != nil {
+			t.Error("unexpected timestamp")
+		}
+		if _, err := sd.VerifyDetached(append([]byte("x"), content...)); err == nil {
+			t.Error("signature verified with different content")
+		}
+	}
+}
+
+func TestSignDetachedTimeStamp(t *testing.T) {
+	pki := testpki.NewPKI(t)
+	leaf := pki.Issue(t, "Test Signer", nil)
+	token := []byte{0x30, 0x03, 0x02, 0x01, 0x2a}
+	var stamped []byte
+	der, err := SignDetached([]byte("content"), &SignOptions{
+		Key:         leaf.Key,
+		Certificate: leaf.Cert,
+		TimeStamp: func(signature []byte) ([]byte, error) {
+			stamped = signature
+			return token, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := Parse(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	si := sd.Signers[0]
+	if !bytes.Equal(stamped, si.Signature) {
+		t.Error("timestamp requested for a different value than the signature")
+	}
+	if !bytes.Equal(si.TimeStampToken(), token) {
+		t.Errorf("timestamp token = %x, want %x", si.TimeStampToken(), token)
+	}
+}
+
+func TestSignDetachedErrors(t *testing.T) {
+	pki := testpki.NewPKI(t)
+	leaf := pki.Issue(t, "Test Signer", nil)
+	if _, err := SignDetached(nil, &SignOptions{Key: leaf.Key}); err == nil {
+		t.Error("signed without a certificate")
+	}
+	_, err := SignDetached(nil, &SignOptions{
+		Key:         leaf.Key,
+		Certificate: leaf.Cert,
+		TimeStamp: func([]byte) ([]byte, error) {
+			return nil, errTestTSA
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), errTestTSA.Error()) {
+		t.Errorf("error = %v, want %v", err, errTestTSA)
+	}
+}
+
+var errTestTSA = errors.New("TSA unavailable")
@@ -0,0 +1,102 @@
+package cms
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+type timeStampReq struct {
+	Version        int
+	MessageImprint messageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+}
+
+type pkiStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional,utf8"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+type timeStampResp struct {
+	Status         pkiStatusInfo
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+// PKIStatus values in timestamp responses
+const (
+	pkiStatusGranted         = 0
+	pkiStatusGrantedWithMods = 1
+)
+
+// TimeStampRequest is an RFC 3161 request for timestamping
+// the SHA-256 digest of some data
+type TimeStampRequest struct {
+	HashedMessage []byte
+	Nonce         *big.Int
+}
+
+// NewTimeStampRequest returns a request for timestamping
+// data, with a random nonce
+func NewTimeStampRequest(data []byte) (*TimeStampRequest, error) {
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256(data)
+	return &TimeStampRequest{HashedMessage: digest[:], Nonce: nonce}, nil
+}
+
+// Marshal returns the DER encoded request, asking the
+// TSA to include its certificate in the response
+func (r *TimeStampRequest) Marshal() ([]byte, error) {
+	return asn1.Marshal(timeStampReq{
+		Version: 1,
+		MessageImprint: messageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: OIDDigestSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: r.HashedMessage,
+		},
+		Nonce:   r.Nonce,
+		CertReq: true,
+	})
+}
+
+// ParseResponse decodes a DER encoded timestamp response and
+// returns its token, after checking that it was granted and
+// that it matches the request.
+func (r *TimeStampRequest) ParseResponse(der []byte) ([]byte, error) {
+	var resp timeStampResp
+	if _, err := asn1.Unmarshal(der, &resp); err != nil {
+		return nil, fmt.Errorf("invalid timestamp response: %v", err)
+	}
+	if s := resp.Status.Status; s != pkiStatusGranted && s != pkiStatusGrantedWithMods {
+		msg := fmt.Sprintf("timestamp request rejected with status %d", s)
+		if len(resp.Status.StatusString) > 0 {
+			msg += ": " + strings.Join(resp.Status.StatusString, ", ")
+		}
+		return nil, errors.New(msg)
+	}
+	token := resp.TimeStampToken.FullBytes
+	if len(token) == 0 {
+		return nil, errors.New("timestamp response doesn't contain a token")
+	}
+	ts, err := ParseTimeStamp(token)
+	if err != nil {
+		return nil, err
+	}
+	if !ts.HashAlgorithm.Equal(OIDDigestSHA256) || !bytes.Equal(ts.HashedMessage, r.HashedMessage) {
+		return nil, errors.New("timestamp token doesn't match the request digest")
+	}
+	if ts.Nonce == nil || ts.Nonce.Cmp(r.Nonce) != 0 {
+		return nil, errors.New("timestamp token doesn't match the request nonce")
+	}
+	return token, nil
+}
@@ -0,0 +1,109 @@
+package cms
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+
+	// Register the hashes used by signatures
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+var digestHashes = []struct {
+	oid  asn1.ObjectIdentifier
+	hash crypto.Hash
+	rsa  x509.SignatureAlgorithm
+	ec   x509.SignatureAlgorithm
+}{
+	{OIDDigestSHA1, crypto.SHA1, x509.SHA1WithRSA, x509.ECDSAWithSHA1},
+	{OIDDigestSHA256, crypto.SHA256, x509.SHA256WithRSA, x509.ECDSAWithSHA256},
+	{OIDDigestSHA384, crypto.SHA384, x509.SHA384WithRSA, x509.ECDSAWithSHA384},
+	{OIDDigestSHA512, crypto.SHA512, x509.SHA512WithRSA, x509.ECDSAWithSHA512},
+}
+
+// x509SignatureAlgorithm returns the signature algorithm used
+// by si with the key in cert, as used by crypto/x509
+func x509SignatureAlgorithm(si *SignerInfo, cert *x509.Certificate) (crypto.Hash, x509.SignatureAlgorithm, error) {
+	for _, v := range digestHashes {
+		if !si.DigestAlgorithm.Algorithm.Equal(v.oid) {
+			continue
+		}
+		switch cert.PublicKeyAlgorithm {
+		case x509.RSA:
+			return v.hash, v.rsa, nil
+		case x509.ECDSA:
+			return v.hash, v.ec, nil
+		}
+		return 0, 0, fmt.Errorf("unsupported public key algorithm %v", cert.PublicKeyAlgorithm)
+	}
+	return 0, 0, fmt.Errorf("unsupported digest algorithm %s", si.DigestAlgorithm.Algorithm)
+}
+
+// VerifyDetached checks the signatures in sd for the given
+// content, returning the signing certificate of the first
+// signer. Detached signatures contain no content, so it
+// must be provided by the caller. The certificate chain
+// is not validated.
+func (sd *SignedData) VerifyDetached(content []byte) (*x509.Certificate, error) {
+	if len(sd.Signers) == 0 {
+		return nil, errors.New("no signers")
+	}
+	var signer *x509.Certificate
+	for _, si := range sd.Signers {
+		cert := sd.Certificate(si)
+		if cert == nil {
+			return nil, errors.New("missing signer certificate")
+		}
+		h, algo, err := x509SignatureAlgorithm(si, cert)
+		if err != nil {
+			return nil, err
+		}
+		signed := content
+		if len(si.RawSignedAttrs) > 0 {
+			digest := si.MessageDigest()
+			hh := h.New()
+			hh.Write(content)
+			if !bytes.Equal(digest, hh.Sum(nil)) {
+				return nil, errors.New("message digest doesn't match the content")
+			}
+			signed = si.RawSignedAttrs
+		}
+		if err := cert.CheckSignature(algo, signed, si.Signature); err != nil {
+			return nil, fmt.Errorf("invalid signature by %s: %v", cert.Subject.CommonName, err)
+		}
+		if signer == nil {
+			signer = cert
+		}
+	}
+	return signer, nil
+}
+
+// Verify checks that the timestamp was issued for the given
+// signature value and that the TSA signature is valid. The
+// TSA certificate chain is not validated.
+func (ts *TimeStamp) Verify(signature []byte) error {
+	var h crypto.Hash
+	for _, v := range digestHashes {
+		if ts.HashAlgorithm.Equal(v.oid) {
+			h = v.hash
+			break
+		}
+	}
+	if h == 0 {
+		return fmt.Errorf("unsupported timestamp digest algorithm %s", ts.HashAlgorithm)
+	}
+	hh := h.New()
+	hh.Write(signature)
+	if !bytes.Equal(hh.Sum(nil), ts.HashedMessage) {
+		return errors.New("timestamp doesn't match the signature")
+	}
+	if _, err := ts.SignedData.VerifyDetached(ts.SignedData.Content); err != nil {
+		return fmt.Errorf("invalid timestamp signature: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package codesign
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+// appleRootCASHA256 is the SHA-256 fingerprint of the Apple
+// Root CA, published at https://www.apple.com/certificateauthority/
+const appleRootCASHA256 = "b0b1730ecbc7ff4505142c49f1295e6eda6bcaed7e2c68c5be91b5a11001f024"
+
+func TestAppleCertificates(t *testing.T) {
+	certs := AppleCertificates()
+	if len(certs) == 0 {
+		t.Fatal("no bundled certificates")
+	}
+	sum := sha256.Sum256(certs[0].Raw)
+	if hex.EncodeToString(sum[:]) != appleRootCASHA256 || !isSelfSigned(certs[0]) {
+		t.Fatal("the bundled Apple Root CA doesn't match its fingerprint")
+	}
+	// The root itself is signed with SHA-1, which crypto/x509
+	// doesn't check, but it's pinned by its fingerprint
+	for _, c := range certs[1:] {
+		if err := c.CheckSignatureFrom(certs[0]); err != nil {
+			t.Errorf("%q is not issued by the Apple Root CA: %v", c.Subject.CommonName, err)
+		}
+	}
+}
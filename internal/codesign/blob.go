@@ -0,0 +1,161 @@
+// Package codesign implements reading and writing of
+// Apple code signatures.
+package codesign
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Blob magic numbers
+const (
+	MagicRequirement       = 0xfade0c00
+	MagicRequirements      = 0xfade0c01
+	MagicCodeDirectory     = 0xfade0c02
+	MagicEmbeddedSignature = 0xfade0cc0
+	MagicDetachedSignature = 0xfade0cc1
+	MagicBlobWrapper       = 0xfade0b01
+	MagicEntitlements      = 0xfade7171
+	MagicEntitlementsDER   = 0xfade7172
+)
+
+// Slot types inside a SuperBlob. Special slots in the
+// CodeDirectory use the same numbers, negated.
+const (
+	SlotCodeDirectory   = 0
+	SlotInfo            = 1
+	SlotRequirements    = 2
+	SlotResourceDir     = 3
+	SlotApplication     = 4
+	SlotEntitlements    = 5
+	SlotRepSpecific     = 6
+	SlotEntitlementsDER = 7
+
+	SlotAlternateCodeDirectory      = 0x1000
+	SlotAlternateCodeDirectoryLimit = 5
+	SlotSignature                   = 0x10000
+)
+
+var (
+	errShortBlob = errors.New("blob is too short")
+)
+
+// Blob is an entry in a SuperBlob
+type Blob struct {
+	Type uint32
+	// Data contains the whole blob, including its
+	// magic and length
+	Data []byte
+}
+
+// Magic returns the magic number of the blob
+func (b *Blob) Magic() uint32 {
+	if len(b.Data) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b.Data)
+}
+
+// SuperBlob is a collection of blobs, as found in
+// LC_CODE_SIGNATURE
+type SuperBlob struct {
+	Magic uint32
+	Blobs []*Blob
+}
+
+// blobData validates the header of the blob at the start
+// of data and returns the whole blob
+func blobData(data []byte, magic uint32) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, errShortBlob
+	}
+	if m := binary.BigEndian.Uint32(data); m != magic {
+		return nil, fmt.Errorf("invalid blob magic %#x, expecting %#x", m, magic)
+	}
+	length := binary.BigEndian.Uint32(data[4:])
+	if length < 8 || uint64(length) > uint64(len(data)) {
+		return nil, fmt.Errorf("invalid blob length %d", length)
+	}
+	return data[:length], nil
+}
+
+// ParseSuperBlob parses an embedded signature SuperBlob
+func ParseSuperBlob(data []byte) (*SuperBlob, error) {
+	if len(data) < 12 {
+		return nil, errShortBlob
+	}
+	magic := binary.BigEndian.Uint32(data)
+	data, err := blobData(data, magic)
+	if err != nil {
+		return nil, err
+	}
+	count := binary.BigEndian.Uint32(data[8:])
+	if 12+uint64(count)*8 > uint64(len(data)) {
+		return nil, errors.New("SuperBlob index extends beyond its length")
+	}
+	sb := &SuperBlob{Magic: magic}
+	for ii := 0; ii < int(count); ii++ {
+		typ := binary.BigEndian.Uint32(data[12+ii*8:])
+		offset := binary.BigEndian.Uint32(data[16+ii*8:])
+		if uint64(offset)+8 > uint64(len(data)) {
+			return nil, fmt.Errorf("blob %d at invalid offset %d", ii, offset)
+		}
+		blob, err := blobData(data[offset:], binary.BigEndian.Uint32(data[offset:]))
+		if err != nil {
+			return nil, fmt.Errorf("blob %d: %v", ii, err)
+		}
+		sb.Blobs = append(sb.Blobs, &Blob{Type: typ, Data: blob})
+	}
+	return sb, nil
+}
+
+// Blob returns the blob with the given slot type,
+// or nil if there's no such blob
+func (sb *SuperBlob) Blob(typ uint32) *Blob {
+	for _, b := range sb.Blobs {
+		if b.Type == typ {
+			return b
+		}
+	}
+	return nil
+}
+
+// Bytes encodes the SuperBlob
+func (sb *SuperBlob) Bytes() []byte {
+	size := 12 + 8*len(sb.Blobs)
+	for _, b := range sb.Blobs {
+		size += len(b.Data)
+	}
+	data := make([]byte, size)
+	binary.BigEndian.PutUint32(data, sb.Magic)
+	binary.BigEndian.PutUint32(data[4:], uint32(size))
+	binary.BigEndian.PutUint32(data[8:], uint32(len(sb.Blobs)))
+	offset := 12 + 8*len(sb.Blobs)
+	for ii, b := range sb.Blobs {
+		binary.BigEndian.PutUint32(data[12+ii*8:], b.Type)
+		binary.BigEndian.PutUint32(data[16+ii*8:], uint32(offset))
+		copy(data[offset:], b.Data)
+		offset += len(b.Data)
+	}
+	return data
+}
+
+// makeBlob returns a blob with the given magic and payload
+func makeBlob(magic uint32, payload []byte) []byte {
+	data := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(data, magic)
+	binary.BigEndian.PutUint32(data[4:], uint32(len(data)))
+	copy(data[8:], payload)
+	return data
+}
+
+// blobPayload returns the data in a blob after its header,
+// checking its magic
+func blobPayload(data []byte, magic uint32) ([]byte, error) {
+	blob, err := blobData(data, magic)
+	if err != nil {
+		return nil, err
+	}
+	return blob[8:], nil
+}
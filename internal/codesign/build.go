@@ -0,0 +1,174 @@
+package codesign
+
+import (
+	"encoding/binary"
+)
+
+const (
+	// DefaultPageSizeLog2 is the page size used for code
+	// slots, as used by codesign
+	DefaultPageSizeLog2 = 12
+
+	codeDirectoryHeaderSizeExecSeg = 88
+	codeDirectoryHeaderSizeRuntime = 96
+)
+
+// CodeDirectoryParams contains the values for building
+// a new CodeDirectory
+type CodeDirectoryParams struct {
+	HashType     uint8
+	Identifier   string
+	TeamID       string
+	Flags        uint32
+	ExecSegBase  uint64
+	ExecSegLimit uint64
+	ExecSegFlags uint64
+	// Runtime is the hardened runtime version, usually
+	// the SDK version. If zero, an older CodeDirectory
+	// version without it is built.
+	Runtime uint32
+	// SpecialSlots contains the data for each special slot,
+	// indexed by slot number. Missing slots are left empty.
+	SpecialSlots map[int][]byte
+	// Code contains the data to hash in code slots, whose
+	// length is the code limit
+	Code         []byte
+	PageSizeLog2 uint8
+}
+
+// BuildCodeDirectory returns a new encoded CodeDirectory
+func BuildCodeDirectory(params *CodeDirectoryParams) ([]byte, error) {
+	_, hashSize, err := NewHash(params.HashType)
+	if err != nil {
+		return nil, err
+	}
+	pageSizeLog2 := params.PageSizeLog2
+	if pageSizeLog2 == 0 {
+		pageSizeLog2 = DefaultPageSizeLog2
+	}
+	pageSize := 1 << pageSizeLog2
+	codeLimit := uint64(len(params.Code))
+	nCodeSlots := int((codeLimit + uint64(pageSize) - 1) / uint64(pageSize))
+	nSpecialSlots := 0
+	for slot, data := range params.SpecialSlots {
+		if data != nil && slot > nSpecialSlots {
+			nSpecialSlots = slot
+		}
+	}
+
+	version := uint32(CodeDirectoryVersionExecSeg)
+	headerSize := codeDirectoryHeaderSizeExecSeg
+	if params.Runtime != 0 {
+		version = CodeDirectoryVersionRuntime
+		headerSize = codeDirectoryHeaderSizeRuntime
+	}
+	identOffset := headerSize
+	teamOffset := 0
+	offset := identOffset + len(params.Identifier) + 1
+	if params.TeamID != "" {
+		teamOffset = offset
+		offset += len(params.TeamID) + 1
+	}
+	hashOffset := offset + nSpecialSlots*hashSize
+	size := hashOffset + nCodeSlots*hashSize
+
+	data := make([]byte, size)
+	be := binary.BigEndian
+	be.PutUint32(data, MagicCodeDirectory)
+	be.PutUint32(data[4:], uint32(size))
+	be.PutUint32(data[8:], version)
+	be.PutUint32(data[12:], params.Flags)
+	be.PutUint32(data[16:], uint32(hashOffset))
+	be.PutUint32(data[20:], uint32(identOffset))
+	be.PutUint32(data[24:], uint32(nSpecialSlots))
+	be.PutUint32(data[28:], uint32(nCodeSlots))
+	if codeLimit > 1<<32-1 {
+		be.PutUint64(data[56:], codeLimit)
+	} else {
+		be.PutUint32(data[32:], uint32(codeLimit))
+	}
+	data[36] = uint8(hashSize)
+	data[37] = params.HashType
+	data[39] = pageSizeLog2
+	be.PutUint32(data[48:], uint32(teamOffset))
+	be.PutUint64(data[64:], params.ExecSegBase)
+	be.PutUint64(data[72:], params.ExecSegLimit)
+	be.PutUint64(data[80:], params.ExecSegFlags)
+	if params.Runtime != 0 {
+		be.PutUint32(data[88:], params.Runtime)
+	}
+	copy(data[identOffset:], params.Identifier)
+	if teamOffset != 0 {
+		copy(data[teamOffset:], params.TeamID)
+	}
+	for slot, slotData := range params.SpecialSlots {
+		if slotData == nil {
+			continue
+		}
+		h, err := Digest(params.HashType, slotData)
+		if err != nil {
+			return nil, err
+		}
+		copy(data[hashOffset-slot*hashSize:], h)
+	}
+	for ii := 0; ii < nCodeSlots; ii++ {
+		start := ii * pageSize
+		end := start + pageSize
+		if end > len(params.Code) {
+			end = len(params.Code)
+		}
+		h, err := Digest(params.HashType, params.Code[start:end])
+		if err != nil {
+			return nil, err
+		}
+		copy(data[hashOffset+ii*hashSize:], h)
+	}
+	return data, nil
+}
+
+// CodeDirectorySize returns the size of the CodeDirectory that
+// BuildCodeDirectory would return for the given parameters,
+// without hashing any data
+func CodeDirectorySize(params *CodeDirectoryParams, codeLimit uint64) (int, error) {
+	_, hashSize, err := NewHash(params.HashType)
+	if err != nil {
+		return 0, err
+	}
+	pageSizeLog2 := params.PageSizeLog2
+	if pageSizeLog2 == 0 {
+		pageSizeLog2 = DefaultPageSizeLog2
+	}
+	pageSize := uint64(1) << pageSizeLog2
+	nCodeSlots := int((codeLimit + pageSize - 1) / pageSize)
+	nSpecialSlots := 0
+	for slot, data := range params.SpecialSlots {
+		if data != nil && slot > nSpecialSlots {
+			nSpecialSlots = slot
+		}
+	}
+	size := codeDirectoryHeaderSizeExecSeg
+	if params.Runtime != 0 {
+		size = codeDirectoryHeaderSizeRuntime
+	}
+	size += len(params.Identifier) + 1
+	if params.TeamID != "" {
+		size += len(params.TeamID) + 1
+	}
+	return size + (nSpecialSlots+nCodeSlots)*hashSize, nil
+}
+
+// EmptyRequirements returns a requirements set blob
+// with no requirements
+func EmptyRequirements() []byte {
+	return makeBlob(MagicRequirements, make([]byte, 4))
+}
+
+// EntitlementsBlob wraps an XML entitlements plist in a blob
+func EntitlementsBlob(xml []byte) []byte {
+	return makeBlob(MagicEntitlements, xml)
+}
+
+// wrapperBlob wraps a CMS signature in a blob
+func wrapperBlob(cms []byte) []byte {
+	return makeBlob(MagicBlobWrapper, cms)
+}
@@ -0,0 +1,297 @@
+package codesign
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// Hash types used in a CodeDirectory
+const (
+	HashTypeSHA1            = 1
+	HashTypeSHA256          = 2
+	HashTypeSHA256Truncated = 3
+	HashTypeSHA384          = 4
+)
+
+// CodeDirectory versions
+const (
+	CodeDirectoryVersionScatter     = 0x20100
+	CodeDirectoryVersionTeamID      = 0x20200
+	CodeDirectoryVersionCodeLimit64 = 0x20300
+	CodeDirectoryVersionExecSeg     = 0x20400
+	CodeDirectoryVersionRuntime     = 0x20500
+)
+
+// CodeDirectory flags
+const (
+	FlagHost              = 0x1
+	FlagAdhoc             = 0x2
+	FlagForceHard         = 0x100
+	FlagForceKill         = 0x200
+	FlagForceExpiration   = 0x400
+	FlagRestrict          = 0x800
+	FlagEnforcement       = 0x1000
+	FlagLibraryValidation = 0x2000
+	FlagRuntime           = 0x10000
+	FlagLinkerSigned      = 0x20000
+)
+
+// Executable segment flags
+const (
+	ExecSegMainBinary    = 0x1
+	ExecSegAllowUnsigned = 0x10
+)
+
+// CDHashSize is the length of a cdhash, as used in
+// requirements and in the CMS signature
+const CDHashSize = 20
+
+var flagNames = []struct {
+	Flag uint32
+	Name string
+}{
+	{FlagHost, "host"},
+	{FlagAdhoc, "adhoc"},
+	{FlagForceHard, "hard"},
+	{FlagForceKill, "kill"},
+	{FlagForceExpiration, "expires"},
+	{FlagRestrict, "restrict"},
+	{FlagEnforcement, "enforcement"},
+	{FlagLibraryValidation, "library-validation"},
+	{FlagRuntime, "runtime"},
+	{FlagLinkerSigned, "linker-signed"},
+}
+
+// FlagNames returns the names of the given CodeDirectory flags,
+// as used by codesign --options
+func FlagNames(flags uint32) []string {
+	var names []string
+	for _, v := range flagNames {
+		if flags&v.Flag != 0 {
+			names = append(names, v.Name)
+			flags &^= v.Flag
+		}
+	}
+	if flags != 0 {
+		names = append(names, fmt.Sprintf("%#x", flags))
+	}
+	return names
+}
+
+// flagAliases contains the alternate names accepted by
+// codesign --options
+var flagAliases = map[string]string{
+	"library": "library-validation",
+}
+
+// ParseFlags parses a comma separated list of flag names,
+// in the same format accepted by codesign --options
+func ParseFlags(s string) (uint32, error) {
+	var flags uint32
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if alias, ok := flagAliases[name]; ok {
+			name = alias
+		}
+		found := false
+		for _, v := range flagNames {
+			if v.Name == name {
+				flags |= v.Flag
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown code signing flag %q", name)
+		}
+	}
+	return flags, nil
+}
+
+// HashTypeName returns the name of a CodeDirectory hash type
+func HashTypeName(hashType uint8) string {
+	switch hashType {
+	case HashTypeSHA1:
+		return "sha1"
+	case HashTypeSHA256:
+		return "sha256"
+	case HashTypeSHA256Truncated:
+		return "sha256-truncated"
+	case HashTypeSHA384:
+		return "sha384"
+	}
+	return fmt.Sprintf("hash(%d)", hashType)
+}
+
+// NewHash returns a hash.Hash for the given hash type, and the
+// number of bytes of its output that are used.
+func NewHash(hashType uint8) (hash.Hash, int, error) {
+	switch hashType {
+	case HashTypeSHA1:
+		return sha1.New(), sha1.Size, nil
+	case HashTypeSHA256:
+		return sha256.New(), sha256.Size, nil
+	case HashTypeSHA256Truncated:
+		return sha256.New(), CDHashSize, nil
+	case HashTypeSHA384:
+		return sha512.New384(), sha512.Size384, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported hash type %d", hashType)
+}
+
+// Digest returns the hash of data using the given hash type
+func Digest(hashType uint8, data []byte) ([]byte, error) {
+	h, size, err := NewHash(hashType)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(data)
+	return h.Sum(nil)[:size], nil
+}
+
+// CodeDirectory describes the hashes of a code object
+type CodeDirectory struct {
+	Version      uint32
+	Flags        uint32
+	CodeLimit    uint64
+	HashSize     uint8
+	HashType     uint8
+	Platform     uint8
+	PageSizeLog2 uint8
+	Identifier   string
+	TeamID       string
+	ExecSegBase  uint64
+	ExecSegLimit uint64
+	ExecSegFlags uint64
+	Runtime      uint32
+	// SpecialSlots contains the special slots hashes. The hash
+	// for slot -n is at SpecialSlots[n-1].
+	SpecialSlots [][]byte
+	CodeSlots    [][]byte
+	// Raw contains the whole encoded CodeDirectory
+	Raw []byte
+}
+
+// PageSize returns the page size used for code slots. A
+// zero page size means the whole file is hashed in a single
+// slot.
+func (cd *CodeDirectory) PageSize() int {
+	if cd.PageSizeLog2 == 0 {
+		return 0
+	}
+	return 1 << cd.PageSizeLog2
+}
+
+// SpecialSlot returns the hash for the given special slot,
+// or nil if it's not present or it's empty.
+func (cd *CodeDirectory) SpecialSlot(slot int) []byte {
+	if slot < 1 || slot > len(cd.SpecialSlots) {
+		return nil
+	}
+	h := cd.SpecialSlots[slot-1]
+	for _, b := range h {
+		if b != 0 {
+			return h
+		}
+	}
+	return nil
+}
+
+// CDHash returns the full hash of the CodeDirectory, using
+// its own hash type. Truncate it to CDHashSize to obtain
+// the cdhash.
+func (cd *CodeDirectory) CDHash() []byte {
+	h, err := Digest(cd.HashType, cd.Raw)
+	if err != nil {
+		return nil
+	}
+	return h
+}
+
+// ParseCodeDirectory parses a CodeDirectory blob
+func ParseCodeDirectory(data []byte) (*CodeDirectory, error) {
+	data, err := blobData(data, MagicCodeDirectory)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 44 {
+		return nil, errShortBlob
+	}
+	be := binary.BigEndian
+	cd := &CodeDirectory{
+		Version:      be.Uint32(data[8:]),
+		Flags:        be.Uint32(data[12:]),
+		CodeLimit:    uint64(be.Uint32(data[32:])),
+		HashSize:     data[36],
+		HashType:     data[37],
+		Platform:     data[38],
+		PageSizeLog2: data[39],
+		Raw:          data,
+	}
+	// Check the hash type, so CDHash() always succeeds for
+	// parsed CodeDirectories
+	_, size, err := NewHash(cd.HashType)
+	if err != nil {
+		return nil, err
+	}
+	if int(cd.HashSize) != size {
+		return nil, fmt.Errorf("invalid hash size %d for %s", cd.HashSize, HashTypeName(cd.HashType))
+	}
+	hashOffset := be.Uint32(data[16:])
+	identOffset := be.Uint32(data[20:])
+	nSpecialSlots := be.Uint32(data[24:])
+	nCodeSlots := be.Uint32(data[28:])
+	if identOffset >= uint32(len(data)) {
+		return nil, errors.New("invalid identifier offset")
+	}
+	cd.Identifier = cstring(data[identOffset:])
+	if cd.Version >= CodeDirectoryVersionTeamID && len(data) >= 52 {
+		if teamOffset := be.Uint32(data[48:]); teamOffset != 0 && teamOffset < uint32(len(data)) {
+			cd.TeamID = cstring(data[teamOffset:])
+		}
+	}
+	if cd.Version >= CodeDirectoryVersionCodeLimit64 && len(data) >= 64 {
+		if limit64 := be.Uint64(data[56:]); limit64 != 0 {
+			cd.CodeLimit = limit64
+		}
+	}
+	if cd.Version >= CodeDirectoryVersionExecSeg && len(data) >= 88 {
+		cd.ExecSegBase = be.Uint64(data[64:])
+		cd.ExecSegLimit = be.Uint64(data[72:])
+		cd.ExecSegFlags = be.Uint64(data[80:])
+	}
+	if cd.Version >= CodeDirectoryVersionRuntime && len(data) >= 92 {
+		cd.Runtime = be.Uint32(data[88:])
+	}
+	hashSize := uint64(cd.HashSize)
+	end := uint64(hashOffset) + uint64(nCodeSlots)*hashSize
+	if uint64(hashOffset) < uint64(nSpecialSlots)*hashSize || end > uint64(len(data)) {
+		return nil, errors.New("hash slots extend beyond CodeDirectory")
+	}
+	for ii := uint64(1); ii <= uint64(nSpecialSlots); ii++ {
+		p := uint64(hashOffset) - ii*hashSize
+		cd.SpecialSlots = append(cd.SpecialSlots, data[p:p+hashSize])
+	}
+	for p := uint64(hashOffset); p < end; p += hashSize {
+		cd.CodeSlots = append(cd.CodeSlots, data[p:p+hashSize])
+	}
+	return cd, nil
+}
+
+func cstring(b []byte) string {
+	for ii, c := range b {
+		if c == 0 {
+			return string(b[:ii])
+		}
+	}
+	return string(b)
+}
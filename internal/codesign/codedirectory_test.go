@@ -0,0 +1,71 @@
+package codesign
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func testCodeDirectory(t *testing.T) []byte {
+	data, err := BuildCodeDirectory(&CodeDirectoryParams{
+		HashType:     HashTypeSHA256,
+		Identifier:   "com.example.app",
+		TeamID:       "ABCDE12345",
+		SpecialSlots: map[int][]byte{2: EmptyRequirements()},
+		Code:         bytes.Repeat([]byte{0xcc}, 5000),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseCodeDirectory(t *testing.T) {
+	cd, err := ParseCodeDirectory(testCodeDirectory(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cd.Identifier != "com.example.app" || cd.TeamID != "ABCDE12345" {
+		t.Errorf("identifier = %q, team = %q", cd.Identifier, cd.TeamID)
+	}
+	if len(cd.CodeSlots) != 2 || len(cd.SpecialSlots) != 2 || cd.CodeLimit != 5000 {
+		t.Errorf("code slots = %d, special slots = %d, code limit = %d", len(cd.CodeSlots), len(cd.SpecialSlots), cd.CodeLimit)
+	}
+	if cd.SpecialSlot(1) != nil || cd.SpecialSlot(2) == nil {
+		t.Error("unexpected special slots")
+	}
+	if len(cd.CDHash()) != 32 {
+		t.Errorf("cdhash = %x", cd.CDHash())
+	}
+}
+
+func TestParseCodeDirectoryMalformed(t *testing.T) {
+	be := binary.BigEndian
+	tests := []struct {
+		name   string
+		modify func(data []byte) []byte
+		err    string
+	}{
+		{"short", func(data []byte) []byte { return data[:40] }, "invalid blob length"},
+		{"bad magic", func(data []byte) []byte { be.PutUint32(data, MagicEmbeddedSignature); return data }, "invalid blob magic"},
+		{"short header", func(data []byte) []byte { be.PutUint32(data[4:], 40); return data }, errShortBlob.Error()},
+		{"unknown hash type", func(data []byte) []byte { data[37] = 42; return data }, "unsupported hash type 42"},
+		{"hash size mismatch", func(data []byte) []byte { data[36] = 20; return data }, "invalid hash size 20 for sha256"},
+		{"identifier offset", func(data []byte) []byte { be.PutUint32(data[20:], 1<<31); return data }, "invalid identifier offset"},
+		{"code slots", func(data []byte) []byte { be.PutUint32(data[28:], 1<<30); return data }, "hash slots extend beyond CodeDirectory"},
+		{"special slots", func(data []byte) []byte { be.PutUint32(data[24:], 1<<30); return data }, "hash slots extend beyond CodeDirectory"},
+		{"hash offset", func(data []byte) []byte { be.PutUint32(data[16:], 1<<31); return data }, "hash slots extend beyond CodeDirectory"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCodeDirectory(tt.modify(testCodeDirectory(t)))
+			if err == nil {
+				t.Fatal("malformed CodeDirectory parsed without errors")
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %q, want %q", err, tt.err)
+			}
+		})
+	}
+}
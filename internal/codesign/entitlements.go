@@ -0,0 +1,201 @@
+package codesign
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"howett.net/plist"
+)
+
+// DER entitlements are encoded as [APPLICATION 16] { version, dict },
+// where dictionaries use [CONTEXT 16] and contain SEQUENCEs
+// of key/value pairs.
+const (
+	derEntitlementsVersion = 1
+	derTagDict             = 16
+)
+
+// ParseEntitlements returns the XML plist stored in
+// an entitlements blob
+func ParseEntitlements(data []byte) ([]byte, error) {
+	return blobPayload(data, MagicEntitlements)
+}
+
+// ParseEntitlementsDER decodes a DER entitlements blob into
+// a map, using the same types as a decoded plist.
+func ParseEntitlementsDER(data []byte) (map[string]interface{}, error) {
+	payload, err := blobPayload(data, MagicEntitlementsDER)
+	if err != nil {
+		return nil, err
+	}
+	var outer asn1.RawValue
+	if _, err := asn1.Unmarshal(payload, &outer); err != nil {
+		return nil, err
+	}
+	if outer.Class != asn1.ClassApplication || outer.Tag != derTagDict {
+		return nil, errors.New("invalid DER entitlements header")
+	}
+	var version int
+	rest, err := asn1.Unmarshal(outer.Bytes, &version)
+	if err != nil {
+		return nil, err
+	}
+	if version != derEntitlementsVersion {
+		return nil, fmt.Errorf("unsupported DER entitlements version %d", version)
+	}
+	var dict asn1.RawValue
+	if _, err := asn1.Unmarshal(rest, &dict); err != nil {
+		return nil, err
+	}
+	value, err := decodeDERValue(dict)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("DER entitlements don't contain a dictionary")
+	}
+	return m, nil
+}
+
+func decodeDERValue(v asn1.RawValue) (interface{}, error) {
+	switch {
+	case v.Class == asn1.ClassContextSpecific && v.Tag == derTagDict:
+		m := make(map[string]interface{})
+		rest := v.Bytes
+		for len(rest) > 0 {
+			var pair []asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &pair); err != nil {
+				return nil, err
+			}
+			if len(pair) != 2 || pair[0].Tag != asn1.TagUTF8String {
+				return nil, errors.New("invalid DER entitlements dictionary entry")
+			}
+			value, err := decodeDERValue(pair[1])
+			if err != nil {
+				return nil, err
+			}
+			m[string(pair[0].Bytes)] = value
+		}
+		return m, nil
+	case v.Class != asn1.ClassUniversal:
+		return nil, fmt.Errorf("unexpected DER entitlements value class %d", v.Class)
+	case v.Tag == asn1.TagBoolean:
+		var b bool
+		_, err := asn1.Unmarshal(v.FullBytes, &b)
+		return b, err
+	case v.Tag == asn1.TagInteger:
+		var n *big.Int
+		if _, err := asn1.Unmarshal(v.FullBytes, &n); err != nil {
+			return nil, err
+		}
+		if n.IsInt64() {
+			return n.Int64(), nil
+		}
+		return n.String(), nil
+	case v.Tag == asn1.TagUTF8String:
+		return string(v.Bytes), nil
+	case v.Tag == asn1.TagSequence:
+		var items []asn1.RawValue
+		if _, err := asn1.Unmarshal(v.FullBytes, &items); err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, 0, len(items))
+		for _, item := range items {
+			value, err := decodeDERValue(item)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("unexpected DER entitlements value tag %d", v.Tag)
+}
+
+// DecodeEntitlements decodes an entitlements plist
+func DecodeEntitlements(data []byte) (map[string]interface{}, error) {
+	var ents map[string]interface{}
+	if _, err := plist.Unmarshal(data, &ents); err != nil {
+		return nil, err
+	}
+	return ents, nil
+}
+
+// EntitlementsDERBlob converts an entitlements plist to
+// a DER entitlements blob
+func EntitlementsDERBlob(data []byte) ([]byte, error) {
+	ents, err := DecodeEntitlements(data)
+	if err != nil {
+		return nil, err
+	}
+	dict, err := encodeDERValue(ents)
+	if err != nil {
+		return nil, err
+	}
+	version, err := asn1.Marshal(derEntitlementsVersion)
+	if err != nil {
+		return nil, err
+	}
+	der, err := asn1.Marshal(asn1.RawValue{
+		Class:      asn1.ClassApplication,
+		Tag:        derTagDict,
+		IsCompound: true,
+		Bytes:      append(version, dict...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return makeBlob(MagicEntitlementsDER, der), nil
+}
+
+func encodeDERValue(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case bool:
+		return asn1.Marshal(v)
+	case int64:
+		return asn1.Marshal(v)
+	case uint64:
+		return asn1.Marshal(new(big.Int).SetUint64(v))
+	case string:
+		return asn1.Marshal(asn1.RawValue{Tag: asn1.TagUTF8String, Bytes: []byte(v)})
+	case []interface{}:
+		var items []byte
+		for _, item := range v {
+			data, err := encodeDERValue(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, data...)
+		}
+		return asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: items})
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		var pairs []byte
+		for _, k := range keys {
+			key, err := encodeDERValue(k)
+			if err != nil {
+				return nil, err
+			}
+			data, err := encodeDERValue(v[k])
+			if err != nil {
+				return nil, fmt.Errorf("entitlement %s: %v", k, err)
+			}
+			pair, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSequence, IsCompound: true, Bytes: append(key, data...)})
+			if err != nil {
+				return nil, err
+			}
+			pairs = append(pairs, pair...)
+		}
+		return asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: derTagDict, IsCompound: true, Bytes: pairs})
+	}
+	return nil, fmt.Errorf("unsupported value of type %T in DER entitlements", value)
+}
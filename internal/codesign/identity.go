@@ -0,0 +1,111 @@
+package codesign
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+
+	"howett.net/plist"
+
+	"macapptool/internal/cms"
+)
+
+// Identity is a certificate with its private key, used
+// for non ad-hoc signatures
+type Identity struct {
+	Key         crypto.Signer
+	Certificate *x509.Certificate
+	// Chain contains the intermediate certificates and,
+	// optionally, the root certificate, in order
+	Chain []*x509.Certificate
+}
+
+// TeamID returns the team identifier, which Apple stores
+// in the certificate organizational unit
+func (id *Identity) TeamID() string {
+	if len(id.Certificate.Subject.OrganizationalUnit) > 0 {
+		return id.Certificate.Subject.OrganizationalUnit[0]
+	}
+	return ""
+}
+
+// IsDeveloperID returns true iff the certificate is a
+// Developer ID Application certificate
+func (id *Identity) IsDeveloperID() bool {
+	for _, ext := range id.Certificate.Extensions {
+		if ext.Id.Equal(oidAppleDeveloperIDLeaf) {
+			return true
+		}
+	}
+	return false
+}
+
+// timeStampSizeEstimate is the space reserved for the
+// timestamp token, including the TSA certificates
+const timeStampSizeEstimate = 8192
+
+// signatureSizeEstimate returns the space reserved for the
+// CMS signature, which must be allocated before it's known
+func (id *Identity) signatureSizeEstimate(timestamped bool) int {
+	size := len(id.Certificate.Raw)
+	for _, c := range id.Chain {
+		size += len(c.Raw)
+	}
+	if timestamped {
+		size += timeStampSizeEstimate
+	}
+	// Attributes, signer info and a signature with
+	// up to a 4096 bit key
+	return size + 4096
+}
+
+var hashTypeOIDs = map[uint8]asn1.ObjectIdentifier{
+	HashTypeSHA1:   cms.OIDDigestSHA1,
+	HashTypeSHA256: cms.OIDDigestSHA256,
+	HashTypeSHA384: cms.OIDDigestSHA384,
+}
+
+type cdHashAttrValue struct {
+	HashAlgorithm asn1.ObjectIdentifier
+	Digest        []byte
+}
+
+// cmsSignature signs the primary CodeDirectory, including
+// the hashes of every CodeDirectory in the attributes
+// Apple uses to pin the alternate ones.
+func (id *Identity) cmsSignature(cds [][]byte, hashTypes []uint8, timeStamp func([]byte) ([]byte, error)) ([]byte, error) {
+	var cdhashes [][]byte
+	var values []interface{}
+	for ii, cd := range cds {
+		h, err := Digest(hashTypes[ii], cd)
+		if err != nil {
+			return nil, err
+		}
+		cdhashes = append(cdhashes, h[:CDHashSize])
+		oid, ok := hashTypeOIDs[hashTypes[ii]]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash type %s for CMS signatures", HashTypeName(hashTypes[ii]))
+		}
+		values = append(values, cdHashAttrValue{HashAlgorithm: oid, Digest: h})
+	}
+	cdhashPlist, err := plist.MarshalIndent(map[string]interface{}{"cdhashes": cdhashes}, plist.XMLFormat, "\t")
+	if err != nil {
+		return nil, err
+	}
+	plistAttr, err := cms.NewAttribute(cms.OIDAppleCDHashPlist, cdhashPlist)
+	if err != nil {
+		return nil, err
+	}
+	hashesAttr, err := cms.NewAttribute(cms.OIDAppleCDHashes, values...)
+	if err != nil {
+		return nil, err
+	}
+	return cms.SignDetached(cds[0], &cms.SignOptions{
+		Key:          id.Key,
+		Certificate:  id.Certificate,
+		Certificates: id.Chain,
+		SignedAttrs:  []cms.Attribute{plistAttr, hashesAttr},
+		TimeStamp:    timeStamp,
+	})
+}
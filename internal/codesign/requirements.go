@@ -0,0 +1,577 @@
+package codesign
+
+import (
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requirement types
+const (
+	RequirementHost       = 1
+	RequirementGuest      = 2
+	RequirementDesignated = 3
+	RequirementLibrary    = 4
+	RequirementPlugin     = 5
+)
+
+var requirementTypeNames = map[uint32]string{
+	RequirementHost:       "host",
+	RequirementGuest:      "guest",
+	RequirementDesignated: "designated",
+	RequirementLibrary:    "library",
+	RequirementPlugin:     "plugin",
+}
+
+// Requirement expression opcodes
+const (
+	opFalse = iota
+	opTrue
+	opIdent
+	opAppleAnchor
+	opAnchorHash
+	opInfoKeyValue
+	opAnd
+	opOr
+	opCDHash
+	opNot
+	opInfoKeyField
+	opCertField
+	opTrustedCert
+	opTrustedCerts
+	opCertGeneric
+	opAppleGenericAnchor
+	opEntitlementField
+	opCertPolicy
+	opNamedAnchor
+	opNamedCode
+	opPlatform
+	opNotarized
+	opCertFieldDate
+	opLegacyDevID
+
+	opFlagMask    = 0xff000000
+	opGenericSkip = 0x40000000
+)
+
+// Match operations
+const (
+	matchExists = iota
+	matchEqual
+	matchContains
+	matchBeginsWith
+	matchEndsWith
+	matchLessThan
+	matchGreaterThan
+	matchLessEqual
+	matchGreaterEqual
+	matchOn
+	matchBefore
+	matchAfter
+	matchOnOrBefore
+	matchOnOrAfter
+	matchAbsent
+)
+
+const (
+	// Requirement expressions use this kind
+	requirementKindExpr = 1
+
+	// Slots used in certificate operations
+	certSlotLeaf   = 0
+	certSlotAnchor = -1
+)
+
+// Requirement is a single code requirement
+type Requirement struct {
+	Type uint32
+	// Raw contains the whole requirement blob
+	Raw []byte
+}
+
+// TypeName returns the name of the requirement type
+func (r *Requirement) TypeName() string {
+	if s, ok := requirementTypeNames[r.Type]; ok {
+		return s
+	}
+	return fmt.Sprintf("requirement(%d)", r.Type)
+}
+
+// String returns the requirement in the requirement language
+func (r *Requirement) String() string {
+	s, err := DecompileRequirement(r.Raw)
+	if err != nil {
+		return fmt.Sprintf("<invalid requirement: %v>", err)
+	}
+	return fmt.Sprintf("%s => %s", r.TypeName(), s)
+}
+
+// ParseRequirements parses a requirements set blob
+func ParseRequirements(data []byte) ([]*Requirement, error) {
+	data, err := blobData(data, MagicRequirements)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 12 {
+		return nil, errShortBlob
+	}
+	count := binary.BigEndian.Uint32(data[8:])
+	if 12+uint64(count)*8 > uint64(len(data)) {
+		return nil, errors.New("requirements index extends beyond its length")
+	}
+	var reqs []*Requirement
+	for ii := 0; ii < int(count); ii++ {
+		typ := binary.BigEndian.Uint32(data[12+ii*8:])
+		offset := binary.BigEndian.Uint32(data[16+ii*8:])
+		if uint64(offset) >= uint64(len(data)) {
+			return nil, fmt.Errorf("requirement %d at invalid offset %d", ii, offset)
+		}
+		raw, err := blobData(data[offset:], MagicRequirement)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, &Requirement{Type: typ, Raw: raw})
+	}
+	return reqs, nil
+}
+
+// requirementReader decodes a requirement expression
+type requirementReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *requirementReader) uint32() (uint32, error) {
+	if r.pos+4 > len(r.data) {
+		return 0, errShortBlob
+	}
+	v := binary.BigEndian.Uint32(r.data[r.pos:])
+	r.pos += 4
+	return v, nil
+}
+
+func (r *requirementReader) bytes() ([]byte, error) {
+	n, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(r.pos)+uint64(n) > uint64(len(r.data)) {
+		return nil, errShortBlob
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	// Data is padded to 4 bytes
+	r.pos += (int(n) + 3) &^ 3
+	return b, nil
+}
+
+func (r *requirementReader) str() (string, error) {
+	b, err := r.bytes()
+	return string(b), err
+}
+
+func (r *requirementReader) slot() (string, error) {
+	v, err := r.uint32()
+	if err != nil {
+		return "", err
+	}
+	switch int32(v) {
+	case certSlotLeaf:
+		return "leaf", nil
+	case certSlotAnchor:
+		return "root", nil
+	}
+	return strconv.Itoa(int(int32(v))), nil
+}
+
+// requirementKeywords are quoted when used as values, so
+// they're not confused with the language syntax
+var requirementKeywords = map[string]bool{
+	"always": true, "never": true, "and": true, "or": true, "not": true,
+	"anchor": true, "apple": true, "generic": true, "certificate": true,
+	"cert": true, "trusted": true, "info": true, "entitlement": true,
+	"exists": true, "absent": true, "identifier": true, "cdhash": true,
+	"platform": true, "notarized": true, "legacy": true, "host": true,
+	"guest": true, "designated": true, "library": true, "plugin": true,
+}
+
+// formatRequirementData formats s the same way as the
+// requirement dumper in Security.framework: alphanumeric
+// strings are left unquoted (allowing dots when dotOkay is
+// true), other printable strings are quoted and anything
+// else is printed in hexadecimal
+func formatRequirementData(s string, dotOkay bool) string {
+	simple := s != "" && !(s[0] >= '0' && s[0] <= '9') && !requirementKeywords[s]
+	printable := true
+	for ii := 0; ii < len(s); ii++ {
+		c := s[ii]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || dotOkay && c == '.') {
+			simple = false
+		}
+		if c < 0x20 || c > 0x7e {
+			printable = false
+		}
+	}
+	switch {
+	case simple:
+		return s
+	case printable:
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+	}
+	return "0x" + hex.EncodeToString([]byte(s))
+}
+
+func quoteRequirementString(s string) string {
+	return formatRequirementData(s, false)
+}
+
+func quoteRequirementKey(s string) string {
+	return formatRequirementData(s, true)
+}
+
+func (r *requirementReader) match() (string, error) {
+	op, err := r.uint32()
+	if err != nil {
+		return "", err
+	}
+	switch op {
+	case matchExists:
+		return " /* exists */", nil
+	case matchAbsent:
+		return " absent", nil
+	case matchOn, matchBefore, matchAfter, matchOnOrBefore, matchOnOrAfter:
+		b, err := r.bytes()
+		if err != nil {
+			return "", err
+		}
+		if len(b) != 8 {
+			return "", errors.New("invalid date in requirement")
+		}
+		// Dates are CFAbsoluteTime, as a big endian float64
+		// number of seconds since 2001-01-01
+		secs := math.Float64frombits(binary.BigEndian.Uint64(b))
+		t := time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(secs * float64(time.Second)))
+		ops := map[uint32]string{matchOn: "=", matchBefore: "<", matchAfter: ">", matchOnOrBefore: "<=", matchOnOrAfter: ">="}
+		return fmt.Sprintf(" %s timestamp %q", ops[op], t.Format(time.RFC3339)), nil
+	}
+	s, err := r.str()
+	if err != nil {
+		return "", err
+	}
+	switch op {
+	case matchEqual:
+		return " = " + quoteRequirementString(s), nil
+	case matchContains:
+		return " ~ " + quoteRequirementString(s), nil
+	case matchBeginsWith:
+		return " = " + strconv.Quote(s+"*"), nil
+	case matchEndsWith:
+		return " = " + strconv.Quote("*"+s), nil
+	case matchLessThan:
+		return " < " + quoteRequirementString(s), nil
+	case matchGreaterThan:
+		return " > " + quoteRequirementString(s), nil
+	case matchLessEqual:
+		return " <= " + quoteRequirementString(s), nil
+	case matchGreaterEqual:
+		return " >= " + quoteRequirementString(s), nil
+	}
+	return "", fmt.Errorf("unknown match operation %d", op)
+}
+
+func oidString(b []byte) string {
+	var oid asn1.ObjectIdentifier
+	// OIDs are stored without their DER tag and length
+	der := append([]byte{0x06, byte(len(b))}, b...)
+	if _, err := asn1.Unmarshal(der, &oid); err != nil {
+		return hex.EncodeToString(b)
+	}
+	return oid.String()
+}
+
+// expr decodes an expression. The returned precedence is
+// used to decide when parenthesis are required.
+func (r *requirementReader) expr() (string, int, error) {
+	const (
+		precOr = iota
+		precAnd
+		precPrimary
+	)
+	op, err := r.uint32()
+	if err != nil {
+		return "", 0, err
+	}
+	switch op &^ opFlagMask {
+	case opFalse:
+		return "never", precPrimary, nil
+	case opTrue:
+		return "always", precPrimary, nil
+	case opIdent:
+		s, err := r.str()
+		return "identifier " + quoteRequirementString(s), precPrimary, err
+	case opAppleAnchor:
+		return "anchor apple", precPrimary, nil
+	case opAppleGenericAnchor:
+		return "anchor apple generic", precPrimary, nil
+	case opAnchorHash:
+		slot, err := r.slot()
+		if err != nil {
+			return "", 0, err
+		}
+		h, err := r.bytes()
+		return fmt.Sprintf("certificate %s = H\"%x\"", slot, h), precPrimary, err
+	case opInfoKeyValue:
+		key, err := r.str()
+		if err != nil {
+			return "", 0, err
+		}
+		value, err := r.str()
+		return fmt.Sprintf("info[%s] = %s", quoteRequirementKey(key), quoteRequirementString(value)), precPrimary, err
+	case opAnd, opOr:
+		left, lprec, err := r.expr()
+		if err != nil {
+			return "", 0, err
+		}
+		right, rprec, err := r.expr()
+		if err != nil {
+			return "", 0, err
+		}
+		prec, sep := precAnd, " and "
+		if op&^opFlagMask == opOr {
+			prec, sep = precOr, " or "
+		}
+		if lprec < prec {
+			left = "(" + left + ")"
+		}
+		if rprec < prec {
+			right = "(" + right + ")"
+		}
+		return left + sep + right, prec, nil
+	case opNot:
+		s, prec, err := r.expr()
+		if prec < precPrimary {
+			s = "(" + s + ")"
+		}
+		return "! " + s, precPrimary, err
+	case opCDHash:
+		h, err := r.bytes()
+		return fmt.Sprintf("cdhash H\"%x\"", h), precPrimary, err
+	case opInfoKeyField:
+		key, err := r.str()
+		if err != nil {
+			return "", 0, err
+		}
+		m, err := r.match()
+		return fmt.Sprintf("info[%s]%s", quoteRequirementKey(key), m), precPrimary, err
+	case opEntitlementField:
+		key, err := r.str()
+		if err != nil {
+			return "", 0, err
+		}
+		m, err := r.match()
+		return fmt.Sprintf("entitlement[%s]%s", quoteRequirementKey(key), m), precPrimary, err
+	case opCertField, opCertFieldDate:
+		slot, err := r.slot()
+		if err != nil {
+			return "", 0, err
+		}
+		key, err := r.str()
+		if err != nil {
+			return "", 0, err
+		}
+		m, err := r.match()
+		prefix := ""
+		if op&^opFlagMask == opCertFieldDate {
+			prefix = "timestamp."
+		}
+		return fmt.Sprintf("certificate %s[%s%s]%s", slot, prefix, key, m), precPrimary, err
+	case opCertGeneric, opCertPolicy:
+		slot, err := r.slot()
+		if err != nil {
+			return "", 0, err
+		}
+		oid, err := r.bytes()
+		if err != nil {
+			return "", 0, err
+		}
+		m, err := r.match()
+		kind := "field"
+		if op&^opFlagMask == opCertPolicy {
+			kind = "policy"
+		}
+		return fmt.Sprintf("certificate %s[%s.%s]%s", slot, kind, oidString(oid), m), precPrimary, err
+	case opTrustedCert:
+		slot, err := r.slot()
+		return fmt.Sprintf("certificate %s trusted", slot), precPrimary, err
+	case opTrustedCerts:
+		return "anchor trusted", precPrimary, nil
+	case opNamedAnchor:
+		s, err := r.str()
+		return "anchor apple " + s, precPrimary, err
+	case opNamedCode:
+		s, err := r.str()
+		return "(" + s + ")", precPrimary, err
+	case opPlatform:
+		v, err := r.uint32()
+		return fmt.Sprintf("platform = %d", v), precPrimary, err
+	case opNotarized:
+		return "notarized", precPrimary, nil
+	case opLegacyDevID:
+		return "legacy", precPrimary, nil
+	}
+	return "", 0, fmt.Errorf("unknown requirement opcode %#x", op)
+}
+
+// DecompileRequirement returns the text representation of
+// a requirement blob.
+func DecompileRequirement(data []byte) (string, error) {
+	payload, err := blobPayload(data, MagicRequirement)
+	if err != nil {
+		return "", err
+	}
+	if len(payload) < 4 {
+		return "", errShortBlob
+	}
+	if kind := binary.BigEndian.Uint32(payload); kind != requirementKindExpr {
+		return "", fmt.Errorf("unsupported requirement kind %d", kind)
+	}
+	r := &requirementReader{data: payload, pos: 4}
+	s, _, err := r.expr()
+	return strings.TrimSpace(s), err
+}
+
+// requirementWriter encodes a requirement expression
+type requirementWriter struct {
+	buf []byte
+}
+
+func (w *requirementWriter) uint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *requirementWriter) bytes(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.buf = append(w.buf, b...)
+	// Data is padded to 4 bytes
+	for len(w.buf)%4 != 0 {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func (w *requirementWriter) oid(oid asn1.ObjectIdentifier) {
+	der, err := asn1.Marshal(oid)
+	if err != nil {
+		panic(err)
+	}
+	// OIDs are stored without their DER tag and length
+	w.bytes(der[2:])
+}
+
+// and writes the conjunction of exprs, grouping from the left
+// like codesign does
+func (w *requirementWriter) and(exprs ...func()) {
+	for range exprs[1:] {
+		w.uint32(opAnd)
+	}
+	for _, e := range exprs {
+		e()
+	}
+}
+
+// requirementBlob wraps an encoded expression into a
+// requirement blob
+func requirementBlob(expr []byte) []byte {
+	payload := make([]byte, 4, 4+len(expr))
+	binary.BigEndian.PutUint32(payload, requirementKindExpr)
+	return makeBlob(MagicRequirement, append(payload, expr...))
+}
+
+// RequirementsSet encodes a requirements set blob containing
+// the given requirement blobs, indexed by requirement type
+func RequirementsSet(reqs map[uint32][]byte) []byte {
+	types := make([]int, 0, len(reqs))
+	for typ := range reqs {
+		types = append(types, int(typ))
+	}
+	sort.Ints(types)
+	header := make([]byte, 4+8*len(types))
+	binary.BigEndian.PutUint32(header, uint32(len(types)))
+	var body []byte
+	for ii, typ := range types {
+		offset := 8 + len(header) + len(body)
+		binary.BigEndian.PutUint32(header[4+ii*8:], uint32(typ))
+		binary.BigEndian.PutUint32(header[8+ii*8:], uint32(offset))
+		body = append(body, reqs[uint32(typ)]...)
+	}
+	return makeBlob(MagicRequirements, append(header, body...))
+}
+
+var (
+	oidAppleDeveloperIDLeaf         = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 1, 13}
+	oidAppleDeveloperIDIntermediate = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6, 2, 6}
+)
+
+// DesignatedRequirement returns the requirements set with the
+// designated requirement codesign generates for code with the
+// given identifier, signed by id.
+//
+// Developer ID certificates get the usual Apple anchored
+// requirement pinned to the team ID. Other certificates get
+// a requirement pinned to the hash of their root certificate.
+func DesignatedRequirement(identifier string, id *Identity) []byte {
+	w := &requirementWriter{}
+	ident := func() {
+		w.uint32(opIdent)
+		w.bytes([]byte(identifier))
+	}
+	if id.IsDeveloperID() {
+		w.and(ident,
+			func() { w.uint32(opAppleGenericAnchor) },
+			func() {
+				w.uint32(opCertGeneric)
+				w.uint32(1)
+				w.oid(oidAppleDeveloperIDIntermediate)
+				w.uint32(matchExists)
+			},
+			func() {
+				w.uint32(opCertGeneric)
+				w.uint32(certSlotLeaf)
+				w.oid(oidAppleDeveloperIDLeaf)
+				w.uint32(matchExists)
+			},
+			func() {
+				w.uint32(opCertField)
+				w.uint32(certSlotLeaf)
+				w.bytes([]byte("subject.OU"))
+				w.uint32(matchEqual)
+				w.bytes([]byte(id.TeamID()))
+			},
+		)
+	} else {
+		root := id.Certificate
+		slot := uint32(certSlotLeaf)
+		if n := len(id.Chain); n > 0 {
+			root = id.Chain[n-1]
+			anchor := int32(certSlotAnchor)
+			slot = uint32(anchor)
+		}
+		h := sha1.Sum(root.Raw)
+		w.and(ident, func() {
+			w.uint32(opAnchorHash)
+			w.uint32(slot)
+			w.bytes(h[:])
+		})
+	}
+	return RequirementsSet(map[uint32][]byte{
+		RequirementDesignated: requirementBlob(w.buf),
+	})
+}
@@ -0,0 +1,491 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"howett.net/plist"
+)
+
+// ResourceRule is a rule in the resource seal, describing
+// how files matching Pattern are sealed
+type ResourceRule struct {
+	Pattern  string
+	Omit     bool
+	Optional bool
+	Nested   bool
+	Weight   int
+
+	re *regexp.Regexp
+}
+
+func (r *ResourceRule) match(p string) bool {
+	if r.re == nil {
+		r.re = regexp.MustCompile(r.Pattern)
+	}
+	return r.re.MatchString(p)
+}
+
+// plistValue returns the value for the rule in the
+// CodeResources plist
+func (r *ResourceRule) plistValue() interface{} {
+	if !r.Omit && !r.Optional && !r.Nested && r.Weight == 0 {
+		return true
+	}
+	m := make(map[string]interface{})
+	if r.Omit {
+		m["omit"] = true
+	}
+	if r.Optional {
+		m["optional"] = true
+	}
+	if r.Nested {
+		m["nested"] = true
+	}
+	if r.Weight != 0 {
+		m["weight"] = float64(r.Weight)
+	}
+	return m
+}
+
+// DefaultResourceRules returns the default rules used by
+// codesign for the legacy "files" section
+func DefaultResourceRules() []*ResourceRule {
+	return []*ResourceRule{
+		{Pattern: "^Resources/"},
+		{Pattern: "^Resources/.*\\.lproj/", Optional: true, Weight: 1000},
+		{Pattern: "^Resources/.*\\.lproj/locversion.plist$", Omit: true, Weight: 1100},
+		{Pattern: "^Resources/Base\\.lproj/", Weight: 1010},
+		{Pattern: "^version.plist$"},
+	}
+}
+
+// DefaultResourceRules2 returns the default rules used by
+// codesign for the "files2" section
+func DefaultResourceRules2() []*ResourceRule {
+	return []*ResourceRule{
+		{Pattern: ".*\\.dSYM($|/)", Weight: 11},
+		{Pattern: "^(.*/)?\\.DS_Store$", Omit: true, Weight: 2000},
+		{Pattern: "^.*"},
+		{Pattern: "^Info\\.plist$", Omit: true, Weight: 20},
+		{Pattern: "^PkgInfo$", Omit: true, Weight: 20},
+		{Pattern: "^Resources/", Weight: 20},
+		{Pattern: "^Resources/.*\\.lproj/", Optional: true, Weight: 1000},
+		{Pattern: "^Resources/.*\\.lproj/locversion.plist$", Omit: true, Weight: 1100},
+		{Pattern: "^Resources/Base\\.lproj/", Weight: 1010},
+		{Pattern: "^[^/]+$", Nested: true, Weight: 10},
+		{Pattern: "^embedded\\.provisionprofile$", Weight: 20},
+		{Pattern: "^version\\.plist$", Weight: 20},
+		{Pattern: "^(Frameworks|SharedFrameworks|PlugIns|Plug-ins|XPCServices|Helpers|MacOS|Library/(Automator|Spotlight|LoginItems))/", Nested: true, Weight: 10},
+	}
+}
+
+// matchRule returns the rule with the highest weight
+// matching p, or nil if no rule matches
+func matchRule(rules []*ResourceRule, p string) *ResourceRule {
+	var best *ResourceRule
+	for _, r := range rules {
+		if r.match(p) && (best == nil || r.Weight > best.Weight) {
+			best = r
+		}
+	}
+	return best
+}
+
+// ResourceSealOptions contains the parameters for building
+// a resource seal
+type ResourceSealOptions struct {
+	// Root is the directory containing the sealed resources,
+	// like foo.app/Contents
+	Root string
+	// Exclude contains the paths relative to Root which are
+	// never sealed, like the main executable
+	Exclude []string
+	// Nested is called for the files and directories matched
+	// by a nested rule. If it returns a non-nil NestedCode,
+	// the code is sealed by its cdhash and requirement rather
+	// than by its contents.
+	Nested func(p string, info os.FileInfo) (*NestedCode, error)
+}
+
+// root returns Root with its symlinks resolved. The contents
+// of versioned frameworks are often referenced through the
+// Versions/Current symlink, which filepath.Walk doesn't follow.
+func (o *ResourceSealOptions) root() (string, error) {
+	return filepath.EvalSymlinks(o.Root)
+}
+
+// NestedCode describes signed code nested in a bundle
+type NestedCode struct {
+	// CDHash is the cdhash of the nested code, truncated
+	// to CDHashSize
+	CDHash []byte
+	// Requirement is the designated requirement of the nested
+	// code, in the requirement language
+	Requirement string
+}
+
+// NewNestedCode returns the NestedCode for code signed with sig
+func NewNestedCode(sig *Signature) (*NestedCode, error) {
+	cd := sig.CodeDirectory()
+	cdhash := cd.CDHash()
+	if len(cdhash) < CDHashSize {
+		return nil, fmt.Errorf("invalid CodeDirectory hash type %d", cd.HashType)
+	}
+	cdhash = cdhash[:CDHashSize]
+	for _, r := range sig.Requirements {
+		if r.Type == RequirementDesignated {
+			req, err := DecompileRequirement(r.Raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid designated requirement: %v", err)
+			}
+			return &NestedCode{CDHash: cdhash, Requirement: req}, nil
+		}
+	}
+	if !sig.IsAdhoc() {
+		return nil, errors.New("missing designated requirement")
+	}
+	// Ad-hoc signatures can only be identified by their cdhash
+	return &NestedCode{CDHash: cdhash, Requirement: fmt.Sprintf("cdhash H\"%x\"", cdhash)}, nil
+}
+
+// nestedCode returns the NestedCode for p if it's matched by
+// a nested rule in rules and it contains code
+func (opts *ResourceSealOptions) nestedCode(rules []*ResourceRule, rel string, p string, info os.FileInfo) (*NestedCode, error) {
+	if opts.Nested == nil || !(info.IsDir() || info.Mode().IsRegular()) {
+		return nil, nil
+	}
+	if r := matchRule(rules, rel); r == nil || !r.Nested {
+		return nil, nil
+	}
+	code, err := opts.Nested(p, info)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", rel, err)
+	}
+	return code, nil
+}
+
+func hashFile(p string) ([]byte, []byte, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	h1 := sha1.New()
+	h2 := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(h1, h2), f); err != nil {
+		return nil, nil, err
+	}
+	return h1.Sum(nil), h2.Sum(nil), nil
+}
+
+// BuildResourceSeal returns the CodeResources plist for
+// the given bundle contents
+func BuildResourceSeal(opts *ResourceSealOptions) ([]byte, error) {
+	rules := DefaultResourceRules()
+	rules2 := DefaultResourceRules2()
+	excluded := map[string]bool{"_CodeSignature": true}
+	for _, v := range opts.Exclude {
+		excluded[filepath.ToSlash(v)] = true
+	}
+	files := make(map[string]interface{})
+	files2 := make(map[string]interface{})
+	root, err := opts.root()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if excluded[rel] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		code, err := opts.nestedCode(rules2, rel, p, info)
+		if err != nil {
+			return err
+		}
+		if code != nil {
+			files2[rel] = map[string]interface{}{
+				"cdhash":      code.CDHash,
+				"requirement": code.Requirement,
+			}
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.IsDir() {
+			paths = append(paths, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	for _, rel := range paths {
+		p := filepath.Join(root, filepath.FromSlash(rel))
+		st, err := os.Lstat(p)
+		if err != nil {
+			return nil, err
+		}
+		if st.Mode()&os.ModeSymlink != 0 {
+			if r := matchRule(rules2, rel); r != nil && !r.Omit {
+				target, err := os.Readlink(p)
+				if err != nil {
+					return nil, err
+				}
+				files2[rel] = map[string]interface{}{"symlink": target}
+			}
+			continue
+		}
+		h1, h2, err := hashFile(p)
+		if err != nil {
+			return nil, err
+		}
+		if r := matchRule(rules, rel); r != nil && !r.Omit {
+			if r.Optional {
+				files[rel] = map[string]interface{}{"hash": h1, "optional": true}
+			} else {
+				files[rel] = h1
+			}
+		}
+		if r := matchRule(rules2, rel); r != nil && !r.Omit {
+			entry := map[string]interface{}{"hash": h1, "hash2": h2}
+			if r.Optional {
+				entry["optional"] = true
+			}
+			files2[rel] = entry
+		}
+	}
+	seal := map[string]interface{}{
+		"files":  files,
+		"files2": files2,
+		"rules":  rulesPlist(rules),
+		"rules2": rulesPlist(rules2),
+	}
+	return encodeXMLPlist(seal)
+}
+
+func rulesPlist(rules []*ResourceRule) map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, r := range rules {
+		m[r.Pattern] = r.plistValue()
+	}
+	return m
+}
+
+// SealDiff contains the differences between a resource seal
+// and the files in the bundle, as paths relative to the
+// bundle contents
+type SealDiff struct {
+	Modified []string
+	Added    []string
+	Removed  []string
+}
+
+// Empty returns true iff the files match the seal
+func (d *SealDiff) Empty() bool {
+	return len(d.Modified) == 0 && len(d.Added) == 0 && len(d.Removed) == 0
+}
+
+type sealPlist struct {
+	Files  map[string]interface{} `plist:"files"`
+	Files2 map[string]interface{} `plist:"files2"`
+	Rules  map[string]interface{} `plist:"rules"`
+	Rules2 map[string]interface{} `plist:"rules2"`
+}
+
+// parseRules decodes the rules in a CodeResources plist
+func parseRules(m map[string]interface{}) ([]*ResourceRule, error) {
+	var rules []*ResourceRule
+	for pattern, v := range m {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", pattern, err)
+		}
+		r := &ResourceRule{Pattern: pattern, re: re}
+		if d, ok := v.(map[string]interface{}); ok {
+			r.Omit, _ = d["omit"].(bool)
+			r.Optional, _ = d["optional"].(bool)
+			r.Nested, _ = d["nested"].(bool)
+			switch w := d["weight"].(type) {
+			case float64:
+				r.Weight = int(w)
+			case uint64:
+				r.Weight = int(w)
+			case int64:
+				r.Weight = int(w)
+			}
+		}
+		rules = append(rules, r)
+	}
+	// Make matching deterministic when weights are equal
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Pattern < rules[j].Pattern })
+	return rules, nil
+}
+
+// sealEntry is a decoded entry in the files2 (or files)
+// dictionary of a resource seal
+type sealEntry struct {
+	Hash     []byte
+	Hash2    []byte
+	Symlink  string
+	Optional bool
+	CDHash   []byte
+}
+
+func parseSealEntry(v interface{}) *sealEntry {
+	switch x := v.(type) {
+	case []byte:
+		return &sealEntry{Hash: x}
+	case map[string]interface{}:
+		e := &sealEntry{}
+		e.Hash, _ = x["hash"].([]byte)
+		e.Hash2, _ = x["hash2"].([]byte)
+		e.Symlink, _ = x["symlink"].(string)
+		e.Optional, _ = x["optional"].(bool)
+		e.CDHash, _ = x["cdhash"].([]byte)
+		return e
+	}
+	return nil
+}
+
+// VerifyResourceSeal compares the seal with the files in the
+// bundle contents at opts.Root, returning the files which
+// were modified, added or removed after sealing them
+func VerifyResourceSeal(seal []byte, opts *ResourceSealOptions) (*SealDiff, error) {
+	var sp sealPlist
+	if _, err := plist.Unmarshal(seal, &sp); err != nil {
+		return nil, fmt.Errorf("invalid resource seal: %v", err)
+	}
+	files, rulesMap := sp.Files2, sp.Rules2
+	if rulesMap == nil {
+		// Seals made before 10.9 only have version 1 rules
+		files, rulesMap = sp.Files, sp.Rules
+	}
+	rules, err := parseRules(rulesMap)
+	if err != nil {
+		return nil, err
+	}
+	excluded := map[string]bool{"_CodeSignature": true}
+	for _, v := range opts.Exclude {
+		excluded[filepath.ToSlash(v)] = true
+	}
+	root, err := opts.root()
+	if err != nil {
+		return nil, err
+	}
+	diff := &SealDiff{}
+	seen := make(map[string]bool)
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if excluded[rel] {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		code, err := opts.nestedCode(rules, rel, p, info)
+		if err != nil {
+			return err
+		}
+		skip := error(nil)
+		if code != nil && info.IsDir() {
+			skip = filepath.SkipDir
+		}
+		if info.IsDir() && code == nil {
+			return nil
+		}
+		if r := matchRule(rules, rel); r == nil || r.Omit {
+			return nil
+		}
+		v, found := files[rel]
+		if !found {
+			diff.Added = append(diff.Added, rel)
+			return skip
+		}
+		seen[rel] = true
+		entry := parseSealEntry(v)
+		if entry == nil {
+			diff.Modified = append(diff.Modified, rel)
+			return skip
+		}
+		if code != nil || entry.CDHash != nil {
+			if code == nil || !bytes.Equal(code.CDHash, entry.CDHash) {
+				diff.Modified = append(diff.Modified, rel)
+			}
+			return skip
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if target != entry.Symlink {
+				diff.Modified = append(diff.Modified, rel)
+			}
+			return nil
+		}
+		if entry.Symlink != "" {
+			diff.Modified = append(diff.Modified, rel)
+			return nil
+		}
+		h1, h2, err := hashFile(p)
+		if err != nil {
+			return err
+		}
+		if (entry.Hash2 != nil && !bytes.Equal(entry.Hash2, h2)) ||
+			(entry.Hash2 == nil && !bytes.Equal(entry.Hash, h1)) {
+			diff.Modified = append(diff.Modified, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for rel, v := range files {
+		if seen[rel] {
+			continue
+		}
+		if entry := parseSealEntry(v); entry != nil && entry.Optional {
+			continue
+		}
+		diff.Removed = append(diff.Removed, rel)
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Modified)
+	sort.Strings(diff.Removed)
+	return diff, nil
+}
@@ -0,0 +1,164 @@
+package codesign
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// sampleContents is a bundle with every kind of entry in a
+// resource seal. Its _CodeSignature/CodeResources was written
+// with the formatting and rules used by codesign, with hashes
+// computed independently of this package.
+var sampleContents = filepath.Join("testdata", "Sample.app", "Contents")
+
+// sampleNested seals Frameworks/Foo.framework as nested code
+// with a fixed cdhash. Other files in nested locations, like
+// the shell script in MacOS, are sealed as resources.
+func sampleNested(p string, info os.FileInfo) (*NestedCode, error) {
+	if filepath.Base(p) != "Foo.framework" {
+		return nil, nil
+	}
+	cdhash := make([]byte, CDHashSize)
+	for ii := range cdhash {
+		cdhash[ii] = byte(ii + 1)
+	}
+	return &NestedCode{
+		CDHash:      cdhash,
+		Requirement: `identifier "com.example.Foo" and anchor apple generic and certificate leaf[subject.OU] = "ABCDE12345"`,
+	}, nil
+}
+
+func sampleSealOptions(root string) *ResourceSealOptions {
+	return &ResourceSealOptions{
+		Root:    root,
+		Exclude: []string{"MacOS/Sample"},
+		Nested:  sampleNested,
+	}
+}
+
+func TestBuildResourceSeal(t *testing.T) {
+	want, err := ioutil.ReadFile(filepath.Join(sampleContents, "_CodeSignature", "CodeResources"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := BuildResourceSeal(sampleSealOptions(sampleContents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		gotLines := strings.Split(string(got), "\n")
+		wantLines := strings.Split(string(want), "\n")
+		for ii := 0; ii < len(gotLines) && ii < len(wantLines); ii++ {
+			if gotLines[ii] != wantLines[ii] {
+				t.Fatalf("seal differs at line %d:\n got: %q\nwant: %q", ii+1, gotLines[ii], wantLines[ii])
+			}
+		}
+		t.Fatalf("seal has %d lines, want %d", len(gotLines), len(wantLines))
+	}
+}
+
+func TestVerifyResourceSeal(t *testing.T) {
+	seal, err := ioutil.ReadFile(filepath.Join(sampleContents, "_CodeSignature", "CodeResources"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := VerifyResourceSeal(seal, sampleSealOptions(sampleContents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() {
+		t.Errorf("unmodified bundle differs from its seal: %+v", diff)
+	}
+
+	// Modify a copy of the bundle
+	dir, err := ioutil.TempDir("", "macapptool-seal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(rel string, data string) {
+		p := filepath.Join(dir, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Resources/Sample.icns", "modified")
+	write("Resources/Base.lproj/Main.nib", "nib placeholder\n")
+	write("Resources/new.txt", "added")
+	// Omitted files can change freely
+	write("Info.plist", "<plist/>")
+	write(".DS_Store", "changed")
+	write("Resources/en.lproj/locversion.plist", "<plist/>")
+	if err := os.MkdirAll(filepath.Join(dir, "Frameworks", "Foo.framework"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	diff, err = VerifyResourceSeal(seal, sampleSealOptions(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(what string, got []string, want string) {
+		if strings.Join(got, ",") != want {
+			t.Errorf("%s = %v, want %s", what, got, want)
+		}
+	}
+	check("modified", diff.Modified, "Resources/Sample.icns")
+	check("added", diff.Added, "Resources/new.txt")
+	// Optional files can be removed
+	check("removed", diff.Removed, "MacOS/helper.sh,SharedSupport/Localizable.strings,version.plist")
+}
+
+func TestVerifyResourceSealSymlinkRoot(t *testing.T) {
+	// Framework contents are referenced through the
+	// Versions/Current symlink
+	dir, err := ioutil.TempDir("", "macapptool-seal-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	version := filepath.Join(dir, "Versions", "A")
+	if err := os.MkdirAll(filepath.Join(version, "Resources"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := filepath.Join(version, "Resources", "data.txt")
+	if err := ioutil.WriteFile(data, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("A", filepath.Join(dir, "Versions", "Current")); err != nil {
+		t.Fatal(err)
+	}
+	opts := &ResourceSealOptions{Root: version}
+	seal, err := BuildResourceSeal(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(seal, []byte("<key>Resources/data.txt</key>")) {
+		t.Fatal("data.txt not sealed")
+	}
+	opts.Root = filepath.Join(dir, "Versions", "Current")
+	if current, err := BuildResourceSeal(opts); err != nil || !bytes.Equal(current, seal) {
+		t.Errorf("seal built from Versions/Current differs, %v", err)
+	}
+	if diff, err := VerifyResourceSeal(seal, opts); err != nil || !diff.Empty() {
+		t.Fatalf("diff = %+v, %v", diff, err)
+	}
+	if err := ioutil.WriteFile(data, []byte("modified"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(version, "Resources", "evil.txt"), []byte("added"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	diff, err := VerifyResourceSeal(seal, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(diff.Modified, ",") != "Resources/data.txt" || strings.Join(diff.Added, ",") != "Resources/evil.txt" {
+		t.Errorf("modified = %v, added = %v", diff.Modified, diff.Added)
+	}
+}
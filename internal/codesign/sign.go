@@ -0,0 +1,311 @@
+package codesign
+
+import (
+	"errors"
+	"fmt"
+
+	"macapptool/internal/macho"
+)
+
+// SignOptions contains the parameters for signing a Mach-O file
+type SignOptions struct {
+	Identifier string
+	// TeamID defaults to the one in the Identity certificate
+	TeamID string
+	// Identity is used for signing. If nil, an ad-hoc
+	// signature is created.
+	Identity *Identity
+	// Flags contains the CodeDirectory flags. FlagAdhoc is
+	// added automatically for ad-hoc signatures.
+	Flags uint32
+	// HashTypes contains the hash types for the CodeDirectories.
+	// The first one is the primary CodeDirectory. Defaults to
+	// DefaultHashTypes() for each slice.
+	HashTypes []uint8
+	// InfoPlist contains the Info.plist data, for bundle
+	// main executables
+	InfoPlist []byte
+	// CodeResources contains the resource seal, for bundle
+	// main executables
+	CodeResources []byte
+	// Requirements contains the requirements set blob. If
+	// empty, the designated requirement for the Identity is
+	// used, or an empty requirements set for ad-hoc signatures.
+	Requirements []byte
+	// Entitlements contains the XML entitlements plist
+	Entitlements []byte
+	// RuntimeVersion is the hardened runtime version, used
+	// when Flags includes FlagRuntime. Defaults to the SDK
+	// version in the file.
+	RuntimeVersion uint32
+	// TimeStamp returns an RFC 3161 timestamp token for the
+	// CMS signature value. If nil, signatures are not
+	// timestamped. Ignored for ad-hoc signatures.
+	TimeStamp func(signature []byte) ([]byte, error)
+}
+
+type signatureBlobs struct {
+	specialSlots map[int][]byte
+	blobs        []*Blob
+	execSegFlags uint64
+	runtime      uint32
+}
+
+// DefaultHashTypes returns the CodeDirectory hash types codesign
+// uses for f. Systems older than macOS 10.11.4, iOS 11 and
+// their counterparts only understand SHA-1, so files that can
+// run on them get a primary SHA-1 CodeDirectory and an
+// alternate SHA-256 one.
+func DefaultHashTypes(f *macho.File) []uint8 {
+	sha1Only := true
+	if bv := f.BuildVersion(); bv != nil {
+		switch bv.Platform {
+		case macho.PlatformMacOS:
+			sha1Only = bv.MinOS < macho.MakeVersion(10, 11, 4)
+		case macho.PlatformIOS, macho.PlatformTvOS:
+			sha1Only = bv.MinOS < macho.MakeVersion(11, 0, 0)
+		case macho.PlatformWatchOS:
+			sha1Only = bv.MinOS < macho.MakeVersion(4, 0, 0)
+		default:
+			// Newer platforms always support SHA-256
+			sha1Only = false
+		}
+	}
+	if sha1Only {
+		return []uint8{HashTypeSHA1, HashTypeSHA256}
+	}
+	return []uint8{HashTypeSHA256}
+}
+
+func (opts *SignOptions) hashTypes(f *macho.File) []uint8 {
+	if len(opts.HashTypes) == 0 {
+		return DefaultHashTypes(f)
+	}
+	return opts.HashTypes
+}
+
+// SliceSignature describes the signature added to
+// a slice by Sign
+type SliceSignature struct {
+	Arch string
+	// Offset, Size and Align describe the position of
+	// the slice in a universal file. They're zero for
+	// thin files.
+	Offset uint64
+	Size   uint64
+	Align  uint32
+	// HashTypes contains the hash type for each
+	// CodeDirectory, starting with the primary one
+	HashTypes []uint8
+	// CDHash is the hash of the primary CodeDirectory,
+	// truncated to CDHashSize
+	CDHash []byte
+}
+
+func (opts *SignOptions) prepare(f *macho.File) (*signatureBlobs, error) {
+	sb := &signatureBlobs{specialSlots: make(map[int][]byte)}
+	reqs := opts.Requirements
+	if len(reqs) == 0 {
+		if opts.Identity != nil {
+			reqs = DesignatedRequirement(opts.Identifier, opts.Identity)
+		} else {
+			reqs = EmptyRequirements()
+		}
+	}
+	sb.specialSlots[SlotRequirements] = reqs
+	sb.blobs = append(sb.blobs, &Blob{Type: SlotRequirements, Data: reqs})
+	if opts.InfoPlist != nil {
+		sb.specialSlots[SlotInfo] = opts.InfoPlist
+	}
+	if opts.CodeResources != nil {
+		sb.specialSlots[SlotResourceDir] = opts.CodeResources
+	}
+	if len(opts.Entitlements) > 0 {
+		ents, err := DecodeEntitlements(opts.Entitlements)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entitlements: %v", err)
+		}
+		entsBlob := EntitlementsBlob(opts.Entitlements)
+		sb.specialSlots[SlotEntitlements] = entsBlob
+		sb.blobs = append(sb.blobs, &Blob{Type: SlotEntitlements, Data: entsBlob})
+		derBlob, err := EntitlementsDERBlob(opts.Entitlements)
+		if err != nil {
+			return nil, err
+		}
+		sb.specialSlots[SlotEntitlementsDER] = derBlob
+		sb.blobs = append(sb.blobs, &Blob{Type: SlotEntitlementsDER, Data: derBlob})
+		if v, ok := ents["get-task-allow"].(bool); ok && v {
+			sb.execSegFlags |= ExecSegAllowUnsigned
+		}
+	}
+	if f.Type == macho.TypeExecute {
+		sb.execSegFlags |= ExecSegMainBinary
+	}
+	if opts.Flags&FlagRuntime != 0 {
+		// The hardened runtime version is the SDK version
+		sb.runtime = opts.RuntimeVersion
+		if bv := f.BuildVersion(); bv != nil && sb.runtime == 0 {
+			sb.runtime = uint32(bv.SDK)
+		}
+	}
+	return sb, nil
+}
+
+func (opts *SignOptions) codeDirectoryParams(f *macho.File, sb *signatureBlobs, hashType uint8) *CodeDirectoryParams {
+	params := &CodeDirectoryParams{
+		HashType:     hashType,
+		Identifier:   opts.Identifier,
+		TeamID:       opts.TeamID,
+		Flags:        opts.Flags,
+		ExecSegFlags: sb.execSegFlags,
+		Runtime:      sb.runtime,
+		SpecialSlots: sb.specialSlots,
+	}
+	if opts.Identity != nil {
+		if params.TeamID == "" {
+			params.TeamID = opts.Identity.TeamID()
+		}
+	} else {
+		params.Flags |= FlagAdhoc
+	}
+	if text := f.Segment("__TEXT"); text != nil {
+		params.ExecSegBase = text.Offset
+		params.ExecSegLimit = text.Filesz
+	}
+	return params
+}
+
+// SignFile signs a thin Mach-O file, returning the data
+// for the signed file.
+func SignFile(f *macho.File, opts *SignOptions) ([]byte, error) {
+	data, _, err := signFile(f, opts)
+	return data, err
+}
+
+func signFile(f *macho.File, opts *SignOptions) ([]byte, *SliceSignature, error) {
+	if opts.Identifier == "" {
+		return nil, nil, errors.New("missing identifier")
+	}
+	sb, err := opts.prepare(f)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Allocating an empty signature lets us know the code
+	// limit, which doesn't depend on the signature size
+	code, err := f.AllocateSignature(0)
+	if err != nil {
+		return nil, nil, err
+	}
+	codeLimit := uint64(len(code))
+	hashTypes := opts.hashTypes(f)
+	var paramsList []*CodeDirectoryParams
+	size := 12 + 8
+	for _, ht := range hashTypes {
+		params := opts.codeDirectoryParams(f, sb, ht)
+		cdSize, err := CodeDirectorySize(params, codeLimit)
+		if err != nil {
+			return nil, nil, err
+		}
+		size += 8 + cdSize
+		paramsList = append(paramsList, params)
+	}
+	for _, b := range sb.blobs {
+		size += 8 + len(b.Data)
+	}
+	// Ad-hoc signatures contain an empty CMS blob
+	if opts.Identity != nil {
+		size += 8 + len(wrapperBlob(make([]byte, opts.Identity.signatureSizeEstimate(opts.TimeStamp != nil))))
+	} else {
+		size += 8 + len(wrapperBlob(nil))
+	}
+	size = (size + 15) &^ 15
+
+	code, err = f.AllocateSignature(uint32(size))
+	if err != nil {
+		return nil, nil, err
+	}
+	superBlob := &SuperBlob{Magic: MagicEmbeddedSignature}
+	var cds [][]byte
+	for ii, params := range paramsList {
+		params.Code = code
+		cd, err := BuildCodeDirectory(params)
+		if err != nil {
+			return nil, nil, err
+		}
+		cds = append(cds, cd)
+		typ := uint32(SlotCodeDirectory)
+		if ii > 0 {
+			typ = SlotAlternateCodeDirectory + uint32(ii-1)
+		}
+		b := &Blob{Type: typ, Data: cd}
+		if ii == 0 {
+			superBlob.Blobs = append(superBlob.Blobs, b)
+			superBlob.Blobs = append(superBlob.Blobs, sb.blobs...)
+		} else {
+			superBlob.Blobs = append(superBlob.Blobs, b)
+		}
+	}
+	var signature []byte
+	if opts.Identity != nil {
+		if signature, err = opts.Identity.cmsSignature(cds, hashTypes, opts.TimeStamp); err != nil {
+			return nil, nil, fmt.Errorf("error creating CMS signature: %v", err)
+		}
+	}
+	superBlob.Blobs = append(superBlob.Blobs, &Blob{Type: SlotSignature, Data: wrapperBlob(signature)})
+	sig := superBlob.Bytes()
+	if len(sig) > size {
+		return nil, nil, fmt.Errorf("signature size %d exceeds allocated size %d", len(sig), size)
+	}
+	data := make([]byte, len(code)+size)
+	copy(data, code)
+	copy(data[len(code):], sig)
+	cdhash, err := Digest(hashTypes[0], cds[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, &SliceSignature{
+		Arch:      f.Arch(),
+		Size:      uint64(len(data)),
+		HashTypes: hashTypes,
+		CDHash:    cdhash[:CDHashSize],
+	}, nil
+}
+
+// Sign signs a thin or universal Mach-O file, returning the
+// data for the signed file and the signature of each slice.
+// Slices in universal files are signed independently and
+// keep their alignment.
+func Sign(b *macho.Binary, opts *SignOptions) ([]byte, []*SliceSignature, error) {
+	if !b.Fat {
+		data, sig, err := signFile(b.Slices[0].File, opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		return data, []*SliceSignature{sig}, nil
+	}
+	var slices []macho.SliceData
+	var sigs []*SliceSignature
+	for _, s := range b.Slices {
+		data, sig, err := signFile(s.File, opts)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", s.Arch(), err)
+		}
+		slices = append(slices, macho.SliceData{
+			Cpu:    s.File.Cpu,
+			SubCpu: s.File.SubCpu,
+			Align:  s.Align,
+			Data:   data,
+		})
+		sigs = append(sigs, sig)
+	}
+	data := macho.BuildUniversal(slices, b.Fat64)
+	signed, err := macho.Parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	for ii, s := range signed.Slices {
+		sigs[ii].Offset = s.Offset
+		sigs[ii].Align = s.Align
+	}
+	return data, sigs, nil
+}
@@ -0,0 +1,111 @@
+package codesign
+
+import (
+	"fmt"
+)
+
+// Signature is a decoded embedded code signature
+type Signature struct {
+	// CodeDirectories contains the primary CodeDirectory
+	// followed by any alternate ones
+	CodeDirectories []*CodeDirectory
+	Requirements    []*Requirement
+	// Entitlements contains the XML entitlements plist
+	Entitlements []byte
+	// EntitlementsDER contains the raw DER entitlements
+	// blob, including its header
+	EntitlementsDER []byte
+	// CMS contains the CMS SignedData, empty for ad-hoc
+	// signatures
+	CMS []byte
+	// SuperBlob contains all the blobs in the signature
+	SuperBlob *SuperBlob
+}
+
+// CodeDirectory returns the primary CodeDirectory
+func (s *Signature) CodeDirectory() *CodeDirectory {
+	if len(s.CodeDirectories) == 0 {
+		return nil
+	}
+	return s.CodeDirectories[0]
+}
+
+// BestCodeDirectory returns the CodeDirectory using the
+// strongest hash type
+func (s *Signature) BestCodeDirectory() *CodeDirectory {
+	var best *CodeDirectory
+	for _, cd := range s.CodeDirectories {
+		if best == nil || hashTypeStrength(cd.HashType) > hashTypeStrength(best.HashType) {
+			best = cd
+		}
+	}
+	return best
+}
+
+func hashTypeStrength(hashType uint8) int {
+	switch hashType {
+	case HashTypeSHA1:
+		return 1
+	case HashTypeSHA256Truncated:
+		return 2
+	case HashTypeSHA256:
+		return 3
+	case HashTypeSHA384:
+		return 4
+	}
+	return 0
+}
+
+// IsAdhoc returns true if the signature has no CMS signer
+func (s *Signature) IsAdhoc() bool {
+	cd := s.CodeDirectory()
+	return cd != nil && cd.Flags&FlagAdhoc != 0
+}
+
+// ParseSignature parses an embedded signature, as stored
+// in LC_CODE_SIGNATURE.
+func ParseSignature(data []byte) (*Signature, error) {
+	sb, err := ParseSuperBlob(data)
+	if err != nil {
+		return nil, err
+	}
+	if sb.Magic != MagicEmbeddedSignature && sb.Magic != MagicDetachedSignature {
+		return nil, fmt.Errorf("invalid signature magic %#x", sb.Magic)
+	}
+	sig := &Signature{SuperBlob: sb}
+	for _, b := range sb.Blobs {
+		switch {
+		case b.Type == SlotCodeDirectory ||
+			(b.Type >= SlotAlternateCodeDirectory && b.Type < SlotAlternateCodeDirectory+SlotAlternateCodeDirectoryLimit):
+			cd, err := ParseCodeDirectory(b.Data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CodeDirectory: %v", err)
+			}
+			sig.CodeDirectories = append(sig.CodeDirectories, cd)
+		case b.Type == SlotRequirements:
+			reqs, err := ParseRequirements(b.Data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid requirements: %v", err)
+			}
+			sig.Requirements = reqs
+		case b.Type == SlotEntitlements:
+			ents, err := ParseEntitlements(b.Data)
+			if err != nil {
+				return nil, fmt.Errorf("invalid entitlements: %v", err)
+			}
+			sig.Entitlements = ents
+		case b.Type == SlotEntitlementsDER:
+			sig.EntitlementsDER = b.Data
+		case b.Type == SlotSignature:
+			cms, err := blobPayload(b.Data, MagicBlobWrapper)
+			if err != nil {
+				return nil, fmt.Errorf("invalid CMS blob: %v", err)
+			}
+			sig.CMS = cms
+		}
+	}
+	if len(sig.CodeDirectories) == 0 {
+		return nil, fmt.Errorf("signature has no CodeDirectory")
+	}
+	return sig, nil
+}
@@ -0,0 +1,200 @@
+package codesign
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"time"
+
+	"macapptool/internal/cms"
+)
+
+// oidAppleCertificateExtensions is the prefix of the
+// extensions Apple adds to its certificates. Some of them
+// are marked as critical, so they must be accepted explicitly
+// for crypto/x509 to validate the chain.
+var oidAppleCertificateExtensions = asn1.ObjectIdentifier{1, 2, 840, 113635, 100, 6}
+
+// TrustOptions configures the validation of the certificate
+// chains in signatures
+type TrustOptions struct {
+	// Roots contains additional trusted root certificates.
+	// The bundled Apple root certificates are always trusted.
+	Roots []*x509.Certificate
+	// Now is the time used to validate signatures without
+	// a secure timestamp. If zero, time.Now() is used.
+	Now time.Time
+}
+
+// TrustReport is the result of validating the certificates
+// in a signature
+type TrustReport struct {
+	// Chain contains the validated chain, from the signing
+	// certificate to the root
+	Chain       []*x509.Certificate
+	DeveloperID bool
+	SigningTime *time.Time
+	// Timestamp is the time in the secure timestamp, if any
+	Timestamp *time.Time
+	Problems  []string
+	Warnings  []string
+}
+
+func (r *TrustReport) problem(format string, args ...interface{}) {
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+}
+
+func (r *TrustReport) warning(format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, fmt.Sprintf(format, args...))
+}
+
+// isSelfSigned returns true if cert is a root certificate. The
+// signature isn't checked, since the Apple Root CA is signed
+// with SHA-1, which crypto/x509 rejects.
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject)
+}
+
+func hasExtension(cert *x509.Certificate, oid asn1.ObjectIdentifier) bool {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptAppleExtensions returns a copy of cert with the
+// critical Apple extensions marked as handled
+func acceptAppleExtensions(cert *x509.Certificate) *x509.Certificate {
+	var unhandled []asn1.ObjectIdentifier
+	for _, oid := range cert.UnhandledCriticalExtensions {
+		if len(oid) > len(oidAppleCertificateExtensions) && oid[:len(oidAppleCertificateExtensions)].Equal(oidAppleCertificateExtensions) {
+			continue
+		}
+		unhandled = append(unhandled, oid)
+	}
+	c := *cert
+	c.UnhandledCriticalExtensions = unhandled
+	return &c
+}
+
+// verifyChain validates the chain for leaf at the given time,
+// using the certificates included in the signature as
+// intermediates. Roots must be either one of the bundled
+// Apple certificates or one of the additional roots in opts,
+// the ones in the signature are never trusted.
+func verifyChain(leaf *x509.Certificate, certs []*x509.Certificate, opts *TrustOptions, at time.Time, usage x509.ExtKeyUsage) ([]*x509.Certificate, error) {
+	roots := x509.NewCertPool()
+	intermediates := x509.NewCertPool()
+	for _, c := range appleCertificates {
+		if isSelfSigned(c) {
+			roots.AddCert(acceptAppleExtensions(c))
+		} else {
+			intermediates.AddCert(acceptAppleExtensions(c))
+		}
+	}
+	for _, c := range opts.Roots {
+		roots.AddCert(acceptAppleExtensions(c))
+	}
+	for _, c := range certs {
+		if c != leaf {
+			intermediates.AddCert(acceptAppleExtensions(c))
+		}
+	}
+	chains, err := acceptAppleExtensions(leaf).Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chains[0], nil
+}
+
+// withinValidity returns an error if t is outside of the
+// validity period of cert
+func withinValidity(cert *x509.Certificate, t time.Time) error {
+	if t.Before(cert.NotBefore) || t.After(cert.NotAfter) {
+		return fmt.Errorf("%s is outside of the validity of %q (%s to %s)", t.UTC().Format(time.RFC3339),
+			cert.Subject.CommonName, cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// CheckTrust validates the CMS signature in data, which must
+// not be ad-hoc: the signer chain must lead to a trusted root,
+// Developer ID certificates must be issued by a Developer ID
+// CA and the signing time and secure timestamp must be within
+// the validity of the signing certificate. Signatures are
+// validated at the time of their secure timestamp, if they
+// have one, like Gatekeeper does.
+func CheckTrust(data []byte, opts *TrustOptions) *TrustReport {
+	if opts == nil {
+		opts = &TrustOptions{}
+	}
+	report := &TrustReport{}
+	sd, err := cms.Parse(data)
+	if err != nil {
+		report.problem("invalid CMS signature: %v", err)
+		return report
+	}
+	if len(sd.Signers) == 0 {
+		report.problem("CMS signature has no signers")
+		return report
+	}
+	si := sd.Signers[0]
+	leaf := sd.Certificate(si)
+	if leaf == nil {
+		report.problem("signer certificate not found")
+		return report
+	}
+	at := opts.Now
+	if at.IsZero() {
+		at = time.Now()
+	}
+	if t, ok := si.SigningTime(); ok {
+		report.SigningTime = &t
+		if err := withinValidity(leaf, t); err != nil {
+			report.problem("signing time %v", err)
+		}
+	}
+	if token := si.TimeStampToken(); token != nil {
+		ts, err := cms.ParseTimeStamp(token)
+		if err == nil {
+			err = ts.Verify(si.Signature)
+		}
+		if err != nil {
+			report.problem("invalid secure timestamp: %v", err)
+		} else {
+			report.Timestamp = &ts.Time
+			at = ts.Time
+			if err := withinValidity(leaf, ts.Time); err != nil {
+				report.problem("secure timestamp %v", err)
+			}
+			if ts.Certificate == nil {
+				report.problem("secure timestamp doesn't include the TSA certificate")
+			} else if _, err := verifyChain(ts.Certificate, ts.SignedData.Certificates, opts, ts.Time, x509.ExtKeyUsageTimeStamping); err != nil {
+				report.problem("untrusted timestamp authority %q: %v", ts.Certificate.Subject.CommonName, err)
+			}
+		}
+	} else {
+		report.warning("signature has no secure timestamp")
+	}
+	chain, err := verifyChain(leaf, sd.Certificates, opts, at, x509.ExtKeyUsageCodeSigning)
+	if err != nil {
+		report.problem("untrusted signing certificate %q: %v", leaf.Subject.CommonName, err)
+		return report
+	}
+	report.Chain = chain
+	report.DeveloperID = hasExtension(leaf, oidAppleDeveloperIDLeaf)
+	if !report.DeveloperID {
+		report.warning("%q is not a Developer ID Application certificate", leaf.Subject.CommonName)
+	} else if len(chain) < 2 || !hasExtension(chain[1], oidAppleDeveloperIDIntermediate) {
+		report.problem("Developer ID certificate %q is not issued by a Developer ID CA", leaf.Subject.CommonName)
+	}
+	return report
+}
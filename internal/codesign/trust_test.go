@@ -0,0 +1,233 @@
+package codesign
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+	"time"
+
+	"macapptool/internal/cms"
+	"macapptool/internal/testpki"
+)
+
+func TestVerifyChain(t *testing.T) {
+	pki := testpki.NewPKI(t)
+	leaf := pki.Issue(t, "Test Signer", nil)
+	root, inter := pki.Root, pki.Intermediate
+	certs := []*x509.Certificate{leaf.Cert, inter.Cert, root.Cert}
+	now := time.Now()
+
+	// Roots included in the signature are not trusted
+	if _, err := verifyChain(leaf.Cert, certs, &TrustOptions{}, now, x509.ExtKeyUsageCodeSigning); err == nil {
+		t.Error("chain validated with the root from the signature")
+	}
+	chain, err := verifyChain(leaf.Cert, certs, &TrustOptions{Roots: []*x509.Certificate{root.Cert}}, now, x509.ExtKeyUsageCodeSigning)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 3 || !chain[2].Equal(root.Cert) {
+		t.Errorf("chain has %d certificates", len(chain))
+	}
+	if _, err := verifyChain(leaf.Cert, certs[:1], &TrustOptions{Roots: []*x509.Certificate{root.Cert}}, now, x509.ExtKeyUsageCodeSigning); err == nil {
+		t.Error("chain validated without the intermediate")
+	}
+	if _, err := verifyChain(leaf.Cert, certs, &TrustOptions{Roots: []*x509.Certificate{root.Cert}}, now.Add(2*time.Hour), x509.ExtKeyUsageCodeSigning); err == nil {
+		t.Error("chain validated after expiring")
+	}
+}
+
+// withAppleCertificates replaces the bundled Apple certificates
+// with certs, returning a function which restores them
+func withAppleCertificates(certs ...*x509.Certificate) func() {
+	prev := appleCertificates
+	appleCertificates = certs
+	return func() { appleCertificates = prev }
+}
+
+// appleExtension returns a critical Apple marker extension,
+// which like the ones in Apple certificates contains a NULL
+func appleExtension(oid []int) pkix.Extension {
+	return pkix.Extension{Id: oid, Critical: true, Value: []byte{0x05, 0x00}}
+}
+
+// developerIDPKI is a root with a Developer ID CA and a CA
+// without the Developer ID marker
+type developerIDPKI struct {
+	Root        *testpki.Cert
+	DeveloperID *testpki.Cert
+	Other       *testpki.Cert
+}
+
+func newDeveloperIDPKI(t *testing.T) *developerIDPKI {
+	// The CAs outlive the signing certificates
+	ca := func(ext ...pkix.Extension) *testpki.Options {
+		now := time.Now()
+		return &testpki.Options{CA: true, NotBefore: now.AddDate(-1, 0, 0), NotAfter: now.AddDate(1, 0, 0), Extensions: ext}
+	}
+	root := testpki.New(t, "Test Root CA", nil, ca())
+	return &developerIDPKI{
+		Root:        root,
+		DeveloperID: testpki.New(t, "Test Developer ID Certification Authority", root, ca(appleExtension(oidAppleDeveloperIDIntermediate))),
+		Other:       testpki.New(t, "Test Other CA", root, ca()),
+	}
+}
+
+func (p *developerIDPKI) developerID(t *testing.T, issuer *testpki.Cert, opts *testpki.Options) *testpki.Cert {
+	if opts == nil {
+		opts = &testpki.Options{}
+	}
+	opts.OrganizationalUnit = "ABCDE12345"
+	opts.Extensions = append(opts.Extensions, appleExtension(oidAppleDeveloperIDLeaf))
+	return testpki.New(t, "Developer ID Application: Test (ABCDE12345)", issuer, opts)
+}
+
+// testSignature returns a CMS signature by leaf, including
+// certs, with the given signing time
+func testSignature(t *testing.T, leaf *testpki.Cert, signingTime time.Time, certs ...*testpki.Cert) []byte {
+	opts := &cms.SignOptions{Key: leaf.Key, Certificate: leaf.Cert, SigningTime: signingTime}
+	for _, c := range certs {
+		opts.Certificates = append(opts.Certificates, c.Cert)
+	}
+	data, err := cms.SignDetached([]byte("CodeDirectory"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCheckTrustBundledIntermediate(t *testing.T) {
+	pki := newDeveloperIDPKI(t)
+	defer withAppleCertificates(pki.Root.Cert, pki.DeveloperID.Cert)()
+	leaf := pki.developerID(t, pki.DeveloperID, nil)
+	// The signature only includes the signing certificate, the
+	// intermediate comes from the bundled certificates
+	report := CheckTrust(testSignature(t, leaf, time.Now()), nil)
+	if len(report.Problems) != 0 {
+		t.Fatalf("problems = %v", report.Problems)
+	}
+	if !report.DeveloperID || len(report.Chain) != 3 || !report.Chain[1].Equal(pki.DeveloperID.Cert) {
+		t.Errorf("Developer ID = %v, chain has %d certificates", report.DeveloperID, len(report.Chain))
+	}
+	if report.SigningTime == nil || report.Timestamp != nil {
+		t.Errorf("signing time = %v, timestamp = %v", report.SigningTime, report.Timestamp)
+	}
+	if strings.Join(report.Warnings, ",") != "signature has no secure timestamp" {
+		t.Errorf("warnings = %v", report.Warnings)
+	}
+
+	// Without the bundled intermediate, the chain is incomplete
+	defer withAppleCertificates(pki.Root.Cert)()
+	report = CheckTrust(testSignature(t, leaf, time.Now()), nil)
+	if len(report.Problems) != 1 || !strings.Contains(report.Problems[0], "untrusted signing certificate") {
+		t.Errorf("problems = %v, want untrusted signing certificate", report.Problems)
+	}
+}
+
+func TestCheckTrust(t *testing.T) {
+	pki := newDeveloperIDPKI(t)
+	defer withAppleCertificates(pki.Root.Cert)()
+	now := time.Now()
+	expiring := pki.developerID(t, pki.DeveloperID, &testpki.Options{
+		NotBefore: now.Add(-48 * time.Hour),
+		NotAfter:  now.Add(-24 * time.Hour),
+	})
+	tests := []struct {
+		name        string
+		signature   func(t *testing.T) []byte
+		opts        *TrustOptions
+		developerID bool
+		problems    []string
+		warnings    []string
+	}{
+		{
+			name: "developer id",
+			signature: func(t *testing.T) []byte {
+				return testSignature(t, pki.developerID(t, pki.DeveloperID, nil), now, pki.DeveloperID)
+			},
+			developerID: true,
+			warnings:    []string{"signature has no secure timestamp"},
+		},
+		{
+			name: "developer id from another CA",
+			signature: func(t *testing.T) []byte {
+				return testSignature(t, pki.developerID(t, pki.Other, nil), now, pki.Other)
+			},
+			developerID: true,
+			problems:    []string{"is not issued by a Developer ID CA"},
+			warnings:    []string{"signature has no secure timestamp"},
+		},
+		{
+			name: "not developer id",
+			signature: func(t *testing.T) []byte {
+				return testSignature(t, testpki.New(t, "Apple Development: Test (ABCDE12345)", pki.DeveloperID, nil), now, pki.DeveloperID)
+			},
+			warnings: []string{"signature has no secure timestamp", `"Apple Development: Test (ABCDE12345)" is not a Developer ID Application certificate`},
+		},
+		{
+			name: "signing time after expiration",
+			signature: func(t *testing.T) []byte {
+				return testSignature(t, expiring, now, pki.DeveloperID)
+			},
+			// Without a timestamp, the chain is validated at
+			// opts.Now, when the certificate was valid
+			opts:        &TrustOptions{Now: now.Add(-36 * time.Hour)},
+			developerID: true,
+			problems:    []string{"signing time " + now.UTC().Format(time.RFC3339) + " is outside of the validity of"},
+			warnings:    []string{"signature has no secure timestamp"},
+		},
+		{
+			name: "expired",
+			signature: func(t *testing.T) []byte {
+				return testSignature(t, expiring, now.Add(-36*time.Hour), pki.DeveloperID)
+			},
+			problems: []string{"certificate has expired"},
+			warnings: []string{"signature has no secure timestamp"},
+		},
+		{
+			name: "untrusted root",
+			signature: func(t *testing.T) []byte {
+				other := testpki.NewPKI(t)
+				return testSignature(t, other.Issue(t, "Test Signer", nil), now, other.Intermediate, other.Root)
+			},
+			problems: []string{"untrusted signing certificate"},
+			warnings: []string{"signature has no secure timestamp"},
+		},
+		{
+			name: "additional root",
+			signature: func(t *testing.T) []byte {
+				return testSignature(t, testpki.New(t, "Test Signer", pki.Other, nil), now, pki.Other)
+			},
+			opts:     &TrustOptions{Roots: []*x509.Certificate{pki.Other.Cert}},
+			warnings: []string{"signature has no secure timestamp", `"Test Signer" is not a Developer ID Application certificate`},
+		},
+		{
+			name: "not CMS",
+			signature: func(t *testing.T) []byte {
+				return []byte("not a signature")
+			},
+			problems: []string{"invalid CMS signature"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := CheckTrust(tt.signature(t), tt.opts)
+			if report.DeveloperID != tt.developerID {
+				t.Errorf("Developer ID = %v, want %v", report.DeveloperID, tt.developerID)
+			}
+			check := func(what string, got []string, want []string) {
+				if len(got) != len(want) {
+					t.Errorf("%s = %q, want %q", what, got, want)
+					return
+				}
+				for ii, v := range want {
+					if !strings.Contains(got[ii], v) {
+						t.Errorf("%s = %q, want %q", what, got, want)
+					}
+				}
+			}
+			check("problems", report.Problems, tt.problems)
+			check("warnings", report.Warnings, tt.warnings)
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package codesign
+
+import (
+	"bytes"
+	"encoding/asn1"
+	"fmt"
+
+	"howett.net/plist"
+
+	"macapptool/internal/cms"
+	"macapptool/internal/macho"
+)
+
+// VerifyOptions contains the data bound to a signature
+// through its special slots, which is stored outside of
+// the signed file
+type VerifyOptions struct {
+	// InfoPlist contains the Info.plist of the bundle, nil
+	// for standalone files
+	InfoPlist []byte
+	// CodeResources contains the resource seal of the bundle,
+	// nil for standalone files
+	CodeResources []byte
+}
+
+var specialSlotNames = map[int]string{
+	SlotInfo:            "Info.plist",
+	SlotRequirements:    "requirements",
+	SlotResourceDir:     "resource seal",
+	SlotEntitlements:    "entitlements",
+	SlotEntitlementsDER: "DER entitlements",
+}
+
+// specialSlotData returns the data for each special slot
+func specialSlotData(sig *Signature, opts *VerifyOptions) map[int][]byte {
+	slots := map[int][]byte{
+		SlotInfo:        opts.InfoPlist,
+		SlotResourceDir: opts.CodeResources,
+	}
+	for _, typ := range []int{SlotRequirements, SlotEntitlements, SlotEntitlementsDER} {
+		if b := sig.SuperBlob.Blob(uint32(typ)); b != nil {
+			slots[typ] = b.Data
+		}
+	}
+	return slots
+}
+
+// verifyCodeDirectory checks the hashes in cd against the
+// code in f and the special slots data
+func verifyCodeDirectory(f *macho.File, cd *CodeDirectory, slots map[int][]byte) []string {
+	var problems []string
+	name := HashTypeName(cd.HashType)
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, name+": "+fmt.Sprintf(format, args...))
+	}
+	if cs := f.CodeSignature(); cs != nil && uint64(cs.DataOff) != cd.CodeLimit {
+		add("code limit %d doesn't match the signature offset %d", cd.CodeLimit, cs.DataOff)
+	}
+	limit := cd.CodeLimit
+	if limit > uint64(len(f.Data)) {
+		add("code limit %d is beyond the end of the file", limit)
+		limit = uint64(len(f.Data))
+	}
+	code := f.Data[:limit]
+	pageSize := uint64(cd.PageSize())
+	if pageSize == 0 {
+		pageSize = limit
+	}
+	nPages := 0
+	if pageSize > 0 {
+		nPages = int((limit + pageSize - 1) / pageSize)
+	}
+	if nPages != len(cd.CodeSlots) {
+		add("has %d code slots, expecting %d", len(cd.CodeSlots), nPages)
+	}
+	var mismatched []int
+	for ii, expected := range cd.CodeSlots {
+		start := uint64(ii) * pageSize
+		if start >= limit {
+			break
+		}
+		end := start + pageSize
+		if end > limit {
+			end = limit
+		}
+		digest, err := Digest(cd.HashType, code[start:end])
+		if err != nil {
+			add("%v", err)
+			return problems
+		}
+		if !bytes.Equal(digest, expected) {
+			mismatched = append(mismatched, ii)
+		}
+	}
+	if len(mismatched) > 0 {
+		add("%d modified pages %v", len(mismatched), mismatched)
+	}
+	for slot := SlotInfo; slot <= SlotEntitlementsDER; slot++ {
+		slotName := specialSlotNames[slot]
+		if slotName == "" {
+			continue
+		}
+		expected := cd.SpecialSlot(slot)
+		data := slots[slot]
+		switch {
+		case expected == nil && data != nil:
+			add("%s is not bound by the signature", slotName)
+		case expected != nil && data == nil:
+			add("%s is missing", slotName)
+		case expected != nil:
+			digest, err := Digest(cd.HashType, data)
+			if err != nil {
+				add("%v", err)
+				continue
+			}
+			if !bytes.Equal(digest, expected) {
+				add("%s was modified", slotName)
+			}
+		}
+	}
+	return problems
+}
+
+type cdHashesPlist struct {
+	CDHashes [][]byte `plist:"cdhashes"`
+}
+
+// verifyCMS checks the CMS signature of the primary
+// CodeDirectory and, if present, the list of cdhashes
+// for the alternate ones
+func verifyCMS(sig *Signature) []string {
+	if len(sig.CMS) == 0 {
+		return []string{"missing CMS signature"}
+	}
+	sd, err := cms.Parse(sig.CMS)
+	if err != nil {
+		return []string{fmt.Sprintf("invalid CMS signature: %v", err)}
+	}
+	if _, err := sd.VerifyDetached(sig.CodeDirectory().Raw); err != nil {
+		return []string{fmt.Sprintf("invalid CMS signature: %v", err)}
+	}
+	raw := cms.Attr(sd.Signers[0].SignedAttrs, cms.OIDAppleCDHashPlist)
+	if raw == nil {
+		return nil
+	}
+	var data []byte
+	var hashes cdHashesPlist
+	if _, err := asn1.Unmarshal(raw, &data); err != nil {
+		return []string{fmt.Sprintf("invalid cdhashes attribute: %v", err)}
+	}
+	if _, err := plist.Unmarshal(data, &hashes); err != nil {
+		return []string{fmt.Sprintf("invalid cdhashes attribute: %v", err)}
+	}
+	var problems []string
+	for _, cd := range sig.CodeDirectories {
+		cdhash := cd.CDHash()
+		if len(cdhash) > CDHashSize {
+			cdhash = cdhash[:CDHashSize]
+		}
+		found := false
+		for _, h := range hashes.CDHashes {
+			if bytes.Equal(h, cdhash) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s CodeDirectory is not covered by the CMS signature", HashTypeName(cd.HashType)))
+		}
+	}
+	return problems
+}
+
+// VerifyFile checks the signature of a thin Mach-O file
+// against its contents, returning a description of every
+// problem found. It doesn't validate the certificates.
+func VerifyFile(f *macho.File, opts *VerifyOptions) []string {
+	if opts == nil {
+		opts = &VerifyOptions{}
+	}
+	data := f.Signature()
+	if data == nil {
+		return []string{"not signed"}
+	}
+	sig, err := ParseSignature(data)
+	if err != nil {
+		return []string{fmt.Sprintf("invalid signature: %v", err)}
+	}
+	slots := specialSlotData(sig, opts)
+	var problems []string
+	for _, cd := range sig.CodeDirectories {
+		problems = append(problems, verifyCodeDirectory(f, cd, slots)...)
+	}
+	if !sig.IsAdhoc() {
+		problems = append(problems, verifyCMS(sig)...)
+	}
+	return problems
+}
@@ -0,0 +1,98 @@
+package codesign
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const xmlPlistHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`
+
+// base64LineLength is the maximum length of the base64 lines
+// written by CoreFoundation
+const base64LineLength = 76
+
+// encodeXMLPlist encodes v as an XML plist, with exactly the
+// same formatting used by CoreFoundation, so the resource seals
+// we generate are identical to the ones written by codesign.
+// Only the types used in resource seals are supported.
+func encodeXMLPlist(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xmlPlistHeader)
+	if err := encodeXMLPlistValue(&buf, v, 0); err != nil {
+		return nil, err
+	}
+	buf.WriteString("</plist>\n")
+	return buf.Bytes(), nil
+}
+
+func writeEscaped(buf *bytes.Buffer, s string) {
+	// CoreFoundation only escapes &, < and >
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	r := strings.NewReplacer("&#34;", `"`, "&#39;", "'", "&#x9;", "\t", "&#xA;", "\n", "&#xD;", "\r")
+	buf.WriteString(r.Replace(b.String()))
+}
+
+func encodeXMLPlistValue(buf *bytes.Buffer, v interface{}, depth int) error {
+	indent := strings.Repeat("\t", depth)
+	buf.WriteString(indent)
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if len(x) == 0 {
+			buf.WriteString("<dict/>\n")
+			return nil
+		}
+		buf.WriteString("<dict>\n")
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			buf.WriteString(indent + "\t<key>")
+			writeEscaped(buf, k)
+			buf.WriteString("</key>\n")
+			if err := encodeXMLPlistValue(buf, x[k], depth+1); err != nil {
+				return err
+			}
+		}
+		buf.WriteString(indent + "</dict>\n")
+	case []byte:
+		buf.WriteString("<data>\n")
+		encoded := base64.StdEncoding.EncodeToString(x)
+		for len(encoded) > 0 {
+			n := len(encoded)
+			if n > base64LineLength {
+				n = base64LineLength
+			}
+			buf.WriteString(indent + encoded[:n] + "\n")
+			encoded = encoded[n:]
+		}
+		buf.WriteString(indent + "</data>\n")
+	case string:
+		buf.WriteString("<string>")
+		writeEscaped(buf, x)
+		buf.WriteString("</string>\n")
+	case bool:
+		if x {
+			buf.WriteString("<true/>\n")
+		} else {
+			buf.WriteString("<false/>\n")
+		}
+	case float64:
+		buf.WriteString("<real>" + strconv.FormatFloat(x, 'g', -1, 64) + "</real>\n")
+	case int:
+		buf.WriteString("<integer>" + strconv.Itoa(x) + "</integer>\n")
+	default:
+		return fmt.Errorf("unsupported plist type %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,325 @@
+// Package entitlements checks entitlements against the rules
+// for notarized, hardened runtime and sandboxed apps.
+package entitlements
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"macapptool/internal/plist"
+)
+
+// Well known entitlement keys
+const (
+	GetTaskAllow                    = "com.apple.security.get-task-allow"
+	AppSandbox                      = "com.apple.security.app-sandbox"
+	Inherit                         = "com.apple.security.inherit"
+	AllowJIT                        = "com.apple.security.cs.allow-jit"
+	AllowUnsignedExecutableMemory   = "com.apple.security.cs.allow-unsigned-executable-memory"
+	AllowDyldEnvironmentVariables   = "com.apple.security.cs.allow-dyld-environment-variables"
+	DisableLibraryValidation        = "com.apple.security.cs.disable-library-validation"
+	DisableExecutablePageProtection = "com.apple.security.cs.disable-executable-page-protection"
+	Debugger                        = "com.apple.security.cs.debugger"
+
+	// Legacy name, still honored by the system
+	legacyGetTaskAllow = "get-task-allow"
+
+	temporaryExceptionPrefix = "com.apple.security.temporary-exception."
+)
+
+// knownKeys contains the entitlements documented for macOS
+// apps, other than temporary exceptions
+var knownKeys = map[string]bool{
+	GetTaskAllow:                    true,
+	legacyGetTaskAllow:              true,
+	AppSandbox:                      true,
+	Inherit:                         true,
+	AllowJIT:                        true,
+	AllowUnsignedExecutableMemory:   true,
+	AllowDyldEnvironmentVariables:   true,
+	DisableLibraryValidation:        true,
+	DisableExecutablePageProtection: true,
+	Debugger:                        true,
+
+	"com.apple.application-identifier":                                         true,
+	"com.apple.developer.team-identifier":                                      true,
+	"keychain-access-groups":                                                   true,
+	"com.apple.security.application-groups":                                    true,
+	"com.apple.security.network.client":                                        true,
+	"com.apple.security.network.server":                                        true,
+	"com.apple.security.device.camera":                                         true,
+	"com.apple.security.device.microphone":                                     true,
+	"com.apple.security.device.audio-input":                                    true,
+	"com.apple.security.device.usb":                                            true,
+	"com.apple.security.device.serial":                                         true,
+	"com.apple.security.device.bluetooth":                                      true,
+	"com.apple.security.print":                                                 true,
+	"com.apple.security.personal-information.location":                         true,
+	"com.apple.security.personal-information.addressbook":                      true,
+	"com.apple.security.personal-information.calendars":                        true,
+	"com.apple.security.personal-information.photos-library":                   true,
+	"com.apple.security.automation.apple-events":                               true,
+	"com.apple.security.scripting-targets":                                     true,
+	"com.apple.security.files.user-selected.read-only":                         true,
+	"com.apple.security.files.user-selected.read-write":                        true,
+	"com.apple.security.files.user-selected.executable":                        true,
+	"com.apple.security.files.downloads.read-only":                             true,
+	"com.apple.security.files.downloads.read-write":                            true,
+	"com.apple.security.files.bookmarks.app-scope":                             true,
+	"com.apple.security.files.bookmarks.document-scope":                        true,
+	"com.apple.security.files.all":                                             true,
+	"com.apple.security.assets.pictures.read-only":                             true,
+	"com.apple.security.assets.pictures.read-write":                            true,
+	"com.apple.security.assets.music.read-only":                                true,
+	"com.apple.security.assets.music.read-write":                               true,
+	"com.apple.security.assets.movies.read-only":                               true,
+	"com.apple.security.assets.movies.read-write":                              true,
+	"com.apple.security.hypervisor":                                            true,
+	"com.apple.security.virtualization":                                        true,
+	"com.apple.security.smartcard":                                             true,
+	"com.apple.developer.aps-environment":                                      true,
+	"com.apple.developer.icloud-container-identifiers":                         true,
+	"com.apple.developer.icloud-container-environment":                         true,
+	"com.apple.developer.icloud-services":                                      true,
+	"com.apple.developer.ubiquity-container-identifiers":                       true,
+	"com.apple.developer.ubiquity-kvstore-identifier":                          true,
+	"com.apple.developer.associated-domains":                                   true,
+	"com.apple.developer.applesignin":                                          true,
+	"com.apple.developer.networking.networkextension":                          true,
+	"com.apple.developer.networking.vpn.api":                                   true,
+	"com.apple.developer.system-extension.install":                             true,
+	"com.apple.developer.endpoint-security.client":                             true,
+	"com.apple.developer.driverkit":                                            true,
+	"com.apple.developer.in-app-payments":                                      true,
+	"com.apple.developer.usernotifications.time-sensitive":                     true,
+	"com.apple.developer.usernotifications.communication":                      true,
+	"com.apple.developer.web-browser.public-key-credential":                    true,
+	"com.apple.developer.authentication-services.autofill-credential-provider": true,
+}
+
+// broadExceptions contains the hardened runtime exceptions
+// which weaken the runtime protections for the whole process
+var broadExceptions = map[string]string{
+	AllowUnsignedExecutableMemory:   "allows writable and executable memory without MAP_JIT, prefer " + AllowJIT,
+	DisableExecutablePageProtection: "disables all executable memory protections",
+	DisableLibraryValidation:        "allows loading libraries signed by other teams",
+	AllowDyldEnvironmentVariables:   "allows injecting code with DYLD_* environment variables",
+	Debugger:                        "allows attaching to other processes",
+}
+
+// usageDescriptions maps the entitlements for protected
+// resources to the Info.plist keys which must describe why
+// they're used
+var usageDescriptions = map[string][]string{
+	"com.apple.security.device.camera":                       {"NSCameraUsageDescription"},
+	"com.apple.security.device.microphone":                   {"NSMicrophoneUsageDescription"},
+	"com.apple.security.device.audio-input":                  {"NSMicrophoneUsageDescription"},
+	"com.apple.security.device.bluetooth":                    {"NSBluetoothAlwaysUsageDescription"},
+	"com.apple.security.personal-information.location":       {"NSLocationUsageDescription", "NSLocationWhenInUseUsageDescription"},
+	"com.apple.security.personal-information.addressbook":    {"NSContactsUsageDescription"},
+	"com.apple.security.personal-information.calendars":      {"NSCalendarsUsageDescription"},
+	"com.apple.security.personal-information.photos-library": {"NSPhotoLibraryUsageDescription"},
+	"com.apple.security.automation.apple-events":             {"NSAppleEventsUsageDescription"},
+}
+
+// Severity is the severity of a finding
+type Severity int
+
+const (
+	Info Severity = iota
+	Warning
+	Error
+)
+
+func (s Severity) String() string {
+	switch s {
+	case Info:
+		return "info"
+	case Warning:
+		return "warning"
+	case Error:
+		return "error"
+	}
+	return fmt.Sprintf("severity(%d)", int(s))
+}
+
+// Finding is a problem found by Lint
+type Finding struct {
+	Severity  Severity
+	Component string
+	// Key is the entitlement which caused the finding,
+	// if any
+	Key     string
+	Message string
+}
+
+func (f *Finding) String() string {
+	if f.Key != "" {
+		return fmt.Sprintf("%s: %s: %s: %s", f.Severity, f.Component, f.Key, f.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", f.Severity, f.Component, f.Message)
+}
+
+// Component is a code object to check
+type Component struct {
+	// Path identifies the component in findings
+	Path string
+	// Entitlements contains the decoded entitlements. Nil
+	// means the component has no entitlements.
+	Entitlements map[string]interface{}
+	// InfoPlist is the Info.plist for the component or for
+	// its enclosing bundle, if any
+	InfoPlist *plist.PList
+	// Main is true for the outermost component, whose
+	// sandbox settings the nested ones must follow
+	Main bool
+}
+
+// Options contains the parameters for Lint
+type Options struct {
+	// Distribution is true when signing for distribution,
+	// which forbids debugging entitlements
+	Distribution bool
+}
+
+type linter struct {
+	findings []*Finding
+}
+
+func (l *linter) add(sev Severity, c *Component, key string, format string, args ...interface{}) {
+	l.findings = append(l.findings, &Finding{
+		Severity:  sev,
+		Component: c.Path,
+		Key:       key,
+		Message:   fmt.Sprintf(format, args...),
+	})
+}
+
+func isTrue(ents map[string]interface{}, key string) bool {
+	v, ok := ents[key].(bool)
+	return ok && v
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (l *linter) lintComponent(c *Component, opts *Options) {
+	ents := c.Entitlements
+	for _, key := range sortedKeys(ents) {
+		value := ents[key]
+		switch {
+		case key == GetTaskAllow || key == legacyGetTaskAllow:
+			if isTrue(ents, key) {
+				if opts.Distribution {
+					l.add(Error, c, key, "not allowed when signing for distribution, notarization will reject it")
+				} else {
+					l.add(Info, c, key, "allows attaching a debugger, remove it before distributing")
+				}
+			}
+		case strings.HasPrefix(key, temporaryExceptionPrefix):
+			l.add(Warning, c, key, "temporary exceptions are not allowed in the Mac App Store")
+		case broadExceptions[key] != "":
+			if isTrue(ents, key) {
+				l.add(Warning, c, key, "broad hardened runtime exception: %s", broadExceptions[key])
+			}
+		case !knownKeys[key]:
+			l.add(Warning, c, key, "unknown entitlement")
+		}
+		if strings.HasPrefix(key, "com.apple.security.") && !strings.HasPrefix(key, temporaryExceptionPrefix) &&
+			key != "com.apple.security.application-groups" && key != "com.apple.security.scripting-targets" {
+			if _, ok := value.(bool); !ok {
+				l.add(Error, c, key, "must be a boolean, got %T", value)
+			}
+		}
+		if keys, ok := usageDescriptions[key]; ok && isTrue(ents, key) {
+			found := false
+			if c.InfoPlist != nil {
+				for _, k := range keys {
+					if c.InfoPlist.Has(k) {
+						found = true
+						break
+					}
+				}
+			}
+			if !found {
+				l.add(Error, c, key, "requires %s in Info.plist, access will be denied without it", strings.Join(keys, " or "))
+			}
+		}
+	}
+	if isTrue(ents, Inherit) {
+		if !isTrue(ents, AppSandbox) {
+			l.add(Error, c, Inherit, "requires %s", AppSandbox)
+		}
+		for _, key := range sortedKeys(ents) {
+			if key != Inherit && key != AppSandbox {
+				l.add(Error, c, key, "components inheriting the sandbox can only have %s and %s", AppSandbox, Inherit)
+			}
+		}
+	}
+}
+
+// lintSandbox checks that either every component is sandboxed
+// or none of them is
+func (l *linter) lintSandbox(components []*Component) {
+	var main *Component
+	for _, c := range components {
+		if c.Main {
+			main = c
+			break
+		}
+	}
+	if main == nil {
+		return
+	}
+	sandboxed := isTrue(main.Entitlements, AppSandbox)
+	for _, c := range components {
+		if c == main {
+			continue
+		}
+		switch {
+		case sandboxed && c.Entitlements != nil && !isTrue(c.Entitlements, AppSandbox):
+			// Libraries don't need entitlements, so only report
+			// components with some entitlements, which must be
+			// executables
+			l.add(Warning, c, AppSandbox, "the main component is sandboxed but this one isn't")
+		case !sandboxed && isTrue(c.Entitlements, AppSandbox):
+			l.add(Warning, c, AppSandbox, "sandboxed, but the main component isn't")
+		}
+	}
+}
+
+// Lint checks the entitlements of the given components,
+// returning the findings sorted by component
+func Lint(components []*Component, opts *Options) []*Finding {
+	if opts == nil {
+		opts = &Options{}
+	}
+	l := &linter{}
+	for _, c := range components {
+		l.lintComponent(c, opts)
+	}
+	l.lintSandbox(components)
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		return l.findings[i].Component < l.findings[j].Component
+	})
+	return l.findings
+}
+
+// MaxSeverity returns the highest severity in findings, or
+// -1 if there are no findings
+func MaxSeverity(findings []*Finding) Severity {
+	max := Severity(-1)
+	for _, f := range findings {
+		if f.Severity > max {
+			max = f.Severity
+		}
+	}
+	return max
+}
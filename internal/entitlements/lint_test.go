@@ -0,0 +1,140 @@
+package entitlements
+
+import (
+	"strings"
+	"testing"
+
+	"macapptool/internal/plist"
+)
+
+func testInfoPlist(t *testing.T, keys ...string) *plist.PList {
+	var b strings.Builder
+	b.WriteString(`<?xml version="1.0" encoding="UTF-8"?><plist version="1.0"><dict>`)
+	for _, k := range keys {
+		b.WriteString("<key>" + k + "</key><string>description</string>")
+	}
+	b.WriteString("</dict></plist>")
+	pl, err := plist.New(strings.NewReader(b.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pl
+}
+
+func TestLint(t *testing.T) {
+	main := func(ents map[string]interface{}) *Component {
+		return &Component{Path: "App.app", Entitlements: ents, Main: true}
+	}
+	helper := func(ents map[string]interface{}) *Component {
+		return &Component{Path: "App.app/Contents/MacOS/helper", Entitlements: ents}
+	}
+	tests := []struct {
+		name         string
+		components   []*Component
+		distribution bool
+		want         []string
+	}{
+		{
+			name:       "no entitlements",
+			components: []*Component{main(nil), helper(nil)},
+		},
+		{
+			name:       "get-task-allow development",
+			components: []*Component{main(map[string]interface{}{GetTaskAllow: true})},
+			want:       []string{"info: App.app: com.apple.security.get-task-allow: allows attaching a debugger, remove it before distributing"},
+		},
+		{
+			name:         "get-task-allow distribution",
+			components:   []*Component{main(map[string]interface{}{legacyGetTaskAllow: true})},
+			distribution: true,
+			want:         []string{"error: App.app: get-task-allow: not allowed when signing for distribution, notarization will reject it"},
+		},
+		{
+			name:         "get-task-allow false",
+			components:   []*Component{main(map[string]interface{}{GetTaskAllow: false})},
+			distribution: true,
+		},
+		{
+			name: "exceptions",
+			components: []*Component{main(map[string]interface{}{
+				DisableLibraryValidation: true,
+				AllowJIT:                 true,
+				temporaryExceptionPrefix + "files.absolute-path.read-only": []interface{}{"/"},
+				"com.example.custom": true,
+			})},
+			want: []string{
+				"warning: App.app: com.apple.security.cs.disable-library-validation: broad hardened runtime exception: allows loading libraries signed by other teams",
+				"warning: App.app: com.apple.security.temporary-exception.files.absolute-path.read-only: temporary exceptions are not allowed in the Mac App Store",
+				"warning: App.app: com.example.custom: unknown entitlement",
+			},
+		},
+		{
+			name:       "not a boolean",
+			components: []*Component{main(map[string]interface{}{AllowJIT: "yes", "com.apple.security.application-groups": []interface{}{"group"}})},
+			want:       []string{"error: App.app: com.apple.security.cs.allow-jit: must be a boolean, got string"},
+		},
+		{
+			name: "usage descriptions",
+			components: []*Component{
+				{Path: "App.app", Main: true, InfoPlist: testInfoPlist(t, "NSCameraUsageDescription"), Entitlements: map[string]interface{}{
+					"com.apple.security.device.camera":     true,
+					"com.apple.security.device.microphone": true,
+				}},
+				helper(map[string]interface{}{"com.apple.security.personal-information.location": true}),
+			},
+			want: []string{
+				"error: App.app: com.apple.security.device.microphone: requires NSMicrophoneUsageDescription in Info.plist, access will be denied without it",
+				"error: App.app/Contents/MacOS/helper: com.apple.security.personal-information.location: requires NSLocationUsageDescription or NSLocationWhenInUseUsageDescription in Info.plist, access will be denied without it",
+			},
+		},
+		{
+			name: "inherit",
+			components: []*Component{
+				main(map[string]interface{}{AppSandbox: true}),
+				helper(map[string]interface{}{Inherit: true, AllowJIT: true}),
+			},
+			want: []string{
+				"error: App.app/Contents/MacOS/helper: com.apple.security.inherit: requires com.apple.security.app-sandbox",
+				"error: App.app/Contents/MacOS/helper: com.apple.security.cs.allow-jit: components inheriting the sandbox can only have com.apple.security.app-sandbox and com.apple.security.inherit",
+				"warning: App.app/Contents/MacOS/helper: com.apple.security.app-sandbox: the main component is sandboxed but this one isn't",
+			},
+		},
+		{
+			name: "sandboxed helper",
+			components: []*Component{
+				main(map[string]interface{}{AllowJIT: true}),
+				helper(map[string]interface{}{AppSandbox: true, Inherit: true}),
+			},
+			want: []string{"warning: App.app/Contents/MacOS/helper: com.apple.security.app-sandbox: sandboxed, but the main component isn't"},
+		},
+		{
+			name: "sandboxed libraries",
+			components: []*Component{
+				main(map[string]interface{}{AppSandbox: true}),
+				helper(nil),
+				helper(map[string]interface{}{AppSandbox: true, Inherit: true}),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, f := range Lint(tt.components, &Options{Distribution: tt.distribution}) {
+				got = append(got, f.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("findings:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestMaxSeverity(t *testing.T) {
+	if max := MaxSeverity(nil); max != -1 {
+		t.Errorf("MaxSeverity(nil) = %v", max)
+	}
+	findings := []*Finding{{Severity: Warning}, {Severity: Info}}
+	if max := MaxSeverity(findings); max != Warning {
+		t.Errorf("MaxSeverity = %v, want %v", max, Warning)
+	}
+}
@@ -0,0 +1,185 @@
+// Package keychain manages macOS keychains using the security
+// tool, for importing signing identities on CI machines.
+//
+// security can't read the passwords from stdin without
+// prompting on the terminal, so they're passed as arguments
+// and any process on the machine can see them while the
+// commands run. They're only hidden from the command
+// descriptions.
+package keychain
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// lockTimeout is the number of seconds before the keychain
+// locks itself. It's long enough for any CI job.
+const lockTimeout = 6 * 60 * 60
+
+// Command is a command to run
+type Command struct {
+	Args []string
+	// Secrets contains the indexes in Args of the values
+	// which must not be shown, like passwords
+	Secrets map[int]bool
+}
+
+func (c *Command) String() string {
+	args := make([]string, len(c.Args))
+	for ii, v := range c.Args {
+		if c.Secrets[ii] {
+			v = "XXXXXXXX"
+		}
+		args[ii] = v
+	}
+	return strings.Join(args, " ")
+}
+
+// Runner runs commands, returning their standard output. It
+// can be replaced to run the commands elsewhere or to test
+// the code without macOS.
+type Runner interface {
+	Run(ctx context.Context, cmd *Command) ([]byte, error)
+}
+
+// ExecRunner runs the commands as subprocesses
+type ExecRunner struct{}
+
+// Run implements Runner
+func (ExecRunner) Run(ctx context.Context, c *Command) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %v: %s", c.Args[1], err, msg)
+		}
+		return nil, fmt.Errorf("%s: %v", c.Args[1], err)
+	}
+	return out, nil
+}
+
+// Manager runs security commands using Runner
+type Manager struct {
+	Runner Runner
+}
+
+// NewManager returns a Manager which runs the commands
+// with the given runner. If runner is nil, ExecRunner
+// is used.
+func NewManager(runner Runner) *Manager {
+	if runner == nil {
+		runner = ExecRunner{}
+	}
+	return &Manager{Runner: runner}
+}
+
+// security runs the security tool with the given arguments.
+// Arguments of type secret are not shown in the command
+// description.
+func (m *Manager) security(ctx context.Context, args ...interface{}) ([]byte, error) {
+	cmd := &Command{Args: []string{"security"}}
+	for _, v := range args {
+		switch x := v.(type) {
+		case string:
+			cmd.Args = append(cmd.Args, x)
+		case secret:
+			if cmd.Secrets == nil {
+				cmd.Secrets = make(map[int]bool)
+			}
+			cmd.Secrets[len(cmd.Args)] = true
+			cmd.Args = append(cmd.Args, string(x))
+		default:
+			panic(fmt.Errorf("invalid argument type %T", v))
+		}
+	}
+	return m.Runner.Run(ctx, cmd)
+}
+
+// secret is an argument which must not be shown
+type secret string
+
+// SearchList returns the user keychain search list
+func (m *Manager) SearchList(ctx context.Context) ([]string, error) {
+	out, err := m.security(ctx, "list-keychains", "-d", "user")
+	if err != nil {
+		return nil, err
+	}
+	return parseKeychainList(out), nil
+}
+
+// parseKeychainList decodes the output of list-keychains,
+// which prints each keychain quoted in its own line
+func parseKeychainList(out []byte) []string {
+	var keychains []string
+	sc := bufio.NewScanner(bytes.NewReader(out))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		line = strings.TrimPrefix(line, `"`)
+		line = strings.TrimSuffix(line, `"`)
+		if line != "" {
+			keychains = append(keychains, line)
+		}
+	}
+	return keychains
+}
+
+// SetSearchList replaces the user keychain search list
+func (m *Manager) SetSearchList(ctx context.Context, keychains []string) error {
+	args := []interface{}{"list-keychains", "-d", "user", "-s"}
+	for _, k := range keychains {
+		args = append(args, k)
+	}
+	_, err := m.security(ctx, args...)
+	return err
+}
+
+// Create creates a keychain at path protected by password
+// and unlocks it
+func (m *Manager) Create(ctx context.Context, path string, password string) error {
+	if _, err := m.security(ctx, "create-keychain", "-p", secret(password), path); err != nil {
+		return err
+	}
+	// Don't lock on sleep and use a long timeout, so the
+	// keychain doesn't lock in the middle of a job
+	if _, err := m.security(ctx, "set-keychain-settings", "-u", "-t", fmt.Sprint(lockTimeout), path); err != nil {
+		return err
+	}
+	return m.Unlock(ctx, path, password)
+}
+
+// Unlock unlocks the keychain at path
+func (m *Manager) Unlock(ctx context.Context, path string, password string) error {
+	_, err := m.security(ctx, "unlock-keychain", "-p", secret(password), path)
+	return err
+}
+
+// ImportP12 imports the identity in the PKCS#12 file at p12
+// into the keychain, allowing codesign to use it
+func (m *Manager) ImportP12(ctx context.Context, path string, p12 string, p12Password string) error {
+	_, err := m.security(ctx, "import", p12, "-k", path, "-f", "pkcs12",
+		"-P", secret(p12Password), "-T", "/usr/bin/codesign", "-T", "/usr/bin/security")
+	return err
+}
+
+// SetPartitionList allows Apple tools to use the keys in the
+// keychain without prompting for the password, which would
+// block non-interactive sessions
+func (m *Manager) SetPartitionList(ctx context.Context, path string, password string) error {
+	_, err := m.security(ctx, "set-key-partition-list", "-S", "apple-tool:,apple:,codesign:",
+		"-s", "-k", secret(password), path)
+	return err
+}
+
+// Delete deletes the keychain at path, removing it from the
+// search list
+func (m *Manager) Delete(ctx context.Context, path string) error {
+	_, err := m.security(ctx, "delete-keychain", path)
+	return err
+}
@@ -0,0 +1,152 @@
+package keychain
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeRunner records the commands and returns the output
+// for each of them, in order
+type fakeRunner struct {
+	cmds    []*Command
+	outputs [][]byte
+	err     error
+}
+
+func (r *fakeRunner) Run(ctx context.Context, cmd *Command) ([]byte, error) {
+	r.cmds = append(r.cmds, cmd)
+	if r.err != nil {
+		return nil, r.err
+	}
+	var out []byte
+	if len(r.outputs) > 0 {
+		out, r.outputs = r.outputs[0], r.outputs[1:]
+	}
+	return out, nil
+}
+
+func (r *fakeRunner) check(t *testing.T, want ...string) {
+	t.Helper()
+	var got []string
+	for _, c := range r.cmds {
+		got = append(got, strings.Join(c.Args, " "))
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestManager(t *testing.T) {
+	ctx := context.Background()
+	const kc = "/tmp/ci.keychain-db"
+	tests := []struct {
+		name string
+		run  func(m *Manager) error
+		want []string
+	}{
+		{
+			name: "create",
+			run:  func(m *Manager) error { return m.Create(ctx, kc, "kc pass") },
+			want: []string{
+				"security create-keychain -p kc pass " + kc,
+				"security set-keychain-settings -u -t 21600 " + kc,
+				"security unlock-keychain -p kc pass " + kc,
+			},
+		},
+		{
+			name: "unlock",
+			run:  func(m *Manager) error { return m.Unlock(ctx, kc, "kc pass") },
+			want: []string{"security unlock-keychain -p kc pass " + kc},
+		},
+		{
+			name: "import",
+			run:  func(m *Manager) error { return m.ImportP12(ctx, kc, "id.p12", "p12 pass") },
+			want: []string{"security import id.p12 -k " + kc + " -f pkcs12 -P p12 pass -T /usr/bin/codesign -T /usr/bin/security"},
+		},
+		{
+			name: "partition list",
+			run:  func(m *Manager) error { return m.SetPartitionList(ctx, kc, "kc pass") },
+			want: []string{"security set-key-partition-list -S apple-tool:,apple:,codesign: -s -k kc pass " + kc},
+		},
+		{
+			name: "search list",
+			run: func(m *Manager) error {
+				return m.SetSearchList(ctx, []string{kc, "/Users/ci/Library/Keychains/login.keychain-db"})
+			},
+			want: []string{"security list-keychains -d user -s " + kc + " /Users/ci/Library/Keychains/login.keychain-db"},
+		},
+		{
+			name: "delete",
+			run:  func(m *Manager) error { return m.Delete(ctx, kc) },
+			want: []string{"security delete-keychain " + kc},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &fakeRunner{}
+			if err := tt.run(NewManager(r)); err != nil {
+				t.Fatal(err)
+			}
+			r.check(t, tt.want...)
+		})
+	}
+}
+
+func TestManagerArgs(t *testing.T) {
+	// Passwords with spaces must stay in a single argument
+	r := &fakeRunner{}
+	if err := NewManager(r).Create(context.Background(), "ci.keychain-db", "two words"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"security", "create-keychain", "-p", "two words", "ci.keychain-db"}
+	if !reflect.DeepEqual(r.cmds[0].Args, want) {
+		t.Errorf("args = %q, want %q", r.cmds[0].Args, want)
+	}
+}
+
+func TestManagerError(t *testing.T) {
+	r := &fakeRunner{err: errors.New("create-keychain: exit status 48")}
+	if err := NewManager(r).Create(context.Background(), "ci.keychain-db", "secret"); err != r.err {
+		t.Errorf("error = %v, want %v", err, r.err)
+	}
+	// The keychain isn't configured after failing to create it
+	r.check(t, "security create-keychain -p secret ci.keychain-db")
+}
+
+func TestSearchList(t *testing.T) {
+	r := &fakeRunner{outputs: [][]byte{[]byte(
+		"    \"/Users/ci/Library/Keychains/login.keychain-db\"\n" +
+			"    \"/Library/Keychains/System.keychain\"\n")}}
+	list, err := NewManager(r).SearchList(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.check(t, "security list-keychains -d user")
+	want := []string{"/Users/ci/Library/Keychains/login.keychain-db", "/Library/Keychains/System.keychain"}
+	if !reflect.DeepEqual(list, want) {
+		t.Errorf("search list = %q, want %q", list, want)
+	}
+}
+
+func TestCommandString(t *testing.T) {
+	r := &fakeRunner{}
+	m := NewManager(r)
+	if err := m.ImportP12(context.Background(), "ci.keychain-db", "id.p12", "p12 pass"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Unlock(context.Background(), "ci.keychain-db", "kc pass"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"security import id.p12 -k ci.keychain-db -f pkcs12 -P XXXXXXXX -T /usr/bin/codesign -T /usr/bin/security",
+		"security unlock-keychain -p XXXXXXXX ci.keychain-db",
+	}
+	for ii, c := range r.cmds {
+		if s := c.String(); s != want[ii] {
+			t.Errorf("String() = %q, want %q", s, want[ii])
+		}
+	}
+}
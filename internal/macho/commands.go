@@ -0,0 +1,380 @@
+package macho
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Section is a section inside a segment
+type Section struct {
+	Name    string
+	Segment string
+	Addr    uint64
+	Size    uint64
+	Offset  uint32
+}
+
+// Segment is a LC_SEGMENT or LC_SEGMENT_64 load command
+type Segment struct {
+	*Load
+	Name     string
+	Addr     uint64
+	Memsz    uint64
+	Offset   uint64
+	Filesz   uint64
+	Maxprot  uint32
+	Initprot uint32
+	Flags    uint32
+	Sections []*Section
+}
+
+// Segments returns all the segments in the file
+func (f *File) Segments() []*Segment {
+	var segs []*Segment
+	bo := f.ByteOrder
+	for _, l := range f.Loads {
+		raw := l.Raw
+		var seg *Segment
+		var sectOffset, sectSize int
+		var nsects uint32
+		switch l.Cmd {
+		case LoadCmdSegment:
+			if len(raw) < 56 {
+				continue
+			}
+			seg = &Segment{
+				Load:     l,
+				Name:     cstring(raw[8:24]),
+				Addr:     uint64(bo.Uint32(raw[24:])),
+				Memsz:    uint64(bo.Uint32(raw[28:])),
+				Offset:   uint64(bo.Uint32(raw[32:])),
+				Filesz:   uint64(bo.Uint32(raw[36:])),
+				Maxprot:  bo.Uint32(raw[40:]),
+				Initprot: bo.Uint32(raw[44:]),
+				Flags:    bo.Uint32(raw[52:]),
+			}
+			nsects = bo.Uint32(raw[48:])
+			sectOffset, sectSize = 56, 68
+		case LoadCmdSegment64:
+			if len(raw) < 72 {
+				continue
+			}
+			seg = &Segment{
+				Load:     l,
+				Name:     cstring(raw[8:24]),
+				Addr:     bo.Uint64(raw[24:]),
+				Memsz:    bo.Uint64(raw[32:]),
+				Offset:   bo.Uint64(raw[40:]),
+				Filesz:   bo.Uint64(raw[48:]),
+				Maxprot:  bo.Uint32(raw[56:]),
+				Initprot: bo.Uint32(raw[60:]),
+				Flags:    bo.Uint32(raw[68:]),
+			}
+			nsects = bo.Uint32(raw[64:])
+			sectOffset, sectSize = 72, 80
+		default:
+			continue
+		}
+		for ii := 0; ii < int(nsects); ii++ {
+			p := sectOffset + ii*sectSize
+			if p+sectSize > len(raw) {
+				break
+			}
+			s := raw[p:]
+			sect := &Section{
+				Name:    cstring(s[0:16]),
+				Segment: cstring(s[16:32]),
+			}
+			if l.Cmd == LoadCmdSegment64 {
+				sect.Addr = bo.Uint64(s[32:])
+				sect.Size = bo.Uint64(s[40:])
+				sect.Offset = bo.Uint32(s[48:])
+			} else {
+				sect.Addr = uint64(bo.Uint32(s[32:]))
+				sect.Size = uint64(bo.Uint32(s[36:]))
+				sect.Offset = bo.Uint32(s[40:])
+			}
+			seg.Sections = append(seg.Sections, sect)
+		}
+		segs = append(segs, seg)
+	}
+	return segs
+}
+
+// Segment returns the segment with the given name,
+// or nil if there's no such segment
+func (f *File) Segment(name string) *Segment {
+	for _, s := range f.Segments() {
+		if s.Name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// LinkEditData is a load command pointing to data in
+// __LINKEDIT, like LC_CODE_SIGNATURE
+type LinkEditData struct {
+	*Load
+	DataOff  uint32
+	DataSize uint32
+}
+
+// Load returns the first load command with the given type
+func (f *File) Load(cmd LoadCmd) *Load {
+	for _, l := range f.Loads {
+		if l.Cmd == cmd {
+			return l
+		}
+	}
+	return nil
+}
+
+// CodeSignature returns the LC_CODE_SIGNATURE load command,
+// or nil if the file isn't signed
+func (f *File) CodeSignature() *LinkEditData {
+	l := f.Load(LoadCmdCodeSignature)
+	if l == nil || len(l.Raw) < 16 {
+		return nil
+	}
+	return &LinkEditData{
+		Load:     l,
+		DataOff:  f.ByteOrder.Uint32(l.Raw[8:]),
+		DataSize: f.ByteOrder.Uint32(l.Raw[12:]),
+	}
+}
+
+// Signature returns the raw code signature data, or
+// nil if the file isn't signed
+func (f *File) Signature() []byte {
+	cs := f.CodeSignature()
+	if cs == nil {
+		return nil
+	}
+	end := uint64(cs.DataOff) + uint64(cs.DataSize)
+	if end > uint64(len(f.Data)) {
+		return nil
+	}
+	return f.Data[cs.DataOff:end]
+}
+
+// Platforms in LC_BUILD_VERSION
+const (
+	PlatformMacOS            = 1
+	PlatformIOS              = 2
+	PlatformTvOS             = 3
+	PlatformWatchOS          = 4
+	PlatformBridgeOS         = 5
+	PlatformMacCatalyst      = 6
+	PlatformIOSSimulator     = 7
+	PlatformTvOSSimulator    = 8
+	PlatformWatchOSSimulator = 9
+	PlatformDriverKit        = 10
+)
+
+var platformNames = map[uint32]string{
+	PlatformMacOS:            "macos",
+	PlatformIOS:              "ios",
+	PlatformTvOS:             "tvos",
+	PlatformWatchOS:          "watchos",
+	PlatformBridgeOS:         "bridgeos",
+	PlatformMacCatalyst:      "maccatalyst",
+	PlatformIOSSimulator:     "iossimulator",
+	PlatformTvOSSimulator:    "tvossimulator",
+	PlatformWatchOSSimulator: "watchossimulator",
+	PlatformDriverKit:        "driverkit",
+}
+
+// PlatformName returns the name of a LC_BUILD_VERSION platform
+func PlatformName(platform uint32) string {
+	if s, ok := platformNames[platform]; ok {
+		return s
+	}
+	return fmt.Sprintf("platform(%d)", platform)
+}
+
+// Version is a version encoded as xxxx.yy.zz
+type Version uint32
+
+// MakeVersion returns a Version from its components
+func MakeVersion(major, minor, patch int) Version {
+	return Version(uint32(major)<<16 | uint32(minor&0xff)<<8 | uint32(patch&0xff))
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d", v>>16, (v>>8)&0xff)
+	if patch := v & 0xff; patch != 0 {
+		s += fmt.Sprintf(".%d", patch)
+	}
+	return s
+}
+
+// versionLimits are the largest values of each component
+// of a Version
+var versionLimits = [3]int{0xffff, 0xff, 0xff}
+
+// ParseVersion parses a version in the x.y.z format. The
+// major version must fit in 16 bits and the others in 8.
+func ParseVersion(s string) (Version, error) {
+	var parts [3]int
+	fields := strings.Split(s, ".")
+	if len(fields) > 3 || s == "" {
+		return 0, fmt.Errorf("invalid version %q", s)
+	}
+	for ii, f := range fields {
+		n, err := strconv.Atoi(f)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid version %q", s)
+		}
+		if n > versionLimits[ii] {
+			return 0, fmt.Errorf("invalid version %q: %d is larger than %d", s, n, versionLimits[ii])
+		}
+		parts[ii] = n
+	}
+	return MakeVersion(parts[0], parts[1], parts[2]), nil
+}
+
+// BuildVersion describes the platform and versions a
+// slice was built for, from either LC_BUILD_VERSION
+// or LC_VERSION_MIN_*
+type BuildVersion struct {
+	Platform uint32
+	MinOS    Version
+	SDK      Version
+}
+
+// versionMinPlatforms maps the LC_VERSION_MIN_* load
+// commands to their platforms
+var versionMinPlatforms = map[LoadCmd]uint32{
+	LoadCmdVersionMinMacOSX:   PlatformMacOS,
+	LoadCmdVersionMinIPhoneOS: PlatformIOS,
+	LoadCmdVersionMinTvOS:     PlatformTvOS,
+	LoadCmdVersionMinWatchOS:  PlatformWatchOS,
+}
+
+// BuildVersions returns all the build versions of the file.
+// Zippered files, which can be loaded by both macOS and Mac
+// Catalyst apps, have one for each platform.
+func (f *File) BuildVersions() []*BuildVersion {
+	bo := f.ByteOrder
+	var versions []*BuildVersion
+	for _, l := range f.Loads {
+		switch l.Cmd {
+		case LoadCmdBuildVersion:
+			if len(l.Raw) < 24 {
+				continue
+			}
+			versions = append(versions, &BuildVersion{
+				Platform: bo.Uint32(l.Raw[8:]),
+				MinOS:    Version(bo.Uint32(l.Raw[12:])),
+				SDK:      Version(bo.Uint32(l.Raw[16:])),
+			})
+		case LoadCmdVersionMinMacOSX, LoadCmdVersionMinIPhoneOS, LoadCmdVersionMinTvOS, LoadCmdVersionMinWatchOS:
+			if len(l.Raw) < 16 {
+				continue
+			}
+			versions = append(versions, &BuildVersion{
+				Platform: versionMinPlatforms[l.Cmd],
+				MinOS:    Version(bo.Uint32(l.Raw[8:])),
+				SDK:      Version(bo.Uint32(l.Raw[12:])),
+			})
+		}
+	}
+	return versions
+}
+
+// BuildVersion returns the first build version of the file,
+// or nil if it doesn't contain any version load command
+func (f *File) BuildVersion() *BuildVersion {
+	if versions := f.BuildVersions(); len(versions) > 0 {
+		return versions[0]
+	}
+	return nil
+}
+
+// Dylib is a load command referencing a dynamic library,
+// like LC_LOAD_DYLIB, or identifying one, like LC_ID_DYLIB
+type Dylib struct {
+	*Load
+	Name                 string
+	Timestamp            uint32
+	CurrentVersion       Version
+	CompatibilityVersion Version
+}
+
+// Weak returns true if the library is not required to
+// be present at runtime
+func (d *Dylib) Weak() bool {
+	return d.Cmd == LoadCmdLoadWeakDylib
+}
+
+// lcString returns the string referenced by the lc_str at
+// the given offset of the load command
+func (l *Load) lcString(bo binary.ByteOrder, offset int) string {
+	if len(l.Raw) < offset+4 {
+		return ""
+	}
+	start := int(bo.Uint32(l.Raw[offset:]))
+	if start >= len(l.Raw) {
+		return ""
+	}
+	return cstring(l.Raw[start:])
+}
+
+func (f *File) dylib(l *Load) *Dylib {
+	bo := f.ByteOrder
+	if len(l.Raw) < 24 {
+		return nil
+	}
+	return &Dylib{
+		Load:                 l,
+		Name:                 l.lcString(bo, 8),
+		Timestamp:            bo.Uint32(l.Raw[12:]),
+		CurrentVersion:       Version(bo.Uint32(l.Raw[16:])),
+		CompatibilityVersion: Version(bo.Uint32(l.Raw[20:])),
+	}
+}
+
+// Dylibs returns the libraries loaded by the file, in the
+// order they appear in the load commands
+func (f *File) Dylibs() []*Dylib {
+	var dylibs []*Dylib
+	for _, l := range f.Loads {
+		switch l.Cmd {
+		case LoadCmdLoadDylib, LoadCmdLoadWeakDylib, LoadCmdReexportDylib, LoadCmdLazyLoadDylib, LoadCmdLoadUpwardDylib:
+			if d := f.dylib(l); d != nil {
+				dylibs = append(dylibs, d)
+			}
+		}
+	}
+	return dylibs
+}
+
+// DylibID returns the LC_ID_DYLIB load command, or nil
+// if the file is not a dynamic library
+func (f *File) DylibID() *Dylib {
+	l := f.Load(LoadCmdIDDylib)
+	if l == nil {
+		return nil
+	}
+	return f.dylib(l)
+}
+
+// Rpath is a LC_RPATH load command
+type Rpath struct {
+	*Load
+	Path string
+}
+
+// Rpaths returns the LC_RPATH load commands, in order
+func (f *File) Rpaths() []*Rpath {
+	var rpaths []*Rpath
+	for _, l := range f.Loads {
+		if l.Cmd == LoadCmdRpath && len(l.Raw) >= 12 {
+			rpaths = append(rpaths, &Rpath{Load: l, Path: l.lcString(f.ByteOrder, 8)})
+		}
+	}
+	return rpaths
+}
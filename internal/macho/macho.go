@@ -0,0 +1,384 @@
+// Package macho implements reading and editing of thin
+// and universal Mach-O files.
+package macho
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const (
+	Magic32    = 0xfeedface
+	Magic64    = 0xfeedfacf
+	MagicFat   = 0xcafebabe
+	MagicFat64 = 0xcafebabf
+
+	fileHeaderSize32 = 7 * 4
+	fileHeaderSize64 = 8 * 4
+	fatHeaderSize    = 2 * 4
+	fatArchSize      = 5 * 4
+	fatArch64Size    = 8 * 4
+
+	// Java class files share the fat magic, but their
+	// version number is always bigger than this.
+	maxFatArches = 30
+
+	// maxAlign is the maximum slice alignment, as a power
+	// of 2, accepted by lipo
+	maxAlign = 15
+)
+
+var (
+	ErrNotMachO = errors.New("not a Mach-O file")
+)
+
+// Type is the Mach-O file type (MH_EXECUTE, MH_DYLIB, etc...)
+type Type uint32
+
+const (
+	TypeObject     Type = 0x1
+	TypeExecute    Type = 0x2
+	TypeFVMLib     Type = 0x3
+	TypeCore       Type = 0x4
+	TypePreload    Type = 0x5
+	TypeDylib      Type = 0x6
+	TypeDylinker   Type = 0x7
+	TypeBundle     Type = 0x8
+	TypeDylibStub  Type = 0x9
+	TypeDsym       Type = 0xa
+	TypeKextBundle Type = 0xb
+)
+
+var typeNames = map[Type]string{
+	TypeObject:     "object",
+	TypeExecute:    "execute",
+	TypeFVMLib:     "fvmlib",
+	TypeCore:       "core",
+	TypePreload:    "preload",
+	TypeDylib:      "dylib",
+	TypeDylinker:   "dylinker",
+	TypeBundle:     "bundle",
+	TypeDylibStub:  "dylib_stub",
+	TypeDsym:       "dsym",
+	TypeKextBundle: "kext_bundle",
+}
+
+func (t Type) String() string {
+	if s, ok := typeNames[t]; ok {
+		return s
+	}
+	return fmt.Sprintf("type(%#x)", uint32(t))
+}
+
+// Cpu is a Mach-O CPU type
+type Cpu uint32
+
+const (
+	cpuArch64   = 0x01000000
+	cpuArch6432 = 0x02000000
+
+	CpuX86     Cpu = 7
+	CpuAmd64   Cpu = CpuX86 | cpuArch64
+	CpuArm     Cpu = 12
+	CpuArm64   Cpu = CpuArm | cpuArch64
+	CpuArm6432 Cpu = CpuArm | cpuArch6432
+	CpuPpc     Cpu = 18
+	CpuPpc64   Cpu = CpuPpc | cpuArch64
+
+	// CpuSubtypeMask masks out the capability bits
+	// from a CPU subtype
+	CpuSubtypeMask    = 0x00ffffff
+	CpuSubtypeArm64E  = 2
+	CpuSubtypeX86_64H = 8
+)
+
+var cpuNames = map[Cpu]string{
+	CpuX86:     "i386",
+	CpuAmd64:   "x86_64",
+	CpuArm:     "arm",
+	CpuArm64:   "arm64",
+	CpuArm6432: "arm64_32",
+	CpuPpc:     "ppc",
+	CpuPpc64:   "ppc64",
+}
+
+func (c Cpu) String() string {
+	if s, ok := cpuNames[c]; ok {
+		return s
+	}
+	return fmt.Sprintf("cpu(%#x)", uint32(c))
+}
+
+// ArchName returns the architecture name used by the Apple
+// tools for the given CPU type and subtype (e.g. arm64e).
+func ArchName(cpu Cpu, subCpu uint32) string {
+	switch {
+	case cpu == CpuArm64 && subCpu&CpuSubtypeMask == CpuSubtypeArm64E:
+		return "arm64e"
+	case cpu == CpuAmd64 && subCpu&CpuSubtypeMask == CpuSubtypeX86_64H:
+		return "x86_64h"
+	}
+	return cpu.String()
+}
+
+// LoadCmd is a load command type
+type LoadCmd uint32
+
+const (
+	loadCmdReqDyld LoadCmd = 0x80000000
+
+	LoadCmdSegment                LoadCmd = 0x1
+	LoadCmdSymtab                 LoadCmd = 0x2
+	LoadCmdUnixThread             LoadCmd = 0x5
+	LoadCmdDysymtab               LoadCmd = 0xb
+	LoadCmdLoadDylib              LoadCmd = 0xc
+	LoadCmdIDDylib                LoadCmd = 0xd
+	LoadCmdLoadDylinker           LoadCmd = 0xe
+	LoadCmdIDDylinker             LoadCmd = 0xf
+	LoadCmdSegment64              LoadCmd = 0x19
+	LoadCmdUUID                   LoadCmd = 0x1b
+	LoadCmdRpath                  LoadCmd = 0x1c | loadCmdReqDyld
+	LoadCmdCodeSignature          LoadCmd = 0x1d
+	LoadCmdSegmentSplitInfo       LoadCmd = 0x1e
+	LoadCmdReexportDylib          LoadCmd = 0x1f | loadCmdReqDyld
+	LoadCmdLazyLoadDylib          LoadCmd = 0x20
+	LoadCmdEncryptionInfo         LoadCmd = 0x21
+	LoadCmdDyldInfo               LoadCmd = 0x22
+	LoadCmdDyldInfoOnly           LoadCmd = 0x22 | loadCmdReqDyld
+	LoadCmdLoadUpwardDylib        LoadCmd = 0x23 | loadCmdReqDyld
+	LoadCmdVersionMinMacOSX       LoadCmd = 0x24
+	LoadCmdVersionMinIPhoneOS     LoadCmd = 0x25
+	LoadCmdFunctionStarts         LoadCmd = 0x26
+	LoadCmdDyldEnvironment        LoadCmd = 0x27
+	LoadCmdMain                   LoadCmd = 0x28 | loadCmdReqDyld
+	LoadCmdDataInCode             LoadCmd = 0x29
+	LoadCmdSourceVersion          LoadCmd = 0x2a
+	LoadCmdDylibCodeSignDrs       LoadCmd = 0x2b
+	LoadCmdEncryptionInfo64       LoadCmd = 0x2c
+	LoadCmdLinkerOption           LoadCmd = 0x2d
+	LoadCmdVersionMinTvOS         LoadCmd = 0x2f
+	LoadCmdVersionMinWatchOS      LoadCmd = 0x30
+	LoadCmdBuildVersion           LoadCmd = 0x32
+	LoadCmdDyldExportsTrie        LoadCmd = 0x33 | loadCmdReqDyld
+	LoadCmdDyldChainedFixups      LoadCmd = 0x34 | loadCmdReqDyld
+	LoadCmdLoadWeakDylib          LoadCmd = 0x18 | loadCmdReqDyld
+	LoadCmdLinkerOptimizationHint LoadCmd = 0x2e
+)
+
+// Load is a load command
+type Load struct {
+	Cmd LoadCmd
+	// Offset of the load command inside the file
+	Offset uint32
+	// Raw contains the whole load command, including
+	// its cmd and cmdsize fields
+	Raw []byte
+}
+
+// File is a thin Mach-O file
+type File struct {
+	ByteOrder binary.ByteOrder
+	Magic     uint32
+	Cpu       Cpu
+	SubCpu    uint32
+	Type      Type
+	Flags     uint32
+	Loads     []*Load
+	// Data contains the whole file
+	Data []byte
+}
+
+// Is64 returns true if this is a 64 bit Mach-O file
+func (f *File) Is64() bool {
+	return f.Magic == Magic64
+}
+
+// Arch returns the architecture name for the file
+func (f *File) Arch() string {
+	return ArchName(f.Cpu, f.SubCpu)
+}
+
+// HeaderSize returns the size of the Mach-O header,
+// without the load commands
+func (f *File) HeaderSize() int {
+	if f.Is64() {
+		return fileHeaderSize64
+	}
+	return fileHeaderSize32
+}
+
+// NewFile parses a thin Mach-O file from its data.
+func NewFile(data []byte) (*File, error) {
+	if len(data) < fileHeaderSize32 {
+		return nil, ErrNotMachO
+	}
+	f := &File{Data: data}
+	le := binary.LittleEndian.Uint32(data)
+	be := binary.BigEndian.Uint32(data)
+	switch {
+	case le == Magic32 || le == Magic64:
+		f.ByteOrder = binary.LittleEndian
+		f.Magic = le
+	case be == Magic32 || be == Magic64:
+		f.ByteOrder = binary.BigEndian
+		f.Magic = be
+	default:
+		return nil, ErrNotMachO
+	}
+	bo := f.ByteOrder
+	f.Cpu = Cpu(bo.Uint32(data[4:]))
+	f.SubCpu = bo.Uint32(data[8:])
+	f.Type = Type(bo.Uint32(data[12:]))
+	ncmds := bo.Uint32(data[16:])
+	sizeofcmds := bo.Uint32(data[20:])
+	f.Flags = bo.Uint32(data[24:])
+	offset := uint32(f.HeaderSize())
+	end := uint64(offset) + uint64(sizeofcmds)
+	if end > uint64(len(data)) {
+		return nil, errors.New("load commands extend beyond end of file")
+	}
+	for ii := uint32(0); ii < ncmds; ii++ {
+		if uint64(offset)+8 > end {
+			return nil, fmt.Errorf("load command %d extends beyond load commands area", ii)
+		}
+		cmd := LoadCmd(bo.Uint32(data[offset:]))
+		size := bo.Uint32(data[offset+4:])
+		if size < 8 || uint64(offset)+uint64(size) > end {
+			return nil, fmt.Errorf("load command %d has invalid size %d", ii, size)
+		}
+		f.Loads = append(f.Loads, &Load{
+			Cmd:    cmd,
+			Offset: offset,
+			Raw:    data[offset : offset+size],
+		})
+		offset += size
+	}
+	return f, nil
+}
+
+// FatArch describes a slice in a universal file
+type FatArch struct {
+	Cpu    Cpu
+	SubCpu uint32
+	Offset uint64
+	Size   uint64
+	// Align is the alignment of the slice as a power of 2
+	Align uint32
+}
+
+// Slice is an architecture contained in a Mach-O file. For
+// thin files, FatArch is empty.
+type Slice struct {
+	FatArch
+	*File
+}
+
+// Binary is a thin or universal Mach-O file
+type Binary struct {
+	Fat    bool
+	Fat64  bool
+	Slices []*Slice
+}
+
+// Arches returns the architecture names in the binary
+func (b *Binary) Arches() []string {
+	var arches []string
+	for _, s := range b.Slices {
+		arches = append(arches, s.Arch())
+	}
+	return arches
+}
+
+// IsMachO returns true if the given header, which should
+// contain at least 8 bytes, corresponds to a thin or universal
+// Mach-O file.
+func IsMachO(header []byte) bool {
+	if len(header) < 8 {
+		return false
+	}
+	switch binary.LittleEndian.Uint32(header) {
+	case Magic32, Magic64:
+		return true
+	}
+	switch binary.BigEndian.Uint32(header) {
+	case Magic32, Magic64:
+		return true
+	case MagicFat, MagicFat64:
+		n := binary.BigEndian.Uint32(header[4:])
+		return n > 0 && n < maxFatArches
+	}
+	return false
+}
+
+// Parse parses a thin or universal Mach-O file
+func Parse(data []byte) (*Binary, error) {
+	if !IsMachO(data) {
+		return nil, ErrNotMachO
+	}
+	magic := binary.BigEndian.Uint32(data)
+	if magic != MagicFat && magic != MagicFat64 {
+		f, err := NewFile(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Binary{Slices: []*Slice{{File: f}}}, nil
+	}
+	b := &Binary{Fat: true, Fat64: magic == MagicFat64}
+	count := binary.BigEndian.Uint32(data[4:])
+	archSize := fatArchSize
+	if b.Fat64 {
+		archSize = fatArch64Size
+	}
+	if fatHeaderSize+int(count)*archSize > len(data) {
+		return nil, errors.New("fat header extends beyond end of file")
+	}
+	for ii := 0; ii < int(count); ii++ {
+		p := data[fatHeaderSize+ii*archSize:]
+		var arch FatArch
+		arch.Cpu = Cpu(binary.BigEndian.Uint32(p))
+		arch.SubCpu = binary.BigEndian.Uint32(p[4:])
+		if b.Fat64 {
+			arch.Offset = binary.BigEndian.Uint64(p[8:])
+			arch.Size = binary.BigEndian.Uint64(p[16:])
+			arch.Align = binary.BigEndian.Uint32(p[24:])
+		} else {
+			arch.Offset = uint64(binary.BigEndian.Uint32(p[8:]))
+			arch.Size = uint64(binary.BigEndian.Uint32(p[12:]))
+			arch.Align = binary.BigEndian.Uint32(p[16:])
+		}
+		// Offset and Size come from the file, so compare them
+		// without adding them, which can overflow
+		if arch.Offset > uint64(len(data)) || arch.Size > uint64(len(data))-arch.Offset {
+			return nil, fmt.Errorf("slice %d (%s) extends beyond end of file", ii, ArchName(arch.Cpu, arch.SubCpu))
+		}
+		if arch.Align > maxAlign {
+			return nil, fmt.Errorf("slice %d (%s) has invalid alignment 2^%d", ii, ArchName(arch.Cpu, arch.SubCpu), arch.Align)
+		}
+		f, err := NewFile(data[arch.Offset : arch.Offset+arch.Size])
+		if err != nil {
+			return nil, fmt.Errorf("slice %d (%s): %v", ii, ArchName(arch.Cpu, arch.SubCpu), err)
+		}
+		b.Slices = append(b.Slices, &Slice{FatArch: arch, File: f})
+	}
+	return b, nil
+}
+
+// ReadFile reads and parses a thin or universal Mach-O file
+func ReadFile(path string) (*Binary, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// cstring returns the NUL terminated string at the start of b
+func cstring(b []byte) string {
+	if pos := bytes.IndexByte(b, 0); pos >= 0 {
+		b = b[:pos]
+	}
+	return string(b)
+}
@@ -0,0 +1,193 @@
+package macho
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// thinHeader returns a 64 bit little endian Mach-O header for
+// cpu, followed by the given load commands
+func thinHeader(cpu Cpu, ncmds uint32, cmds []byte) []byte {
+	data := make([]byte, fileHeaderSize64, fileHeaderSize64+len(cmds))
+	le := binary.LittleEndian
+	le.PutUint32(data, Magic64)
+	le.PutUint32(data[4:], uint32(cpu))
+	le.PutUint32(data[12:], uint32(TypeExecute))
+	le.PutUint32(data[16:], ncmds)
+	le.PutUint32(data[20:], uint32(len(cmds)))
+	return append(data, cmds...)
+}
+
+// loadCommand returns a load command with the given
+// command and size, filled with zeros
+func loadCommand(cmd LoadCmd, size uint32) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint32(data, uint32(cmd))
+	binary.LittleEndian.PutUint32(data[4:], size)
+	return data
+}
+
+type fatArchHeader struct {
+	cpu    Cpu
+	offset uint64
+	size   uint64
+	align  uint32
+}
+
+// fatHeader returns a universal file header for the given
+// slices, padded or truncated to size bytes
+func fatHeader(fat64 bool, arches []fatArchHeader, size int) []byte {
+	data := make([]byte, fatHeaderSize+len(arches)*fatArch64Size+size)
+	be := binary.BigEndian
+	be.PutUint32(data, MagicFat)
+	if fat64 {
+		be.PutUint32(data, MagicFat64)
+	}
+	be.PutUint32(data[4:], uint32(len(arches)))
+	for ii, a := range arches {
+		if fat64 {
+			p := data[fatHeaderSize+ii*fatArch64Size:]
+			be.PutUint32(p, uint32(a.cpu))
+			be.PutUint64(p[8:], a.offset)
+			be.PutUint64(p[16:], a.size)
+			be.PutUint32(p[24:], a.align)
+		} else {
+			p := data[fatHeaderSize+ii*fatArchSize:]
+			be.PutUint32(p, uint32(a.cpu))
+			be.PutUint32(p[8:], uint32(a.offset))
+			be.PutUint32(p[12:], uint32(a.size))
+			be.PutUint32(p[16:], a.align)
+		}
+	}
+	return data[:size]
+}
+
+func TestParse(t *testing.T) {
+	thin := thinHeader(CpuArm64, 1, loadCommand(LoadCmd(0x1b), 8))
+	b, err := Parse(thin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Fat || len(b.Slices) != 1 || b.Slices[0].Arch() != "arm64" || len(b.Slices[0].Loads) != 1 {
+		t.Errorf("unexpected thin file %+v", b)
+	}
+
+	fat := fatHeader(false, []fatArchHeader{{cpu: CpuArm64, offset: 64, size: uint64(len(thin)), align: 6}}, 64)
+	fat = append(fat, thin...)
+	b, err = Parse(fat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !b.Fat || b.Fat64 || len(b.Slices) != 1 || b.Slices[0].Offset != 64 || b.Slices[0].Align != 6 {
+		t.Errorf("unexpected universal file %+v", b)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	truncated := thinHeader(CpuArm64, 0, nil)[:fileHeaderSize32-1]
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"empty", nil, ErrNotMachO.Error()},
+		{"truncated header", truncated, ErrNotMachO.Error()},
+		{"load commands beyond end", thinHeader(CpuArm64, 1, loadCommand(LoadCmd(0x1b), 8))[:fileHeaderSize64+4], "load commands extend beyond end of file"},
+		{"too many load commands", thinHeader(CpuArm64, 2, loadCommand(LoadCmd(0x1b), 8)), "load command 1 extends beyond load commands area"},
+		{"short load command", thinHeader(CpuArm64, 1, loadCommand(LoadCmd(0x1b), 4)), "load command 0 has invalid size 4"},
+		{"load command beyond area", thinHeader(CpuArm64, 1, loadCommand(LoadCmd(0x1b), 16)), "load command 0 has invalid size 16"},
+		{"fat arches beyond end", fatHeader(false, []fatArchHeader{{cpu: CpuArm64}, {cpu: CpuAmd64}}, 16), "fat header extends beyond end of file"},
+		{"slice beyond end", fatHeader(false, []fatArchHeader{{cpu: CpuArm64, offset: 32, size: 64}}, 64), "slice 0 (arm64) extends beyond end of file"},
+		{"slice offset beyond end", fatHeader(false, []fatArchHeader{{cpu: CpuArm64, offset: 1024}}, 64), "slice 0 (arm64) extends beyond end of file"},
+		{"fat64 offset overflow", fatHeader(true, []fatArchHeader{{cpu: CpuArm64, offset: 1<<64 - 16, size: 32}}, 64), "slice 0 (arm64) extends beyond end of file"},
+		{"fat64 size overflow", fatHeader(true, []fatArchHeader{{cpu: CpuArm64, offset: 48, size: 1<<64 - 16}}, 64), "slice 0 (arm64) extends beyond end of file"},
+		{"alignment too big", fatHeader(false, []fatArchHeader{{cpu: CpuArm64, offset: 32, size: 32, align: 64}}, 64), "slice 0 (arm64) has invalid alignment 2^64"},
+		{"slice not Mach-O", fatHeader(false, []fatArchHeader{{cpu: CpuArm64, offset: 32, size: 32}}, 64), "slice 0 (arm64): " + ErrNotMachO.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.data)
+			if err == nil {
+				t.Fatal("malformed file parsed without errors")
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %q, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestDylibs(t *testing.T) {
+	f := parseTestData(t, "hello_arm64").Slices[0].File
+	var names []string
+	for _, d := range f.Dylibs() {
+		names = append(names, fmt.Sprintf("%s weak=%v", d.Name, d.Weak()))
+	}
+	want := []string{
+		"/usr/lib/libSystem.B.dylib weak=false",
+		"@rpath/libfoo.dylib weak=false",
+		"/opt/local/lib/libbar.1.dylib weak=true",
+	}
+	if got := strings.Join(names, "\n"); got != strings.Join(want, "\n") {
+		t.Errorf("dylibs = %q, want %q", names, want)
+	}
+	if rpaths := f.Rpaths(); len(rpaths) != 1 || rpaths[0].Path != "@executable_path/../Frameworks" {
+		t.Errorf("rpaths = %v", rpaths)
+	}
+	if id := f.DylibID(); id != nil {
+		t.Errorf("executable has install name %s", id.Name)
+	}
+
+	lib := parseTestData(t, "libfoo_arm64.dylib").Slices[0].File
+	if id := lib.DylibID(); id == nil || id.Name != "@rpath/libfoo.dylib" {
+		t.Errorf("install name = %v, want @rpath/libfoo.dylib", id)
+	}
+	if rpaths := lib.Rpaths(); len(rpaths) != 0 {
+		t.Errorf("library has %d rpaths", len(rpaths))
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		s    string
+		want Version
+		err  string
+	}{
+		{s: "10.9", want: 0x000a0900},
+		{s: "11", want: 0x000b0000},
+		{s: "10.15.7", want: 0x000a0f07},
+		{s: "65535.255.255", want: 0xffffffff},
+		{s: "", err: "invalid version"},
+		{s: "10.x", err: "invalid version"},
+		{s: "10.-1", err: "invalid version"},
+		{s: "1.2.3.4", err: "invalid version"},
+		{s: "65536", err: "65536 is larger than 65535"},
+		{s: "10.256", err: "256 is larger than 255"},
+		{s: "10.15.256", err: "256 is larger than 255"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			v, err := ParseVersion(tt.s)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("ParseVersion() = %s, %v, want error %q", v, err, tt.err)
+				}
+				return
+			}
+			if err != nil || v != tt.want {
+				t.Errorf("ParseVersion() = %#x, %v, want %#x", uint32(v), err, uint32(tt.want))
+			}
+		})
+	}
+}
+
+func TestBuildVersion(t *testing.T) {
+	for _, name := range []string{"hello_arm64", "hello_x86_64", "libfoo_arm64.dylib"} {
+		bv := parseTestData(t, name).Slices[0].BuildVersion()
+		if bv == nil || bv.Platform != PlatformMacOS || bv.MinOS.String() != "11.0" || bv.SDK.String() != "12.0" {
+			t.Errorf("%s: build version = %+v", name, bv)
+		}
+	}
+}
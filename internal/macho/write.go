@@ -0,0 +1,411 @@
+package macho
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	codeSignatureCmdSize = 16
+	// Code signatures must start at a 16 byte boundary
+	codeSignatureAlign = 16
+)
+
+func alignUp(v, align uint64) uint64 {
+	return (v + align - 1) &^ (align - 1)
+}
+
+// PageAlign returns the page size used for segments
+// in the file
+func (f *File) PageAlign() uint64 {
+	if f.Cpu == CpuArm64 || f.Cpu == CpuArm6432 {
+		return 0x4000
+	}
+	return 0x1000
+}
+
+// loadCommandsEnd returns the offset where the load commands end
+func (f *File) loadCommandsEnd() uint64 {
+	return uint64(f.HeaderSize()) + uint64(f.ByteOrder.Uint32(f.Data[20:]))
+}
+
+// LoadCommandsSpace returns the number of free bytes between
+// the end of the load commands and the start of the first
+// section.
+func (f *File) LoadCommandsSpace() uint64 {
+	first := uint64(len(f.Data))
+	for _, seg := range f.Segments() {
+		if seg.Filesz > 0 && seg.Offset > 0 && seg.Offset < first {
+			first = seg.Offset
+		}
+		for _, sect := range seg.Sections {
+			if sect.Offset > 0 && uint64(sect.Offset) < first {
+				first = uint64(sect.Offset)
+			}
+		}
+	}
+	end := f.loadCommandsEnd()
+	if first < end {
+		return 0
+	}
+	return first - end
+}
+
+func (f *File) setSegmentSizes(data []byte, seg *Segment, filesz, memsz uint64) {
+	bo := f.ByteOrder
+	p := data[seg.Load.Offset:]
+	if seg.Load.Cmd == LoadCmdSegment64 {
+		bo.PutUint64(p[32:], memsz)
+		bo.PutUint64(p[48:], filesz)
+	} else {
+		bo.PutUint32(p[28:], uint32(memsz))
+		bo.PutUint32(p[36:], uint32(filesz))
+	}
+}
+
+// AllocateSignature returns a copy of the file prepared to hold
+// a code signature of the given size at the end of __LINKEDIT,
+// adding a LC_CODE_SIGNATURE load command if needed. Any existing
+// signature is discarded. The returned data ends where the
+// signature should be appended, so its length is the code limit
+// for the signature.
+func (f *File) AllocateSignature(size uint32) ([]byte, error) {
+	linkedit := f.Segment("__LINKEDIT")
+	if linkedit == nil {
+		return nil, errors.New("missing __LINKEDIT segment")
+	}
+	data := make([]byte, len(f.Data))
+	copy(data, f.Data)
+	bo := f.ByteOrder
+	var offset uint64
+	var cmdOffset uint32
+	if cs := f.CodeSignature(); cs != nil {
+		offset = uint64(cs.DataOff)
+		cmdOffset = cs.Load.Offset
+	} else {
+		if f.LoadCommandsSpace() < codeSignatureCmdSize {
+			return nil, errors.New("not enough space in the header to add LC_CODE_SIGNATURE")
+		}
+		end := f.loadCommandsEnd()
+		cmdOffset = uint32(end)
+		bo.PutUint32(data[cmdOffset:], uint32(LoadCmdCodeSignature))
+		bo.PutUint32(data[cmdOffset+4:], codeSignatureCmdSize)
+		bo.PutUint32(data[16:], bo.Uint32(data[16:])+1)
+		bo.PutUint32(data[20:], bo.Uint32(data[20:])+codeSignatureCmdSize)
+		offset = linkedit.Offset + linkedit.Filesz
+	}
+	if offset < linkedit.Offset {
+		return nil, errors.New("code signature is not inside __LINKEDIT")
+	}
+	offset = alignUp(offset, codeSignatureAlign)
+	if offset+uint64(size) > 1<<32-1 {
+		return nil, fmt.Errorf("file is too big to be signed")
+	}
+	bo.PutUint32(data[cmdOffset+8:], uint32(offset))
+	bo.PutUint32(data[cmdOffset+12:], size)
+	filesz := offset + uint64(size) - linkedit.Offset
+	memsz := alignUp(filesz, f.PageAlign())
+	if linkedit.Memsz > memsz {
+		memsz = linkedit.Memsz
+	}
+	f.setSegmentSizes(data, linkedit, filesz, memsz)
+	if uint64(len(data)) > offset {
+		data = data[:offset]
+	} else {
+		data = append(data, make([]byte, offset-uint64(len(data)))...)
+	}
+	return data, nil
+}
+
+// DefaultAlign returns the default alignment, as a power
+// of 2, for a slice with the given CPU type in a universal
+// file
+func DefaultAlign(cpu Cpu) uint32 {
+	if cpu == CpuArm64 || cpu == CpuArm6432 || cpu == CpuArm {
+		return 14
+	}
+	return 12
+}
+
+// SliceData is used to build universal files
+type SliceData struct {
+	Cpu    Cpu
+	SubCpu uint32
+	// Align is the alignment as a power of 2. If zero,
+	// DefaultAlign() is used.
+	Align uint32
+	Data  []byte
+}
+
+// BuildUniversal returns a universal file containing the given
+// slices. If fat64 is false but the offsets don't fit in 32 bits,
+// a 64 bit fat header is used.
+func BuildUniversal(slices []SliceData, fat64 bool) []byte {
+	offsets := make([]uint64, len(slices))
+	layout := func(archSize int) uint64 {
+		offset := uint64(fatHeaderSize + archSize*len(slices))
+		for ii, s := range slices {
+			align := s.Align
+			if align == 0 {
+				align = DefaultAlign(s.Cpu)
+			}
+			offset = alignUp(offset, 1<<align)
+			offsets[ii] = offset
+			offset += uint64(len(s.Data))
+		}
+		return offset
+	}
+	archSize := fatArchSize
+	if fat64 {
+		archSize = fatArch64Size
+	}
+	total := layout(archSize)
+	if !fat64 && total > 1<<32-1 {
+		fat64 = true
+		archSize = fatArch64Size
+		total = layout(archSize)
+	}
+	data := make([]byte, total)
+	be := binary.BigEndian
+	if fat64 {
+		be.PutUint32(data, MagicFat64)
+	} else {
+		be.PutUint32(data, MagicFat)
+	}
+	be.PutUint32(data[4:], uint32(len(slices)))
+	for ii, s := range slices {
+		p := data[fatHeaderSize+ii*archSize:]
+		align := s.Align
+		if align == 0 {
+			align = DefaultAlign(s.Cpu)
+		}
+		be.PutUint32(p, uint32(s.Cpu))
+		be.PutUint32(p[4:], s.SubCpu)
+		if fat64 {
+			be.PutUint64(p[8:], offsets[ii])
+			be.PutUint64(p[16:], uint64(len(s.Data)))
+			be.PutUint32(p[24:], align)
+		} else {
+			be.PutUint32(p[8:], uint32(offsets[ii]))
+			be.PutUint32(p[12:], uint32(len(s.Data)))
+			be.PutUint32(p[16:], align)
+		}
+		copy(data[offsets[ii]:], s.Data)
+	}
+	return data
+}
+
+// RemoveSignature returns a copy of the file without its code
+// signature, removing the LC_CODE_SIGNATURE load command and
+// truncating __LINKEDIT, or nil if the file is not signed.
+func (f *File) RemoveSignature() ([]byte, error) {
+	cs := f.CodeSignature()
+	if cs == nil {
+		return nil, nil
+	}
+	linkedit := f.Segment("__LINKEDIT")
+	if linkedit == nil {
+		return nil, errors.New("missing __LINKEDIT segment")
+	}
+	offset := uint64(cs.DataOff)
+	if offset < linkedit.Offset || offset+uint64(cs.DataSize) != linkedit.Offset+linkedit.Filesz {
+		return nil, errors.New("code signature is not at the end of __LINKEDIT")
+	}
+	data := make([]byte, offset)
+	copy(data, f.Data)
+	bo := f.ByteOrder
+	// Resize __LINKEDIT before moving the load commands, since
+	// its command might come after LC_CODE_SIGNATURE
+	filesz := offset - linkedit.Offset
+	f.setSegmentSizes(data, linkedit, filesz, alignUp(filesz, f.PageAlign()))
+	// Move the following load commands over LC_CODE_SIGNATURE
+	// and clear the space it leaves at the end
+	end := f.loadCommandsEnd()
+	cmdStart := uint64(cs.Load.Offset)
+	cmdSize := uint64(len(cs.Load.Raw))
+	copy(data[cmdStart:], data[cmdStart+cmdSize:end])
+	for ii := end - cmdSize; ii < end; ii++ {
+		data[ii] = 0
+	}
+	bo.PutUint32(data[16:], bo.Uint32(data[16:])-1)
+	bo.PutUint32(data[20:], bo.Uint32(data[20:])-uint32(cmdSize))
+	return data, nil
+}
+
+// RemoveSignatures returns a copy of the binary without the
+// code signatures in any of its slices, or nil if none of
+// them is signed. The layout of universal files is kept.
+func (b *Binary) RemoveSignatures() ([]byte, error) {
+	var slices []SliceData
+	removed := false
+	for _, s := range b.Slices {
+		data, err := s.File.RemoveSignature()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.Arch(), err)
+		}
+		if data != nil {
+			removed = true
+		} else {
+			data = s.File.Data
+		}
+		slices = append(slices, SliceData{
+			Cpu:    s.File.Cpu,
+			SubCpu: s.File.SubCpu,
+			Align:  s.Align,
+			Data:   data,
+		})
+	}
+	if !removed {
+		return nil, nil
+	}
+	if !b.Fat {
+		return slices[0].Data, nil
+	}
+	return BuildUniversal(slices, b.Fat64), nil
+}
+
+// Relink describes changes to the libraries referenced by
+// a file, like the ones made by install_name_tool
+type Relink struct {
+	// ID replaces the install name of a library, if not empty
+	ID string
+	// Dylibs maps the names of the libraries loaded by the
+	// file to their replacements
+	Dylibs map[string]string
+	// Rpaths contains the run paths to add, unless the file
+	// already has them
+	Rpaths []string
+}
+
+// stringCommand returns a load command made of the fixed
+// part, whose first lc_str field is at offset 8, followed by s
+func (f *File) stringCommand(fixed []byte, s string) []byte {
+	align := uint64(4)
+	if f.Is64() {
+		align = 8
+	}
+	size := alignUp(uint64(len(fixed)+len(s)+1), align)
+	raw := make([]byte, size)
+	copy(raw, fixed)
+	copy(raw[len(fixed):], s)
+	f.ByteOrder.PutUint32(raw[4:], uint32(size))
+	f.ByteOrder.PutUint32(raw[8:], uint32(len(fixed)))
+	return raw
+}
+
+// replaceLoads returns a copy of the file with the given
+// load commands, which must fit before the first section
+func (f *File) replaceLoads(loads [][]byte) ([]byte, error) {
+	start := uint64(f.HeaderSize())
+	end := f.loadCommandsEnd()
+	limit := end + f.LoadCommandsSpace()
+	size := uint64(0)
+	for _, raw := range loads {
+		size += uint64(len(raw))
+	}
+	if start+size > limit {
+		return nil, fmt.Errorf("not enough space in the header for %d bytes of load commands, only %d available", size, limit-start)
+	}
+	data := make([]byte, len(f.Data))
+	copy(data, f.Data)
+	offset := start
+	for _, raw := range loads {
+		copy(data[offset:], raw)
+		offset += uint64(len(raw))
+	}
+	// Clear the space left by shorter load commands
+	for ii := offset; ii < end; ii++ {
+		data[ii] = 0
+	}
+	bo := f.ByteOrder
+	bo.PutUint32(data[16:], uint32(len(loads)))
+	bo.PutUint32(data[20:], uint32(size))
+	return data, nil
+}
+
+// Relink returns a copy of the file with the changes in r
+// applied, or nil if it doesn't need any changes. Since the
+// changes invalidate the code signature, it's removed.
+func (f *File) Relink(r *Relink) ([]byte, error) {
+	if data, err := f.RemoveSignature(); err != nil {
+		return nil, err
+	} else if data != nil {
+		if f, err = NewFile(data); err != nil {
+			return nil, err
+		}
+	}
+	var loads [][]byte
+	changed := false
+	rpaths := make(map[string]bool)
+	for _, l := range f.Loads {
+		raw := l.Raw
+		switch l.Cmd {
+		case LoadCmdIDDylib:
+			if d := f.dylib(l); d != nil && r.ID != "" && d.Name != r.ID {
+				raw = f.stringCommand(l.Raw[:24], r.ID)
+				changed = true
+			}
+		case LoadCmdLoadDylib, LoadCmdLoadWeakDylib, LoadCmdReexportDylib, LoadCmdLazyLoadDylib, LoadCmdLoadUpwardDylib:
+			// The order of these commands must be kept, since
+			// the bindings reference the libraries by index
+			if d := f.dylib(l); d != nil {
+				if name, ok := r.Dylibs[d.Name]; ok && name != d.Name {
+					raw = f.stringCommand(l.Raw[:24], name)
+					changed = true
+				}
+			}
+		case LoadCmdRpath:
+			if len(l.Raw) >= 12 {
+				rpaths[l.lcString(f.ByteOrder, 8)] = true
+			}
+		}
+		loads = append(loads, raw)
+	}
+	for _, p := range r.Rpaths {
+		if rpaths[p] {
+			continue
+		}
+		rpaths[p] = true
+		fixed := make([]byte, 12)
+		f.ByteOrder.PutUint32(fixed, uint32(LoadCmdRpath))
+		loads = append(loads, f.stringCommand(fixed, p))
+		changed = true
+	}
+	if !changed {
+		return nil, nil
+	}
+	return f.replaceLoads(loads)
+}
+
+// Relink applies the changes in r to every slice of the
+// binary, returning nil if none of them needs any changes.
+// The layout of universal files is kept.
+func (b *Binary) Relink(r *Relink) ([]byte, error) {
+	var slices []SliceData
+	changed := false
+	for _, s := range b.Slices {
+		data, err := s.File.Relink(r)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", s.Arch(), err)
+		}
+		if data != nil {
+			changed = true
+		} else {
+			data = s.File.Data
+		}
+		slices = append(slices, SliceData{
+			Cpu:    s.File.Cpu,
+			SubCpu: s.File.SubCpu,
+			Align:  s.Align,
+			Data:   data,
+		})
+	}
+	if !changed {
+		return nil, nil
+	}
+	if !b.Fat {
+		return slices[0].Data, nil
+	}
+	return BuildUniversal(slices, b.Fat64), nil
+}
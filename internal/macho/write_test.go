@@ -0,0 +1,210 @@
+package macho
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The files in testdata are minimal executables and libraries
+// with __TEXT and __LINKEDIT segments. The .signed ones were
+// ad-hoc signed by macapptool sign -native.
+
+func readTestData(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func parseTestData(t *testing.T, name string) *Binary {
+	b, err := Parse(readTestData(t, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestRemoveSignature(t *testing.T) {
+	unsigned := readTestData(t, "hello_arm64")
+	signed := parseTestData(t, "hello_arm64.signed")
+	if signed.Slices[0].CodeSignature() == nil {
+		t.Fatal("test file is not signed")
+	}
+	data, err := signed.Slices[0].RemoveSignature()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, unsigned) {
+		t.Error("removing the signature doesn't restore the unsigned file")
+	}
+
+	b, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := b.Slices[0].RemoveSignature(); data != nil || err != nil {
+		t.Errorf("RemoveSignature() = %d bytes, %v for an unsigned file", len(data), err)
+	}
+	if data, err := b.RemoveSignatures(); data != nil || err != nil {
+		t.Errorf("RemoveSignatures() = %d bytes, %v for an unsigned file", len(data), err)
+	}
+}
+
+func TestRemoveSignaturesUniversal(t *testing.T) {
+	var signed, unsigned []SliceData
+	for _, name := range []string{"hello_arm64", "hello_x86_64"} {
+		for _, s := range parseTestData(t, name+".signed").Slices {
+			signed = append(signed, SliceData{Cpu: s.File.Cpu, SubCpu: s.File.SubCpu, Data: s.Data})
+		}
+		for _, s := range parseTestData(t, name).Slices {
+			unsigned = append(unsigned, SliceData{Cpu: s.File.Cpu, SubCpu: s.File.SubCpu, Data: s.Data})
+		}
+	}
+	// Only the first slice is signed
+	mixed := []SliceData{signed[0], unsigned[1]}
+	for _, slices := range [][]SliceData{signed, mixed} {
+		b, err := Parse(BuildUniversal(slices, false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := b.RemoveSignatures()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, BuildUniversal(unsigned, false)) {
+			t.Error("removing the signatures doesn't restore the unsigned universal file")
+		}
+	}
+}
+
+func TestRemoveSignatureMalformed(t *testing.T) {
+	signed := readTestData(t, "hello_arm64.signed")
+	// Data after the signature, like the one added by
+	// some installers, can't be removed safely
+	f, err := NewFile(append(append([]byte(nil), signed...), make([]byte, 16)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := f.ByteOrder
+	seg := f.Segment("__LINKEDIT")
+	le.PutUint64(f.Data[seg.Load.Offset+48:], seg.Filesz+16)
+	f, err = NewFile(f.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.RemoveSignature(); err == nil || !strings.Contains(err.Error(), "not at the end of __LINKEDIT") {
+		t.Errorf("error = %v, want not at the end of __LINKEDIT", err)
+	}
+}
+
+func TestBuildUniversal(t *testing.T) {
+	arm64 := parseTestData(t, "hello_arm64").Slices[0]
+	x86 := parseTestData(t, "hello_x86_64").Slices[0]
+	for _, fat64 := range []bool{false, true} {
+		data := BuildUniversal([]SliceData{
+			{Cpu: x86.File.Cpu, SubCpu: x86.File.SubCpu, Data: x86.Data},
+			{Cpu: arm64.File.Cpu, SubCpu: arm64.File.SubCpu, Align: 15, Data: arm64.Data},
+		}, fat64)
+		b, err := Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !b.Fat || b.Fat64 != fat64 {
+			t.Errorf("fat = %v, fat64 = %v, want fat64 = %v", b.Fat, b.Fat64, fat64)
+		}
+		if got := strings.Join(b.Arches(), ","); got != "x86_64,arm64" {
+			t.Errorf("arches = %s", got)
+		}
+		for ii, want := range []struct {
+			align uint32
+			data  []byte
+		}{{12, x86.Data}, {15, arm64.Data}} {
+			s := b.Slices[ii]
+			if s.Align != want.align || s.Offset%(1<<s.Align) != 0 {
+				t.Errorf("%s: offset = %#x, align = 2^%d, want 2^%d", s.Arch(), s.Offset, s.Align, want.align)
+			}
+			if !bytes.Equal(s.Data, want.data) {
+				t.Errorf("%s: data doesn't match the thin file", s.Arch())
+			}
+		}
+	}
+}
+
+func TestRelink(t *testing.T) {
+	signed := parseTestData(t, "hello_arm64.signed")
+	unsigned := readTestData(t, "hello_arm64")
+	r := &Relink{
+		Dylibs: map[string]string{
+			"/opt/local/lib/libbar.1.dylib": "@rpath/libbar.1.dylib",
+			"/usr/local/lib/libbaz.dylib":   "@rpath/libbaz.dylib",
+		},
+		Rpaths: []string{"@executable_path/../Frameworks", "@loader_path/../lib"},
+	}
+	data, err := signed.Relink(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := b.Slices[0].File
+	if f.CodeSignature() != nil {
+		t.Error("signature not removed")
+	}
+	var names []string
+	for _, d := range f.Dylibs() {
+		names = append(names, d.Name)
+	}
+	// The order of the libraries is kept, and weak ones stay weak
+	if got := strings.Join(names, ","); got != "/usr/lib/libSystem.B.dylib,@rpath/libfoo.dylib,@rpath/libbar.1.dylib" {
+		t.Errorf("dylibs = %s", got)
+	}
+	if !f.Dylibs()[2].Weak() {
+		t.Error("libbar is no longer weak")
+	}
+	var rpaths []string
+	for _, rp := range f.Rpaths() {
+		rpaths = append(rpaths, rp.Path)
+	}
+	if got := strings.Join(rpaths, ","); got != "@executable_path/../Frameworks,@loader_path/../lib" {
+		t.Errorf("rpaths = %s", got)
+	}
+	// Only the header changes
+	text := f.Segment("__TEXT").Sections[0]
+	if !bytes.Equal(data[text.Offset:], unsigned[text.Offset:]) {
+		t.Error("contents after the load commands changed")
+	}
+	if data, err := b.Relink(r); data != nil || err != nil {
+		t.Errorf("Relink() = %d bytes, %v when already relinked", len(data), err)
+	}
+
+	// Changing the install name back restores the library
+	lib := parseTestData(t, "libfoo_arm64.dylib")
+	data, err = lib.Relink(&Relink{ID: "/usr/local/lib/libfoo.1.dylib"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = Parse(data); err != nil {
+		t.Fatal(err)
+	}
+	if id := b.Slices[0].DylibID(); id == nil || id.Name != "/usr/local/lib/libfoo.1.dylib" {
+		t.Fatalf("install name = %v", id)
+	}
+	if data, err = b.Relink(&Relink{ID: "@rpath/libfoo.dylib"}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, readTestData(t, "libfoo_arm64.dylib")) {
+		t.Error("restoring the install name doesn't restore the original file")
+	}
+
+	// The load commands must fit before __text
+	long := "@loader_path/" + strings.Repeat("x", 0x400)
+	if _, err := signed.Relink(&Relink{Rpaths: []string{long}}); err == nil || !strings.Contains(err.Error(), "not enough space") {
+		t.Errorf("error = %v, want not enough space", err)
+	}
+}
@@ -12,9 +12,12 @@ import (
 )
 
 const (
+	CFBundleExecutable         = "CFBundleExecutable"
 	CFBundleIdentifier         = "CFBundleIdentifier"
 	CFBundleName               = "CFBundleName"
 	CFBundleShortVersionString = "CFBundleShortVersionString"
+	CFBundleVersion            = "CFBundleVersion"
+	LSMinimumSystemVersion     = "LSMinimumSystemVersion"
 )
 
 type ErrKeyNotFound struct {
@@ -95,6 +98,10 @@ func (pl *PList) BundleName() (string, error) {
 	return pl.stringKey(CFBundleName)
 }
 
+func (pl *PList) BundleExecutable() (string, error) {
+	return pl.stringKey(CFBundleExecutable)
+}
+
 func (pl *PList) BundleIdentifier() (string, error) {
 	return pl.stringKey(CFBundleIdentifier)
 }
@@ -102,3 +109,17 @@ func (pl *PList) BundleIdentifier() (string, error) {
 func (pl *PList) BundleShortVersionString() (string, error) {
 	return pl.stringKey(CFBundleShortVersionString)
 }
+
+func (pl *PList) BundleVersion() (string, error) {
+	return pl.stringKey(CFBundleVersion)
+}
+
+func (pl *PList) MinimumSystemVersion() (string, error) {
+	return pl.stringKey(LSMinimumSystemVersion)
+}
+
+// Has returns true iff the plist contains the given key
+func (pl *PList) Has(key string) bool {
+	_, found := pl.data[key]
+	return found
+}
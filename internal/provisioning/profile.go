@@ -0,0 +1,209 @@
+// Package provisioning decodes and validates provisioning
+// profiles.
+package provisioning
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"howett.net/plist"
+
+	"macapptool/internal/cms"
+)
+
+// Entitlement keys for the application identifier, used on
+// macOS and on the other platforms respectively
+const (
+	macApplicationIdentifier = "com.apple.application-identifier"
+	applicationIdentifier    = "application-identifier"
+)
+
+// Profile is a decoded provisioning profile
+type Profile struct {
+	Name                        string                 `plist:"Name"`
+	UUID                        string                 `plist:"UUID"`
+	AppIDName                   string                 `plist:"AppIDName"`
+	TeamName                    string                 `plist:"TeamName"`
+	TeamIdentifier              []string               `plist:"TeamIdentifier"`
+	ApplicationIdentifierPrefix []string               `plist:"ApplicationIdentifierPrefix"`
+	Platform                    []string               `plist:"Platform"`
+	CreationDate                time.Time              `plist:"CreationDate"`
+	ExpirationDate              time.Time              `plist:"ExpirationDate"`
+	Entitlements                map[string]interface{} `plist:"Entitlements"`
+	DeveloperCertificates       [][]byte               `plist:"DeveloperCertificates"`
+	ProvisionedDevices          []string               `plist:"ProvisionedDevices"`
+	ProvisionsAllDevices        bool                   `plist:"ProvisionsAllDevices"`
+
+	// Raw contains the encoded profile
+	Raw []byte `plist:"-"`
+}
+
+// Parse decodes a provisioning profile, which is a plist
+// wrapped in a CMS SignedData
+func Parse(data []byte) (*Profile, error) {
+	sd, err := cms.Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid provisioning profile: %v", err)
+	}
+	if len(sd.Content) == 0 {
+		return nil, errors.New("provisioning profile doesn't contain a plist")
+	}
+	var p Profile
+	if _, err := plist.Unmarshal(sd.Content, &p); err != nil {
+		return nil, fmt.Errorf("invalid provisioning profile plist: %v", err)
+	}
+	p.Raw = data
+	return &p, nil
+}
+
+// ParseFile decodes the provisioning profile at path
+func ParseFile(path string) (*Profile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// TeamID returns the team identifier of the profile
+func (p *Profile) TeamID() string {
+	if len(p.TeamIdentifier) > 0 {
+		return p.TeamIdentifier[0]
+	}
+	return ""
+}
+
+// AppID returns the application identifier pattern in the
+// profile, including the team prefix, like TEAMID.com.example.*
+func (p *Profile) AppID() string {
+	for _, key := range []string{macApplicationIdentifier, applicationIdentifier} {
+		if s, ok := p.Entitlements[key].(string); ok {
+			return s
+		}
+	}
+	return ""
+}
+
+// matchPattern returns true if value matches pattern, where a
+// trailing * in pattern matches any suffix
+func matchPattern(pattern, value string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(value, strings.TrimSuffix(pattern, "*"))
+	}
+	return pattern == value
+}
+
+// MatchesBundleID returns true iff the profile application
+// identifier pattern allows the given bundle ID
+func (p *Profile) MatchesBundleID(bundleID string) bool {
+	appID := p.AppID()
+	prefix := p.TeamID() + "."
+	if len(p.ApplicationIdentifierPrefix) > 0 {
+		prefix = p.ApplicationIdentifierPrefix[0] + "."
+	}
+	if !strings.HasPrefix(appID, prefix) {
+		return false
+	}
+	return matchPattern(strings.TrimPrefix(appID, prefix), bundleID)
+}
+
+// ContainsCertificate returns true iff cert is one of the
+// certificates allowed to sign with the profile
+func (p *Profile) ContainsCertificate(cert *x509.Certificate) bool {
+	for _, v := range p.DeveloperCertificates {
+		if bytes.Equal(v, cert.Raw) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsValue returns true if the value in the profile allows
+// the requested one. Strings in the profile can end with a *
+// to allow any value with that prefix, and arrays allow
+// any subset of their elements.
+func allowsValue(allowed, requested interface{}) bool {
+	switch a := allowed.(type) {
+	case string:
+		switch r := requested.(type) {
+		case string:
+			return matchPattern(a, r)
+		case []interface{}:
+			for _, v := range r {
+				if !allowsValue(a, v) {
+					return false
+				}
+			}
+			return true
+		}
+	case []interface{}:
+		if r, ok := requested.([]interface{}); ok {
+			for _, v := range r {
+				if !allowsValue(a, v) {
+					return false
+				}
+			}
+			return true
+		}
+		for _, v := range a {
+			if allowsValue(v, requested) {
+				return true
+			}
+		}
+		return false
+	case bool:
+		// true allows both values, false only allows false
+		r, ok := requested.(bool)
+		return ok && (a || !r)
+	}
+	return reflect.DeepEqual(allowed, requested)
+}
+
+// isRestricted returns true if the entitlement needs to be
+// allowed by the profile. The sandbox and hardened runtime
+// entitlements are available to every app.
+func isRestricted(key string) bool {
+	return !strings.HasPrefix(key, "com.apple.security.")
+}
+
+// Check validates the profile for signing the bundle with the
+// given ID and team ID, requesting ents at time now. It returns
+// a list with all the problems found.
+func (p *Profile) Check(bundleID string, teamID string, ents map[string]interface{}, now time.Time) []error {
+	var errs []error
+	if now.After(p.ExpirationDate) {
+		errs = append(errs, fmt.Errorf("profile %q expired on %s", p.Name, p.ExpirationDate.Format(time.RFC3339)))
+	}
+	if teamID != "" && p.TeamID() != teamID {
+		errs = append(errs, fmt.Errorf("profile %q belongs to team %s, not %s", p.Name, p.TeamID(), teamID))
+	}
+	if !p.MatchesBundleID(bundleID) {
+		errs = append(errs, fmt.Errorf("profile %q for %s doesn't match bundle ID %s", p.Name, p.AppID(), bundleID))
+	}
+	keys := make([]string, 0, len(ents))
+	for k := range ents {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !isRestricted(k) {
+			continue
+		}
+		allowed, found := p.Entitlements[k]
+		if !found {
+			errs = append(errs, fmt.Errorf("entitlement %s is not allowed by profile %q", k, p.Name))
+			continue
+		}
+		if !allowsValue(allowed, ents[k]) {
+			errs = append(errs, fmt.Errorf("value %v for entitlement %s is not allowed by profile %q, which allows %v", ents[k], k, p.Name, allowed))
+		}
+	}
+	return errs
+}
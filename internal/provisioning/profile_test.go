@@ -0,0 +1,299 @@
+package provisioning
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"strings"
+	"testing"
+	"time"
+
+	"macapptool/internal/cms"
+)
+
+const testProfilePlist = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>AppIDName</key><string>Example</string>
+	<key>ApplicationIdentifierPrefix</key><array><string>ABCDE12345</string></array>
+	<key>CreationDate</key><date>2024-01-01T00:00:00Z</date>
+	<key>DeveloperCertificates</key><array><data>Y2VydGlmaWNhdGUgQQ==</data></array>
+	<key>Entitlements</key>
+	<dict>
+		<key>com.apple.application-identifier</key><string>ABCDE12345.com.example.*</string>
+		<key>com.apple.developer.team-identifier</key><string>ABCDE12345</string>
+		<key>keychain-access-groups</key><array><string>ABCDE12345.*</string></array>
+		<key>com.apple.developer.icloud-container-environment</key><array><string>Development</string><string>Production</string></array>
+		<key>com.apple.developer.aps-environment</key><string>production</string>
+		<key>get-task-allow</key><false/>
+	</dict>
+	<key>ExpirationDate</key><date>2025-01-01T00:00:00Z</date>
+	<key>Name</key><string>Example Developer ID</string>
+	<key>Platform</key><array><string>OSX</string></array>
+	<key>ProvisionsAllDevices</key><true/>
+	<key>TeamIdentifier</key><array><string>ABCDE12345</string></array>
+	<key>TeamName</key><string>Example Inc.</string>
+	<key>UUID</key><string>01234567-89AB-CDEF-0123-456789ABCDEF</string>
+</dict>
+</plist>`
+
+// berConstructed returns a BER constructed element with an
+// indefinite length, like the ones in provisioning profiles
+func berConstructed(tag byte, children ...[]byte) []byte {
+	data := []byte{tag, 0x80}
+	for _, v := range children {
+		data = append(data, v...)
+	}
+	return append(data, 0, 0)
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := asn1.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testProfile returns an unsigned CMS SignedData containing
+// content, encoded like Apple does with indefinite lengths and
+// the content split in a constructed OCTET STRING
+func testProfile(t *testing.T, content string) []byte {
+	var chunks [][]byte
+	for len(content) > 0 {
+		n := 100
+		if n > len(content) {
+			n = len(content)
+		}
+		chunks = append(chunks, mustMarshal(t, []byte(content[:n])))
+		content = content[n:]
+	}
+	encap := [][]byte{mustMarshal(t, cms.OIDData)}
+	if len(chunks) > 0 {
+		encap = append(encap, berConstructed(0xa0, berConstructed(0x24, chunks...)))
+	}
+	signedData := berConstructed(0x30,
+		mustMarshal(t, 1),
+		[]byte{0x31, 0},
+		berConstructed(0x30, encap...),
+		[]byte{0x31, 0},
+	)
+	return berConstructed(0x30, mustMarshal(t, cms.OIDSignedData), berConstructed(0xa0, signedData))
+}
+
+func TestParse(t *testing.T) {
+	data := testProfile(t, testProfilePlist)
+	p, err := Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "Example Developer ID" || p.UUID != "01234567-89AB-CDEF-0123-456789ABCDEF" || p.TeamName != "Example Inc." {
+		t.Errorf("name = %q, UUID = %q, team name = %q", p.Name, p.UUID, p.TeamName)
+	}
+	if p.TeamID() != "ABCDE12345" || p.AppID() != "ABCDE12345.com.example.*" {
+		t.Errorf("team ID = %q, app ID = %q", p.TeamID(), p.AppID())
+	}
+	if want := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC); !p.ExpirationDate.Equal(want) {
+		t.Errorf("expiration date = %s, want %s", p.ExpirationDate, want)
+	}
+	if len(p.DeveloperCertificates) != 1 || string(p.DeveloperCertificates[0]) != "certificate A" {
+		t.Errorf("developer certificates = %q", p.DeveloperCertificates)
+	}
+	if !p.ProvisionsAllDevices || !bytes.Equal(p.Raw, data) {
+		t.Errorf("provisions all devices = %v, raw = %d bytes", p.ProvisionsAllDevices, len(p.Raw))
+	}
+	if !p.ContainsCertificate(&x509.Certificate{Raw: []byte("certificate A")}) {
+		t.Error("certificate in the profile not found")
+	}
+	if p.ContainsCertificate(&x509.Certificate{Raw: []byte("certificate B")}) {
+		t.Error("certificate not in the profile found")
+	}
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"not CMS", []byte(testProfilePlist), "invalid provisioning profile"},
+		{"no content", testProfile(t, ""), "doesn't contain a plist"},
+		{"not a plist", testProfile(t, "not a plist"), "invalid provisioning profile plist"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Parse(tt.data); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %s", err, tt.err)
+			}
+		})
+	}
+}
+
+func parseTestProfile(t *testing.T) *Profile {
+	p, err := Parse(testProfile(t, testProfilePlist))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCheck(t *testing.T) {
+	valid := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		bundleID string
+		teamID   string
+		ents     map[string]interface{}
+		now      time.Time
+		errs     []string
+	}{
+		{
+			name:     "valid",
+			bundleID: "com.example.app",
+			teamID:   "ABCDE12345",
+			ents: map[string]interface{}{
+				"com.apple.application-identifier":                 "ABCDE12345.com.example.app",
+				"keychain-access-groups":                           []interface{}{"ABCDE12345.com.example.shared"},
+				"com.apple.developer.icloud-container-environment": "Production",
+				"get-task-allow":                                   false,
+				// Sandbox entitlements don't need to be in the profile
+				"com.apple.security.app-sandbox": true,
+			},
+			now: valid,
+		},
+		{
+			name:     "no team",
+			bundleID: "com.example.app",
+			now:      valid,
+		},
+		{
+			name:     "expired",
+			bundleID: "com.example.app",
+			now:      time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC),
+			errs:     []string{`profile "Example Developer ID" expired on 2025-01-01T00:00:00Z`},
+		},
+		{
+			name:     "team mismatch",
+			bundleID: "com.example.app",
+			teamID:   "ZZZZZ99999",
+			now:      valid,
+			errs:     []string{"belongs to team ABCDE12345, not ZZZZZ99999"},
+		},
+		{
+			name:     "bundle ID mismatch",
+			bundleID: "org.example.app",
+			now:      valid,
+			errs:     []string{"for ABCDE12345.com.example.* doesn't match bundle ID org.example.app"},
+		},
+		{
+			name:     "entitlement not in profile",
+			bundleID: "com.example.app",
+			ents:     map[string]interface{}{"com.apple.developer.networking.vpn.api": []interface{}{"allow-vpn"}},
+			now:      valid,
+			errs:     []string{"entitlement com.apple.developer.networking.vpn.api is not allowed"},
+		},
+		{
+			name:     "values not allowed",
+			bundleID: "com.example.app",
+			ents: map[string]interface{}{
+				"com.apple.developer.aps-environment": "development",
+				"get-task-allow":                      true,
+				"keychain-access-groups":              []interface{}{"ABCDE12345.shared", "ZZZZZ99999.shared"},
+			},
+			now: valid,
+			errs: []string{
+				"value development for entitlement com.apple.developer.aps-environment is not allowed",
+				"value true for entitlement get-task-allow is not allowed",
+				"value [ABCDE12345.shared ZZZZZ99999.shared] for entitlement keychain-access-groups is not allowed",
+			},
+		},
+		{
+			name:     "every problem",
+			bundleID: "org.example.app",
+			teamID:   "ZZZZZ99999",
+			now:      time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			errs:     []string{"expired", "belongs to team", "doesn't match bundle ID"},
+		},
+	}
+	p := parseTestProfile(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := p.Check(tt.bundleID, tt.teamID, tt.ents, tt.now)
+			if len(errs) != len(tt.errs) {
+				t.Fatalf("errors = %v, want %d", errs, len(tt.errs))
+			}
+			for ii, err := range errs {
+				if !strings.Contains(err.Error(), tt.errs[ii]) {
+					t.Errorf("error = %q, want %q", err, tt.errs[ii])
+				}
+			}
+		})
+	}
+}
+
+func TestMatchesBundleID(t *testing.T) {
+	tests := []struct {
+		appID    string
+		prefix   string
+		bundleID string
+		want     bool
+	}{
+		{"ABCDE12345.*", "", "com.example.app", true},
+		{"ABCDE12345.*", "", "org.example", true},
+		{"ABCDE12345.com.example.*", "", "com.example.app", true},
+		{"ABCDE12345.com.example.*", "", "com.example.app.helper", true},
+		{"ABCDE12345.com.example.*", "", "com.other.app", false},
+		{"ABCDE12345.com.example.app", "", "com.example.app", true},
+		{"ABCDE12345.com.example.app", "", "com.example.app.helper", false},
+		{"ZZZZZ99999.com.example.app", "", "com.example.app", false},
+		// Old profiles have a prefix which isn't the team ID
+		{"XYZ9876543.com.example.app", "XYZ9876543", "com.example.app", true},
+		{"com.example.app", "", "com.example.app", false},
+	}
+	for _, tt := range tests {
+		p := &Profile{
+			TeamIdentifier: []string{"ABCDE12345"},
+			Entitlements:   map[string]interface{}{"application-identifier": tt.appID},
+		}
+		if tt.prefix != "" {
+			p.ApplicationIdentifierPrefix = []string{tt.prefix}
+		}
+		if got := p.MatchesBundleID(tt.bundleID); got != tt.want {
+			t.Errorf("%s: MatchesBundleID(%q) = %v, want %v", tt.appID, tt.bundleID, got, tt.want)
+		}
+	}
+}
+
+func TestAllowsValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   interface{}
+		requested interface{}
+		want      bool
+	}{
+		{"same string", "production", "production", true},
+		{"different string", "production", "development", false},
+		{"wildcard", "*", "anything", true},
+		{"team wildcard", "ABCDE12345.*", "ABCDE12345.com.example.group", true},
+		{"team wildcard other team", "ABCDE12345.*", "ZZZZZ99999.com.example.group", false},
+		{"wildcard array", "ABCDE12345.*", []interface{}{"ABCDE12345.a", "ABCDE12345.b"}, true},
+		{"wildcard array other team", "ABCDE12345.*", []interface{}{"ABCDE12345.a", "ZZZZZ99999.b"}, false},
+		{"array string", []interface{}{"Development", "Production"}, "Production", true},
+		{"array other string", []interface{}{"Development", "Production"}, "Staging", false},
+		{"array subset", []interface{}{"a", "b", "c"}, []interface{}{"c", "a"}, true},
+		{"array not subset", []interface{}{"a", "b"}, []interface{}{"a", "d"}, false},
+		{"array wildcard", []interface{}{"ABCDE12345.*"}, []interface{}{"ABCDE12345.a"}, true},
+		{"true allows false", true, false, true},
+		{"true allows true", true, true, true},
+		{"false allows false", false, false, true},
+		{"false rejects true", false, true, false},
+		{"bool rejects string", true, "true", false},
+		{"numbers", uint64(1), uint64(1), true},
+		{"different numbers", uint64(1), uint64(2), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowsValue(tt.allowed, tt.requested); got != tt.want {
+				t.Errorf("allowsValue(%v, %v) = %v, want %v", tt.allowed, tt.requested, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+// Package testpki generates certificates for tests
+package testpki
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Cert is a certificate with its private key
+type Cert struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+}
+
+// Options configures the certificates returned by New. The
+// zero value is an ECDSA code signing certificate, valid from
+// an hour ago to an hour from now.
+type Options struct {
+	// CA makes the certificate a certificate authority. CAs
+	// have no extended key usage, so they can issue
+	// certificates for any usage.
+	CA bool
+	// RSA uses a 2048 bit RSA key instead of a P-256 one
+	RSA bool
+	// Usage overrides the extended key usage
+	Usage []x509.ExtKeyUsage
+	// OrganizationalUnit is the subject OU, where Apple puts
+	// the team ID
+	OrganizationalUnit string
+	// IssuerURL is the URL of the issuer certificate, in the
+	// Authority Information Access extension
+	IssuerURL string
+	NotBefore time.Time
+	NotAfter  time.Time
+	// Extensions are added to the certificate, like the ones
+	// Apple uses to mark Developer ID certificates
+	Extensions []pkix.Extension
+}
+
+// Key returns a new P-256 or, if rsaKey is true, RSA key
+func Key(t testing.TB, rsaKey bool) crypto.Signer {
+	var key crypto.Signer
+	var err error
+	if rsaKey {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	} else {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// New returns a certificate issued by parent, or a self-signed
+// one if parent is nil. opts might be nil.
+func New(t testing.TB, name string, parent *Cert, opts *Options) *Cert {
+	if opts == nil {
+		opts = &Options{}
+	}
+	key := Key(t, opts.RSA)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             opts.NotBefore,
+		NotAfter:              opts.NotAfter,
+		BasicConstraintsValid: true,
+		IsCA:                  opts.CA,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           opts.Usage,
+		ExtraExtensions:       opts.Extensions,
+	}
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = now.Add(-time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = now.Add(time.Hour)
+	}
+	if opts.CA {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else if tmpl.ExtKeyUsage == nil {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+	}
+	if opts.OrganizationalUnit != "" {
+		tmpl.Subject.OrganizationalUnit = []string{opts.OrganizationalUnit}
+	}
+	if opts.IssuerURL != "" {
+		tmpl.IssuingCertificateURL = []string{opts.IssuerURL}
+	}
+	issuer, issuerKey := tmpl, key
+	if parent != nil {
+		issuer, issuerKey = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Cert{Cert: cert, Key: key}
+}
+
+// PKI is a root CA with an intermediate CA, which issues the
+// leaf certificates
+type PKI struct {
+	Root         *Cert
+	Intermediate *Cert
+}
+
+// NewPKI returns a new root and intermediate CA
+func NewPKI(t testing.TB) *PKI {
+	root := New(t, "Test Root CA", nil, &Options{CA: true})
+	return &PKI{
+		Root:         root,
+		Intermediate: New(t, "Test Intermediate CA", root, &Options{CA: true}),
+	}
+}
+
+// Issue returns a certificate issued by the intermediate CA
+func (p *PKI) Issue(t testing.TB, name string, opts *Options) *Cert {
+	return New(t, name, p.Intermediate, opts)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/subcommands"
+
+	"macapptool/internal/keychain"
+)
+
+// keychainState is saved by keychain setup, so keychain
+// teardown can undo its changes
+type keychainState struct {
+	Keychain   string   `json:"keychain"`
+	SearchList []string `json:"search_list"`
+}
+
+// keychainRunner prints the commands at -v 2 and only prints
+// them in dry run mode
+type keychainRunner struct {
+	runner keychain.Runner
+}
+
+func (r *keychainRunner) Run(ctx context.Context, cmd *keychain.Command) ([]byte, error) {
+	if *dryRun {
+		fmt.Printf("%s\n", cmd)
+		return nil, nil
+	}
+	verbosePrintf(2, "%s\n", cmd)
+	return r.runner.Run(ctx, cmd)
+}
+
+type keychainCmd struct {
+	Keychain    string
+	Password    string
+	P12         string
+	P12Base64   string
+	P12Password string
+
+	// runner runs the security commands, ExecRunner if nil
+	runner keychain.Runner
+}
+
+func (*keychainCmd) Name() string {
+	return "keychain"
+}
+
+func (*keychainCmd) Synopsis() string {
+	return "Set up a temporary keychain for signing on CI"
+}
+
+func (*keychainCmd) Usage() string {
+	return `keychain [-keychain path] setup [-password secret] -p12 file|-p12-base64 secret [-p12-password secret]
+keychain [-keychain path] teardown
+
+setup creates a keychain, imports the identity in the PKCS#12
+file, allows codesign to use it without prompting and adds the
+keychain to the search list. teardown restores the original
+search list and deletes the keychain.
+
+security only takes the passwords as arguments, so they're
+visible to other processes on the machine while it runs. The
+keychain password is random unless -password is set, and the
+keychain is only meant to live for a CI job, which makes this
+an acceptable exposure on machines dedicated to the job.
+`
+}
+
+func (c *keychainCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&c.Keychain, "keychain", filepath.Join(os.TempDir(), "macapptool.keychain-db"), "Path to the temporary keychain")
+	f.StringVar(&c.Password, "password", "", "Password for the temporary keychain, random by default. Use @env:NAME or @file:PATH to read it from elsewhere")
+	f.StringVar(&c.P12, "p12", "", "PKCS#12 file with the signing identity")
+	f.StringVar(&c.P12Base64, "p12-base64", "", "Base64 encoded PKCS#12 file with the signing identity. Use @env:NAME or @file:PATH to read it from elsewhere")
+	f.StringVar(&c.P12Password, "p12-password", "", "Password for the PKCS#12 file. Use @env:NAME, @keychain:ITEM or @file:PATH to read it from elsewhere")
+}
+
+func (c *keychainCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	// The flags for each action can also come after it
+	action := f.Arg(0)
+	if err := f.Parse(f.Args()[1:]); err != nil {
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() > 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	runner := c.runner
+	if runner == nil {
+		runner = keychain.ExecRunner{}
+	}
+	m := keychain.NewManager(&keychainRunner{runner: runner})
+	var err error
+	switch action {
+	case "setup":
+		err = c.setup(ctx, m)
+	case "teardown":
+		err = c.teardown(ctx, m)
+	default:
+		errPrintf("unknown action %q, must be setup or teardown\n", action)
+		return subcommands.ExitUsageError
+	}
+	if err != nil {
+		errPrint(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *keychainCmd) keychainPath() (string, error) {
+	p, err := filepath.Abs(c.Keychain)
+	if err != nil {
+		return "", err
+	}
+	// security appends -db to names ending in .keychain,
+	// use the actual path so the state matches it
+	if strings.HasSuffix(p, ".keychain") {
+		p += "-db"
+	}
+	return p, nil
+}
+
+func (c *keychainCmd) statePath(p string) string {
+	return p + ".macapptool.json"
+}
+
+// p12File returns the path to the PKCS#12 file to import. If
+// the file was decoded from base64, it must be removed after
+// importing it.
+func (c *keychainCmd) p12File() (string, bool, error) {
+	switch {
+	case c.P12 != "" && c.P12Base64 != "":
+		return "", false, errors.New("-p12 and -p12-base64 are mutually exclusive")
+	case c.P12 != "":
+		return c.P12, false, nil
+	case c.P12Base64 != "":
+		encoded, err := resolveSecret(c.P12Base64)
+		if err != nil {
+			return "", false, err
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+		if err != nil {
+			return "", false, fmt.Errorf("invalid -p12-base64: %v", err)
+		}
+		f, err := ioutil.TempFile("", "macapptool-*.p12")
+		if err != nil {
+			return "", false, err
+		}
+		if _, err := f.Write(data); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return "", false, err
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(f.Name())
+			return "", false, err
+		}
+		return f.Name(), true, nil
+	}
+	return "", false, errors.New("missing -p12 or -p12-base64")
+}
+
+func randomPassword() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func (c *keychainCmd) setup(ctx context.Context, m *keychain.Manager) error {
+	p, err := c.keychainPath()
+	if err != nil {
+		return err
+	}
+	statePath := c.statePath(p)
+	if _, err := os.Stat(statePath); err == nil {
+		return fmt.Errorf("keychain %s is already set up, run keychain teardown first", p)
+	}
+	p12, isTemp, err := c.p12File()
+	if err != nil {
+		return err
+	}
+	if isTemp {
+		defer os.Remove(p12)
+	}
+	p12Password, err := resolveSecret(c.P12Password)
+	if err != nil {
+		return fmt.Errorf("error reading PKCS#12 password: %v", err)
+	}
+	password := c.Password
+	if password == "" {
+		if password, err = randomPassword(); err != nil {
+			return err
+		}
+	} else if password, err = resolveSecret(password); err != nil {
+		return fmt.Errorf("error reading keychain password: %v", err)
+	}
+	searchList, err := m.SearchList(ctx)
+	if err != nil {
+		return err
+	}
+	if err := m.Create(ctx, p, password); err != nil {
+		return err
+	}
+	state := &keychainState{Keychain: p, SearchList: searchList}
+	if err := c.finishSetup(ctx, m, state, p12, p12Password, password); err != nil {
+		// Leave the machine as we found it
+		if err := m.Delete(ctx, p); err != nil {
+			errPrintf("error deleting keychain %s: %v\n", p, err)
+		}
+		if err := m.SetSearchList(ctx, searchList); err != nil {
+			errPrintf("error restoring the keychain search list: %v\n", err)
+		}
+		return err
+	}
+	fmt.Println(p)
+	return nil
+}
+
+func (c *keychainCmd) finishSetup(ctx context.Context, m *keychain.Manager, state *keychainState, p12 string, p12Password string, password string) error {
+	p := state.Keychain
+	if err := m.ImportP12(ctx, p, p12, p12Password); err != nil {
+		return err
+	}
+	if err := m.SetPartitionList(ctx, p, password); err != nil {
+		return err
+	}
+	searchList := []string{p}
+	for _, k := range state.SearchList {
+		if k != p {
+			searchList = append(searchList, k)
+		}
+	}
+	if err := m.SetSearchList(ctx, searchList); err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("write %s\n", c.statePath(p))
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(c.statePath(p), data, 0600)
+}
+
+func (c *keychainCmd) teardown(ctx context.Context, m *keychain.Manager) error {
+	p, err := c.keychainPath()
+	if err != nil {
+		return err
+	}
+	statePath := c.statePath(p)
+	data, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("keychain %s was not set up by keychain setup", p)
+		}
+		return err
+	}
+	var state keychainState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("error decoding %s: %v", statePath, err)
+	}
+	if err := m.SetSearchList(ctx, state.SearchList); err != nil {
+		return err
+	}
+	if err := m.Delete(ctx, state.Keychain); err != nil {
+		return err
+	}
+	return osRemove(statePath)
+}
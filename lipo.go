@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/google/subcommands"
+
+	"macapptool/internal/macho"
+)
+
+type lipoCmd struct {
+	Arches stringList
+	Output string
+	Fat64  bool
+
+	// thin is set when running lipo thin
+	thin bool
+}
+
+func (*lipoCmd) Name() string {
+	return "lipo"
+}
+
+func (*lipoCmd) Synopsis() string {
+	return "Create, thin and inspect universal binaries"
+}
+
+func (*lipoCmd) Usage() string {
+	return `lipo create [-fat64] -output file some-binary...
+lipo thin -arch arch [-output file] some-binary|some.app
+lipo extract -arch arch [-arch arch...] [-output file] some-binary|some.app
+lipo info some-binary|some.app...
+
+create combines thin or universal binaries into a universal
+binary. thin keeps only the given architecture, producing a
+thin binary, while extract keeps the given architectures in
+a universal binary. Both modify the files in place unless
+-output is given and, when given a bundle, are applied to
+every Mach-O file inside it. Signatures are kept, since each
+slice has its own. info lists the architectures in each
+file.
+`
+}
+
+func (c *lipoCmd) SetFlags(f *flag.FlagSet) {
+	f.Var(&c.Arches, "arch", "Architecture to keep. Can be specified multiple times for extract")
+	f.StringVar(&c.Output, "output", "", "Output file")
+	f.BoolVar(&c.Fat64, "fat64", false, "Use a 64 bit universal header, which is also used automatically for slices beyond 4GiB")
+}
+
+func (c *lipoCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	// The flags for each action can also come after it
+	action := f.Arg(0)
+	if err := f.Parse(f.Args()[1:]); err != nil {
+		return subcommands.ExitUsageError
+	}
+	if f.NArg() == 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	var err error
+	switch action {
+	case "create":
+		err = c.create(f.Args())
+	case "thin":
+		if len(c.Arches) != 1 {
+			errPrintf("thin requires exactly one -arch\n")
+			return subcommands.ExitUsageError
+		}
+		c.thin = true
+		err = c.each(f.Args(), c.keepArches)
+	case "extract":
+		if len(c.Arches) == 0 {
+			errPrintf("extract requires at least one -arch\n")
+			return subcommands.ExitUsageError
+		}
+		err = c.each(f.Args(), c.keepArches)
+	case "info":
+		err = c.each(f.Args(), lipoInfo)
+	default:
+		errPrintf("unknown action %q, must be create, thin, extract or info\n", action)
+		return subcommands.ExitUsageError
+	}
+	if err != nil {
+		errPrint(err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// sliceData returns the data for including s in a universal
+// file, keeping its alignment
+func sliceData(s *macho.Slice) macho.SliceData {
+	return macho.SliceData{
+		Cpu:    s.File.Cpu,
+		SubCpu: s.File.SubCpu,
+		Align:  s.Align,
+		Data:   s.File.Data,
+	}
+}
+
+// writeOutput writes data to p, with the permissions of
+// the file at src
+func writeOutput(p string, src string, data []byte) error {
+	if *dryRun {
+		fmt.Printf("write %s\n", p)
+		return nil
+	}
+	st, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p, data, st.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chmod(p, st.Mode().Perm())
+}
+
+func (c *lipoCmd) create(files []string) error {
+	if c.Output == "" {
+		return errors.New("create requires -output")
+	}
+	if len(c.Arches) > 0 {
+		return errors.New("-arch can't be used with create")
+	}
+	var slices []macho.SliceData
+	seen := make(map[string]string)
+	for _, p := range files {
+		bin, err := macho.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+		for _, s := range bin.Slices {
+			arch := s.Arch()
+			if prev := seen[arch]; prev != "" {
+				return fmt.Errorf("%s and %s both contain %s", prev, p, arch)
+			}
+			seen[arch] = p
+			slices = append(slices, sliceData(s))
+		}
+	}
+	// Like lipo, put the slices with the smallest alignment
+	// first, to minimize the padding
+	sort.SliceStable(slices, func(i, j int) bool {
+		return alignOf(slices[i]) < alignOf(slices[j])
+	})
+	verbosePrintf(1, "creating %s with %d architectures\n", c.Output, len(slices))
+	return writeOutput(c.Output, files[0], macho.BuildUniversal(slices, c.Fat64))
+}
+
+func alignOf(s macho.SliceData) uint32 {
+	if s.Align == 0 {
+		return macho.DefaultAlign(s.Cpu)
+	}
+	return s.Align
+}
+
+// each calls fn for every Mach-O file in the given paths,
+// which can be files or bundles
+func (c *lipoCmd) each(paths []string, fn func(p string, bin *macho.Binary) error) error {
+	for _, arg := range paths {
+		root := strings.TrimSuffix(arg, "/")
+		st, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+		if st.IsDir() && c.Output != "" {
+			return fmt.Errorf("-output can't be used with directories like %s", arg)
+		}
+		err = walkCode(root, func(p string) error {
+			exe, err := codeExecutable(p)
+			if err != nil {
+				verbosePrintf(1, "skipping %s: %v\n", p, err)
+				return nil
+			}
+			bin, err := macho.ReadFile(exe)
+			if err != nil {
+				if err == macho.ErrNotMachO {
+					verbosePrintf(1, "skipping %s: not a Mach-O file\n", exe)
+					return nil
+				}
+				return fmt.Errorf("%s: %v", exe, err)
+			}
+			return fn(exe, bin)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepArches implements thin and extract, keeping only the
+// slices for the architectures in -arch. thin produces a
+// thin file, while extract always produces a universal one.
+func (c *lipoCmd) keepArches(p string, bin *macho.Binary) error {
+	keep := make(map[string]bool)
+	for _, arch := range c.Arches {
+		keep[arch] = true
+	}
+	var kept []*macho.Slice
+	for _, s := range bin.Slices {
+		if keep[s.Arch()] {
+			kept = append(kept, s)
+		}
+	}
+	for _, arch := range c.Arches {
+		found := false
+		for _, s := range kept {
+			found = found || s.Arch() == arch
+		}
+		if !found {
+			return fmt.Errorf("%s doesn't contain %s, only %s", p, arch, strings.Join(bin.Arches(), ", "))
+		}
+	}
+	var data []byte
+	if c.thin {
+		if !bin.Fat && c.Output == "" {
+			verbosePrintf(1, "skipping %s: already thin\n", p)
+			return nil
+		}
+		data = kept[0].File.Data
+	} else {
+		if bin.Fat && len(kept) == len(bin.Slices) && c.Output == "" {
+			verbosePrintf(1, "skipping %s: only contains %s\n", p, strings.Join(bin.Arches(), ", "))
+			return nil
+		}
+		var slices []macho.SliceData
+		for _, s := range kept {
+			slices = append(slices, sliceData(s))
+		}
+		data = macho.BuildUniversal(slices, bin.Fat64 || c.Fat64)
+	}
+	if c.Output != "" {
+		return writeOutput(c.Output, p, data)
+	}
+	verbosePrintf(1, "keeping %s in %s\n", strings.Join(c.Arches, ", "), p)
+	if *dryRun {
+		fmt.Printf("write %s\n", p)
+		return nil
+	}
+	// Replace the actual file rather than a symlink to it
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(real, data)
+}
+
+func lipoInfo(p string, bin *macho.Binary) error {
+	if !bin.Fat {
+		fmt.Printf("%s: %s\n", p, bin.Slices[0].Arch())
+		return nil
+	}
+	kind := "universal"
+	if bin.Fat64 {
+		kind = "universal (fat64)"
+	}
+	fmt.Printf("%s: %s %s\n", p, kind, strings.Join(bin.Arches(), " "))
+	for _, s := range bin.Slices {
+		verbosePrintf(1, "  %s: offset=%d size=%d align=2^%d\n", s.Arch(), s.Offset, s.Size, s.Align)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"macapptool/internal/macho"
+)
+
+func TestLipo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macapptool-lipo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	arm64 := filepath.Join("testdata", "hello_arm64")
+	x86 := filepath.Join("testdata", "hello_x86_64")
+	universal := filepath.Join(dir, "hello")
+
+	c := &lipoCmd{Output: universal}
+	if err := c.create([]string{arm64, x86}); err != nil {
+		t.Fatal(err)
+	}
+	bin, err := macho.ReadFile(universal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Slices are sorted by alignment, like lipo does
+	if got := strings.Join(bin.Arches(), ","); !bin.Fat || got != "x86_64,arm64" {
+		t.Errorf("created fat = %v, arches = %s", bin.Fat, got)
+	}
+	if err := c.create([]string{arm64, universal}); err == nil || !strings.Contains(err.Error(), "both contain arm64") {
+		t.Errorf("error = %v, want both contain arm64", err)
+	}
+
+	// thin and extract round trip to the original files
+	thin := filepath.Join(dir, "thin")
+	c = &lipoCmd{Arches: stringList{"arm64"}, Output: thin, thin: true}
+	if err := c.each([]string{universal}, c.keepArches); err != nil {
+		t.Fatal(err)
+	}
+	checkSameFile(t, thin, "hello_arm64")
+	extracted := filepath.Join(dir, "extracted")
+	c = &lipoCmd{Arches: stringList{"x86_64"}, Output: extracted}
+	if err := c.each([]string{universal}, c.keepArches); err != nil {
+		t.Fatal(err)
+	}
+	bin, err = macho.ReadFile(extracted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(x86)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bin.Fat || len(bin.Slices) != 1 || !bytes.Equal(bin.Slices[0].Data, want) {
+		t.Errorf("extracted fat = %v, arches = %v", bin.Fat, bin.Arches())
+	}
+	c = &lipoCmd{Arches: stringList{"arm64e"}, Output: thin, thin: true}
+	if err := c.each([]string{universal}, c.keepArches); err == nil || !strings.Contains(err.Error(), "doesn't contain arm64e") {
+		t.Errorf("error = %v, want doesn't contain arm64e", err)
+	}
+}
+
+func TestLipoBundle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macapptool-lipo-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	universal := filepath.Join(dir, "hello")
+	c := &lipoCmd{Output: universal}
+	if err := c.create([]string{filepath.Join("testdata", "hello_arm64"), filepath.Join("testdata", "hello_x86_64")}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(universal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, cleanup := writeTestBundle(t, map[string]string{
+		"MacOS/App":    "hello_arm64",
+		"MacOS/helper": "hello_arm64",
+	})
+	defer cleanup()
+	for _, name := range []string{"App", "helper"} {
+		if err := ioutil.WriteFile(filepath.Join(root, "Contents", "MacOS", name), data, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Thinning a bundle modifies every file in place
+	c = &lipoCmd{Arches: stringList{"x86_64"}, thin: true}
+	if err := c.each([]string{root}, c.keepArches); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"App", "helper"} {
+		checkSameFile(t, filepath.Join(root, "Contents", "MacOS", name), "hello_x86_64")
+	}
+	c = &lipoCmd{Arches: stringList{"x86_64"}, Output: universal}
+	if err := c.each([]string{root}, c.keepArches); err == nil {
+		t.Error("-output accepted for a bundle")
+	}
+}
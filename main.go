@@ -21,6 +21,16 @@ func main() {
 	subcommands.Register(&signCmd{}, "")
 	subcommands.Register(&notarizeCmd{}, "")
 	subcommands.Register(&zipCmd{}, "")
+	subcommands.Register(&publishCmd{}, "")
+	subcommands.Register(&inspectCmd{}, "")
+	subcommands.Register(&verifyCmd{}, "")
+	subcommands.Register(&unsignCmd{}, "")
+	subcommands.Register(&lipoCmd{}, "")
+	subcommands.Register(&relinkCmd{}, "")
+	subcommands.Register(&auditCmd{}, "")
+	subcommands.Register(&identitiesCmd{}, "")
+	subcommands.Register(&keychainCmd{}, "")
+	subcommands.Register(&certsCmd{}, "")
 
 	flag.Parse()
 	ctx := context.Background()
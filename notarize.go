@@ -164,19 +164,24 @@ func stapleAndVerify(zipFile string) error {
 	return nil
 }
 
-func findPrimaryBundleID(payload string) (string, error) {
+// readPrimaryInfoPlist returns the Info.plist for the main app bundle
+// inside the given payload. If the payload contains a single executable
+// with no Info.plist, it returns a nil *plist.PList and the executable
+// name.
+func readPrimaryInfoPlist(payload string) (*plist.PList, string, error) {
 	var pr payloadReader
 	switch strings.ToLower(filepath.Ext(payload)) {
 	case ".zip":
 		zr, err := zip.OpenReader(payload)
 		if err != nil {
-			return "", err
+			return nil, "", err
 
 		}
 		pr = newZipPayloadReader(zr)
 	default:
-		return "", fmt.Errorf("can't read payload with extension %q", filepath.Ext(payload))
+		return nil, "", fmt.Errorf("can't read payload with extension %q", filepath.Ext(payload))
 	}
+	defer pr.Close()
 	count := 0
 	var last string
 	for {
@@ -185,7 +190,7 @@ func findPrimaryBundleID(payload string) (string, error) {
 			if err == io.EOF {
 				break
 			}
-			return "", err
+			return nil, "", err
 		}
 		last = filename
 		count++
@@ -197,25 +202,32 @@ func findPrimaryBundleID(payload string) (string, error) {
 
 			ff, err := pr.Open()
 			if err != nil {
-				return "", err
+				return nil, "", err
 			}
 			defer ff.Close()
-			plist, err := plist.New(ff)
+			pl, err := plist.New(ff)
 			if err != nil {
-				return "", err
+				return nil, "", err
 			}
-			bundleID, err := plist.BundleIdentifier()
-			if err != nil {
-				return "", err
-			}
-			return bundleID, nil
+			return pl, "", nil
 		}
 	}
 	if count == 1 && strings.IndexByte(last, '/') < 0 {
 		// Single file zip, likely command line executable
-		return "com.example." + last, nil
+		return nil, last, nil
+	}
+	return nil, "", errors.New("could not find Info.plist")
+}
+
+func findPrimaryBundleID(payload string) (string, error) {
+	pl, executable, err := readPrimaryInfoPlist(payload)
+	if err != nil {
+		return "", err
+	}
+	if pl == nil {
+		return "com.example." + executable, nil
 	}
-	return "", errors.New("could not find Info.plist")
+	return pl.BundleIdentifier()
 }
 
 func submitForNotarization(payload, username, password string) (string, error) {
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+const (
+	defaultPublishRetries = 3
+	// Files bigger than this are uploaded in parts when
+	// the destination supports it
+	defaultMultipartThreshold = 64 << 20
+	defaultPartSize           = 16 << 20
+)
+
+// publishRetryDelay is the delay before the first retry of a
+// failed request, doubled for every following one
+var publishRetryDelay = time.Second
+
+// publishDestination is implemented by every location
+// we can upload artifacts to.
+type publishDestination interface {
+	// String returns a human readable description of the destination
+	String() string
+	// Publish uploads the file at p as name
+	Publish(name string, p string) error
+}
+
+// credentialsChecker is implemented by the destinations which
+// need credentials. They're checked before uploading anything,
+// except in dry runs, which don't need them.
+type credentialsChecker interface {
+	checkCredentials() error
+}
+
+// permanentError is implemented by errors which should not
+// be retried, like an HTTP 4xx response.
+type permanentError interface {
+	Permanent() bool
+}
+
+type httpStatusError struct {
+	Method     string
+	URL        string
+	StatusCode int
+	Body       string
+}
+
+func (e *httpStatusError) Error() string {
+	msg := fmt.Sprintf("%s %s: unexpected status %d", e.Method, e.URL, e.StatusCode)
+	if e.Body != "" {
+		msg += ": " + e.Body
+	}
+	return msg
+}
+
+func (e *httpStatusError) Permanent() bool {
+	return e.StatusCode < 500 && e.StatusCode != http.StatusTooManyRequests
+}
+
+// doHTTP performs the given request and returns the response
+// body. If the response status is not one of the expected ones,
+// an *httpStatusError is returned.
+func doHTTP(req *http.Request, expected ...int) ([]byte, *http.Response, error) {
+	verbosePrintf(2, "%s %s\n", req.Method, req.URL)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, v := range expected {
+		if resp.StatusCode == v {
+			return data, resp, nil
+		}
+	}
+	body := strings.TrimSpace(string(data))
+	if len(body) > 512 {
+		body = body[:512] + "..."
+	}
+	return nil, nil, &httpStatusError{
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		StatusCode: resp.StatusCode,
+		Body:       body,
+	}
+}
+
+// withRetries calls fn up to attempts times, doubling the delay
+// between each attempt, until it succeeds or returns a permanent
+// error.
+func withRetries(attempts int, what string, fn func() error) error {
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := publishRetryDelay
+	var err error
+	for ii := 0; ii < attempts; ii++ {
+		if ii > 0 {
+			errPrintf("%s failed (%v), retrying in %s...\n", what, err, delay)
+			time.Sleep(delay)
+			delay *= 2
+		}
+		if err = fn(); err == nil {
+			return nil
+		}
+		if p, ok := err.(permanentError); ok && p.Permanent() {
+			return err
+		}
+	}
+	return err
+}
+
+type dirDestination struct {
+	Dir string
+}
+
+func (d *dirDestination) String() string {
+	return d.Dir
+}
+
+func (d *dirDestination) Publish(name string, p string) error {
+	if err := os.MkdirAll(d.Dir, 0755); err != nil {
+		return err
+	}
+	dest := filepath.Join(d.Dir, name)
+	// Copy to a temporary file first, so an interrupted
+	// copy never leaves a truncated artifact behind
+	tmp := filepath.Join(d.Dir, "."+name+".tmp")
+	if err := copyFile(tmp, p); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+func copyFile(dest, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, st.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// httpDestination uploads files using HTTP PUT. When WebDAV
+// is set, the collection is created with MKCOL before uploading.
+type httpDestination struct {
+	URL     *url.URL
+	WebDAV  bool
+	Retries int
+}
+
+func (d *httpDestination) String() string {
+	u := *d.URL
+	u.User = nil
+	return u.String()
+}
+
+func (d *httpDestination) fileURL(name string) string {
+	u := *d.URL
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + name
+	u.RawPath = ""
+	return u.String()
+}
+
+func (d *httpDestination) newRequest(method, u string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if user := d.URL.User; user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
+	}
+	return req, nil
+}
+
+func (d *httpDestination) makeCollections() error {
+	u := *d.URL
+	u.User = nil
+	var current string
+	for _, part := range strings.Split(strings.Trim(u.Path, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		current += "/" + part
+		u.Path = current + "/"
+		req, err := d.newRequest("MKCOL", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		// 405 means the collection already exists
+		if _, _, err := doHTTP(req, http.StatusCreated, http.StatusOK, http.StatusMethodNotAllowed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *httpDestination) Publish(name string, p string) error {
+	if d.WebDAV {
+		if err := withRetries(d.Retries, "creating collection", d.makeCollections); err != nil {
+			return err
+		}
+	}
+	u := d.fileURL(name)
+	return withRetries(d.Retries, "uploading "+name, func() error {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		req, err := d.newRequest("PUT", u, f)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = st.Size()
+		req.Header.Set("Content-Type", "application/octet-stream")
+		_, _, err = doHTTP(req, http.StatusOK, http.StatusCreated, http.StatusNoContent)
+		return err
+	})
+}
+
+type publishCmd struct {
+	Destinations       stringList
+	Checksums          bool
+	AppcastURL         string
+	Version            string
+	ShortVersion       string
+	Retries            int
+	MultipartThreshold int64
+	PartSize           int64
+}
+
+func (*publishCmd) Name() string {
+	return "publish"
+}
+
+func (*publishCmd) Synopsis() string {
+	return "Upload a notarized archive to one or more destinations"
+}
+
+func (*publishCmd) Usage() string {
+	return fmt.Sprintf(`Usage: %s publish -d destination [-d destination...][-checksums][-appcast url] some.zip
+
+	publish uploads the archive, plus optional checksums and
+	a Sparkle appcast, to each destination. Supported destinations:
+
+	  /some/dir, file:///some/dir
+	      Copy the files to a local directory
+	  s3://bucket/prefix[?endpoint=url&region=region]
+	      Upload to an S3 compatible bucket, using the credentials in
+	      AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+	  http(s)://[user:password@]host/path
+	      Upload with HTTP PUT
+	  webdav(s)://[user:password@]host/path
+	      Upload with HTTP PUT, creating the collections first
+	  github://owner/repo?tag=tag[&api=url][&draft=1]
+	      Upload as release assets, using the token in GITHUB_TOKEN
+`, filepath.Base(os.Args[0]))
+}
+
+func (c *publishCmd) SetFlags(f *flag.FlagSet) {
+	f.Var(&c.Destinations, "d", "Destination to publish to. Might be specified multiple times")
+	f.BoolVar(&c.Checksums, "checksums", false, "Publish a .sha256 file with the archive checksum")
+	f.StringVar(&c.AppcastURL, "appcast", "", "Publish an appcast.xml with the archive enclosure at the given base URL")
+	f.StringVar(&c.Version, "version", "", "Version for the appcast. Defaults to CFBundleVersion")
+	f.StringVar(&c.ShortVersion, "short-version", "", "Short version for the appcast. Defaults to CFBundleShortVersionString")
+	f.IntVar(&c.Retries, "retries", defaultPublishRetries, "Number of attempts for each upload")
+	f.Int64Var(&c.MultipartThreshold, "multipart-threshold", defaultMultipartThreshold, "Upload files bigger than this size in parts, when supported")
+	f.Int64Var(&c.PartSize, "part-size", defaultPartSize, "Size of each part in multipart uploads")
+}
+
+func (c *publishCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 || len(c.Destinations) == 0 {
+		return subcommands.ExitUsageError
+	}
+	archive := f.Arg(0)
+	if err := c.publish(archive); err != nil {
+		errPrintf("error publishing %s: %v\n", archive, err)
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+func (c *publishCmd) parseDestination(dest string) (publishDestination, error) {
+	if !strings.Contains(dest, "://") {
+		return &dirDestination{Dir: dest}, nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "file":
+		return &dirDestination{Dir: u.Path}, nil
+	case "http", "https":
+		return &httpDestination{URL: u, Retries: c.Retries}, nil
+	case "webdav", "webdavs":
+		u.Scheme = strings.Replace(u.Scheme, "webdav", "http", 1)
+		return &httpDestination{URL: u, WebDAV: true, Retries: c.Retries}, nil
+	case "s3":
+		return newS3Destination(u, c.Retries, c.MultipartThreshold, c.PartSize)
+	case "github":
+		return newGitHubDestination(u, c.Retries)
+	}
+	return nil, fmt.Errorf("unknown destination scheme %q", u.Scheme)
+}
+
+type publishArtifact struct {
+	Name string
+	Path string
+}
+
+func (c *publishCmd) publish(archive string) error {
+	var dests []publishDestination
+	for _, v := range c.Destinations {
+		dest, err := c.parseDestination(v)
+		if err != nil {
+			return fmt.Errorf("invalid destination %q: %v", v, err)
+		}
+		dests = append(dests, dest)
+	}
+	if !*dryRun {
+		for _, dest := range dests {
+			if c, ok := dest.(credentialsChecker); ok {
+				if err := c.checkCredentials(); err != nil {
+					return fmt.Errorf("%s: %v", dest, err)
+				}
+			}
+		}
+	}
+	tmpDir, err := ioutil.TempDir("", "macapptool-publish")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	name := filepath.Base(archive)
+	artifacts := []publishArtifact{{Name: name, Path: archive}}
+	if c.Checksums {
+		p := filepath.Join(tmpDir, name+".sha256")
+		if err := writeChecksumFile(p, archive); err != nil {
+			return err
+		}
+		artifacts = append(artifacts, publishArtifact{Name: name + ".sha256", Path: p})
+	}
+	if c.AppcastURL != "" {
+		p := filepath.Join(tmpDir, "appcast.xml")
+		if err := c.writeAppcast(p, archive); err != nil {
+			return err
+		}
+		artifacts = append(artifacts, publishArtifact{Name: "appcast.xml", Path: p})
+	}
+	for _, dest := range dests {
+		for _, a := range artifacts {
+			if *dryRun {
+				fmt.Printf("upload %s to %s\n", a.Name, dest)
+				continue
+			}
+			fmt.Printf("uploading %s to %s\n", a.Name, dest)
+			if err := dest.Publish(a.Name, a.Path); err != nil {
+				return fmt.Errorf("error uploading %s to %s: %v", a.Name, dest, err)
+			}
+		}
+	}
+	return nil
+}
+
+func fileSHA256(p string) (string, int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func writeChecksumFile(p string, archive string) error {
+	sum, _, err := fileSHA256(archive)
+	if err != nil {
+		return err
+	}
+	// Same format as shasum -a 256
+	data := fmt.Sprintf("%s  %s\n", sum, filepath.Base(archive))
+	return ioutil.WriteFile(p, []byte(data), 0644)
+}
+
+type appcastEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type appcastItem struct {
+	Title                string           `xml:"title"`
+	PubDate              string           `xml:"pubDate"`
+	Version              string           `xml:"sparkle:version"`
+	ShortVersionString   string           `xml:"sparkle:shortVersionString,omitempty"`
+	MinimumSystemVersion string           `xml:"sparkle:minimumSystemVersion,omitempty"`
+	Enclosure            appcastEnclosure `xml:"enclosure"`
+}
+
+type appcastChannel struct {
+	Title string      `xml:"title"`
+	Item  appcastItem `xml:"item"`
+}
+
+type appcast struct {
+	XMLName      xml.Name       `xml:"rss"`
+	Version      string         `xml:"version,attr"`
+	SparkleXMLNS string         `xml:"xmlns:sparkle,attr"`
+	Channel      appcastChannel `xml:"channel"`
+}
+
+func (c *publishCmd) writeAppcast(p string, archive string) error {
+	name := strings.TrimSuffix(filepath.Base(archive), filepath.Ext(archive))
+	version := c.Version
+	shortVersion := c.ShortVersion
+	var minSystemVersion string
+	if version == "" {
+		pl, _, err := readPrimaryInfoPlist(archive)
+		if err != nil {
+			return fmt.Errorf("can't determine version for appcast, use -version: %v", err)
+		}
+		if pl == nil {
+			return errors.New("can't determine version for appcast, use -version")
+		}
+		if version, err = pl.BundleVersion(); err != nil {
+			return err
+		}
+		if shortVersion == "" {
+			shortVersion, _ = pl.BundleShortVersionString()
+		}
+		if bundleName, err := pl.BundleName(); err == nil {
+			name = bundleName
+		}
+		minSystemVersion, _ = pl.MinimumSystemVersion()
+	}
+	st, err := os.Stat(archive)
+	if err != nil {
+		return err
+	}
+	title := version
+	if shortVersion != "" {
+		title = shortVersion
+	}
+	enclosureURL, err := url.Parse(c.AppcastURL)
+	if err != nil {
+		return err
+	}
+	enclosureURL.Path = path.Join(enclosureURL.Path, filepath.Base(archive))
+	ac := &appcast{
+		Version:      "2.0",
+		SparkleXMLNS: "http://www.andymatuschak.org/xml-namespaces/sparkle",
+		Channel: appcastChannel{
+			Title: name,
+			Item: appcastItem{
+				Title:                fmt.Sprintf("Version %s", title),
+				PubDate:              time.Now().Format(time.RFC1123Z),
+				Version:              version,
+				ShortVersionString:   shortVersion,
+				MinimumSystemVersion: minSystemVersion,
+				Enclosure: appcastEnclosure{
+					URL:    enclosureURL.String(),
+					Length: st.Size(),
+					Type:   "application/octet-stream",
+				},
+			},
+		},
+	}
+	data, err := xml.MarshalIndent(ac, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append([]byte(xml.Header), data...)
+	data = append(data, '\n')
+	return ioutil.WriteFile(p, data, 0644)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+const githubDefaultAPI = "https://api.github.com"
+
+// githubDestination uploads files as assets of a release,
+// using any GitHub Releases compatible API. If the release
+// for the tag doesn't exist, it's created. Existing assets
+// with the same name are replaced.
+type githubDestination struct {
+	Owner   string
+	Repo    string
+	Tag     string
+	API     string
+	Draft   bool
+	Token   string
+	Retries int
+
+	// rel is the release found or created by the first
+	// upload, reused by the next ones
+	rel *githubRelease
+}
+
+type githubAsset struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+type githubRelease struct {
+	ID        int64         `json:"id"`
+	TagName   string        `json:"tag_name"`
+	UploadURL string        `json:"upload_url"`
+	Assets    []githubAsset `json:"assets"`
+}
+
+// githubReleasesPerPage is the number of releases requested
+// per page when looking for drafts
+const githubReleasesPerPage = 100
+
+func newGitHubDestination(u *url.URL, retries int) (*githubDestination, error) {
+	repo := strings.Trim(u.Path, "/")
+	if u.Host == "" || repo == "" || strings.Contains(repo, "/") {
+		return nil, errors.New("destination must be github://owner/repo")
+	}
+	q := u.Query()
+	d := &githubDestination{
+		Owner:   u.Host,
+		Repo:    repo,
+		Tag:     q.Get("tag"),
+		API:     strings.TrimSuffix(q.Get("api"), "/"),
+		Draft:   q.Get("draft") == "1" || q.Get("draft") == "true",
+		Token:   os.Getenv("GITHUB_TOKEN"),
+		Retries: retries,
+	}
+	if d.Tag == "" {
+		return nil, errors.New("missing tag")
+	}
+	if d.API == "" {
+		d.API = githubDefaultAPI
+	}
+	return d, nil
+}
+
+func (d *githubDestination) checkCredentials() error {
+	if d.Token == "" {
+		return errors.New("GITHUB_TOKEN must be set")
+	}
+	return nil
+}
+
+func (d *githubDestination) String() string {
+	return fmt.Sprintf("github://%s/%s@%s", d.Owner, d.Repo, d.Tag)
+}
+
+func (d *githubDestination) repoURL() string {
+	return fmt.Sprintf("%s/repos/%s/%s", d.API, url.PathEscape(d.Owner), url.PathEscape(d.Repo))
+}
+
+func (d *githubDestination) do(method, u string, body io.Reader, out interface{}, expected ...int) error {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+d.Token)
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	data, _, err := doHTTP(req, expected...)
+	if err != nil {
+		return err
+	}
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+	return nil
+}
+
+// findRelease returns the release for the tag, or nil if
+// it doesn't exist. Draft releases have no tag yet, so
+// /releases/tags/{tag} never returns them and the releases
+// must be listed to find them.
+func (d *githubDestination) findRelease() (*githubRelease, error) {
+	var rel githubRelease
+	err := d.do("GET", d.repoURL()+"/releases/tags/"+url.PathEscape(d.Tag), nil, &rel, http.StatusOK)
+	if err == nil {
+		return &rel, nil
+	}
+	if se, ok := err.(*httpStatusError); !ok || se.StatusCode != http.StatusNotFound {
+		return nil, err
+	}
+	for page := 1; ; page++ {
+		var releases []githubRelease
+		u := fmt.Sprintf("%s/releases?per_page=%d&page=%d", d.repoURL(), githubReleasesPerPage, page)
+		if err := d.do("GET", u, nil, &releases, http.StatusOK); err != nil {
+			return nil, err
+		}
+		for ii := range releases {
+			if releases[ii].TagName == d.Tag {
+				return &releases[ii], nil
+			}
+		}
+		if len(releases) < githubReleasesPerPage {
+			return nil, nil
+		}
+	}
+}
+
+// release returns the release for the tag, creating it if
+// needed. It's looked up once per publish run. Since a create
+// request which timed out might have succeeded, every retry
+// looks for the release again before creating it, to avoid
+// creating duplicates.
+func (d *githubDestination) release() (*githubRelease, error) {
+	if d.rel != nil {
+		return d.rel, nil
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"tag_name": d.Tag,
+		"name":     d.Tag,
+		"draft":    d.Draft,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = withRetries(d.Retries, "fetching release", func() error {
+		rel, err := d.findRelease()
+		if err != nil || rel != nil {
+			d.rel = rel
+			return err
+		}
+		verbosePrintf(1, "creating release %s\n", d.Tag)
+		rel = &githubRelease{}
+		if err := d.do("POST", d.repoURL()+"/releases", bytes.NewReader(body), rel, http.StatusCreated); err != nil {
+			return err
+		}
+		d.rel = rel
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.rel, nil
+}
+
+func (d *githubDestination) Publish(name string, p string) error {
+	rel, err := d.release()
+	if err != nil {
+		return err
+	}
+	for _, v := range rel.Assets {
+		if v.Name == name {
+			verbosePrintf(1, "deleting existing asset %s\n", name)
+			assetURL := fmt.Sprintf("%s/releases/assets/%d", d.repoURL(), v.ID)
+			err := withRetries(d.Retries, "deleting asset "+name, func() error {
+				return d.do("DELETE", assetURL, nil, nil, http.StatusNoContent, http.StatusNotFound)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	// upload_url is a URI template like
+	// https://uploads.github.com/repos/o/r/releases/1/assets{?name,label}
+	uploadURL := rel.UploadURL
+	if pos := strings.IndexByte(uploadURL, '{'); pos >= 0 {
+		uploadURL = uploadURL[:pos]
+	}
+	if uploadURL == "" {
+		return errors.New("release has no upload URL")
+	}
+	uploadURL += "?name=" + url.QueryEscape(name)
+	var asset githubAsset
+	err = withRetries(d.Retries, "uploading "+name, func() error {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		st, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest("POST", uploadURL, f)
+		if err != nil {
+			return err
+		}
+		req.ContentLength = st.Size()
+		req.Header.Set("Authorization", "token "+d.Token)
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		req.Header.Set("Content-Type", "application/octet-stream")
+		data, _, err := doHTTP(req, http.StatusCreated)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, &asset)
+	})
+	if err != nil {
+		return err
+	}
+	// Keep the cached release up to date, so publishing the
+	// same name again in this run replaces the new asset
+	var assets []githubAsset
+	for _, v := range rel.Assets {
+		if v.Name != name {
+			assets = append(assets, v)
+		}
+	}
+	rel.Assets = append(assets, asset)
+	return nil
+}
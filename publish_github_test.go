@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeGitHub is a minimal stand-in for the GitHub Releases API.
+// Like GitHub, it doesn't return drafts from /releases/tags.
+type fakeGitHub struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	releases []*githubRelease
+	drafts   map[int64]bool
+	uploads  map[string][]byte
+	nextID   int64
+	requests []string
+	// failCreate makes the next create request fail after
+	// creating the release, like a request timing out
+	failCreate bool
+}
+
+func newFakeGitHub(t *testing.T) *fakeGitHub {
+	g := &fakeGitHub{t: t, drafts: make(map[int64]bool), uploads: make(map[string][]byte), nextID: 100}
+	g.srv = httptest.NewServer(http.HandlerFunc(g.serve))
+	return g
+}
+
+func (g *fakeGitHub) addRelease(tag string, draft bool, assets ...string) *githubRelease {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.nextID++
+	rel := &githubRelease{
+		ID:        g.nextID,
+		TagName:   tag,
+		UploadURL: fmt.Sprintf("%s/uploads/%d/assets{?name,label}", g.srv.URL, g.nextID),
+	}
+	for _, name := range assets {
+		g.nextID++
+		rel.Assets = append(rel.Assets, githubAsset{ID: g.nextID, Name: name})
+	}
+	g.releases = append(g.releases, rel)
+	g.drafts[rel.ID] = draft
+	return rel
+}
+
+func (g *fakeGitHub) count(request string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	n := 0
+	for _, v := range g.requests {
+		if v == request {
+			n++
+		}
+	}
+	return n
+}
+
+func (g *fakeGitHub) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "token secret" {
+		http.Error(w, "bad credentials", http.StatusUnauthorized)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	g.mu.Lock()
+	g.requests = append(g.requests, r.Method+" "+r.URL.Path)
+	g.mu.Unlock()
+	const repo = "/repos/owner/repo"
+	switch {
+	case r.Method == "GET" && strings.HasPrefix(r.URL.Path, repo+"/releases/tags/"):
+		tag := strings.TrimPrefix(r.URL.Path, repo+"/releases/tags/")
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for _, rel := range g.releases {
+			if rel.TagName == tag && !g.drafts[rel.ID] {
+				json.NewEncoder(w).Encode(rel)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	case r.Method == "GET" && r.URL.Path == repo+"/releases":
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		releases := []*githubRelease{}
+		if page <= 1 {
+			releases = g.releases
+		}
+		json.NewEncoder(w).Encode(releases)
+	case r.Method == "POST" && r.URL.Path == repo+"/releases":
+		var req struct {
+			TagName string `json:"tag_name"`
+			Draft   bool   `json:"draft"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rel := g.addRelease(req.TagName, req.Draft)
+		g.mu.Lock()
+		fail := g.failCreate
+		g.failCreate = false
+		g.mu.Unlock()
+		if fail {
+			http.Error(w, "timeout", http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rel)
+	case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, repo+"/releases/assets/"):
+		id, _ := strconv.ParseInt(strings.TrimPrefix(r.URL.Path, repo+"/releases/assets/"), 10, 64)
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for _, rel := range g.releases {
+			for ii, a := range rel.Assets {
+				if a.ID == id {
+					rel.Assets = append(rel.Assets[:ii], rel.Assets[ii+1:]...)
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+		}
+		http.NotFound(w, r)
+	case r.Method == "POST" && strings.HasPrefix(r.URL.Path, "/uploads/"):
+		id, _ := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/uploads/"), "/assets"), 10, 64)
+		name := r.URL.Query().Get("name")
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		for _, rel := range g.releases {
+			if rel.ID != id {
+				continue
+			}
+			for _, a := range rel.Assets {
+				if a.Name == name {
+					http.Error(w, "already_exists", http.StatusUnprocessableEntity)
+					return
+				}
+			}
+			g.nextID++
+			asset := githubAsset{ID: g.nextID, Name: name}
+			rel.Assets = append(rel.Assets, asset)
+			g.uploads[name] = body
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(asset)
+			return
+		}
+		http.NotFound(w, r)
+	default:
+		g.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+func writeTestArtifacts(t *testing.T, names ...string) (string, func()) {
+	dir, err := ioutil.TempDir("", "macapptool-publish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("contents of "+name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func withFastRetries() func() {
+	prev := publishRetryDelay
+	publishRetryDelay = time.Millisecond
+	return func() { publishRetryDelay = prev }
+}
+
+func (g *fakeGitHub) destination(draft bool) *githubDestination {
+	return &githubDestination{
+		Owner:   "owner",
+		Repo:    "repo",
+		Tag:     "v1.0",
+		API:     g.srv.URL,
+		Draft:   draft,
+		Token:   "secret",
+		Retries: 3,
+	}
+}
+
+func TestGitHubPublishToDraft(t *testing.T) {
+	g := newFakeGitHub(t)
+	defer g.srv.Close()
+	dir, cleanup := writeTestArtifacts(t, "App.zip", "App.zip.sha256", "appcast.xml")
+	defer cleanup()
+	g.addRelease("v0.9", false)
+	draft := g.addRelease("v1.0", true, "App.zip")
+	existing := draft.Assets[0].ID
+
+	d := g.destination(true)
+	for _, name := range []string{"App.zip", "App.zip.sha256", "appcast.xml"} {
+		if err := d.Publish(name, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("publishing %s: %v", name, err)
+		}
+	}
+	if n := g.count("POST /repos/owner/repo/releases"); n != 0 {
+		t.Errorf("created %d releases, want to reuse the existing draft", n)
+	}
+	if n := g.count("GET /repos/owner/repo/releases"); n != 1 {
+		t.Errorf("listed releases %d times, want 1", n)
+	}
+	if n := g.count("DELETE /repos/owner/repo/releases/assets/" + strconv.FormatInt(existing, 10)); n != 1 {
+		t.Errorf("deleted the existing asset %d times, want 1", n)
+	}
+	var names []string
+	for _, a := range draft.Assets {
+		names = append(names, a.Name)
+	}
+	if got, want := strings.Join(names, ","), "App.zip,App.zip.sha256,appcast.xml"; got != want {
+		t.Errorf("draft assets = %s, want %s", got, want)
+	}
+	if got := string(g.uploads["appcast.xml"]); got != "contents of appcast.xml" {
+		t.Errorf("uploaded appcast.xml = %q", got)
+	}
+}
+
+func TestGitHubCreateReleaseOnce(t *testing.T) {
+	defer withFastRetries()()
+	g := newFakeGitHub(t)
+	defer g.srv.Close()
+	dir, cleanup := writeTestArtifacts(t, "App.zip", "appcast.xml")
+	defer cleanup()
+	// The first create succeeds but its response is lost, so
+	// the retry must find the release rather than create
+	// another one
+	g.failCreate = true
+
+	d := g.destination(true)
+	for _, name := range []string{"App.zip", "appcast.xml"} {
+		if err := d.Publish(name, filepath.Join(dir, name)); err != nil {
+			t.Fatalf("publishing %s: %v", name, err)
+		}
+	}
+	if n := g.count("POST /repos/owner/repo/releases"); n != 1 {
+		t.Errorf("created %d releases, want 1", n)
+	}
+	if len(g.releases) != 1 || len(g.releases[0].Assets) != 2 {
+		t.Errorf("releases = %+v, want 1 release with 2 assets", g.releases)
+	}
+}
+
+func TestGitHubPublishReplacesAsset(t *testing.T) {
+	g := newFakeGitHub(t)
+	defer g.srv.Close()
+	dir, cleanup := writeTestArtifacts(t, "App.zip")
+	defer cleanup()
+	rel := g.addRelease("v1.0", false, "App.zip")
+
+	d := g.destination(false)
+	for ii := 0; ii < 2; ii++ {
+		if err := d.Publish("App.zip", filepath.Join(dir, "App.zip")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := g.count("GET /repos/owner/repo/releases/tags/v1.0"); n != 1 {
+		t.Errorf("fetched the release %d times, want 1", n)
+	}
+	if len(rel.Assets) != 1 || rel.Assets[0].Name != "App.zip" {
+		t.Errorf("assets = %+v, want only App.zip", rel.Assets)
+	}
+}
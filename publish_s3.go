@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion = "us-east-1"
+	s3MinPartSize   = 5 << 20
+	s3MaxParts      = 10000
+)
+
+// s3Destination uploads files to an S3 compatible bucket,
+// using multipart uploads for big files. Multipart uploads
+// are resumable: the upload ID is stored next to the file
+// and the parts that were already uploaded are skipped
+// when publishing again.
+type s3Destination struct {
+	Bucket             string
+	Prefix             string
+	Endpoint           string
+	Region             string
+	AccessKeyID        string
+	SecretAccessKey    string
+	SessionToken       string
+	Retries            int
+	MultipartThreshold int64
+	PartSize           int64
+}
+
+func newS3Destination(u *url.URL, retries int, multipartThreshold int64, partSize int64) (*s3Destination, error) {
+	if u.Host == "" {
+		return nil, errors.New("missing bucket name")
+	}
+	q := u.Query()
+	d := &s3Destination{
+		Bucket:             u.Host,
+		Prefix:             strings.Trim(u.Path, "/"),
+		Endpoint:           strings.TrimSuffix(q.Get("endpoint"), "/"),
+		Region:             q.Get("region"),
+		AccessKeyID:        os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:       os.Getenv("AWS_SESSION_TOKEN"),
+		Retries:            retries,
+		MultipartThreshold: multipartThreshold,
+		PartSize:           partSize,
+	}
+	if d.Region == "" {
+		d.Region = os.Getenv("AWS_REGION")
+	}
+	if d.Region == "" {
+		d.Region = s3DefaultRegion
+	}
+	if d.Endpoint == "" {
+		d.Endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", d.Region)
+	}
+	if d.PartSize < s3MinPartSize {
+		d.PartSize = s3MinPartSize
+	}
+	return d, nil
+}
+
+func (d *s3Destination) checkCredentials() error {
+	if d.AccessKeyID == "" || d.SecretAccessKey == "" {
+		return errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return nil
+}
+
+func (d *s3Destination) String() string {
+	s := "s3://" + d.Bucket
+	if d.Prefix != "" {
+		s += "/" + d.Prefix
+	}
+	return s
+}
+
+func (d *s3Destination) key(name string) string {
+	if d.Prefix == "" {
+		return name
+	}
+	return d.Prefix + "/" + name
+}
+
+// s3Escape escapes s as required by AWS signature V4
+func s3Escape(s string, escapeSlash bool) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !escapeSlash) {
+			buf.WriteByte(c)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+func (d *s3Destination) newRequest(method, key string, query url.Values, body []byte) (*http.Request, error) {
+	// Always use path style addressing, since it's supported
+	// by every S3 compatible service
+	u := d.Endpoint + "/" + s3Escape(d.Bucket, true) + "/" + s3Escape(key, false)
+	if len(query) > 0 {
+		u += "?" + s3CanonicalQuery(query)
+	}
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, u, r)
+	if err != nil {
+		return nil, err
+	}
+	d.sign(req, query, body)
+	return req, nil
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds an AWS signature V4 to the request
+func (d *s3Destination) sign(req *http.Request, query url.Values, body []byte) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256.Sum256(body)
+	payloadHex := hex.EncodeToString(payloadHash[:])
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHex)
+	if d.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", d.SessionToken)
+	}
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "content-type" {
+			headers[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	var headerNames []string
+	for k := range headers {
+		headerNames = append(headerNames, k)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders bytes.Buffer
+	for _, k := range headerNames {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		s3CanonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHex,
+	}, "\n")
+	scope := date + "/" + d.Region + "/s3/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+d.SecretAccessKey), date)
+	key = hmacSHA256(key, d.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		d.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func (d *s3Destination) Publish(name string, p string) error {
+	st, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if st.Size() > d.MultipartThreshold {
+		return d.publishMultipart(name, p, st)
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	return withRetries(d.Retries, "uploading "+name, func() error {
+		req, err := d.newRequest("PUT", d.key(name), nil, data)
+		if err != nil {
+			return err
+		}
+		_, _, err = doHTTP(req, http.StatusOK)
+		return err
+	})
+}
+
+// s3UploadState is stored next to the uploaded file while
+// a multipart upload is in progress
+type s3UploadState struct {
+	Destination string    `json:"destination"`
+	Key         string    `json:"key"`
+	UploadID    string    `json:"upload_id"`
+	Size        int64     `json:"size"`
+	ModTime     time.Time `json:"mod_time"`
+	// PartSize is the size of every part but the last one.
+	// Resuming with a different one would mix parts from
+	// different layouts.
+	PartSize int64 `json:"part_size"`
+}
+
+func (d *s3Destination) statePath(p string) string {
+	h := sha1.Sum([]byte(d.String()))
+	return filepath.Join(filepath.Dir(p), fmt.Sprintf(".%s.%x.upload", filepath.Base(p), h[:4]))
+}
+
+func (d *s3Destination) loadState(p string, key string, st os.FileInfo, partSize int64) *s3UploadState {
+	data, err := ioutil.ReadFile(d.statePath(p))
+	if err != nil {
+		return nil
+	}
+	var state s3UploadState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil
+	}
+	if state.Destination != d.String() || state.Key != key ||
+		state.Size != st.Size() || !state.ModTime.Equal(st.ModTime()) {
+		// File changed since the upload was started
+		return nil
+	}
+	if state.PartSize != partSize {
+		verbosePrintf(1, "part size changed from %d to %d, starting a new upload\n", state.PartSize, partSize)
+		return nil
+	}
+	return &state
+}
+
+func (d *s3Destination) saveState(p string, state *s3UploadState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(d.statePath(p), data, 0644)
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+	Size       int64  `xml:"Size,omitempty"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadID string `xml:"UploadId"`
+}
+
+type s3ListPartsResult struct {
+	IsTruncated          bool     `xml:"IsTruncated"`
+	NextPartNumberMarker int      `xml:"NextPartNumberMarker"`
+	Parts                []s3Part `xml:"Part"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+func (d *s3Destination) createMultipartUpload(key string) (string, error) {
+	var uploadID string
+	err := withRetries(d.Retries, "starting multipart upload", func() error {
+		req, err := d.newRequest("POST", key, url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		data, _, err := doHTTP(req, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		var result s3InitiateMultipartUploadResult
+		if err := xml.Unmarshal(data, &result); err != nil {
+			return err
+		}
+		uploadID = result.UploadID
+		return nil
+	})
+	if err == nil && uploadID == "" {
+		err = errors.New("missing UploadId in response")
+	}
+	return uploadID, err
+}
+
+// listParts returns the parts already uploaded, or nil if the
+// upload doesn't exist anymore
+func (d *s3Destination) listParts(key string, uploadID string) (map[int]s3Part, error) {
+	parts := make(map[int]s3Part)
+	marker := 0
+	for {
+		query := url.Values{"uploadId": {uploadID}}
+		if marker > 0 {
+			query.Set("part-number-marker", strconv.Itoa(marker))
+		}
+		var result s3ListPartsResult
+		err := withRetries(d.Retries, "listing parts", func() error {
+			req, err := d.newRequest("GET", key, query, nil)
+			if err != nil {
+				return err
+			}
+			data, _, err := doHTTP(req, http.StatusOK)
+			if err != nil {
+				return err
+			}
+			return xml.Unmarshal(data, &result)
+		})
+		if err != nil {
+			if se, ok := err.(*httpStatusError); ok && se.StatusCode == http.StatusNotFound {
+				return nil, nil
+			}
+			return nil, err
+		}
+		for _, v := range result.Parts {
+			parts[v.PartNumber] = v
+		}
+		if !result.IsTruncated || result.NextPartNumberMarker <= marker {
+			break
+		}
+		marker = result.NextPartNumberMarker
+	}
+	return parts, nil
+}
+
+func (d *s3Destination) publishMultipart(name string, p string, st os.FileInfo) error {
+	key := d.key(name)
+	partSize := d.PartSize
+	for st.Size()/partSize >= s3MaxParts {
+		partSize *= 2
+	}
+	var uploaded map[int]s3Part
+	state := d.loadState(p, key, st, partSize)
+	if state != nil {
+		var err error
+		if uploaded, err = d.listParts(key, state.UploadID); err != nil {
+			return err
+		}
+		if uploaded == nil {
+			// Upload was aborted or expired, start again
+			state = nil
+		} else {
+			fmt.Printf("resuming upload of %s (%d parts already uploaded)\n", name, len(uploaded))
+		}
+	}
+	if state == nil {
+		uploadID, err := d.createMultipartUpload(key)
+		if err != nil {
+			return err
+		}
+		state = &s3UploadState{
+			Destination: d.String(),
+			Key:         key,
+			UploadID:    uploadID,
+			Size:        st.Size(),
+			ModTime:     st.ModTime(),
+			PartSize:    partSize,
+		}
+		if err := d.saveState(p, state); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	buf := make([]byte, partSize)
+	var complete s3CompleteMultipartUpload
+	for offset, partNumber := int64(0), 1; offset < st.Size(); offset, partNumber = offset+partSize, partNumber+1 {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		data := buf[:n]
+		if prev, ok := uploaded[partNumber]; ok && prev.Size == int64(n) {
+			verbosePrintf(1, "skipping part %d of %s\n", partNumber, name)
+			complete.Parts = append(complete.Parts, s3Part{PartNumber: partNumber, ETag: prev.ETag})
+			continue
+		}
+		verbosePrintf(1, "uploading part %d of %s\n", partNumber, name)
+		query := url.Values{
+			"partNumber": {strconv.Itoa(partNumber)},
+			"uploadId":   {state.UploadID},
+		}
+		var etag string
+		err = withRetries(d.Retries, fmt.Sprintf("uploading part %d of %s", partNumber, name), func() error {
+			req, err := d.newRequest("PUT", key, query, data)
+			if err != nil {
+				return err
+			}
+			_, resp, err := doHTTP(req, http.StatusOK)
+			if err != nil {
+				return err
+			}
+			etag = resp.Header.Get("ETag")
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3Part{PartNumber: partNumber, ETag: etag})
+	}
+	body, err := xml.Marshal(&complete)
+	if err != nil {
+		return err
+	}
+	err = withRetries(d.Retries, "completing upload of "+name, func() error {
+		req, err := d.newRequest("POST", key, url.Values{"uploadId": {state.UploadID}}, body)
+		if err != nil {
+			return err
+		}
+		data, _, err := doHTTP(req, http.StatusOK)
+		if err != nil {
+			return err
+		}
+		// S3 might return an error with a 200 status code
+		if bytes.Contains(data, []byte("<Error>")) {
+			return fmt.Errorf("error completing upload: %s", data)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(d.statePath(p))
+}
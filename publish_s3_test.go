@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 is a minimal stand-in for the S3 API, using path
+// style addressing
+type fakeS3 struct {
+	t   *testing.T
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	objects  map[string][]byte
+	uploads  map[string]map[int][]byte
+	nextID   int
+	requests []string
+	// failPart makes uploading the part with this number fail
+	// with a permanent error, interrupting the upload
+	failPart int
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	s := &fakeS3{t: t, objects: make(map[string][]byte), uploads: make(map[string]map[int][]byte)}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *fakeS3) count(request string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, v := range s.requests {
+		if v == request {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *fakeS3) serve(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || r.Header.Get("X-Amz-Content-Sha256") == "" {
+		http.Error(w, "<Error><Code>AccessDenied</Code></Error>", http.StatusForbidden)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	q := r.URL.Query()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	op := r.Method
+	if _, ok := q["uploads"]; ok {
+		op += " uploads"
+	} else if q.Get("partNumber") != "" {
+		op += " part"
+	} else if q.Get("uploadId") != "" {
+		op += " upload"
+	}
+	s.requests = append(s.requests, op)
+	const prefix = "/bucket/"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, prefix)
+	switch op {
+	case "PUT":
+		s.objects[key] = body
+	case "POST uploads":
+		s.nextID++
+		id := fmt.Sprintf("upload-%d", s.nextID)
+		s.uploads[id] = make(map[int][]byte)
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case "PUT part":
+		parts, ok := s.uploads[q.Get("uploadId")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		if n == s.failPart {
+			s.failPart = 0
+			http.Error(w, "<Error><Code>InvalidRequest</Code></Error>", http.StatusBadRequest)
+			return
+		}
+		parts[n] = body
+		w.Header().Set("ETag", fmt.Sprintf("\"etag-%d-%d\"", n, len(body)))
+	case "GET upload":
+		parts, ok := s.uploads[q.Get("uploadId")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var result s3ListPartsResult
+		for n, data := range parts {
+			result.Parts = append(result.Parts, s3Part{PartNumber: n, ETag: fmt.Sprintf("\"etag-%d-%d\"", n, len(data)), Size: int64(len(data))})
+		}
+		sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+		xml.NewEncoder(w).Encode(struct {
+			XMLName xml.Name `xml:"ListPartsResult"`
+			s3ListPartsResult
+		}{s3ListPartsResult: result})
+	case "POST upload":
+		id := q.Get("uploadId")
+		parts, ok := s.uploads[id]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		var complete s3CompleteMultipartUpload
+		if err := xml.Unmarshal(body, &complete); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var buf bytes.Buffer
+		for ii, p := range complete.Parts {
+			data, ok := parts[p.PartNumber]
+			if p.PartNumber != ii+1 || !ok || p.ETag != fmt.Sprintf("\"etag-%d-%d\"", p.PartNumber, len(data)) {
+				fmt.Fprint(w, "<Error><Code>InvalidPart</Code></Error>")
+				return
+			}
+			buf.Write(data)
+		}
+		s.objects[key] = buf.Bytes()
+		delete(s.uploads, id)
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	default:
+		s.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		http.NotFound(w, r)
+	}
+}
+
+func (s *fakeS3) destination() *s3Destination {
+	return &s3Destination{
+		Bucket:             "bucket",
+		Prefix:             "releases",
+		Endpoint:           s.srv.URL,
+		Region:             "us-east-1",
+		AccessKeyID:        "AKID",
+		SecretAccessKey:    "secret",
+		Retries:            3,
+		MultipartThreshold: 16,
+		PartSize:           10,
+	}
+}
+
+func TestS3PublishSingle(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.srv.Close()
+	dir, cleanup := writeTestArtifacts(t, "App.zip")
+	defer cleanup()
+
+	d := s.destination()
+	d.MultipartThreshold = 1 << 20
+	if err := d.Publish("App.zip", filepath.Join(dir, "App.zip")); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(s.objects["releases/App.zip"]); got != "contents of App.zip" {
+		t.Errorf("uploaded %q", got)
+	}
+}
+
+func writeMultipartArtifact(t *testing.T, dir string) (string, []byte) {
+	// 4 parts of 10 bytes, the last one shorter
+	data := []byte("0123456789abcdefghijABCDEFGHIJxyz")
+	p := filepath.Join(dir, "App.dmg")
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p, data
+}
+
+func TestS3PublishMultipartResume(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.srv.Close()
+	dir, cleanup := writeTestArtifacts(t)
+	defer cleanup()
+	p, data := writeMultipartArtifact(t, dir)
+
+	d := s.destination()
+	s.failPart = 3
+	if err := d.Publish("App.dmg", p); err == nil {
+		t.Fatal("interrupted upload succeeded")
+	}
+	if _, err := os.Stat(d.statePath(p)); err != nil {
+		t.Fatalf("upload state not saved: %v", err)
+	}
+	if err := d.Publish("App.dmg", p); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.count("POST uploads"); n != 1 {
+		t.Errorf("started %d uploads, want 1", n)
+	}
+	// Parts 1 and 2 are uploaded once, part 3 fails and is then
+	// uploaded with part 4
+	if n := s.count("PUT part"); n != 5 {
+		t.Errorf("uploaded %d parts, want 5", n)
+	}
+	if got := s.objects["releases/App.dmg"]; !bytes.Equal(got, data) {
+		t.Errorf("uploaded %q, want %q", got, data)
+	}
+	if _, err := os.Stat(d.statePath(p)); !os.IsNotExist(err) {
+		t.Errorf("upload state not removed: %v", err)
+	}
+}
+
+func TestS3PublishPartSizeChanged(t *testing.T) {
+	s := newFakeS3(t)
+	defer s.srv.Close()
+	dir, cleanup := writeTestArtifacts(t)
+	defer cleanup()
+	p, data := writeMultipartArtifact(t, dir)
+
+	d := s.destination()
+	s.failPart = 2
+	if err := d.Publish("App.dmg", p); err == nil {
+		t.Fatal("interrupted upload succeeded")
+	}
+	// Part 1 has 10 bytes, resuming it with 20 byte parts
+	// would produce a corrupt object
+	d.PartSize = 20
+	if err := d.Publish("App.dmg", p); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.count("POST uploads"); n != 2 {
+		t.Errorf("started %d uploads, want 2", n)
+	}
+	if n := s.count("GET upload"); n != 0 {
+		t.Errorf("listed parts %d times, want 0", n)
+	}
+	if got := s.objects["releases/App.dmg"]; !bytes.Equal(got, data) {
+		t.Errorf("uploaded %q, want %q", got, data)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeHTTPServer records the requests it receives, replying
+// with the next status in statuses, or 201 once it runs out
+type fakeHTTPServer struct {
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []string
+	auth     []string
+	bodies   map[string]string
+}
+
+func newFakeHTTPServer(statuses ...int) *fakeHTTPServer {
+	s := &fakeHTTPServer{statuses: statuses, bodies: make(map[string]string)}
+	s.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		user, password, _ := r.BasicAuth()
+		s.auth = append(s.auth, user+":"+password)
+		status := http.StatusCreated
+		if len(s.statuses) > 0 {
+			status, s.statuses = s.statuses[0], s.statuses[1:]
+		}
+		if r.Method == "PUT" && status < 300 {
+			s.bodies[r.URL.Path] = string(data)
+		}
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+// url returns the URL of the server with the given scheme,
+// credentials and path
+func (s *fakeHTTPServer) url(scheme string, user string, p string) string {
+	u := strings.Replace(s.srv.URL, "http", scheme, 1)
+	if user != "" {
+		u = strings.Replace(u, "://", "://"+user+"@", 1)
+	}
+	return u + p
+}
+
+func TestDirDestination(t *testing.T) {
+	src, cleanup := writeTestArtifacts(t, "App.zip")
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "macapptool-publish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	c := &publishCmd{}
+	for _, v := range []string{filepath.Join(dir, "a"), "file://" + filepath.Join(dir, "b", "c")} {
+		d, err := c.parseDestination(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Publishing twice replaces the file
+		for ii := 0; ii < 2; ii++ {
+			if err := d.Publish("App.zip", filepath.Join(src, "App.zip")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dest := d.(*dirDestination).Dir
+		data, err := ioutil.ReadFile(filepath.Join(dest, "App.zip"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != "contents of App.zip" {
+			t.Errorf("%s: copied %q", v, data)
+		}
+		entries, err := ioutil.ReadDir(dest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("%s: %d files after publishing, want 1", v, len(entries))
+		}
+	}
+}
+
+func TestHTTPDestination(t *testing.T) {
+	defer withFastRetries()()
+	dir, cleanup := writeTestArtifacts(t, "App.zip")
+	defer cleanup()
+	// The first attempt fails with a temporary error
+	s := newFakeHTTPServer(http.StatusServiceUnavailable)
+	defer s.srv.Close()
+	d, err := (&publishCmd{Retries: 3}).parseDestination(s.url("http", "user:secret", "/releases/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(d.String(), "secret") {
+		t.Errorf("String() = %s, includes the password", d)
+	}
+	if err := d.Publish("App.zip", filepath.Join(dir, "App.zip")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(s.requests, ","), "PUT /releases/App.zip,PUT /releases/App.zip"; got != want {
+		t.Errorf("requests = %s, want %s", got, want)
+	}
+	if s.auth[1] != "user:secret" {
+		t.Errorf("authenticated as %q", s.auth[1])
+	}
+	if got := s.bodies["/releases/App.zip"]; got != "contents of App.zip" {
+		t.Errorf("uploaded %q", got)
+	}
+
+	// Client errors aren't retried
+	s = newFakeHTTPServer(http.StatusForbidden)
+	defer s.srv.Close()
+	if d, err = (&publishCmd{Retries: 3}).parseDestination(s.url("http", "", "/releases")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Publish("App.zip", filepath.Join(dir, "App.zip")); err == nil || !strings.Contains(err.Error(), "unexpected status 403") {
+		t.Errorf("error = %v, want unexpected status 403", err)
+	}
+	if len(s.requests) != 1 {
+		t.Errorf("made %d requests, want 1", len(s.requests))
+	}
+}
+
+func TestWebDAVDestination(t *testing.T) {
+	dir, cleanup := writeTestArtifacts(t, "App.zip")
+	defer cleanup()
+	// The first collection already exists
+	s := newFakeHTTPServer(http.StatusMethodNotAllowed)
+	defer s.srv.Close()
+	d, err := (&publishCmd{Retries: 1}).parseDestination(s.url("webdav", "user:secret", "/files/app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Publish("App.zip", filepath.Join(dir, "App.zip")); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(s.requests, ","), "MKCOL /files/,MKCOL /files/app/,PUT /files/app/App.zip"; got != want {
+		t.Errorf("requests = %s, want %s", got, want)
+	}
+	for _, v := range s.auth {
+		if v != "user:secret" {
+			t.Errorf("authenticated as %q", v)
+		}
+	}
+	if got := s.bodies["/files/app/App.zip"]; got != "contents of App.zip" {
+		t.Errorf("uploaded %q", got)
+	}
+}
+
+// unsetEnv unsets the given environment variables, returning a
+// function which restores them
+func unsetEnv(names ...string) func() {
+	prev := make(map[string]string)
+	for _, name := range names {
+		if v, ok := os.LookupEnv(name); ok {
+			prev[name] = v
+		}
+		os.Unsetenv(name)
+	}
+	return func() {
+		for name, v := range prev {
+			os.Setenv(name, v)
+		}
+	}
+}
+
+func TestPublishCredentials(t *testing.T) {
+	defer unsetEnv("AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "GITHUB_TOKEN")()
+	src, cleanup := writeTestArtifacts(t, "App.zip")
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "macapptool-publish-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(v bool) { *dryRun = v }(*dryRun)
+	archive := filepath.Join(src, "App.zip")
+
+	tests := []struct {
+		dest string
+		err  string
+	}{
+		{"s3://bucket/releases", "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set"},
+		{"github://owner/repo?tag=v1.0", "GITHUB_TOKEN must be set"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.dest, func(t *testing.T) {
+			c := &publishCmd{Destinations: stringList{dir, tt.dest}, Checksums: true, Retries: 1}
+			*dryRun = true
+			if err := c.publish(archive); err != nil {
+				t.Fatalf("dry run failed without credentials: %v", err)
+			}
+			// Nothing is uploaded when the credentials are missing,
+			// not even to the destinations which don't need them
+			*dryRun = false
+			if err := c.publish(archive); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want %s", err, tt.err)
+			}
+			if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) != 0 {
+				t.Errorf("published %d files, %v", len(entries), err)
+			}
+		})
+	}
+
+	c := &publishCmd{Destinations: stringList{dir}, Checksums: true, Retries: 1}
+	if err := c.publish(archive); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "App.zip.sha256"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum, _, err := fileSHA256(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := sum + "  App.zip\n"; string(data) != want {
+		t.Errorf("checksum file = %q, want %q", data, want)
+	}
+}
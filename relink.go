@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/subcommands"
+
+	"macapptool/internal/macho"
+)
+
+type relinkCmd struct {
+}
+
+func (*relinkCmd) Name() string {
+	return "relink"
+}
+
+func (*relinkCmd) Synopsis() string {
+	return "Copy the libraries used by an app bundle into it"
+}
+
+func (*relinkCmd) Usage() string {
+	return `relink some.app
+
+relink copies the libraries used by the code in the bundle
+which are outside of it and the system library paths, like
+the ones installed by Homebrew, into Contents/Frameworks,
+including the libraries they use. The copied libraries get
+an @rpath/ install name, the references to them are changed
+to match and LC_RPATH load commands are added where needed.
+Since this invalidates the code signatures of the modified
+files and their bundles, they are removed.
+`
+}
+
+func (c *relinkCmd) SetFlags(f *flag.FlagSet) {
+}
+
+func (c *relinkCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		f.Usage()
+		return subcommands.ExitUsageError
+	}
+	for _, arg := range f.Args() {
+		if err := relinkBundle(strings.TrimSuffix(arg, "/")); err != nil {
+			errPrintf("error relinking %s: %v\n", arg, err)
+			return subcommands.ExitFailure
+		}
+	}
+	return subcommands.ExitSuccess
+}
+
+// relinkFile is a Mach-O file which might need relinking
+type relinkFile struct {
+	// Path is where the file is written
+	Path string
+	// Source is where the file is read from, which differs
+	// from Path for the libraries copied into the bundle.
+	// @loader_path is resolved relative to it.
+	Source string
+	// Data contains the new contents of the file
+	Data []byte
+}
+
+// relinker copies the libraries outside of a bundle into it
+type relinker struct {
+	resolver *libResolver
+	// frameworks is the directory the libraries are copied to
+	frameworks string
+	// copies maps the real paths of the copied libraries to
+	// their names in frameworks
+	copies map[string]string
+	// sources maps the names in frameworks to the real paths
+	// they were copied from
+	sources map[string]string
+	queue   []relinkFile
+	// changed contains the files which must be copied or
+	// modified
+	changed []relinkFile
+}
+
+// bundleLibrary returns the name in frameworks for the library
+// at p, which is outside of the bundle, queueing it to be
+// copied the first time
+func (r *relinker) bundleLibrary(name string, p string) (string, error) {
+	real, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", err
+	}
+	if base, ok := r.copies[real]; ok {
+		return base, nil
+	}
+	if strings.Contains(real, ".framework/") {
+		return "", fmt.Errorf("%s is in a framework, which must be embedded as a whole", name)
+	}
+	// Use the name the library is referenced by, rather than
+	// the one of the file, which often has a longer version
+	base := filepath.Base(name)
+	if prev, ok := r.sources[base]; ok && prev != real {
+		return "", fmt.Errorf("both %s and %s would be copied to %s", prev, real, base)
+	}
+	r.copies[real] = base
+	r.sources[base] = real
+	dest := filepath.Join(r.frameworks, base)
+	if fileExists(dest) {
+		// Reuse the copy made by an earlier run
+		verbosePrintf(1, "%s is already in %s\n", base, r.frameworks)
+		return base, nil
+	}
+	r.queue = append(r.queue, relinkFile{Path: dest, Source: real})
+	return base, nil
+}
+
+// rpathFor returns the run path pointing to frameworks from
+// the file at p. For main executables, @loader_path is the
+// same as @executable_path.
+func (r *relinker) rpathFor(p string) (string, error) {
+	rel, err := filepath.Rel(filepath.Dir(p), r.frameworks)
+	if err != nil {
+		return "", err
+	}
+	if rel == "." {
+		return "@loader_path", nil
+	}
+	return "@loader_path/" + filepath.ToSlash(rel), nil
+}
+
+// edits returns the changes needed by a slice of the file
+func (r *relinker) edits(file relinkFile, f *macho.File, edits *macho.Relink) error {
+	copied := file.Path != file.Source
+	var exePath string
+	var rpaths []string
+	if copied {
+		// The main executable is unknown for the copied
+		// libraries, but they only use @loader_path and
+		// absolute paths
+		rpaths = expandRpaths(f, file.Source, "")
+	} else {
+		exePath, rpaths = r.resolver.runPaths(file.Source, f)
+	}
+	if id := f.DylibID(); id != nil {
+		if copied || (filepath.Dir(file.Path) == r.frameworks && !strings.HasPrefix(id.Name, "@") && !isSystemLibrary(id.Name)) {
+			edits.ID = "@rpath/" + filepath.Base(file.Path)
+		}
+	}
+	needsRpath := false
+	for _, d := range f.Dylibs() {
+		if isSystemLibrary(d.Name) {
+			continue
+		}
+		resolved := resolveLibrary(d.Name, file.Source, exePath, rpaths)
+		if resolved == "" {
+			if d.Weak() {
+				errPrintf("warning: %s: weak library %s not found\n", file.Source, d.Name)
+				continue
+			}
+			return fmt.Errorf("%s: library %s not found", file.Source, d.Name)
+		}
+		if r.resolver.contains(resolved) {
+			if !copied {
+				continue
+			}
+			// Libraries can't reference the bundle they are
+			// copied to using paths relative to the original
+			return fmt.Errorf("%s: library %s resolves inside of the bundle", file.Source, d.Name)
+		}
+		base, err := r.bundleLibrary(d.Name, resolved)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file.Source, err)
+		}
+		edits.Dylibs[d.Name] = "@rpath/" + base
+		needsRpath = true
+	}
+	if !needsRpath {
+		return nil
+	}
+	if !copied {
+		for _, rp := range rpaths {
+			if filepath.Clean(rp) == r.frameworks {
+				return nil
+			}
+		}
+	}
+	rpath, err := r.rpathFor(file.Path)
+	if err != nil {
+		return err
+	}
+	for _, v := range edits.Rpaths {
+		if v == rpath {
+			return nil
+		}
+	}
+	edits.Rpaths = append(edits.Rpaths, rpath)
+	return nil
+}
+
+// relink computes the new contents of a file, adding it to
+// the changed files if it needs to be copied or modified
+func (r *relinker) relink(file relinkFile) error {
+	bin, err := macho.ReadFile(file.Source)
+	if err != nil {
+		return fmt.Errorf("%s: %v", file.Source, err)
+	}
+	edits := &macho.Relink{Dylibs: make(map[string]string)}
+	for _, s := range bin.Slices {
+		if err := r.edits(file, s.File, edits); err != nil {
+			return err
+		}
+	}
+	data, err := bin.Relink(edits)
+	if err != nil {
+		return fmt.Errorf("error relinking %s: %v", file.Source, err)
+	}
+	if file.Path == file.Source && data == nil {
+		verbosePrintf(2, "%s doesn't need relinking\n", file.Path)
+		return nil
+	}
+	if file.Path != file.Source {
+		if data == nil {
+			if data, err = ioutil.ReadFile(file.Source); err != nil {
+				return err
+			}
+		}
+		// Strip the signatures in slices which weren't modified
+		if parsed, err := macho.Parse(data); err == nil {
+			if unsigned, err := parsed.RemoveSignatures(); err != nil {
+				return fmt.Errorf("error unsigning %s: %v", file.Source, err)
+			} else if unsigned != nil {
+				data = unsigned
+			}
+		}
+	}
+	file.Data = data
+	r.changed = append(r.changed, file)
+	return nil
+}
+
+// write copies or modifies a changed file
+func (r *relinker) write(file relinkFile) error {
+	if file.Path == file.Source {
+		verbosePrintf(1, "relinking %s\n", file.Path)
+		if *dryRun {
+			fmt.Printf("relink %s\n", file.Path)
+			return nil
+		}
+		// Modify the actual file rather than replacing
+		// symlinks, like the ones at the root of a framework
+		real, err := filepath.EvalSymlinks(file.Path)
+		if err != nil {
+			return err
+		}
+		return writeFileAtomic(real, file.Data)
+	}
+	verbosePrintf(1, "copying %s to %s\n", file.Source, file.Path)
+	if *dryRun {
+		fmt.Printf("cp %s %s\n", file.Source, file.Path)
+		return nil
+	}
+	st, err := os.Stat(file.Source)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(r.frameworks, 0755); err != nil {
+		return err
+	}
+	// Keep the copies writable, since Homebrew installs its
+	// libraries as read only
+	return ioutil.WriteFile(file.Path, file.Data, st.Mode().Perm()|0200)
+}
+
+// relinkBundle copies the libraries used by the bundle at root
+// into its Contents/Frameworks directory
+func relinkBundle(root string) error {
+	st, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return errors.New("relink requires an app bundle")
+	}
+	resolver, err := newLibResolver(root)
+	if err != nil {
+		return err
+	}
+	// Resolve the bundle itself, like newLibResolver does with
+	// its parent, so the paths can be compared
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	if realRoot, err = filepath.Abs(realRoot); err != nil {
+		return err
+	}
+	contents, _ := bundleContents(realRoot)
+	r := &relinker{
+		resolver:   resolver,
+		frameworks: filepath.Join(contents, "Frameworks"),
+		copies:     make(map[string]string),
+		sources:    make(map[string]string),
+	}
+	err = walkCode(realRoot, func(p string) error {
+		exe, err := codeExecutable(p)
+		if err != nil {
+			verbosePrintf(1, "skipping %s: %v\n", p, err)
+			return nil
+		}
+		r.queue = append(r.queue, relinkFile{Path: exe, Source: exe})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// The queue grows as the libraries used by the copied
+	// ones are found. Nothing is written until all of them
+	// are resolved, so errors leave the bundle untouched.
+	for len(r.queue) > 0 {
+		file := r.queue[0]
+		r.queue = r.queue[1:]
+		if err := r.relink(file); err != nil {
+			return err
+		}
+	}
+	if len(r.changed) == 0 {
+		verbosePrintf(1, "%s doesn't use any libraries outside of it\n", root)
+		return nil
+	}
+	var changed []string
+	for _, file := range r.changed {
+		if err := r.write(file); err != nil {
+			return err
+		}
+		changed = append(changed, file.Path)
+	}
+	return unsignContainers(realRoot, changed)
+}
+
+// unsignContainers removes the signatures of the bundles in
+// root containing any of the given files, since their seals
+// are no longer valid
+func unsignContainers(root string, files []string) error {
+	return walkCode(root, func(p string) error {
+		if !isBundleDir(p) {
+			return nil
+		}
+		for _, f := range files {
+			if strings.HasPrefix(f, p+string(filepath.Separator)) {
+				return unsignCode(p)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"macapptool/internal/macho"
+)
+
+// relinkTestFile writes the testdata file name to p, with the
+// changes in r applied
+func relinkTestFile(t *testing.T, p string, name string, r *macho.Relink) {
+	bin, err := macho.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := bin.Relink(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(p, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelinkBundle(t *testing.T) {
+	root, cleanup := writeTestBundle(t, map[string]string{
+		"MacOS/App":                    "hello_arm64.signed",
+		"Frameworks/libfoo.dylib":      "libfoo_arm64.dylib",
+		"_CodeSignature/CodeResources": "hello_arm64",
+	})
+	defer cleanup()
+	// Make the weak library hello_arm64 links to exist outside
+	// of the bundle, like one installed by Homebrew
+	dir, err := ioutil.TempDir("", "macapptool-relink-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if dir, err = filepath.EvalSymlinks(dir); err != nil {
+		t.Fatal(err)
+	}
+	external := filepath.Join(dir, "lib", "libbar.1.dylib")
+	relinkTestFile(t, external, "libfoo_arm64.dylib", &macho.Relink{ID: external})
+	exe := filepath.Join(root, "Contents", "MacOS", "App")
+	relinkTestFile(t, exe, "hello_arm64.signed", &macho.Relink{
+		Dylibs: map[string]string{"/opt/local/lib/libbar.1.dylib": external},
+	})
+
+	if err := relinkBundle(root); err != nil {
+		t.Fatal(err)
+	}
+	copied := filepath.Join(root, "Contents", "Frameworks", "libbar.1.dylib")
+	copiedData, err := ioutil.ReadFile(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := macho.Parse(copiedData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := bin.Slices[0].DylibID(); id == nil || id.Name != "@rpath/libbar.1.dylib" {
+		t.Errorf("install name = %v, want @rpath/libbar.1.dylib", id)
+	}
+	// Relinking the executable back to the original names
+	// restores the unsigned file, since it already has the
+	// run path to Frameworks
+	if bin, err = macho.ReadFile(exe); err != nil {
+		t.Fatal(err)
+	}
+	data, err := bin.Relink(&macho.Relink{
+		Dylibs: map[string]string{"@rpath/libbar.1.dylib": "/opt/local/lib/libbar.1.dylib"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(filepath.Join("testdata", "hello_arm64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Error("relinked executable doesn't match testdata/hello_arm64")
+	}
+	if fileExists(filepath.Join(root, "Contents", "_CodeSignature")) {
+		t.Error("bundle signature not removed")
+	}
+
+	reports, err := auditLibs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range reports {
+		if r.failed() {
+			t.Errorf("%s: %q", r.(*libReport).Path, r.(*libReport).Problems)
+		}
+	}
+	// Relinking again doesn't change anything
+	if err := relinkBundle(root); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(copied); err != nil || !bytes.Equal(data, copiedData) {
+		t.Errorf("%s changed by relinking again: %v", filepath.Base(copied), err)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// resolveSecret returns the secret referenced by ref, using
+// the same syntax as altool for passwords:
+//
+//	@env:NAME	the NAME environment variable
+//	@keychain:ITEM	the ITEM generic password in the keychain
+//	@file:PATH	the contents of PATH, without trailing newlines
+//
+// Any other value is returned as is.
+func resolveSecret(ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, "@env:"):
+		name := strings.TrimPrefix(ref, "@env:")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(ref, "@keychain:"):
+		item := strings.TrimPrefix(ref, "@keychain:")
+		out, err := exec.Command("security", "find-generic-password", "-w", "-s", item).Output()
+		if err != nil {
+			return "", fmt.Errorf("error reading %s from keychain: %v", item, err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	case strings.HasPrefix(ref, "@file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(ref, "@file:"))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return ref, nil
+}
@@ -1,21 +1,65 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/subcommands"
+
+	"macapptool/internal/codesign"
 )
 
+// adhocIdentity is the identity used for ad-hoc signatures,
+// as accepted by codesign
+const adhocIdentity = "-"
+
 type signCmd struct {
 	Identity     string
 	Entitlements string
+	Native       bool
+	P12          string
+	P12Password  string
+	TimeStamp    string
+	Retries      int
+	Jobs         int
+	Config       string
+	Strict       bool
+	Profile      string
+	Team         string
+	Force        bool
+	Cache        string
+
+	Options                string
+	Identifier             string
+	Prefix                 string
+	Requirements           string
+	PreserveMetadata       string
+	GenerateEntitlementDER bool
+
+	identity *codesign.Identity
+	config   *signConfig
+	cache    *signCache
+	// optionsSet is true when -options was given explicitly
+	optionsSet bool
+
+	// identitiesMu protects the keychain identities and
+	// the identities from -config resolved with them
+	identitiesMu sync.Mutex
+	keychainIDs  []*signingIdentity
+	keychainRead bool
+	keychainErr  error
+	identities   map[string]string
 }
 
 func (*signCmd) Name() string {
@@ -27,12 +71,59 @@ func (*signCmd) Synopsis() string {
 }
 
 func (*signCmd) Usage() string {
-	return `sign [-i identity][-e entitlements] some.app`
+	return `sign [-i identity|hash][-team id][-e entitlements][-profile file][-native][-p12 file [-p12-password secret]][-timestamp url|none][-j N][-config file][-strict][-force][-cache file]
+	[-options flags|none][-identifier id][-prefix prefix][-requirements file|=text][-preserve-metadata list][-generate-entitlement-der] some.app`
 }
 
-func (c *signCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+func (c *signCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if err := validateSignOptions(splitList(c.Options), splitList(c.PreserveMetadata)); err != nil {
+		errPrint(err)
+		return subcommands.ExitUsageError
+	}
+	if c.Native {
+		for _, m := range codesignOnlyMetadata {
+			if (&signSettings{PreserveMetadata: splitList(c.PreserveMetadata)}).preserves(m) {
+				errPrintf("can't preserve %s with -native, it requires codesign\n", m)
+				return subcommands.ExitUsageError
+			}
+		}
+	}
+	f.Visit(func(fl *flag.Flag) {
+		if fl.Name == "options" {
+			c.optionsSet = true
+		}
+	})
+	if c.Config != "" {
+		cfg, err := loadSignConfig(c.Config)
+		if err != nil {
+			errPrint(err)
+			return subcommands.ExitFailure
+		}
+		c.config = cfg
+	}
+	if c.P12 != "" {
+		password, err := resolveSecret(c.P12Password)
+		if err != nil {
+			errPrintf("error reading PKCS#12 password: %v\n", err)
+			return subcommands.ExitFailure
+		}
+		if c.identity, err = loadP12Identity(c.P12, password); err != nil {
+			errPrint(err)
+			return subcommands.ExitFailure
+		}
+		if err := completeChain(c.identity); err != nil {
+			errPrint(err)
+			return subcommands.ExitFailure
+		}
+		// codesign can only use identities from the keychain
+		c.Native = true
+	}
+	if err := c.selectIdentity(ctx); err != nil {
+		errPrint(err)
+		return subcommands.ExitFailure
+	}
 	for _, arg := range f.Args() {
-		if err := c.signApp(arg); err != nil {
+		if err := c.signApp(ctx, arg); err != nil {
 			errPrintf("error signing %s: %v\n", arg, err)
 			return subcommands.ExitFailure
 		}
@@ -41,48 +132,217 @@ func (c *signCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{})
 }
 
 func (c *signCmd) SetFlags(f *flag.FlagSet) {
-	f.StringVar(&c.Identity, "i", "Developer ID", "Identity to sign the app")
-	f.StringVar(&c.Entitlements, "e", "", "Custom entitlements to use")
+	f.StringVar(&c.Identity, "i", "Developer ID", "Identity to sign the app, either a substring of its name or its SHA-1 hash")
+	f.StringVar(&c.Team, "team", "", "Only use signing identities for the given team ID")
+	f.StringVar(&c.Entitlements, "e", "", "Custom entitlements to use for the signed bundle. Nested code gets entitlements only from -config")
+	f.StringVar(&c.Profile, "profile", "", "Provisioning profile to validate and embed in the signed bundle")
+	f.BoolVar(&c.Native, "native", runtime.GOOS != "darwin", "Sign without using codesign. Requires -p12 or an ad-hoc signature (-i -)")
+	f.StringVar(&c.P12, "p12", "", "Sign with the identity in the given PKCS#12 file, implies -native")
+	f.StringVar(&c.P12Password, "p12-password", "", "Password for -p12. Use @env:NAME, @keychain:ITEM or @file:PATH to read it from elsewhere")
+	f.StringVar(&c.TimeStamp, "timestamp", "", "URL of the RFC 3161 timestamp server, defaults to Apple's. Use none to disable timestamps")
+	f.IntVar(&c.Retries, "timestamp-retries", 3, "Number of times to retry failed timestamp requests, only with -native")
+	f.IntVar(&c.Jobs, "j", 1, "Number of independent components to sign in parallel")
+	f.BoolVar(&c.Strict, "strict", false, "Fail if linting the entitlements produces warnings")
+	f.BoolVar(&c.Force, "force", false, "Sign every component, even the ones which haven't changed since they were signed. Use it to disable the signing cache")
+	f.StringVar(&c.Cache, "cache", "", "File recording the signed components, used for skipping the unchanged ones whose signatures are still valid. Defaults to a file in the user cache directory, use -force to ignore it")
+	f.StringVar(&c.Config, "config", "", "JSON file with per-component entitlements, identities, options, requirements and identifiers")
+	f.StringVar(&c.Options, "options", "runtime", "Comma separated code signing flags, like runtime,library,kill. Use none to sign without any")
+	f.StringVar(&c.Identifier, "identifier", "", "Identifier for the signed bundle, instead of its bundle ID or file name")
+	f.StringVar(&c.Prefix, "prefix", "", "Prefix for the identifiers derived from file names without dots, like com.example.")
+	f.StringVar(&c.Requirements, "requirements", "", "Internal requirements for the signed bundle, either a file or requirements in the requirement language prefixed with =")
+	f.StringVar(&c.PreserveMetadata, "preserve-metadata", "", "Comma separated parts of the existing signatures to keep when re-signing: "+strings.Join(preservableMetadata, ", ")+". flags are only kept when -options is not set. "+strings.Join(codesignOnlyMetadata, ", ")+" can't be preserved with -native")
+	f.BoolVar(&c.GenerateEntitlementDER, "generate-entitlement-der", false, "Include DER encoded entitlements when signing with codesign. Native signatures always include them")
 }
 
-func (c *signCmd) signPath(root, p string) error {
-	st, err := os.Stat(p)
-	if err != nil {
-		return err
-	}
-	ext := filepath.Ext(p)
-	var shouldSign bool
-	if st.IsDir() {
-		shouldSign = ext == ".app" || ext == ".framework" || ext == ".xpc"
-		// Inner bundles need to be signed before outer ones
-		entries, err := ioutil.ReadDir(p)
+// selectIdentity checks that the signing identity is
+// unambiguous and belongs to the team from -team, warning
+// if it's about to expire. When signing with codesign, the
+// identity is replaced by its hash, so codesign uses the
+// same one.
+func (c *signCmd) selectIdentity(ctx context.Context) error {
+	var id *signingIdentity
+	switch {
+	case c.identity != nil:
+		id = newSigningIdentity(c.identity.Certificate, "", c.P12)
+		if c.Team != "" && id.TeamID != c.Team {
+			return fmt.Errorf("identity %q in %s belongs to team %q, not %s", id.Name, c.P12, id.TeamID, c.Team)
+		}
+	case c.Identity == adhocIdentity:
+		if c.Team != "" {
+			return errors.New("-team can't be used with ad-hoc signatures")
+		}
+		return nil
+	case c.Native:
+		// nativeSignOptions reports the missing identity
+		return nil
+	default:
+		c.identitiesMu.Lock()
+		ids, err := c.keychainIdentities(ctx)
+		c.identitiesMu.Unlock()
 		if err != nil {
+			if *dryRun {
+				// Nothing is signed, so a missing keychain
+				// shouldn't prevent showing what would be done
+				errPrintf("warning: can't check identity %q: %v\n", c.Identity, err)
+				return nil
+			}
 			return err
 		}
-		for _, v := range entries {
-			if err := c.signPath(root, filepath.Join(p, v.Name())); err != nil {
-				return err
-			}
+		if id, err = selectIdentity(ids, c.Identity, c.Team); err != nil {
+			return err
 		}
-	} else {
-		shouldSign = ext == ".dylib" || filepath.Base(filepath.Dir(p)) == "Helpers" || isExecutable(st)
+		c.Identity = id.Hash
 	}
-	if shouldSign {
-		return c.signEntry(root, p)
+	verbosePrintf(1, "signing with %s (%s)\n", id.Name, id.Hash)
+	if w := id.expiryWarning(time.Now(), identityExpiryWarning); w != "" {
+		errPrintf("warning: %s\n", w)
 	}
 	return nil
 }
 
-func (c *signCmd) signApp(p string) error {
+// keychainIdentities returns the identities in the keychain,
+// reading them only once. identitiesMu must be held.
+func (c *signCmd) keychainIdentities(ctx context.Context) ([]*signingIdentity, error) {
+	if !c.keychainRead {
+		c.keychainIDs, c.keychainErr = keychainIdentities(ctx)
+		c.keychainRead = true
+	}
+	return c.keychainIDs, c.keychainErr
+}
+
+// resolveIdentity resolves an identity from -config like the
+// one from -i, returning the hash to pass to codesign. When
+// signing with -p12, it must match the identity in the file,
+// which is the only one available.
+func (c *signCmd) resolveIdentity(ctx context.Context, name string) (string, error) {
+	if name == adhocIdentity || name == c.Identity {
+		return name, nil
+	}
+	c.identitiesMu.Lock()
+	defer c.identitiesMu.Unlock()
+	if hash, ok := c.identities[name]; ok {
+		return hash, nil
+	}
+	var ids []*signingIdentity
+	switch {
+	case c.identity != nil:
+		ids = []*signingIdentity{newSigningIdentity(c.identity.Certificate, "", c.P12)}
+	case c.Native:
+		// nativeSignOptions reports the missing identity
+		return name, nil
+	default:
+		var err error
+		if ids, err = c.keychainIdentities(ctx); err != nil {
+			if !*dryRun {
+				return "", err
+			}
+			errPrintf("warning: can't check identity %q: %v\n", name, err)
+			c.setIdentity(name, name)
+			return name, nil
+		}
+	}
+	id, err := selectIdentity(ids, name, c.Team)
+	if err != nil {
+		if c.identity != nil {
+			return "", fmt.Errorf("identity %q doesn't match %q in %s, which is the only one available with -p12", name, ids[0].Name, c.P12)
+		}
+		return "", err
+	}
+	c.setIdentity(name, id.Hash)
+	return id.Hash, nil
+}
+
+// setIdentity records the hash resolved for an identity from
+// -config. identitiesMu must be held.
+func (c *signCmd) setIdentity(name string, hash string) {
+	if c.identities == nil {
+		c.identities = make(map[string]string)
+	}
+	c.identities[name] = hash
+}
+
+// signOutput contains the writers for the output produced
+// while signing a component
+type signOutput struct {
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+func (o *signOutput) Printf(format string, args ...interface{}) {
+	fmt.Fprintf(o.Stdout, format, args...)
+}
+
+func (o *signOutput) verbosePrintf(level int, format string, args ...interface{}) {
+	if *verbose >= level {
+		o.Printf(format, args...)
+	}
+}
+
+func (c *signCmd) signPath(ctx context.Context, root, p string) error {
+	if c.Jobs <= 1 {
+		out := &signOutput{Stdout: os.Stdout, Stderr: os.Stderr}
+		return walkCode(p, func(p string) error {
+			return c.signEntry(ctx, root, p, out)
+		})
+	}
+	// Buffer the output for each component, so output from
+	// components signed in parallel is not interleaved
+	var mu sync.Mutex
+	return walkCodeParallel(ctx, p, c.Jobs, func(ctx context.Context, p string) error {
+		var stdout, stderr bytes.Buffer
+		err := c.signEntry(ctx, root, p, &signOutput{Stdout: &stdout, Stderr: &stderr})
+		mu.Lock()
+		defer mu.Unlock()
+		os.Stdout.Write(stdout.Bytes())
+		os.Stderr.Write(stderr.Bytes())
+		return err
+	})
+}
+
+func (c *signCmd) signApp(ctx context.Context, p string) error {
 	// If the argument is foo.app/,
 	// filepath.Ext() will return an empty
 	// string. Make sure we don't skip it
 	if strings.HasSuffix(p, "/") {
 		p = p[:len(p)-1]
 	}
-	if err := c.signPath(p, p); err != nil {
+	if err := c.lintEntitlements(ctx, p); err != nil {
+		return err
+	}
+	cachePath := c.Cache
+	if cachePath == "" {
+		var err error
+		if cachePath, err = defaultSignCachePath(p); err != nil {
+			return err
+		}
+	}
+	cache, err := loadSignCache(cachePath)
+	if err != nil {
 		return err
 	}
+	c.cache = cache
+	err = c.signPath(ctx, p, p)
+	if !*dryRun {
+		// Save the components signed before any errors
+		if err := c.cache.save(); err != nil {
+			errPrintf("error saving signing cache: %v\n", err)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if c.Native {
+		// spctl is only available on macOS, check
+		// the signatures ourselves
+		if *dryRun {
+			return nil
+		}
+		return verifyNative(p)
+	}
+	if c.Identity == adhocIdentity {
+		// spctl rejects ad-hoc signatures
+		return nil
+	}
 	// Verify signature
 	ext := strings.ToLower(filepath.Ext(p))
 	if ext == ".app" || ext == ".framework" {
@@ -91,29 +351,93 @@ func (c *signCmd) signApp(p string) error {
 	return nil
 }
 
-func (c *signCmd) signEntry(root, p string) error {
+func (c *signCmd) signEntry(ctx context.Context, root, p string, out *signOutput) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	rel, _ := filepath.Rel(root, p)
 	name := rel
-	if name == "" {
+	if name == "." {
 		name = root
 	}
-	verbosePrintf(1, "signing %s\n", name)
+	settings, err := c.componentSettings(ctx, root, p)
+	if err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	if !c.Force {
+		signed, err := c.isSigned(rel, p, settings, out)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		if signed {
+			out.verbosePrintf(1, "skipping %s: unchanged since it was signed\n", name)
+			return nil
+		}
+	}
+	out.verbosePrintf(1, "signing %s\n", name)
+	if err := c.signComponent(ctx, name, p, settings, out); err != nil {
+		return err
+	}
+	if *dryRun {
+		return nil
+	}
+	if err := c.recordSigned(rel, p, settings); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+func (c *signCmd) signComponent(ctx context.Context, name string, p string, settings *signSettings, out *signOutput) error {
+	if settings.Profile != "" {
+		if err := c.embedProfile(p, settings, out); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if c.Native {
+		return c.signEntryNative(p, settings, out)
+	}
 	var args []string
 	if *verbose > 0 {
 		args = append(args, "--verbose")
 	}
-	args = append(args, "--force", "--options=runtime", "--timestamp")
-	if c.Entitlements != "" {
-		args = append(args, "--entitlements", c.Entitlements)
+	args = append(args, "--force")
+	if len(settings.Options) > 0 && (settings.OptionsSet || !settings.preserves("flags")) {
+		args = append(args, "--options="+strings.Join(settings.Options, ","))
+	}
+	if c.TimeStamp != "" {
+		args = append(args, "--timestamp="+c.TimeStamp)
+	} else {
+		args = append(args, "--timestamp")
+	}
+	if settings.Entitlements != "" {
+		args = append(args, "--entitlements", settings.Entitlements)
+	}
+	if settings.Requirements != "" {
+		args = append(args, "--requirements", settings.Requirements)
 	}
-	args = append(args, "--sign", c.Identity, p)
-	cmd := exec.Command("codesign", args...)
+	if settings.Identifier != "" {
+		args = append(args, "--identifier", settings.Identifier)
+	}
+	if settings.Prefix != "" {
+		args = append(args, "--prefix", settings.Prefix)
+	}
+	if len(settings.PreserveMetadata) > 0 {
+		args = append(args, "--preserve-metadata="+strings.Join(settings.PreserveMetadata, ","))
+	}
+	if settings.GenerateEntitlementDER {
+		args = append(args, "--generate-entitlement-der")
+	}
+	args = append(args, "--sign", settings.Identity, p)
+	cmd := exec.CommandContext(ctx, "codesign", args...)
 	if *dryRun {
-		fmt.Printf("%s\n", strings.Join(cmd.Args, " "))
+		out.Printf("%s\n", strings.Join(cmd.Args, " "))
 		return nil
 	}
-	verbosePrintf(2, "%s\n", strings.Join(cmd.Args, " "))
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	out.verbosePrintf(2, "%s\n", strings.Join(cmd.Args, " "))
+	cmd.Stdout = out.Stdout
+	cmd.Stderr = out.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("codesign %s: %v", name, err)
+	}
+	return nil
 }
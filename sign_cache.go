@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"macapptool/internal/codesign"
+	"macapptool/internal/macho"
+)
+
+// signCacheEntry records how a component was signed
+type signCacheEntry struct {
+	// ContentHash is the hash of the component after signing it
+	ContentHash string `json:"content_hash"`
+	Identity    string `json:"identity"`
+	// Settings is the hash of the entitlements and every other
+	// setting used for signing the component
+	Settings string `json:"settings"`
+	// CDHash contains the cdhash of each architecture, separated
+	// by commas
+	CDHash string `json:"cdhash"`
+}
+
+// signCache is the manifest of the components signed in a
+// bundle, used to skip the ones that haven't changed since
+// they were signed. sign -force ignores it and signs every
+// component, recording them again.
+type signCache struct {
+	Components map[string]*signCacheEntry `json:"components"`
+
+	path string
+	mu   sync.Mutex
+}
+
+// defaultSignCachePath returns the path of the cache for the
+// bundle at root, inside the user cache directory
+func defaultSignCachePath(root string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(abs))
+	return filepath.Join(dir, "macapptool", "sign", hex.EncodeToString(sum[:16])+".json"), nil
+}
+
+func loadSignCache(p string) (*signCache, error) {
+	cache := &signCache{
+		Components: make(map[string]*signCacheEntry),
+		path:       p,
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cache, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cache); err != nil {
+		// The cache can always be rebuilt
+		errPrintf("warning: ignoring invalid signing cache %s: %v\n", p, err)
+		cache.Components = make(map[string]*signCacheEntry)
+	}
+	if cache.Components == nil {
+		cache.Components = make(map[string]*signCacheEntry)
+	}
+	return cache, nil
+}
+
+func (sc *signCache) get(rel string) *signCacheEntry {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.Components[rel]
+}
+
+func (sc *signCache) set(rel string, e *signCacheEntry) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.Components[rel] = e
+}
+
+func (sc *signCache) save() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	data, err := json.MarshalIndent(sc, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(sc.path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(sc.path, data, 0644)
+}
+
+func hashFile(h hash.Hash, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(h, f)
+	return err
+}
+
+// contentHash returns a hash of the file at p or, if it's a
+// directory, of the names, types, permissions and contents
+// of every file in it
+func contentHash(p string) (string, error) {
+	h := sha256.New()
+	st, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	if !st.IsDir() {
+		if err := hashFile(h, p); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(h.Sum(nil)), nil
+	}
+	// filepath.Walk visits the files in lexical order
+	err = filepath.Walk(p, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(p, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%o\x00", filepath.ToSlash(rel), info.Mode())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(h, target)
+		case info.Mode().IsRegular():
+			if err := hashFile(h, path); err != nil {
+				return err
+			}
+		}
+		h.Write([]byte{0})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// componentCDHash returns the cdhash of every architecture of
+// the signed code at p, which might be a bundle. It returns
+// an empty string if any architecture is not signed.
+func componentCDHash(p string) (string, error) {
+	exe, err := codeExecutable(p)
+	if err != nil {
+		return "", err
+	}
+	bin, err := macho.ReadFile(exe)
+	if err != nil {
+		if err == macho.ErrNotMachO {
+			return "", nil
+		}
+		return "", err
+	}
+	var hashes []string
+	for _, s := range bin.Slices {
+		data := s.Signature()
+		if data == nil {
+			return "", nil
+		}
+		sig, err := codesign.ParseSignature(data)
+		if err != nil {
+			return "", nil
+		}
+		cd := sig.CodeDirectory()
+		if cd == nil {
+			return "", nil
+		}
+		hashes = append(hashes, s.Arch()+":"+hex.EncodeToString(cd.CDHash()))
+	}
+	return strings.Join(hashes, ","), nil
+}
+
+// signingIdentityKey identifies the identity used for
+// signing with settings
+func (c *signCmd) signingIdentityKey(settings *signSettings) string {
+	if c.Native && c.identity != nil && settings.Identity != adhocIdentity {
+		return certificateHash(c.identity.Certificate)
+	}
+	return settings.Identity
+}
+
+// settingsHash returns a hash of the settings used for signing,
+// including the contents of the files they reference
+func (c *signCmd) settingsHash(settings *signSettings) (string, error) {
+	h := sha256.New()
+	fields := map[string]string{
+		"native":     fmt.Sprint(c.Native),
+		"timestamp":  c.TimeStamp,
+		"options":    strings.Join(settings.Options, ","),
+		"optionsset": fmt.Sprint(settings.OptionsSet),
+		"identifier": settings.Identifier,
+		"prefix":     settings.Prefix,
+		"preserve":   strings.Join(settings.PreserveMetadata, ","),
+		"der":        fmt.Sprint(settings.GenerateEntitlementDER),
+	}
+	files := map[string]string{
+		"entitlements": settings.Entitlements,
+		"profile":      settings.Profile,
+	}
+	if strings.HasPrefix(settings.Requirements, "=") {
+		fields["requirements"] = settings.Requirements
+	} else {
+		files["requirements"] = settings.Requirements
+	}
+	for k, p := range files {
+		if p == "" {
+			continue
+		}
+		fh := sha256.New()
+		if err := hashFile(fh, p); err != nil {
+			return "", err
+		}
+		fields[k] = hex.EncodeToString(fh.Sum(nil))
+	}
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(h, "%s=%s\x00", k, fields[k])
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheEntry returns the entry for the component at p signed
+// with settings, to be compared with the cached one
+func (c *signCmd) cacheEntry(p string, settings *signSettings) (*signCacheEntry, error) {
+	settingsHash, err := c.settingsHash(settings)
+	if err != nil {
+		return nil, err
+	}
+	e := &signCacheEntry{
+		Identity: c.signingIdentityKey(settings),
+		Settings: settingsHash,
+	}
+	if e.ContentHash, err = contentHash(p); err != nil {
+		return nil, err
+	}
+	if e.CDHash, err = componentCDHash(p); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// isSigned returns true if the component at p was signed by
+// us with the same settings and hasn't changed since then.
+// The signature on disk must still have the recorded cdhash
+// and match the code and resources it seals, so components
+// modified without changing their contents hash, like bundles
+// whose nested code was re-signed, are signed again.
+func (c *signCmd) isSigned(rel string, p string, settings *signSettings, out *signOutput) (bool, error) {
+	cached := c.cache.get(rel)
+	if cached == nil || cached.CDHash == "" {
+		return false, nil
+	}
+	e, err := c.cacheEntry(p, settings)
+	if err != nil {
+		return false, err
+	}
+	if *e != *cached {
+		return false, nil
+	}
+	if r := verifyCode(p, p, nil); r == nil || !r.Valid() {
+		out.verbosePrintf(1, "signature of %s doesn't match the code, signing it again\n", rel)
+		return false, nil
+	}
+	return true, nil
+}
+
+// recordSigned adds the component at p to the cache, after
+// signing it
+func (c *signCmd) recordSigned(rel string, p string, settings *signSettings) error {
+	e, err := c.cacheEntry(p, settings)
+	if err != nil {
+		return err
+	}
+	c.cache.set(rel, e)
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignCacheVerifiesSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macapptool-sign-cache-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, err := ioutil.ReadFile(filepath.Join("testdata", "hello_arm64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "hello")
+	if err := ioutil.WriteFile(p, data, 0755); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c := &signCmd{Identity: adhocIdentity, Native: true, Cache: filepath.Join(dir, "cache.json")}
+	if err := c.signApp(ctx, p); err != nil {
+		t.Fatal(err)
+	}
+	settings, err := c.componentSettings(ctx, p, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	out := &signOutput{Stdout: &stdout, Stderr: &stdout}
+	if signed, err := c.isSigned(".", p, settings, out); err != nil || !signed {
+		t.Fatalf("isSigned = %v, %v after signing", signed, err)
+	}
+	if signed, err := c.isSigned(".", p, &signSettings{Identity: adhocIdentity, Identifier: "other"}, out); err != nil || signed {
+		t.Errorf("isSigned = %v, %v with different settings", signed, err)
+	}
+
+	// Change the code without touching the signature, so
+	// the cdhash stays the same, and record it as signed
+	signed, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed[0x400] ^= 0xff
+	if err := ioutil.WriteFile(p, signed, 0755); err != nil {
+		t.Fatal(err)
+	}
+	cdhash := c.cache.get(".").CDHash
+	if err := c.recordSigned(".", p, settings); err != nil {
+		t.Fatal(err)
+	}
+	if c.cache.get(".").CDHash != cdhash {
+		t.Fatal("cdhash changed without re-signing")
+	}
+	defer func(v int) { *verbose = v }(*verbose)
+	*verbose = 1
+	if signed, err := c.isSigned(".", p, settings, out); err != nil || signed {
+		t.Errorf("isSigned = %v, %v with an invalid signature", signed, err)
+	}
+	// The message goes to the output of the component, which is
+	// buffered when signing in parallel
+	if got, want := stdout.String(), "signature of . doesn't match the code, signing it again\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+}
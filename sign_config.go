@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"macapptool/internal/codesign"
+)
+
+// signSettings contains the settings used for signing
+// a single component
+type signSettings struct {
+	Identity     string
+	Entitlements string
+	// Options contains the flags passed to codesign --options
+	Options []string
+	// OptionsSet is true when Options were given explicitly,
+	// with -options or in the config, rather than being the
+	// default. Only the default ones are replaced when
+	// preserving the flags.
+	OptionsSet bool
+	// Requirements is either a path to a requirements file or,
+	// when it starts with =, requirements in the requirement
+	// language, as accepted by codesign --requirements
+	Requirements string
+	// Identifier overrides the identifier codesign derives
+	// from the bundle ID or the file name
+	Identifier string
+	// Prefix is prepended to identifiers derived from file
+	// names without dots, like codesign --prefix
+	Prefix string
+	// PreserveMetadata lists the parts of the existing
+	// signature kept when re-signing, as accepted by
+	// codesign --preserve-metadata
+	PreserveMetadata []string
+	// GenerateEntitlementDER adds DER encoded entitlements
+	// when signing with codesign. Native signatures always
+	// include them.
+	GenerateEntitlementDER bool
+	// Profile is the provisioning profile to embed in
+	// the bundle
+	Profile string
+}
+
+// preserves returns true if the existing signature's metadata
+// m is kept when re-signing
+func (s *signSettings) preserves(m string) bool {
+	for _, v := range s.PreserveMetadata {
+		if v == m {
+			return true
+		}
+	}
+	return false
+}
+
+// preservableMetadata contains the values accepted by
+// codesign --preserve-metadata
+var preservableMetadata = []string{"identifier", "entitlements", "requirements", "flags", "runtime", "launch-constraints"}
+
+// codesignOnlyMetadata contains the metadata which can only
+// be preserved when signing with codesign
+var codesignOnlyMetadata = []string{"launch-constraints"}
+
+// validateSignOptions checks the code signing flags and
+// the metadata to preserve
+func validateSignOptions(options []string, preserve []string) error {
+	if _, err := codesign.ParseFlags(strings.Join(options, ",")); err != nil {
+		return err
+	}
+	for _, v := range preserve {
+		found := false
+		for _, m := range preservableMetadata {
+			if v == m {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("can't preserve %q, must be one of %s", v, strings.Join(preservableMetadata, ", "))
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated list, returning nil
+// for an empty string or none
+func splitList(s string) []string {
+	if s == "" || s == "none" {
+		return nil
+	}
+	var values []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// signConfigEntry is an entry in the signing config file. Each
+// entry matches components by path, bundle ID or both. Nil
+// fields leave the setting untouched.
+type signConfigEntry struct {
+	// Path is a glob matched against the path of the component
+	// relative to the signed bundle, like Contents/MacOS/helper.
+	// If it doesn't contain a slash, it's matched against the
+	// component name.
+	Path string `json:"path"`
+	// BundleID matches the CFBundleIdentifier of the component.
+	// A trailing * matches any bundle ID with the given prefix.
+	BundleID     string    `json:"bundle_id"`
+	Identity     *string   `json:"identity"`
+	Entitlements *string   `json:"entitlements"`
+	Options      *[]string `json:"options"`
+	Requirements *string   `json:"requirements"`
+	Identifier   *string   `json:"identifier"`
+	Prefix       *string   `json:"prefix"`
+	Profile      *string   `json:"profile"`
+
+	PreserveMetadata       *[]string `json:"preserve_metadata"`
+	GenerateEntitlementDER *bool     `json:"generate_entitlement_der"`
+}
+
+// signConfig maps components to their signing settings. For
+// each component, the settings from every matching entry are
+// applied in order, so later entries take precedence.
+type signConfig struct {
+	Components []*signConfigEntry `json:"components"`
+
+	// dir is the directory containing the config file, used to
+	// resolve the relative paths inside it
+	dir string
+}
+
+func loadSignConfig(p string) (*signConfig, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cfg signConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %v", p, err)
+	}
+	for ii, e := range cfg.Components {
+		if e.Path == "" && e.BundleID == "" {
+			return nil, fmt.Errorf("%s: component %d doesn't have a path nor a bundle_id", p, ii)
+		}
+		if e.Path != "" {
+			if _, err := path.Match(e.Path, ""); err != nil {
+				return nil, fmt.Errorf("%s: invalid path pattern %q: %v", p, e.Path, err)
+			}
+		}
+		var options, preserve []string
+		if e.Options != nil {
+			options = *e.Options
+		}
+		if e.PreserveMetadata != nil {
+			preserve = *e.PreserveMetadata
+		}
+		if err := validateSignOptions(options, preserve); err != nil {
+			return nil, fmt.Errorf("%s: component %d: %v", p, ii, err)
+		}
+	}
+	cfg.dir = filepath.Dir(p)
+	return &cfg, nil
+}
+
+func (e *signConfigEntry) matches(rel string, bundleID string) bool {
+	if e.Path != "" {
+		name := rel
+		if !strings.Contains(e.Path, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(e.Path, name); !ok {
+			return false
+		}
+	}
+	if e.BundleID != "" {
+		if strings.HasSuffix(e.BundleID, "*") {
+			if !strings.HasPrefix(bundleID, strings.TrimSuffix(e.BundleID, "*")) {
+				return false
+			}
+		} else if bundleID != e.BundleID {
+			return false
+		}
+	}
+	return true
+}
+
+func (cfg *signConfig) resolvePath(p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(cfg.dir, p)
+}
+
+// apply updates s with the settings of the entries matching
+// the component at rel, with the given bundle ID (empty for
+// standalone binaries)
+func (cfg *signConfig) apply(s *signSettings, rel string, bundleID string) {
+	for _, e := range cfg.Components {
+		if !e.matches(rel, bundleID) {
+			continue
+		}
+		if e.Identity != nil {
+			s.Identity = *e.Identity
+		}
+		if e.Entitlements != nil {
+			s.Entitlements = cfg.resolvePath(*e.Entitlements)
+		}
+		if e.Options != nil {
+			s.Options = *e.Options
+			s.OptionsSet = true
+		}
+		if e.Requirements != nil {
+			s.Requirements = *e.Requirements
+			if !strings.HasPrefix(s.Requirements, "=") {
+				s.Requirements = cfg.resolvePath(s.Requirements)
+			}
+		}
+		if e.Identifier != nil {
+			s.Identifier = *e.Identifier
+		}
+		if e.Prefix != nil {
+			s.Prefix = *e.Prefix
+		}
+		if e.PreserveMetadata != nil {
+			s.PreserveMetadata = *e.PreserveMetadata
+		}
+		if e.GenerateEntitlementDER != nil {
+			s.GenerateEntitlementDER = *e.GenerateEntitlementDER
+		}
+		if e.Profile != nil {
+			s.Profile = cfg.resolvePath(*e.Profile)
+		}
+	}
+}
+
+// componentSettings returns the settings for signing the
+// component at p. The -e entitlements, -identifier,
+// -requirements and -profile only apply to the component
+// being signed, not to the code nested inside it. Identities
+// from the config are resolved like the one from -i.
+func (c *signCmd) componentSettings(ctx context.Context, root, p string) (*signSettings, error) {
+	s := &signSettings{
+		Identity:               c.Identity,
+		Options:                splitList(c.Options),
+		OptionsSet:             c.optionsSet,
+		Prefix:                 c.Prefix,
+		PreserveMetadata:       splitList(c.PreserveMetadata),
+		GenerateEntitlementDER: c.GenerateEntitlementDER,
+	}
+	if p == root {
+		s.Entitlements = c.Entitlements
+		s.Identifier = c.Identifier
+		s.Requirements = c.Requirements
+		s.Profile = c.Profile
+	}
+	if c.config == nil {
+		return s, nil
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return nil, err
+	}
+	var bundleID string
+	if st, err := os.Stat(p); err == nil && st.IsDir() {
+		pl, err := bundleInfoPlist(p)
+		if err != nil {
+			return nil, err
+		}
+		if bundleID, err = pl.BundleIdentifier(); err != nil {
+			return nil, err
+		}
+	}
+	c.config.apply(s, filepath.ToSlash(rel), bundleID)
+	if s.Identity == "" {
+		return nil, errors.New("empty signing identity")
+	}
+	if s.Identity, err = c.resolveIdentity(ctx, s.Identity); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"macapptool/internal/codesign"
+	"macapptool/internal/testpki"
+)
+
+// writeTestSignConfig writes a config file assigning identity
+// to the helper binaries and returns the bundle to sign
+func writeTestSignConfig(t *testing.T, identity string) (string, string, func()) {
+	dir, err := ioutil.TempDir("", "macapptool-sign-config-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "App.app")
+	macOS := filepath.Join(root, "Contents", "MacOS")
+	if err := os.MkdirAll(macOS, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"App", "helper"} {
+		if err := ioutil.WriteFile(filepath.Join(macOS, name), nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	info := `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+<key>CFBundleIdentifier</key><string>com.example.app</string>
+<key>CFBundleExecutable</key><string>App</string>
+</dict></plist>`
+	if err := ioutil.WriteFile(filepath.Join(root, "Contents", "Info.plist"), []byte(info), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := `{"components": [{"path": "helper", "identity": "` + identity + `"}]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "sign.json"), []byte(cfg), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return root, filepath.Join(dir, "sign.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestConfigIdentityKeychain(t *testing.T) {
+	devID := newSigningIdentity(testpki.New(t, "Developer ID Application: Test (ABCDE12345)", nil, nil).Cert, "", "keychain")
+	dev := newSigningIdentity(testpki.New(t, "Apple Development: Test (FGHIJ67890)", nil, nil).Cert, "", "keychain")
+	other := newSigningIdentity(testpki.New(t, "Developer ID Application: Other (KLMNO12345)", nil, nil).Cert, "", "keychain")
+	tests := []struct {
+		identity string
+		team     string
+		want     string
+		err      string
+	}{
+		{identity: "Apple Development", want: dev.Hash},
+		{identity: strings.ToLower(devID.Hash), want: devID.Hash},
+		{identity: "Developer ID", team: "ABCDE12345", want: devID.Hash},
+		{identity: "Developer ID", err: "2 signing identities match"},
+		{identity: "Apple Distribution", err: `no signing identity matches "Apple Distribution"`},
+		{identity: "-", want: "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.identity, func(t *testing.T) {
+			root, cfgPath, cleanup := writeTestSignConfig(t, tt.identity)
+			defer cleanup()
+			cfg, err := loadSignConfig(cfgPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &signCmd{
+				Identity:     devID.Hash,
+				Team:         tt.team,
+				config:       cfg,
+				keychainIDs:  []*signingIdentity{devID, dev, other},
+				keychainRead: true,
+			}
+			main, err := c.componentSettings(context.Background(), root, root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if main.Identity != devID.Hash {
+				t.Errorf("main identity = %s, want the one from -i", main.Identity)
+			}
+			helper, err := c.componentSettings(context.Background(), root, filepath.Join(root, "Contents", "MacOS", "helper"))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if helper.Identity != tt.want {
+				t.Errorf("helper identity = %s, want %s", helper.Identity, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigIdentityP12(t *testing.T) {
+	cert := testpki.New(t, "Developer ID Application: Test (ABCDE12345)", nil, nil)
+	tests := []struct {
+		identity string
+		err      string
+	}{
+		{identity: "Developer ID Application"},
+		{identity: "-"},
+		{identity: "Apple Development", err: `identity "Apple Development" doesn't match "Developer ID Application: Test (ABCDE12345)" in test.p12`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.identity, func(t *testing.T) {
+			root, cfgPath, cleanup := writeTestSignConfig(t, tt.identity)
+			defer cleanup()
+			cfg, err := loadSignConfig(cfgPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &signCmd{
+				Identity: "Developer ID",
+				Native:   true,
+				P12:      "test.p12",
+				config:   cfg,
+				identity: &codesign.Identity{Key: cert.Key, Certificate: cert.Cert},
+			}
+			helper := filepath.Join(root, "Contents", "MacOS", "helper")
+			settings, err := c.componentSettings(context.Background(), root, helper)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts, err := c.nativeSignOptions(helper, "helper", settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.identity == adhocIdentity && opts.Identity != nil {
+				t.Error("ad-hoc component signed with the -p12 identity")
+			}
+			if tt.identity != adhocIdentity && opts.Identity != c.identity {
+				t.Error("component not signed with the -p12 identity")
+			}
+		})
+	}
+}
+
+func TestIdentityDryRun(t *testing.T) {
+	defer func(v bool) { *dryRun = v }(*dryRun)
+	for _, dry := range []bool{false, true} {
+		*dryRun = dry
+		c := &signCmd{
+			Identity:     "Developer ID",
+			keychainRead: true,
+			keychainErr:  errors.New("security: executable file not found"),
+		}
+		err := c.selectIdentity(context.Background())
+		if dry && err != nil {
+			t.Errorf("selectIdentity failed in dry run mode: %v", err)
+		}
+		if !dry && err == nil {
+			t.Error("selectIdentity succeeded without keychain identities")
+		}
+		hash, err := c.resolveIdentity(context.Background(), "Apple Development")
+		if dry && (err != nil || hash != "Apple Development") {
+			t.Errorf("resolveIdentity = %q, %v in dry run mode", hash, err)
+		}
+		if !dry && err == nil {
+			t.Error("resolveIdentity succeeded without keychain identities")
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"macapptool/internal/codesign"
+	"macapptool/internal/entitlements"
+	"macapptool/internal/plist"
+)
+
+// enclosingInfoPlist returns the Info.plist of the innermost
+// bundle containing p, up to root. Returns nil if there's no
+// such bundle.
+func enclosingInfoPlist(root, p string) *plist.PList {
+	for dir := p; ; dir = filepath.Dir(dir) {
+		if st, err := os.Stat(dir); err == nil && st.IsDir() && isBundleDir(dir) {
+			if pl, err := bundleInfoPlist(dir); err == nil {
+				return pl
+			}
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return nil
+		}
+	}
+}
+
+// distributionIdentity returns whether the identity used for
+// signing with settings is meant for distribution, like
+// Developer ID and Apple Distribution ones. Development
+// identities allow debugging entitlements.
+func (c *signCmd) distributionIdentity(settings *signSettings) bool {
+	if id := c.signingIdentity(settings); id != nil {
+		return distributionTypes[id.Type]
+	}
+	if c.Native || settings.Identity == adhocIdentity {
+		return false
+	}
+	// Not a known identity, codesign will match the name
+	return distributionTypes[identityType(settings.Identity)]
+}
+
+// lintEntitlements checks the entitlements that would be used
+// for every component in root, returning an error if there are
+// errors or, in strict mode, warnings.
+func (c *signCmd) lintEntitlements(ctx context.Context, root string) error {
+	var components []*entitlements.Component
+	distribution := false
+	err := walkCode(root, func(p string) error {
+		settings, err := c.componentSettings(ctx, root, p)
+		if err != nil {
+			return err
+		}
+		if c.distributionIdentity(settings) {
+			distribution = true
+		}
+		name, _ := filepath.Rel(filepath.Dir(root), p)
+		comp := &entitlements.Component{
+			Path:      name,
+			InfoPlist: enclosingInfoPlist(root, p),
+			Main:      p == root,
+		}
+		if settings.Entitlements != "" {
+			data, err := ioutil.ReadFile(settings.Entitlements)
+			if err != nil {
+				return err
+			}
+			if comp.Entitlements, err = codesign.DecodeEntitlements(data); err != nil {
+				return fmt.Errorf("invalid entitlements in %s: %v", settings.Entitlements, err)
+			}
+		}
+		components = append(components, comp)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	findings := entitlements.Lint(components, &entitlements.Options{Distribution: distribution})
+	for _, f := range findings {
+		if f.Severity > entitlements.Info || *verbose > 0 {
+			errPrintf("%s\n", f)
+		}
+	}
+	switch max := entitlements.MaxSeverity(findings); {
+	case max >= entitlements.Error:
+		return fmt.Errorf("entitlements have errors")
+	case max >= entitlements.Warning && c.Strict:
+		return fmt.Errorf("entitlements have warnings, failing in strict mode")
+	}
+	return nil
+}
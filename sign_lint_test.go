@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+
+	"macapptool/internal/codesign"
+	"macapptool/internal/testpki"
+)
+
+func TestDistributionIdentity(t *testing.T) {
+	devID := newSigningIdentity(testpki.New(t, "Developer ID Application: Test (ABCDE12345)", nil, nil).Cert, "", "keychain")
+	dev := newSigningIdentity(testpki.New(t, "Apple Development: Test (ABCDE12345)", nil, nil).Cert, "", "keychain")
+	dist := testpki.New(t, "Apple Distribution: Test (ABCDE12345)", nil, nil)
+	tests := []struct {
+		name     string
+		c        *signCmd
+		identity string
+		want     bool
+	}{
+		{"ad-hoc", &signCmd{}, adhocIdentity, false},
+		{"developer id", &signCmd{keychainIDs: []*signingIdentity{devID, dev}}, devID.Hash, true},
+		{"development", &signCmd{keychainIDs: []*signingIdentity{devID, dev}}, dev.Hash, false},
+		{"name", &signCmd{}, "Developer ID Application: Other (KLMNO12345)", true},
+		{"p12", &signCmd{Native: true, identity: &codesign.Identity{Certificate: dist.Cert}}, "Apple Distribution", true},
+		{"p12 ad-hoc", &signCmd{Native: true, identity: &codesign.Identity{Certificate: dist.Cert}}, adhocIdentity, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.c.distributionIdentity(&signSettings{Identity: tt.identity}); got != tt.want {
+				t.Errorf("distributionIdentity(%q) = %v, want %v", tt.identity, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"macapptool/internal/codesign"
+	"macapptool/internal/macho"
+)
+
+// writeFileAtomic replaces the file at p with data, keeping
+// its permissions
+func writeFileAtomic(p string, data []byte) error {
+	st, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(p), "."+filepath.Base(p))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), st.Mode().Perm()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+// defaultIdentifier returns the identifier codesign uses for
+// a standalone binary, which is its name without extension,
+// with the given prefix if it doesn't contain any dots
+func defaultIdentifier(p string, prefix string) string {
+	name := filepath.Base(p)
+	identifier := strings.TrimSuffix(name, filepath.Ext(name))
+	if !strings.Contains(identifier, ".") {
+		identifier = prefix + identifier
+	}
+	return identifier
+}
+
+// preserveMetadata replaces the values in opts with the ones
+// in the existing signature of exe for the metadata listed in
+// settings, unless they were explicitly set. Unsigned files
+// are left untouched.
+func preserveMetadata(opts *codesign.SignOptions, exe string, settings *signSettings) error {
+	if len(settings.PreserveMetadata) == 0 {
+		return nil
+	}
+	bin, err := macho.ReadFile(exe)
+	if err != nil {
+		if err == macho.ErrNotMachO {
+			// Skipped by signFileNative
+			return nil
+		}
+		return err
+	}
+	data := bin.Slices[0].Signature()
+	if data == nil {
+		return nil
+	}
+	sig, err := codesign.ParseSignature(data)
+	if err != nil {
+		return fmt.Errorf("error reading the existing signature: %v", err)
+	}
+	cd := sig.CodeDirectory()
+	for _, v := range settings.PreserveMetadata {
+		switch v {
+		case "identifier":
+			if settings.Identifier == "" {
+				opts.Identifier = cd.Identifier
+			}
+		case "entitlements":
+			if settings.Entitlements == "" {
+				opts.Entitlements = sig.Entitlements
+			}
+		case "requirements":
+			if settings.Requirements == "" {
+				if b := sig.SuperBlob.Blob(codesign.SlotRequirements); b != nil {
+					opts.Requirements = b.Data
+				}
+			}
+		case "flags":
+			// Flags set by the signer itself are not preserved
+			if !settings.OptionsSet {
+				opts.Flags = cd.Flags &^ (codesign.FlagAdhoc | codesign.FlagLinkerSigned)
+			}
+		case "runtime":
+			opts.RuntimeVersion = cd.Runtime
+		default:
+			return fmt.Errorf("preserving %s requires codesign", v)
+		}
+	}
+	return nil
+}
+
+func (c *signCmd) nativeSignOptions(exe string, identifier string, settings *signSettings) (*codesign.SignOptions, error) {
+	if settings.Identifier != "" {
+		identifier = settings.Identifier
+	}
+	opts := &codesign.SignOptions{Identifier: identifier}
+	if settings.Identity != adhocIdentity {
+		// resolveIdentity rejects identities from -config
+		// which don't match the one from -p12
+		if c.identity == nil {
+			return nil, fmt.Errorf("can't sign with identity %q without codesign, use -p12 or -i %s for ad-hoc signing", settings.Identity, adhocIdentity)
+		}
+		opts.Identity = c.identity
+	}
+	flags, err := codesign.ParseFlags(strings.Join(settings.Options, ","))
+	if err != nil {
+		return nil, err
+	}
+	opts.Flags = flags
+	if settings.Requirements != "" {
+		if strings.HasPrefix(settings.Requirements, "=") {
+			return nil, errors.New("requirements in the requirement language need codesign, use a compiled requirements file")
+		}
+		data, err := ioutil.ReadFile(settings.Requirements)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := codesign.ParseRequirements(data); err != nil {
+			return nil, fmt.Errorf("invalid requirements in %s: %v", settings.Requirements, err)
+		}
+		opts.Requirements = data
+	}
+	if opts.Identity != nil && c.TimeStamp != noTimeStamp {
+		url := c.TimeStamp
+		if url == "" {
+			url = appleTimeStampURL
+		}
+		opts.TimeStamp = timeStamper(url, c.Retries)
+	}
+	if settings.Entitlements != "" {
+		data, err := ioutil.ReadFile(settings.Entitlements)
+		if err != nil {
+			return nil, err
+		}
+		opts.Entitlements = data
+	}
+	if err := preserveMetadata(opts, exe, settings); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// signEntryNative signs a bundle or a standalone Mach-O
+// file without using codesign
+func (c *signCmd) signEntryNative(p string, settings *signSettings, out *signOutput) error {
+	st, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return c.signBundleNative(p, settings, out)
+	}
+	opts, err := c.nativeSignOptions(p, defaultIdentifier(p, settings.Prefix), settings)
+	if err != nil {
+		return err
+	}
+	return c.signFileNative(p, opts, out)
+}
+
+func (c *signCmd) signFileNative(p string, opts *codesign.SignOptions, out *signOutput) error {
+	// Sign the actual file rather than replacing symlinks,
+	// like the ones at the root of a framework
+	p, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return err
+	}
+	bin, err := macho.Parse(data)
+	if err != nil {
+		if err == macho.ErrNotMachO {
+			// codesign can sign scripts using extended
+			// attributes, but we can't
+			out.verbosePrintf(1, "skipping %s: not a Mach-O file\n", p)
+			return nil
+		}
+		return err
+	}
+	if *dryRun {
+		for _, s := range bin.Slices {
+			out.Printf("sign %s [%s] as %s\n", p, s.Arch(), opts.Identifier)
+		}
+		return nil
+	}
+	signed, sigs, err := codesign.Sign(bin, opts)
+	if err != nil {
+		return fmt.Errorf("error signing %s: %v", p, err)
+	}
+	for _, sig := range sigs {
+		var hashes []string
+		for _, ht := range sig.HashTypes {
+			hashes = append(hashes, codesign.HashTypeName(ht))
+		}
+		out.verbosePrintf(1, "  %s: %s cdhash=%x", sig.Arch, strings.Join(hashes, "+"), sig.CDHash)
+		if bin.Fat {
+			out.verbosePrintf(1, " offset=%d size=%d align=2^%d", sig.Offset, sig.Size, sig.Align)
+		}
+		out.verbosePrintf(1, "\n")
+	}
+	return writeFileAtomic(p, signed)
+}
+
+// signBundleNative seals the bundle resources and signs
+// its main executable
+func (c *signCmd) signBundleNative(p string, settings *signSettings, out *signOutput) error {
+	pl, err := bundleInfoPlist(p)
+	if err != nil {
+		return err
+	}
+	identifier, err := pl.BundleIdentifier()
+	if err != nil {
+		return err
+	}
+	exe, err := bundleExecutable(p)
+	if err != nil {
+		return err
+	}
+	infoPlist, err := ioutil.ReadFile(bundleInfoPlistPath(p))
+	if err != nil {
+		return err
+	}
+	contents, _ := bundleContents(p)
+	exeRel, err := filepath.Rel(contents, exe)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(exeRel, "..") {
+		return errors.New("bundle executable is outside of the bundle contents")
+	}
+	sealDir := filepath.Join(contents, "_CodeSignature")
+	sealPath := filepath.Join(sealDir, "CodeResources")
+	var seal []byte
+	if *dryRun {
+		// Nested code isn't signed in dry runs, so its
+		// cdhash can't be sealed
+		out.Printf("write %s\n", sealPath)
+	} else {
+		seal, err = codesign.BuildResourceSeal(&codesign.ResourceSealOptions{
+			Root:    contents,
+			Exclude: []string{exeRel},
+			Nested:  nestedCode,
+		})
+		if err != nil {
+			return fmt.Errorf("error sealing resources: %v", err)
+		}
+		if err := os.MkdirAll(sealDir, 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(sealPath, seal, 0644); err != nil {
+			return err
+		}
+	}
+	opts, err := c.nativeSignOptions(exe, identifier, settings)
+	if err != nil {
+		return err
+	}
+	opts.InfoPlist = infoPlist
+	opts.CodeResources = seal
+	return c.signFileNative(exe, opts, out)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"macapptool/internal/codesign"
+	"macapptool/internal/macho"
+)
+
+// writeSignedTestBinary writes testdata/hello_arm64 ad-hoc
+// signed with opts to a temporary directory
+func writeSignedTestBinary(t *testing.T, opts *codesign.SignOptions) (string, func()) {
+	bin, err := macho.ReadFile(filepath.Join("testdata", "hello_arm64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := codesign.SignFile(bin.Slices[0].File, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "macapptool-sign-native-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "hello")
+	if err := ioutil.WriteFile(p, data, 0755); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return p, func() { os.RemoveAll(dir) }
+}
+
+func TestPreserveMetadata(t *testing.T) {
+	const runtimeVersion = 0x000a0e00
+	p, cleanup := writeSignedTestBinary(t, &codesign.SignOptions{
+		Identifier:     "com.example.hello",
+		Flags:          codesign.FlagRuntime | codesign.FlagForceKill,
+		RuntimeVersion: runtimeVersion,
+	})
+	defer cleanup()
+	tests := []struct {
+		name     string
+		settings *signSettings
+		flags    uint32
+		runtime  uint32
+		id       string
+	}{
+		{
+			name:     "nothing",
+			settings: &signSettings{Options: []string{"runtime"}},
+			flags:    codesign.FlagRuntime,
+			id:       "hello",
+		},
+		{
+			name:     "default options",
+			settings: &signSettings{Options: []string{"runtime"}, PreserveMetadata: []string{"flags", "runtime", "identifier"}},
+			flags:    codesign.FlagRuntime | codesign.FlagForceKill,
+			runtime:  runtimeVersion,
+			id:       "com.example.hello",
+		},
+		{
+			name:     "explicit options",
+			settings: &signSettings{Options: []string{"runtime"}, OptionsSet: true, PreserveMetadata: []string{"flags"}},
+			flags:    codesign.FlagRuntime,
+			id:       "hello",
+		},
+		{
+			name:     "explicit identifier",
+			settings: &signSettings{Identifier: "com.example.other", PreserveMetadata: []string{"identifier"}},
+			id:       "com.example.other",
+		},
+	}
+	c := &signCmd{Identity: adhocIdentity, Native: true}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.settings.Identity = adhocIdentity
+			opts, err := c.nativeSignOptions(p, "hello", tt.settings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.Flags != tt.flags {
+				t.Errorf("flags = %#x, want %#x", opts.Flags, tt.flags)
+			}
+			if opts.RuntimeVersion != tt.runtime {
+				t.Errorf("runtime version = %#x, want %#x", opts.RuntimeVersion, tt.runtime)
+			}
+			if opts.Identifier != tt.id {
+				t.Errorf("identifier = %q, want %q", opts.Identifier, tt.id)
+			}
+		})
+	}
+	// The preserved runtime version ends up in the signature
+	bin, err := macho.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := codesign.SignFile(bin.Slices[0].File, &codesign.SignOptions{
+		Identifier:     "com.example.hello",
+		Flags:          codesign.FlagRuntime,
+		RuntimeVersion: runtimeVersion,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := macho.Parse(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := codesign.ParseSignature(signed.Slices[0].Signature())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := sig.CodeDirectory().Runtime; v != runtimeVersion {
+		t.Errorf("signed runtime version = %#x, want %#x", v, runtimeVersion)
+	}
+
+	err = preserveMetadata(&codesign.SignOptions{}, p, &signSettings{PreserveMetadata: []string{"launch-constraints"}})
+	if err == nil || !strings.Contains(err.Error(), "requires codesign") {
+		t.Errorf("error = %v, want requires codesign", err)
+	}
+}
+
+func TestSignUniversal(t *testing.T) {
+	var slices []macho.SliceData
+	thin := make(map[string]*macho.File)
+	for _, name := range []string{"hello_x86_64", "hello_arm64"} {
+		bin, err := macho.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := bin.Slices[0].File
+		thin[f.Arch()] = f
+		slices = append(slices, macho.SliceData{Cpu: f.Cpu, SubCpu: f.SubCpu, Align: 14, Data: f.Data})
+	}
+	dir, err := ioutil.TempDir("", "macapptool-sign-native-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "hello")
+	if err := ioutil.WriteFile(p, macho.BuildUniversal(slices, false), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(v int) { *verbose = v }(*verbose)
+	*verbose = 1
+	var buf bytes.Buffer
+	c := &signCmd{Identity: adhocIdentity, Native: true}
+	opts := &codesign.SignOptions{Identifier: "com.example.hello"}
+	if err := c.signFileNative(p, opts, &signOutput{Stdout: &buf, Stderr: &buf}); err != nil {
+		t.Fatal(err)
+	}
+	bin, err := macho.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(bin.Arches(), ","); !bin.Fat || got != "x86_64,arm64" {
+		t.Fatalf("signed fat = %v, arches = %s", bin.Fat, got)
+	}
+	cdhashes := make(map[string]bool)
+	for _, s := range bin.Slices {
+		arch := s.Arch()
+		if s.Align != 14 || s.Offset%(1<<14) != 0 {
+			t.Errorf("%s: offset = %#x, align = 2^%d", arch, s.Offset, s.Align)
+		}
+		// Every slice has its own signature at the end of its
+		// __LINKEDIT, covering the code before it
+		lc := s.CodeSignature()
+		if lc == nil {
+			t.Errorf("%s: no LC_CODE_SIGNATURE", arch)
+			continue
+		}
+		end := uint64(lc.DataOff) + uint64(lc.DataSize)
+		linkedit := s.Segment("__LINKEDIT")
+		if lc.DataOff%16 != 0 || end != uint64(len(s.Data)) || linkedit.Offset+linkedit.Filesz != end {
+			t.Errorf("%s: signature at %#x-%#x, __LINKEDIT ends at %#x, slice size %#x", arch, lc.DataOff, end, linkedit.Offset+linkedit.Filesz, len(s.Data))
+		}
+		sig, err := codesign.ParseSignature(s.Signature())
+		if err != nil {
+			t.Fatalf("%s: %v", arch, err)
+		}
+		cd := sig.CodeDirectory()
+		pages := (int(lc.DataOff) + cd.PageSize() - 1) / cd.PageSize()
+		if cd.CodeLimit != uint64(lc.DataOff) || len(cd.CodeSlots) != pages || cd.Identifier != "com.example.hello" {
+			t.Errorf("%s: code limit = %#x, %d code slots, want %#x, %d", arch, cd.CodeLimit, len(cd.CodeSlots), lc.DataOff, pages)
+		}
+		if problems := codesign.VerifyFile(s.File, nil); len(problems) > 0 {
+			t.Errorf("%s: %s", arch, strings.Join(problems, "; "))
+		}
+		cdhashes[string(cd.CDHash())] = true
+		// Slices are signed like the thin files
+		want, err := codesign.SignFile(thin[arch], opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(s.Data, want) {
+			t.Errorf("%s: slice differs from the signed thin file", arch)
+		}
+		if !strings.Contains(buf.String(), fmt.Sprintf("  %s: sha256 cdhash=", arch)) || !strings.Contains(buf.String(), fmt.Sprintf("offset=%d size=%d align=2^14", s.Offset, len(s.Data))) {
+			t.Errorf("%s: missing from the output %q", arch, buf.String())
+		}
+	}
+	if len(cdhashes) != 2 {
+		t.Error("slices share a CodeDirectory")
+	}
+}
+
+// frameworkCDHash returns the cdhash of the framework at p
+func frameworkCDHash(t *testing.T, p string) []byte {
+	info, err := os.Stat(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := nestedCode(p, info)
+	if err != nil || code == nil {
+		t.Fatalf("nested code = %v, %v", code, err)
+	}
+	return code.CDHash
+}
+
+func TestSignVersionedFramework(t *testing.T) {
+	root, cleanup := writeSignedTestBundle(t)
+	defer cleanup()
+	framework := filepath.Join(root, "Contents", "Frameworks", "Foo.framework")
+	seal, err := ioutil.ReadFile(filepath.Join(framework, "Versions", "A", "_CodeSignature", "CodeResources"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Helpers/tool is nested code, sealed by its cdhash
+	for _, v := range []string{"Resources/Info.plist", "Resources/data.txt", "Helpers/tool", "cdhash"} {
+		if !bytes.Contains(seal, []byte("<key>"+v+"</key>")) {
+			t.Errorf("framework seal doesn't contain %s", v)
+		}
+	}
+
+	// Adding a resource changes the seal, so the framework
+	// gets a different cdhash when signed again
+	cdhash := frameworkCDHash(t, framework)
+	writeTestFile(t, framework, "Resources/new.txt", []byte("new\n"))
+	c := &signCmd{Identity: adhocIdentity, Native: true, Force: true}
+	if err := c.signApp(context.Background(), framework); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(frameworkCDHash(t, framework), cdhash) {
+		t.Error("cdhash unchanged after adding a resource")
+	}
+}
+
+func TestSignNativeDryRun(t *testing.T) {
+	root, cleanup := writeNestedTestBundle(t)
+	defer cleanup()
+	defer func(v bool) { *dryRun = v }(*dryRun)
+	*dryRun = true
+	// The nested code is never signed, so the bundles
+	// containing it can't be sealed
+	c := &signCmd{Identity: adhocIdentity, Native: true}
+	if err := c.signApp(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Name() == "_CodeSignature" {
+			t.Errorf("%s written in a dry run", p)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSameFile(t, filepath.Join(root, "Contents", "MacOS", "App"), "hello_arm64")
+}
+
+func TestSignLooseMachO(t *testing.T) {
+	root, cleanup := writeTestBundle(t, map[string]string{"MacOS/App": "hello_arm64"})
+	defer cleanup()
+	dylib, err := ioutil.ReadFile(filepath.Join("testdata", "libfoo_arm64.dylib"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Loose modules are found by their header, even without an
+	// extension or the executable bit
+	contents := filepath.Join(root, "Contents")
+	addon := filepath.Join(contents, "Resources", "node_modules", "addon", "build", "addon")
+	object := filepath.Join(contents, "Resources", "python", "mod.o")
+	writeTestFile(t, contents, "Resources/node_modules/addon/build/addon", withFileType(dylib, macho.TypeBundle))
+	writeTestFile(t, contents, "Resources/python/mod.o", withFileType(dylib, macho.TypeObject))
+	writeTestFile(t, contents, "Resources/run.sh", []byte("#!/bin/sh\n"))
+	for _, p := range []string{addon, object} {
+		if err := os.Chmod(p, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := &signCmd{Identity: adhocIdentity, Native: true}
+	if err := c.signApp(context.Background(), root); err != nil {
+		t.Fatal(err)
+	}
+	bin, err := macho.ReadFile(addon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bin.Slices[0].File.CodeSignature() == nil {
+		t.Error("loose module not signed")
+	}
+	data, err := ioutil.ReadFile(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, withFileType(dylib, macho.TypeObject)) {
+		t.Error("object file modified")
+	}
+
+	// The module is sealed by its cdhash, the object file and
+	// the script as resources
+	seal, err := ioutil.ReadFile(filepath.Join(contents, "_CodeSignature", "CodeResources"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []string{"Resources/node_modules/addon/build/addon", "Resources/python/mod.o", "Resources/run.sh"} {
+		if !bytes.Contains(seal, []byte("<key>"+v+"</key>")) {
+			t.Errorf("%s not sealed", v)
+		}
+	}
+	reports, err := verifyTree(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, r := range reports {
+		if !r.Valid() {
+			t.Errorf("%s: invalid: %+v", r.Path, r)
+		}
+		paths = append(paths, filepath.ToSlash(r.Path))
+	}
+	if got, want := strings.Join(paths, ","), "App.app/Contents/Resources/node_modules/addon/build/addon,App.app"; got != want {
+		t.Errorf("verified %s, want %s", got, want)
+	}
+}
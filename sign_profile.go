@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"macapptool/internal/codesign"
+	"macapptool/internal/provisioning"
+)
+
+// embeddedProfileName is the name of the provisioning profile
+// inside the Contents directory of macOS bundles
+const embeddedProfileName = "embedded.provisionprofile"
+
+// identityTeamIDRe matches the team ID at the end of identity
+// names like "Developer ID Application: Name (TEAMID)"
+var identityTeamIDRe = regexp.MustCompile(`\(([A-Z0-9]{10})\)$`)
+
+// signingIdentity returns the identity used for signing with
+// settings, or nil if it's ad-hoc or not known
+func (c *signCmd) signingIdentity(settings *signSettings) *signingIdentity {
+	if settings.Identity == adhocIdentity {
+		return nil
+	}
+	if c.Native {
+		if c.identity != nil {
+			return newSigningIdentity(c.identity.Certificate, "", c.P12)
+		}
+		return nil
+	}
+	// Identities from the keychain are replaced by their hash
+	c.identitiesMu.Lock()
+	defer c.identitiesMu.Unlock()
+	for _, id := range c.keychainIDs {
+		if id.Hash == settings.Identity {
+			return id
+		}
+	}
+	return nil
+}
+
+// signingTeamID returns the team ID of the identity used for
+// signing, or an empty string if it's not known
+func (c *signCmd) signingTeamID(settings *signSettings) string {
+	if id := c.signingIdentity(settings); id != nil {
+		return id.TeamID
+	}
+	if c.Native || settings.Identity == adhocIdentity {
+		return ""
+	}
+	if m := identityTeamIDRe.FindStringSubmatch(settings.Identity); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// embedProfile validates the provisioning profile for the
+// bundle at p and copies it into the bundle contents
+func (c *signCmd) embedProfile(p string, settings *signSettings, out *signOutput) error {
+	if st, err := os.Stat(p); err != nil || !st.IsDir() {
+		return errors.New("provisioning profiles can only be embedded in bundles")
+	}
+	profile, err := provisioning.ParseFile(settings.Profile)
+	if err != nil {
+		return err
+	}
+	pl, err := bundleInfoPlist(p)
+	if err != nil {
+		return err
+	}
+	bundleID, err := pl.BundleIdentifier()
+	if err != nil {
+		return err
+	}
+	if settings.Identifier != "" {
+		bundleID = settings.Identifier
+	}
+	var ents map[string]interface{}
+	if settings.Entitlements != "" {
+		data, err := ioutil.ReadFile(settings.Entitlements)
+		if err != nil {
+			return err
+		}
+		if ents, err = codesign.DecodeEntitlements(data); err != nil {
+			return fmt.Errorf("invalid entitlements in %s: %v", settings.Entitlements, err)
+		}
+	}
+	errs := profile.Check(bundleID, c.signingTeamID(settings), ents, time.Now())
+	if c.Native && c.identity != nil && settings.Identity != adhocIdentity && !profile.ContainsCertificate(c.identity.Certificate) {
+		errs = append(errs, fmt.Errorf("profile %q doesn't include the signing certificate", profile.Name))
+	}
+	if len(errs) > 0 {
+		var msgs []string
+		for _, err := range errs {
+			msgs = append(msgs, err.Error())
+		}
+		return fmt.Errorf("invalid provisioning profile %s: %s", settings.Profile, strings.Join(msgs, "; "))
+	}
+	out.verbosePrintf(1, "using profile %q (%s), expires %s\n", profile.Name, profile.UUID, profile.ExpirationDate.Format(time.RFC3339))
+	contents, _ := bundleContents(p)
+	dest := filepath.Join(contents, embeddedProfileName)
+	if *dryRun {
+		out.Printf("copy %s to %s\n", settings.Profile, dest)
+		return nil
+	}
+	return ioutil.WriteFile(dest, profile.Raw, 0644)
+}
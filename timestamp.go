@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+
+	"macapptool/internal/cms"
+)
+
+const (
+	// appleTimeStampURL is the TSA used by codesign --timestamp
+	appleTimeStampURL = "http://timestamp.apple.com/ts01"
+	// noTimeStamp disables timestamps, like --timestamp=none
+	noTimeStamp = "none"
+)
+
+// timeStamper returns a function which requests a RFC 3161
+// timestamp from the TSA at url, retrying failed requests
+func timeStamper(url string, retries int) func(data []byte) ([]byte, error) {
+	return func(data []byte) ([]byte, error) {
+		req, err := cms.NewTimeStampRequest(data)
+		if err != nil {
+			return nil, err
+		}
+		body, err := req.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		var token []byte
+		err = withRetries(retries+1, "timestamp request to "+url, func() error {
+			httpReq, err := http.NewRequest("POST", url, bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			httpReq.Header.Set("Content-Type", "application/timestamp-query")
+			resp, _, err := doHTTP(httpReq, http.StatusOK)
+			if err != nil {
+				return err
+			}
+			token, err = req.ParseResponse(resp)
+			return err
+		})
+		return token, err
+	}
+}
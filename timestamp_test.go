@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"macapptool/internal/cms"
+)
+
+type tsaMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type tsaRequest struct {
+	Version        int
+	MessageImprint tsaMessageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional,default:false"`
+}
+
+type tsaTSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tsaMessageImprint
+	SerialNumber   *big.Int
+	GenTime        time.Time   `asn1:"generalized"`
+	Accuracy       tsaAccuracy `asn1:"optional"`
+	Nonce          *big.Int    `asn1:"optional"`
+}
+
+type tsaAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+}
+
+type tsaStatus struct {
+	Status       int
+	StatusString []asn1.RawValue `asn1:"optional"`
+}
+
+type tsaResponse struct {
+	Status         tsaStatus
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tsaSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+}
+
+type tsaSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo struct {
+		EContentType asn1.ObjectIdentifier
+		EContent     asn1.RawValue
+	}
+	Certificates asn1.RawValue   `asn1:"optional,tag:0"`
+	SignerInfos  []tsaSignerInfo `asn1:"set"`
+}
+
+type tsaContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+// fakeTSA is an RFC 3161 timestamp server which checks the
+// requests and can fail in several ways
+type fakeTSA struct {
+	t    *testing.T
+	srv  *httptest.Server
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	requests []*tsaRequest
+	// failures is the number of requests to fail with
+	// httpStatus before responding
+	failures   int
+	httpStatus int
+	// pkiStatus is the status of the responses
+	pkiStatus  int
+	wrongNonce bool
+	// accuracy adds the optional accuracy to the tokens
+	accuracy bool
+}
+
+func newFakeTSA(t *testing.T) *fakeTSA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test TSA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tsa := &fakeTSA{t: t, cert: cert, key: key}
+	tsa.srv = httptest.NewServer(http.HandlerFunc(tsa.serve))
+	return tsa
+}
+
+func (tsa *fakeTSA) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.Header.Get("Content-Type") != "application/timestamp-query" {
+		tsa.t.Errorf("unexpected %s request with content type %q", r.Method, r.Header.Get("Content-Type"))
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var req tsaRequest
+	if _, err := asn1.Unmarshal(body, &req); err != nil {
+		tsa.t.Errorf("invalid timestamp request: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tsa.mu.Lock()
+	tsa.requests = append(tsa.requests, &req)
+	fail := tsa.failures > 0
+	if fail {
+		tsa.failures--
+	}
+	tsa.mu.Unlock()
+	if fail {
+		http.Error(w, "unavailable", tsa.httpStatus)
+		return
+	}
+	resp := tsaResponse{Status: tsaStatus{Status: tsa.pkiStatus}}
+	if tsa.pkiStatus != 0 {
+		resp.Status.StatusString = []asn1.RawValue{{Tag: asn1.TagUTF8String, Bytes: []byte("bad request")}}
+	} else {
+		nonce := req.Nonce
+		if tsa.wrongNonce {
+			nonce = new(big.Int).Add(nonce, big.NewInt(1))
+		}
+		resp.TimeStampToken = asn1.RawValue{FullBytes: tsa.token(req.MessageImprint, nonce)}
+	}
+	data, err := asn1.Marshal(resp)
+	if err != nil {
+		tsa.t.Fatal(err)
+	}
+	w.Header().Set("Content-Type", "application/timestamp-reply")
+	w.Write(data)
+}
+
+// token returns a timestamp token for the given imprint,
+// signed by the TSA certificate
+func (tsa *fakeTSA) token(imprint tsaMessageImprint, nonce *big.Int) []byte {
+	t := tsa.t
+	info := tsaTSTInfo{
+		Version:        1,
+		Policy:         asn1.ObjectIdentifier{1, 2, 3, 4},
+		MessageImprint: imprint,
+		SerialNumber:   big.NewInt(time.Now().UnixNano()),
+		GenTime:        time.Now().UTC().Truncate(time.Second),
+		Nonce:          nonce,
+	}
+	if tsa.accuracy {
+		info.Accuracy = tsaAccuracy{Seconds: 1, Millis: 500}
+	}
+	content, err := asn1.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256(content)
+	contentType, err := cms.NewAttribute(cms.OIDContentType, cms.OIDTSTInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageDigest, err := cms.NewAttribute(cms.OIDMessageDigest, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs, err := asn1.Marshal(struct {
+		Attrs []cms.Attribute `asn1:"set"`
+	}{[]cms.Attribute{contentType, messageDigest}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Skip the SEQUENCE header to get the SET OF attributes
+	var seq asn1.RawValue
+	if _, err := asn1.Unmarshal(attrs, &seq); err != nil {
+		t.Fatal(err)
+	}
+	attrs = seq.Bytes
+	attrsDigest := sha256.Sum256(attrs)
+	signature, err := tsa.key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, err := asn1.Marshal(struct {
+		Issuer       asn1.RawValue
+		SerialNumber *big.Int
+	}{asn1.RawValue{FullBytes: tsa.cert.RawIssuer}, tsa.cert.SerialNumber})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: cms.OIDDigestSHA256, Parameters: asn1.NullRawValue}
+	content, err = asn1.Marshal(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sd tsaSignedData
+	sd.Version = 3
+	sd.DigestAlgorithms = []pkix.AlgorithmIdentifier{sha256Alg}
+	sd.EncapContentInfo.EContentType = cms.OIDTSTInfo
+	sd.EncapContentInfo.EContent = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: content}
+	sd.Certificates = asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: tsa.cert.Raw}
+	sd.SignerInfos = []tsaSignerInfo{{
+		Version:            1,
+		SID:                asn1.RawValue{FullBytes: sid},
+		DigestAlgorithm:    sha256Alg,
+		SignedAttrs:        asn1.RawValue{FullBytes: append([]byte{0xa0}, attrs[1:]...)},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: cms.OIDSignatureECDSASHA256},
+		Signature:          signature,
+	}}
+	sdData, err := asn1.Marshal(sd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := asn1.Marshal(tsaContentInfo{
+		ContentType: cms.OIDSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: sdData},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestTimeStamper(t *testing.T) {
+	tsa := newFakeTSA(t)
+	defer tsa.srv.Close()
+	signature := []byte("signature value")
+	token, err := timeStamper(tsa.srv.URL, 0)(signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tsa.requests) != 1 {
+		t.Fatalf("sent %d requests, want 1", len(tsa.requests))
+	}
+	req := tsa.requests[0]
+	digest := sha256.Sum256(signature)
+	if !req.MessageImprint.HashAlgorithm.Algorithm.Equal(cms.OIDDigestSHA256) || !bytes.Equal(req.MessageImprint.HashedMessage, digest[:]) {
+		t.Errorf("imprint = %s %x, want SHA-256 %x", req.MessageImprint.HashAlgorithm.Algorithm, req.MessageImprint.HashedMessage, digest)
+	}
+	if req.Nonce == nil || req.Nonce.Sign() == 0 {
+		t.Error("request has no nonce")
+	}
+	if !req.CertReq {
+		t.Error("request doesn't ask for the TSA certificate")
+	}
+	ts, err := cms.ParseTimeStamp(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Verify(signature); err != nil {
+		t.Error(err)
+	}
+	if ts.Certificate == nil || !ts.Certificate.Equal(tsa.cert) {
+		t.Error("token doesn't include the TSA certificate")
+	}
+	if ts.Nonce.Cmp(req.Nonce) != 0 {
+		t.Errorf("nonce = %v, want %v", ts.Nonce, req.Nonce)
+	}
+
+	// Every request uses a new nonce, which is found after
+	// the optional accuracy
+	tsa.accuracy = true
+	if _, err := timeStamper(tsa.srv.URL, 0)(signature); err != nil {
+		t.Fatal(err)
+	}
+	if tsa.requests[0].Nonce.Cmp(tsa.requests[1].Nonce) == 0 {
+		t.Error("nonce reused between requests")
+	}
+}
+
+func TestTimeStamperErrors(t *testing.T) {
+	defer withFastRetries()()
+	tests := []struct {
+		name     string
+		setup    func(tsa *fakeTSA)
+		retries  int
+		requests int
+		err      string
+	}{
+		{
+			name:     "retried",
+			setup:    func(tsa *fakeTSA) { tsa.failures, tsa.httpStatus = 2, http.StatusServiceUnavailable },
+			retries:  2,
+			requests: 3,
+		},
+		{
+			name:     "retries exhausted",
+			setup:    func(tsa *fakeTSA) { tsa.failures, tsa.httpStatus = 3, http.StatusInternalServerError },
+			retries:  2,
+			requests: 3,
+			err:      "unexpected status 500",
+		},
+		{
+			name:     "bad HTTP status",
+			setup:    func(tsa *fakeTSA) { tsa.failures, tsa.httpStatus = 1, http.StatusBadRequest },
+			retries:  2,
+			requests: 1,
+			err:      "unexpected status 400",
+		},
+		{
+			name:     "rejected",
+			setup:    func(tsa *fakeTSA) { tsa.pkiStatus = 2 },
+			requests: 1,
+			err:      "timestamp request rejected with status 2: bad request",
+		},
+		{
+			name:     "nonce mismatch",
+			setup:    func(tsa *fakeTSA) { tsa.wrongNonce = true },
+			requests: 1,
+			err:      "timestamp token doesn't match the request nonce",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tsa := newFakeTSA(t)
+			defer tsa.srv.Close()
+			tt.setup(tsa)
+			_, err := timeStamper(tsa.srv.URL, tt.retries)([]byte("signature value"))
+			if tt.err == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("error = %v, want %q", err, tt.err)
+			}
+			if len(tsa.requests) != tt.requests {
+				t.Errorf("sent %d requests, want %d", len(tsa.requests), tt.requests)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/subcommands"
+
+	"macapptool/internal/macho"
+)
+
+type unsignCmd struct {
+}
+
+func (*unsignCmd) Name() string {
+	return "unsign"
+}
+
+func (*unsignCmd) Synopsis() string {
+	return "Remove the code signatures from an app bundle or Mach-O file"
+}
+
+func (*unsignCmd) Usage() string {
+	return fmt.Sprintf(`Usage: %s unsign some.app|some-binary
+
+	unsign removes the code signature from every slice of the
+	Mach-O files in the app bundle, including nested code, and
+	deletes the _CodeSignature directories, without relying on
+	codesign.
+`, filepath.Base(os.Args[0]))
+}
+
+func (c *unsignCmd) SetFlags(f *flag.FlagSet) {
+}
+
+func (c *unsignCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		return subcommands.ExitUsageError
+	}
+	for _, arg := range f.Args() {
+		root := strings.TrimSuffix(arg, "/")
+		if err := walkCode(root, unsignCode); err != nil {
+			errPrintf("error unsigning %s: %v\n", arg, err)
+			return subcommands.ExitFailure
+		}
+	}
+	return subcommands.ExitSuccess
+}
+
+// unsignCode removes the signature from the code object at p,
+// which can be a bundle or a standalone Mach-O file
+func unsignCode(p string) error {
+	st, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !st.IsDir() {
+		return unsignFile(p)
+	}
+	if exe, err := bundleExecutable(p); err == nil {
+		if err := unsignFile(exe); err != nil {
+			return err
+		}
+	} else {
+		verbosePrintf(1, "%s: %v\n", p, err)
+	}
+	contents, _ := bundleContents(p)
+	sigDir := filepath.Join(contents, "_CodeSignature")
+	if !fileExists(sigDir) {
+		return nil
+	}
+	verbosePrintf(1, "removing %s\n", sigDir)
+	return osRemoveAll(sigDir)
+}
+
+// unsignFile removes the signature from every slice of the
+// Mach-O file at p
+func unsignFile(p string) error {
+	// Modify the actual file rather than replacing symlinks,
+	// like the ones at the root of a framework
+	p, err := filepath.EvalSymlinks(p)
+	if err != nil {
+		return err
+	}
+	bin, err := macho.ReadFile(p)
+	if err != nil {
+		if err == macho.ErrNotMachO {
+			verbosePrintf(1, "skipping %s: not a Mach-O file\n", p)
+			return nil
+		}
+		return err
+	}
+	data, err := bin.RemoveSignatures()
+	if err != nil {
+		return fmt.Errorf("error unsigning %s: %v", p, err)
+	}
+	if data == nil {
+		verbosePrintf(1, "skipping %s: not signed\n", p)
+		return nil
+	}
+	if *dryRun {
+		for _, s := range bin.Slices {
+			if s.CodeSignature() != nil {
+				fmt.Printf("unsign %s [%s]\n", p, s.Arch())
+			}
+		}
+		return nil
+	}
+	verbosePrintf(1, "unsigning %s\n", p)
+	return writeFileAtomic(p, data)
+}
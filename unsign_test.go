@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testInfoPlist = `<?xml version="1.0" encoding="UTF-8"?>
+<plist version="1.0"><dict>
+<key>CFBundleIdentifier</key><string>com.example.app</string>
+<key>CFBundleExecutable</key><string>App</string>
+</dict></plist>`
+
+// writeTestBundle creates App.app in a temporary directory,
+// copying each file in testdata to its path inside Contents.
+// The bundle executable is Contents/MacOS/App.
+func writeTestBundle(t *testing.T, files map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "macapptool-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "App.app")
+	write := func(rel string, data []byte) {
+		p := filepath.Join(root, "Contents", filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, data, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("Info.plist", []byte(testInfoPlist))
+	for rel, name := range files {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(rel, data)
+	}
+	return root, func() { os.RemoveAll(dir) }
+}
+
+func checkSameFile(t *testing.T, p string, name string) {
+	t.Helper()
+	got, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s doesn't match testdata/%s", filepath.Base(p), name)
+	}
+}
+
+func TestUnsign(t *testing.T) {
+	root, cleanup := writeTestBundle(t, map[string]string{
+		"MacOS/App":                    "hello_arm64.signed",
+		"MacOS/helper":                 "hello_arm64.signed",
+		"MacOS/unsigned":               "hello_arm64",
+		"_CodeSignature/CodeResources": "hello_arm64",
+	})
+	defer cleanup()
+	contents := filepath.Join(root, "Contents")
+
+	defer func(v bool) { *dryRun = v }(*dryRun)
+	*dryRun = true
+	if err := walkCode(root, unsignCode); err != nil {
+		t.Fatal(err)
+	}
+	checkSameFile(t, filepath.Join(contents, "MacOS", "App"), "hello_arm64.signed")
+	if !fileExists(filepath.Join(contents, "_CodeSignature")) {
+		t.Error("_CodeSignature removed in dry run mode")
+	}
+
+	*dryRun = false
+	if err := walkCode(root, unsignCode); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"App", "helper", "unsigned"} {
+		checkSameFile(t, filepath.Join(contents, "MacOS", name), "hello_arm64")
+	}
+	if fileExists(filepath.Join(contents, "_CodeSignature")) {
+		t.Error("_CodeSignature not removed")
+	}
+	// Unsigning again doesn't change anything
+	if err := walkCode(root, unsignCode); err != nil {
+		t.Fatal(err)
+	}
+	checkSameFile(t, filepath.Join(contents, "MacOS", "App"), "hello_arm64")
+}
@@ -35,3 +35,16 @@ func verifySignature(p string) error {
 	cmd.Stderr = os.Stderr
 	return cmd.Run()
 }
+
+// stringList is a flag.Value that accumulates the values of
+// a flag that can be specified multiple times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
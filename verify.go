@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/subcommands"
+
+	"macapptool/internal/codesign"
+	"macapptool/internal/macho"
+)
+
+type verifyReport struct {
+	Path     string   `json:"path"`
+	Problems []string `json:"problems,omitempty"`
+	Modified []string `json:"modified,omitempty"`
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// Valid returns true iff no problems were found. Warnings
+// don't make the report invalid.
+func (r *verifyReport) Valid() bool {
+	return len(r.Problems) == 0 && len(r.Modified) == 0 && len(r.Added) == 0 &&
+		len(r.Removed) == 0 && r.Error == ""
+}
+
+func (r *verifyReport) WriteText(w io.Writer) {
+	if r.Valid() {
+		fmt.Fprintf(w, "%s: valid\n", r.Path)
+	} else {
+		fmt.Fprintf(w, "%s: invalid\n", r.Path)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(w, "  error: %s\n", r.Error)
+	}
+	for _, v := range r.Problems {
+		fmt.Fprintf(w, "  %s\n", v)
+	}
+	for _, v := range r.Modified {
+		fmt.Fprintf(w, "  modified: %s\n", v)
+	}
+	for _, v := range r.Added {
+		fmt.Fprintf(w, "  added: %s\n", v)
+	}
+	for _, v := range r.Removed {
+		fmt.Fprintf(w, "  removed: %s\n", v)
+	}
+	for _, v := range r.Warnings {
+		fmt.Fprintf(w, "  warning: %s\n", v)
+	}
+}
+
+type verifyCmd struct {
+	JSON  bool
+	Chain bool
+	Roots string
+}
+
+func (*verifyCmd) Name() string {
+	return "verify"
+}
+
+func (*verifyCmd) Synopsis() string {
+	return "Verify the code signatures in an app bundle or Mach-O file"
+}
+
+func (*verifyCmd) Usage() string {
+	return fmt.Sprintf(`Usage: %s verify [-json][-chain=false][-roots file] some.app|some-binary
+
+	verify checks the page hashes, the bound Info.plist,
+	entitlements and requirements and the resource seal of
+	every code object in the app bundle, without relying on
+	codesign.
+
+	The signer certificate chains must lead to the Apple Root
+	CA or to one of the certificates in the -roots file, and
+	be valid at the time of their secure timestamp. Developer
+	ID certificates must be issued by a Developer ID CA.
+`, filepath.Base(os.Args[0]))
+}
+
+func (c *verifyCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&c.JSON, "json", false, "Print the report as JSON")
+	f.BoolVar(&c.Chain, "chain", true, "Validate the certificate chains and timestamps")
+	f.StringVar(&c.Roots, "roots", "", "File with additional trusted root certificates, in PEM or DER format")
+}
+
+func (c *verifyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() == 0 {
+		return subcommands.ExitUsageError
+	}
+	var trust *codesign.TrustOptions
+	if c.Chain {
+		trust = &codesign.TrustOptions{}
+		if c.Roots != "" {
+			roots, err := readCertificates(c.Roots)
+			if err != nil {
+				errPrint(err)
+				return subcommands.ExitFailure
+			}
+			trust.Roots = roots
+		}
+	} else if c.Roots != "" {
+		errPrintf("-roots can't be used with -chain=false\n")
+		return subcommands.ExitUsageError
+	}
+	var reports []*verifyReport
+	for _, arg := range f.Args() {
+		root := strings.TrimSuffix(arg, "/")
+		r, err := verifyTree(root, trust)
+		if err != nil {
+			errPrintf("error verifying %s: %v\n", arg, err)
+			return subcommands.ExitFailure
+		}
+		reports = append(reports, r...)
+	}
+	valid := true
+	for _, r := range reports {
+		if !r.Valid() {
+			valid = false
+		}
+	}
+	if c.JSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			errPrint(err)
+			return subcommands.ExitFailure
+		}
+	} else {
+		for _, r := range reports {
+			r.WriteText(os.Stdout)
+		}
+	}
+	if !valid {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// verifyTree verifies every code object in root, from the
+// innermost to the outermost. Certificates are only validated
+// when trust is not nil.
+func verifyTree(root string, trust *codesign.TrustOptions) ([]*verifyReport, error) {
+	var reports []*verifyReport
+	err := walkCode(root, func(p string) error {
+		if r := verifyCode(root, p, trust); r != nil {
+			reports = append(reports, r)
+		}
+		return nil
+	})
+	return reports, err
+}
+
+// verifyCode verifies the code object at p, which can be a
+// bundle or a standalone Mach-O file. It returns nil for
+// files which are not Mach-O.
+func verifyCode(root, p string, trust *codesign.TrustOptions) *verifyReport {
+	name, _ := filepath.Rel(filepath.Dir(root), p)
+	report := &verifyReport{Path: name}
+	exe, err := codeExecutable(p)
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+	bin, err := macho.ReadFile(exe)
+	if err != nil {
+		if err == macho.ErrNotMachO {
+			verbosePrintf(1, "skipping %s: not a Mach-O file\n", name)
+			return nil
+		}
+		report.Error = err.Error()
+		return report
+	}
+	opts := &codesign.VerifyOptions{}
+	if exe != p {
+		if err := verifyBundleResources(p, exe, opts, report); err != nil {
+			report.Error = err.Error()
+			return report
+		}
+	}
+	for _, s := range bin.Slices {
+		prefix := ""
+		if bin.Fat {
+			prefix = s.Arch() + ": "
+		}
+		for _, v := range codesign.VerifyFile(s.File, opts) {
+			report.Problems = append(report.Problems, prefix+v)
+		}
+		if trust != nil {
+			problems, warnings := verifyTrust(s.File, trust)
+			for _, v := range problems {
+				report.Problems = append(report.Problems, prefix+v)
+			}
+			for _, v := range warnings {
+				report.Warnings = append(report.Warnings, prefix+v)
+			}
+		}
+	}
+	return report
+}
+
+// verifyTrust validates the certificates in the signature of
+// f. Unsigned files and ad-hoc signatures are ignored, since
+// VerifyFile already reports them.
+func verifyTrust(f *macho.File, trust *codesign.TrustOptions) (problems []string, warnings []string) {
+	data := f.Signature()
+	if data == nil {
+		return nil, nil
+	}
+	sig, err := codesign.ParseSignature(data)
+	if err != nil || sig.IsAdhoc() {
+		return nil, nil
+	}
+	r := codesign.CheckTrust(sig.CMS, trust)
+	return r.Problems, r.Warnings
+}
+
+// verifyBundleResources reads the files bound to the signature
+// of the bundle at p into opts and compares its resource seal
+// with the files in the bundle
+func verifyBundleResources(p string, exe string, opts *codesign.VerifyOptions, report *verifyReport) error {
+	infoPlist, err := ioutil.ReadFile(bundleInfoPlistPath(p))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	opts.InfoPlist = infoPlist
+	contents, _ := bundleContents(p)
+	seal, err := ioutil.ReadFile(filepath.Join(contents, "_CodeSignature", "CodeResources"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	opts.CodeResources = seal
+	exeRel, err := filepath.Rel(contents, exe)
+	if err != nil {
+		return err
+	}
+	diff, err := codesign.VerifyResourceSeal(seal, &codesign.ResourceSealOptions{
+		Root:    contents,
+		Exclude: []string{exeRel},
+		Nested:  nestedCode,
+	})
+	if err != nil {
+		return err
+	}
+	report.Modified = diff.Modified
+	report.Added = diff.Added
+	report.Removed = diff.Removed
+	return nil
+}
+
+// verifyNative verifies the signatures in root without
+// codesign, printing the problems found to stderr. The
+// certificates aren't validated, since they might not be
+// issued by Apple.
+func verifyNative(root string) error {
+	reports, err := verifyTree(root, nil)
+	if err != nil {
+		return err
+	}
+	valid := true
+	for _, r := range reports {
+		if !r.Valid() {
+			r.WriteText(os.Stderr)
+			valid = false
+		}
+	}
+	if !valid {
+		return errors.New("signature verification failed")
+	}
+	return nil
+}
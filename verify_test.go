@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSignedTestBundle returns a copy of the nested test bundle
+// signed natively with an ad-hoc signature
+func writeSignedTestBundle(t *testing.T) (string, func()) {
+	root, cleanup := writeNestedTestBundle(t)
+	c := &signCmd{Identity: adhocIdentity, Native: true}
+	if err := c.signApp(context.Background(), root); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return root, cleanup
+}
+
+func TestVerifyTree(t *testing.T) {
+	root, cleanup := writeSignedTestBundle(t)
+	defer cleanup()
+	reports, err := verifyTree(root, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, r := range reports {
+		if !r.Valid() {
+			t.Errorf("%s: invalid: %+v", r.Path, r)
+		}
+		paths = append(paths, r.Path)
+	}
+	if len(reports) != 5 {
+		t.Errorf("verified %s, want 5 code objects", strings.Join(paths, ", "))
+	}
+}
+
+func TestVerifyFrameworkResources(t *testing.T) {
+	const framework = "App.app/Contents/Frameworks/Foo.framework"
+	tests := []struct {
+		name   string
+		modify func(t *testing.T, resources string)
+		check  func(r *verifyReport) []string
+		want   string
+	}{
+		{
+			name: "modified",
+			modify: func(t *testing.T, resources string) {
+				writeTestFile(t, resources, "data.txt", []byte("tampered\n"))
+			},
+			check: func(r *verifyReport) []string { return r.Modified },
+			want:  "Resources/data.txt",
+		},
+		{
+			name: "added",
+			modify: func(t *testing.T, resources string) {
+				writeTestFile(t, resources, "evil.txt", []byte("evil\n"))
+			},
+			check: func(r *verifyReport) []string { return r.Added },
+			want:  "Resources/evil.txt",
+		},
+		{
+			name: "missing",
+			modify: func(t *testing.T, resources string) {
+				if err := os.Remove(filepath.Join(resources, "data.txt")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			check: func(r *verifyReport) []string { return r.Removed },
+			want:  "Resources/data.txt",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, cleanup := writeSignedTestBundle(t)
+			defer cleanup()
+			// Modify the files through the Resources symlink at
+			// the root of the framework
+			tt.modify(t, filepath.Join(filepath.Dir(root), filepath.FromSlash(framework), "Resources"))
+			reports, err := verifyTree(root, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			found := false
+			for _, r := range reports {
+				if filepath.ToSlash(r.Path) != framework {
+					continue
+				}
+				found = true
+				if r.Valid() {
+					t.Errorf("%s: valid after its resources were %s", r.Path, tt.name)
+				}
+				if got := strings.Join(tt.check(r), ","); got != tt.want {
+					t.Errorf("%s: %s = %q, want %q", r.Path, tt.name, got, tt.want)
+				}
+			}
+			if !found {
+				t.Fatalf("%s not verified", framework)
+			}
+			if err := verifyNative(root); err == nil {
+				t.Error("verification succeeded")
+			}
+		})
+	}
+}